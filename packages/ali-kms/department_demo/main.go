@@ -1,354 +1,253 @@
 package main
 
 import (
-    "crypto/aes"
-    "crypto/cipher"
-    "crypto/rand"
-    "crypto/sha256"
-    "encoding/hex"
-    "errors"
-    "io"
-	"encoding/base64"
+	"context"
 	"fmt"
-	"strings"
+	"io"
+	"os"
+	"time"
 
-    "golang.org/x/crypto/hkdf"
+	"github.com/alibabacloud-go/tea/tea"
+	alikmsopenapi "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi"
+	alikmsopenapiutil "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi-util"
+	alikmssdk "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/sdk"
 
-    "github.com/alibabacloud-go/tea/tea"
-    alikmsopenapi "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi"
-    alikmssdk "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/sdk"
-    lru "github.com/hashicorp/golang-lru"
+	"ali-kms/kms"
 )
 
 const (
-    GcmIvLength           = 12
-    CIPHER_TRANSFORMATION = "AES/GCM/NoPadding"
-    ALGORITHM             = "AES"
+	GcmIvLength           = kms.GcmIvLength
+	CIPHER_TRANSFORMATION = "AES/GCM/NoPadding"
+	ALGORITHM             = "AES"
 )
 
-var client *KmsClient
-
 type KmsConfig struct {
-    CaFilePath       string `json:"ca_filepath"`
-    Protocal         string `json:"protocal"`
-    ClientKeyContent string `json:"clientkey_content"`
-    Password         string `json:"password"`
-    Endpoint         string `json:"endpoint"`
-
-    // 本地&dev无法访问kms
-    IsDev  bool   `json:"is_dev"`
-    DevCMK string `json:"dev_cmk"` // len in [16, 24, 32]
+	CaFilePath       string `json:"ca_filepath"`
+	Protocal         string `json:"protocal"`
+	ClientKeyContent string `json:"clientkey_content"`
+	Password         string `json:"password"`
+	Endpoint         string `json:"endpoint"`
+
+	// 本地&dev无法访问kms
+	IsDev  bool   `json:"is_dev"`
+	DevCMK string `json:"dev_cmk"` // len in [16, 24, 32]
+	// 本地密钥环文件，支持多个密钥和版本（离线测试），设置后优先于 IsDev
+	KeyringFile string `json:"keyring_file"`
+
+	// 数据密钥缓存，为 0 时使用 kms.CachePolicy 的默认值
+	DataKeyCacheSize     int    `json:"datakey_cache_size"`
+	DataKeyMaxAgeSeconds int    `json:"datakey_max_age_seconds"`
+	DataKeyMaxMessages   uint64 `json:"datakey_max_messages"` // 每个数据密钥最多加密的条数
+	DataKeyMaxBytes      uint64 `json:"datakey_max_bytes"`    // 每个数据密钥最多加密的字节数
+
+	// 访问专属KMS的重试和熔断，为 0 时使用 kms.RetryPolicy / kms.NewCircuitBreaker 的默认值
+	MaxAttempts                   int `json:"max_attempts"`
+	CircuitBreakerThreshold       int `json:"circuit_breaker_threshold"`
+	CircuitBreakerCooldownSeconds int `json:"circuit_breaker_cooldown_seconds"`
 }
 
-
-// The envelope cipher obj may be stored
-type EnvelopeCipherObj struct {
-    DataKeyIV        []byte
-    EncryptedDataKey []byte
-    Iv               []byte
-    CipherText       []byte
+// 信封加密示例（在缓存限制内复用DataKey，超出后重新生成）
+// ec 为加密上下文（租户、表、记录ID、用途等），解密时必须传入相同的上下文，密文不能挪到其他记录下解密
+func (cli *KmsClient) EnvelopeEncryptByKeyId(ctx context.Context, keyId string, data []byte, ec kms.EncryptionContext) (*kms.EnvelopeCipherObj, error) {
+	// 获取数据密钥，下面以Aliyun_AES_256密钥为例进行说明，数据密钥长度32字节
+	// 使用数据密钥明文在本地对数据进行加密（AES-256 GCM），密文对象包括:
+	// (1) dataKeyIV: 由KMS生成的加密初始向量，解密数据密钥密文时需要传入
+	// (2) encryptedDataKey: KMS返回的数据密钥密文
+	// (3) iv: 加密初始向量
+	// (4) cipherText: 密文数据
+	// 以及主密钥ID、密钥版本、算法和加密上下文摘要，编码格式见 kms/envelope.go
+	return cli.materials.EnvelopeEncrypt(ctx, keyId, data, ec)
 }
 
-func (eo *EnvelopeCipherObj) EncodeToString() string {
-    return fmt.Sprintf("%s.%s.%s.%s", base64.RawStdEncoding.EncodeToString(eo.DataKeyIV),
-        base64.RawStdEncoding.EncodeToString(eo.EncryptedDataKey),
-        base64.RawStdEncoding.EncodeToString(eo.Iv),
-        base64.RawStdEncoding.EncodeToString(eo.CipherText))
+// 信封加密示例（基于已有的DataKey，DataKey 须以相同的 ec 生成）
+// 不限制DataKey的使用次数，高频写入请使用 EnvelopeEncryptByKeyId
+func (cli *KmsClient) EnvelopeEncryptByDataKey(dataKey *kms.DataKey, data []byte, ec kms.EncryptionContext) (*kms.EnvelopeCipherObj, error) {
+	return kms.EnvelopeEncryptWithDataKey(dataKey, data, ec)
 }
 
-func (eo *EnvelopeCipherObj) Decode(encodedStr string) error {
-
-    arrs := strings.Split(encodedStr, ".")
-    if len(arrs) != 4 {
-        return errors.New("invalid format")
-    }
-
-    var err error
-    eo.DataKeyIV, err = base64.RawStdEncoding.DecodeString(arrs[0])
-    if err != nil {
-        return err
-    }
-    eo.DataKeyIV, err = base64.RawStdEncoding.DecodeString(arrs[1])
-    if err != nil {
-        return err
-    }
-    eo.Iv, err = base64.RawStdEncoding.DecodeString(arrs[2])
-    if err != nil {
-        return err
-    }
-    eo.CipherText, err = base64.RawStdEncoding.DecodeString(arrs[3])
-    if err != nil {
-        return err
-    }
-
-    return nil
+// 信封解密示例，keyId 为空时使用密文中记录的主密钥ID，上下文不一致时返回 kms.ErrContextMismatch
+func (cli *KmsClient) EnvelopeDecrypt(ctx context.Context, keyId string, cipherText *kms.EnvelopeCipherObj, ec kms.EncryptionContext) ([]byte, error) {
+	if keyId != "" && keyId != cipherText.KeyID {
+		obj := *cipherText
+		obj.KeyID = keyId
+		cipherText = &obj
+	}
+	// 数据密钥明文按 (数据密钥密文, 上下文) 缓存，上下文不一致时不调用KMS
+	return cli.materials.EnvelopeDecrypt(ctx, cipherText, ec)
 }
-// 信封加密示例（每次生成DataKey）
-func EnvelopeEncryptByKeyId(keyId string, data []byte) (*EnvelopeCipherObj, error) {
-    // 获取数据密钥，下面以Aliyun_AES_256密钥为例进行说明，数据密钥长度32字节
-    generateDataKeyRequest := &alikmssdk.GenerateDataKeyRequest{
-        KeyId:         tea.String(keyId),
-        NumberOfBytes: tea.Int32(32),
-    }
-
-    // 调用生成数据密钥接口
-    dataKeyResponse, err := client.GenerateDataKey(generateDataKeyRequest)
-    if err != nil {
-        return nil, err
-    }
-
-    // 使用专属KMS返回的数据密钥明文在本地对数据进行加密，下面以AES-256 GCM模式为例
-    iv := make([]byte, GcmIvLength) // 加密初始向量，解密时需要传入
-    rand.Read(iv)
-    block, err := aes.NewCipher(dataKeyResponse.Plaintext)
-    if err != nil {
-        return nil, err
-    }
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        return nil, err
-    }
-    cipherText := gcm.Seal(nil, iv, data, nil)
 
-    // 输出密文，密文输出或持久化由用户根据需要进行处理，下面示例仅展示将密文输出到一个对象的情况
-    // 假如EnvelopeCipherObj是需要输出的密文对象，至少需要包括以下四个内容:
-    // (1) dataKeyIV: 由专属KMS生成的加密初始向量，解密数据密钥密文时需要传入
-    // (2) encryptedDataKey: 专属KMS返回的数据密钥密文
-    // (3) iv: 加密初始向量
-    // (4) cipherText: 密文数据
-    envelopeCipherText := &EnvelopeCipherObj{
-        DataKeyIV:        dataKeyResponse.Iv,
-        EncryptedDataKey: dataKeyResponse.CiphertextBlob,
-        Iv:               iv,
-        CipherText:       cipherText,
-    }
-    return envelopeCipherText, nil
+// 主密钥轮转（每年）或迁移示例：只重新加密数据密钥，数据密文不变
+// targetKeyId 为空时使用原主密钥的当前版本，批量处理见 kms.RewrapAll
+func (cli *KmsClient) EnvelopeRewrap(ctx context.Context, targetKeyId string, cipherText *kms.EnvelopeCipherObj, ec kms.EncryptionContext) (*kms.EnvelopeCipherObj, error) {
+	return kms.Rewrap(ctx, cli.provider, cipherText, targetKeyId, ec)
 }
 
-// 信封加密示例（基于已有的DataKey）
-func EnvelopeEncryptByDataKey(dataKey *alikmssdk.GenerateDataKeyResponse, data []byte) (*EnvelopeCipherObj, error) {
-    // 使用专属KMS返回的数据密钥明文在本地对数据进行加密，下面以AES-256 GCM模式为例
-    iv := make([]byte, GcmIvLength) // 加密初始向量，解密时需要传入
-    rand.Read(iv)
-    block, err := aes.NewCipher(dataKey.Plaintext)
-    if err != nil {
-        return nil, err
-    }
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        return nil, err
-    }
-    cipherText := gcm.Seal(nil, iv, data, nil)
-
-    // 输出密文，密文输出或持久化由用户根据需要进行处理，下面示例仅展示将密文输出到一个对象的情况
-    // 假如envelopeCipherText是需要输出的密文对象，至少需要包括以下四个内容:
-    // (1) dataKeyIV: 由专属KMS生成的加密初始向量，解密数据密钥密文时需要传入
-    // (2) encryptedDataKey: 专属KMS返回的数据密钥密文
-    // (3) iv: 加密初始向量
-    // (4) cipherText: 密文数据
-    envelopeCipherText := &EnvelopeCipherObj{
-        DataKeyIV:        dataKey.Iv,
-        EncryptedDataKey: dataKey.CiphertextBlob,
-        Iv:               iv,
-        CipherText:       cipherText,
-    }
-    return envelopeCipherText, nil
+// 大文件流式信封加密示例，内存占用与文件大小无关，格式见 kms/stream.go
+func (cli *KmsClient) EnvelopeEncryptFile(ctx context.Context, keyId, src, dst string, ec kms.EncryptionContext) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := kms.NewEncryptWriter(ctx, cli.provider, keyId, out, ec)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	// Close 写入最后一段，缺少最后一段的文件无法解密
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
 }
 
-// 信封解密示例
-func EnvelopeDecrypt(keyId string, cipherText *EnvelopeCipherObj) ([]byte, error) {
-    // 调用解密接口进行解密
-    plainDataKey, err := client.DecryptDataKey(keyId, cipherText.EncryptedDataKey, cipherText.DataKeyIV)
-    if err != nil {
-        return nil, err
-    }
-
-    block, err := aes.NewCipher(plainDataKey)
-    if err != nil {
-        return nil, err
-    }
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        return nil, err
-    }
-
-    decryptedData, err := gcm.Open(nil, cipherText.Iv, cipherText.CipherText, nil)
-    if err != nil {
-        return nil, err
-    }
-
-    return decryptedData, nil
+// 大文件流式信封解密示例，密文被截断或篡改时返回 kms.ErrStreamCorrupted
+func (cli *KmsClient) EnvelopeDecryptFile(ctx context.Context, src, dst string, ec kms.EncryptionContext) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, _, err := kms.NewDecryptReader(ctx, cli.provider, in, ec)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Sync()
 }
 
+// KmsClient 可以创建多个（例如不同的KMS实例），方法都是并发安全的
+// 所有方法遵守 ctx 的取消和截止时间；失败时可以用 errors.Is 匹配 kms.ErrKeyNotFound、kms.ErrThrottled、
+// kms.ErrAccessDenied、kms.ErrInvalidCiphertext 和 kms.ErrCircuitOpen
 type KmsClient struct {
-    alikmsClient *alikmssdk.Client
-    isDev        bool
-    devCMK       []byte
+	// 阿里云专属KMS（带重试和熔断）、本地固定密钥或本地密钥环，见 kms/provider.go
+	provider kms.KeyProvider
 
-    // cipher DK -> plain DK
-    cacheDataKey *lru.Cache
+	// 数据密钥缓存，见 kms/cache.go
+	materials *kms.CachingMaterials
 }
 
 // 使用ClientKey内容创建KMS实例SDK Client对象
-func InitKmsClient(c *KmsConfig) (*KmsClient, error) {
-
-    if c.IsDev {
-        if !(len(c.DevCMK) == 16 || len(c.DevCMK) == 24 || len(c.DevCMK) == 32) {
-            return nil, errors.New("key length must be 16/24/32")
-        }
-
-        cache, _ := lru.New(1000)
-
-        client = &KmsClient{
-            isDev:        true,
-            devCMK:       []byte(c.DevCMK),
-            cacheDataKey: cache,
-        }
-        return client, nil
-    }
-
-    // 创建KMS实例SDK Client配置
-    config := &alikmsopenapi.Config{
-        CaFilePath: tea.String(c.CaFilePath),
-        // 连接协议请设置为"https"。KMS实例服务仅允许通过HTTPS协议访问。
-        Protocol: tea.String(c.Protocal),
-        // 请替换为ClientKey文件的内容
-        ClientKeyContent: tea.String(c.ClientKeyContent),
-        // 请替换为创建ClientKey时输入的加密口令
-        Password: tea.String(c.Password),
-        // 设置endpoint为<your KMS Instance Id>.cryptoservice.kms.aliyuncs.com。
-        Endpoint: tea.String(c.Endpoint),
-    }
-    // 创建KMS实例SDK Client对象
-    aliCLI, err := alikmssdk.NewClient(config)
-    if err != nil {
-        return nil, err
-    }
-
-    cache, _ := lru.New(1000)
-    client = &KmsClient{
-        alikmsClient: aliCLI,
-        cacheDataKey: cache,
-    }
-    return client, nil
-}
-
-func (cli *KmsClient) GenerateDataKey(request *alikmssdk.GenerateDataKeyRequest) (_result *alikmssdk.GenerateDataKeyResponse, _err error) {
-    if cli.isDev {
-        // 派生 datakey
-        salt := make([]byte, sha256.Size)
-        rand.Read(salt)
-        kdf := hkdf.New(sha256.New, []byte(cli.devCMK), salt, nil)
-        key := make([]byte, *request.NumberOfBytes)
-        if _, err := io.ReadFull(kdf, key); err != nil {
-            return nil, err
-        }
-
-        cipherDK, err := cli.encrypt(&alikmssdk.EncryptRequest{
-            Plaintext: key,
-        })
-        if err != nil {
-            return nil, err
-        }
-
-        return &alikmssdk.GenerateDataKeyResponse{
-            Iv:             cipherDK.Iv,
-            Plaintext:      key,
-            CiphertextBlob: cipherDK.CiphertextBlob,
-        }, nil
-    }
-
-    return cli.alikmsClient.GenerateDataKey(request)
-
+func NewKmsClient(c *KmsConfig) (*KmsClient, error) {
+	provider, err := newKeyProvider(c)
+	if err != nil {
+		return nil, err
+	}
+	materials, err := kms.NewCachingMaterials(provider, kms.CachePolicy{
+		Capacity:    c.DataKeyCacheSize,
+		MaxAge:      time.Duration(c.DataKeyMaxAgeSeconds) * time.Second,
+		MaxMessages: c.DataKeyMaxMessages,
+		MaxBytes:    c.DataKeyMaxBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KmsClient{
+		provider:  provider,
+		materials: materials,
+	}, nil
 }
 
-func (cli *KmsClient) DecryptDataKey(keyId string, cipher, iv []byte) (_result []byte, _err error) {
-
-    value, ok := cli.cacheDataKey.Get(hex.EncodeToString(cipher))
-    if ok {
-        return value.([]byte), nil
-    }
-
-    // 解密数据密钥密文，得到数据密钥明文
-    decryptRequest := &alikmssdk.DecryptRequest{
-        KeyId:          tea.String(keyId),
-        CiphertextBlob: cipher,
-        Iv:             iv,
-    }
-
-    resp, err := cli.decrypt(decryptRequest)
-    if err != nil {
-        return nil, err
-    }
-
-    cli.cacheDataKey.Add(hex.EncodeToString(cipher), resp.Plaintext)
+// newKeyProvider 按配置选择密钥提供方
+func newKeyProvider(c *KmsConfig) (kms.KeyProvider, error) {
+	if c.KeyringFile != "" {
+		return kms.LoadKeyring(c.KeyringFile)
+	}
+	if c.IsDev {
+		return kms.NewStaticKeyProvider([]byte(c.DevCMK))
+	}
 
-    return resp.Plaintext, nil
+	// 创建KMS实例SDK Client配置
+	config := &alikmsopenapi.Config{
+		CaFilePath: tea.String(c.CaFilePath),
+		// 连接协议请设置为"https"。KMS实例服务仅允许通过HTTPS协议访问。
+		Protocol: tea.String(c.Protocal),
+		// 请替换为ClientKey文件的内容
+		ClientKeyContent: tea.String(c.ClientKeyContent),
+		// 请替换为创建ClientKey时输入的加密口令
+		Password: tea.String(c.Password),
+		// 设置endpoint为<your KMS Instance Id>.cryptoservice.kms.aliyuncs.com。
+		Endpoint: tea.String(c.Endpoint),
+	}
+	// 创建KMS实例SDK Client对象
+	aliCLI, err := alikmssdk.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	// SDK 自带的重试不感知 ctx，关闭后由 kms.RetryingProvider 按退避策略重试
+	runtime := &alikmsopenapiutil.RuntimeOptions{Autoretry: tea.Bool(false)}
+	return kms.NewRetryingProvider(
+		kms.NewDKMSProvider(aliCLI, runtime),
+		kms.RetryPolicy{MaxAttempts: c.MaxAttempts},
+		kms.NewCircuitBreaker(c.CircuitBreakerThreshold, time.Duration(c.CircuitBreakerCooldownSeconds)*time.Second),
+	), nil
 }
 
-func (cli *KmsClient) decrypt(request *alikmssdk.DecryptRequest) (_result *alikmssdk.DecryptResponse, _err error) {
-
-    if cli.isDev {
-        block, err := aes.NewCipher(cli.devCMK)
-        if err != nil {
-            return nil, err
-        }
-        gcm, err := cipher.NewGCM(block)
-        if err != nil {
-            return nil, err
-        }
-
-        decryptedData, err := gcm.Open(nil, request.Iv, request.CiphertextBlob, nil)
-        if err != nil {
-            return nil, err
-        }
-        return &alikmssdk.DecryptResponse{
-            Plaintext: decryptedData,
-        }, nil
-    }
-
-    return cli.alikmsClient.Decrypt(request)
+// aad 作为 KMS 的 Aad 参数，一般为 kms.EncryptionContext 的规范编码
+func (cli *KmsClient) GenerateDataKey(ctx context.Context, keyId string, numberOfBytes int, aad []byte) (*kms.DataKey, error) {
+	return cli.provider.GenerateDataKey(ctx, keyId, numberOfBytes, aad)
 }
 
-func (cli *KmsClient) encrypt(request *alikmssdk.EncryptRequest) (_result *alikmssdk.EncryptResponse, _err error) {
-
-    if cli.isDev {
-
-        iv := make([]byte, GcmIvLength) // 加密初始向量，解密时需要传入
-        rand.Read(iv)
-        block, err := aes.NewCipher(cli.devCMK)
-        if err != nil {
-            return nil, err
-        }
-        gcm, err := cipher.NewGCM(block)
-        if err != nil {
-            return nil, err
-        }
-        cipherText := gcm.Seal(nil, iv, request.Plaintext, nil)
-        return &alikmssdk.EncryptResponse{
-            KeyId:          request.KeyId,
-            Iv:             iv,
-            CiphertextBlob: cipherText,
-        }, nil
-
-    }
-
-    return cli.alikmsClient.Encrypt(request)
+// 缓存命中率，命中率低时可以调大 DataKeyCacheSize 或 DataKeyMaxAgeSeconds
+func (cli *KmsClient) CacheStats() kms.CacheStats {
+	return cli.materials.Stats()
 }
 
 func main() {
 	// 初始化KMS Client对象
+	// 离线测试可以启动本地模拟器（见 dkms_emulator），Endpoint 为其监听地址，CaFilePath 为数据目录下的 ca.pem
 	config := &KmsConfig{
 		CaFilePath:       "", // 可选，指定CA证书路径
-		Protocol:		 "https",
-		Endpoint:         "kms.cn-hangzhou.aliyuncs.com",
-		AccessKeyId:      tea.String("<your access key id>"),
-		AccessKeySecret:  tea.String("<your access key secret>"),
+		Protocal:         "https",
+		Endpoint:         "<your kms instance id>.cryptoservice.kms.aliyuncs.com",
+		ClientKeyContent: "<your client key content>",
+		Password:         "<your client key password>",
 		IsDev:            false,
 		DevCMK:           "yourDevCMK", // IsDev=true时必填
 	}
-	client, err := InitKmsClient(config)
+	client, err := NewKmsClient(config)
 	if err != nil {
-		panic(err)		
+		panic(err)
 	}
-}
\ No newline at end of file
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 加密上下文绑定租户、表和记录，解密时由调用方按记录重新构造
+	ec := kms.EncryptionContext{"tenant": "t1", "table": "users", "id": "42", "purpose": "phone"}
+
+	// 加密后编码为文本持久化，读取时解码再解密
+	envelope, err := client.EnvelopeEncryptByKeyId(ctx, "yourSymmetricKeyId", []byte("hello kms"), ec)
+	if err != nil {
+		panic(err)
+	}
+	encoded, err := envelope.EncodeToString()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("envelope:", encoded)
+
+	var decoded kms.EnvelopeCipherObj
+	if err := decoded.Decode(encoded); err != nil {
+		panic(err)
+	}
+	plaintext, err := client.EnvelopeDecrypt(ctx, "", &decoded, ec)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("plaintext:", string(plaintext))
+	fmt.Printf("datakey cache: %+v\n", client.CacheStats())
+}
@@ -0,0 +1,99 @@
+package main
+
+/*
+本地专属KMS模拟器，实现 dedicatedkmssdk.Client 使用的请求/响应协议，用于离线测试和 CI：
+
+	dkms_emulator create-key   -dir ./kms-data -id yourSymmetricKeyId
+	dkms_emulator rotate-key   -dir ./kms-data -id yourSymmetricKeyId
+	dkms_emulator put-secret   -dir ./kms-data -name db-password -data xxx
+	dkms_emulator client-key   -dir ./kms-data -password yourPassword > clientKey.json
+	dkms_emulator serve        -dir ./kms-data -addr 127.0.0.1:9443
+
+SDK 配置：Endpoint 为 -addr，CaFilePath 为 <dir>/ca.pem，ClientKeyContent/Password 为 client-key 的输出和口令
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"ali-kms/emulator"
+	"ali-kms/kms"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dkms_emulator <serve|create-key|rotate-key|put-secret|client-key> [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	dir := fs.String("dir", "kms-data", "数据目录（CA、密钥环、凭据、ClientKey 证书）")
+	addr := fs.String("addr", "127.0.0.1:9443", "serve: 监听地址")
+	hosts := fs.String("hosts", "", "serve: 服务端证书的域名或 IP，逗号分隔，默认 localhost 和回环地址")
+	id := fs.String("id", "", "create-key/rotate-key: 主密钥 ID")
+	spec := fs.String("spec", kms.KeySpecAES256, "create-key: 密钥规格")
+	name := fs.String("name", "", "put-secret: 凭据名称")
+	data := fs.String("data", "", "put-secret: 凭据值")
+	password := fs.String("password", "", "client-key: ClientKey 的加密口令")
+	fs.Parse(os.Args[2:])
+
+	store, err := emulator.OpenStore(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ca, err := emulator.LoadOrCreateCA(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch cmd {
+	case "serve":
+		var hostList []string
+		if *hosts != "" {
+			hostList = strings.Split(*hosts, ",")
+		}
+		srv := emulator.NewServer(store)
+		srv.SetLogger(log.Printf)
+		ln, err := srv.Listen(ca, *addr, hostList...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("dkms emulator listening on %s, ca: %s/ca.pem", ln.Addr(), *dir)
+		log.Fatal(http.Serve(ln, srv))
+	case "create-key":
+		if err := store.CreateKey(*id, *spec); err != nil {
+			log.Fatal(err)
+		}
+	case "rotate-key":
+		version, err := store.RotateKey(*id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(version)
+	case "put-secret":
+		version, err := store.PutSecret(*name, *data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(version)
+	case "client-key":
+		if *password == "" {
+			log.Fatal("client-key: -password is required")
+		}
+		content, err := store.CreateClientKey(ca, *password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(content)
+	default:
+		usage()
+	}
+}
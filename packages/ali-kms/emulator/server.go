@@ -0,0 +1,462 @@
+package emulator
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi-util/protobuf/api"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"ali-kms/kms"
+)
+
+/*
+专属 KMS 模拟器
+
+实现 dedicatedkmssdk.Client 使用的协议，离线环境（本地、CI）下可以走真实的 SDK 代码路径：
+- POST /，请求和响应都是 protobuf，接口名在 x-kms-apiname 头中
+- 请求用 ClientKey 的 RSA 私钥签名（Authorization: Bearer <base64>），模拟器用签发时保存的证书校验
+- 失败时返回 api.Error，SDK 将其转换为 tea.SDKError（Code 为下面的错误码）
+
+支持的接口：Encrypt、Decrypt、GenerateDataKey、AdvanceEncrypt、AdvanceDecrypt、AdvanceGenerateDataKey、GetSecretValue。
+密文格式与真实服务不同（只能由模拟器自己解密），客户端指定的 Iv/Algorithm/PaddingMode 被忽略，固定为 AES_GCM。
+*/
+
+// 错误码
+const (
+	CodeInvalidParameter      = "InvalidParameter"
+	CodeInvalidAccessKeyId    = "InvalidAccessKeyId"
+	CodeSignatureDoesNotMatch = "SignatureDoesNotMatch"
+	CodeKeyNotFound           = "Forbidden.KeyNotFound"
+	CodeSecretNotFound        = "Forbidden.ResourceNotFound"
+	CodeInvalidCiphertext     = "InvalidCiphertext"
+	CodeThrottling            = "Rejected.Throttling"
+	CodeUnsupportedOperation  = "UnsupportedOperation"
+	CodeInternalFailure       = "InternalFailure"
+)
+
+// algorithmAESGCM 对称加密算法名
+const algorithmAESGCM = "AES_GCM"
+
+// maxClockSkew 请求 Date 头与服务端时间允许的最大偏差
+const maxClockSkew = 15 * time.Minute
+
+// apiError 返回给 SDK 的错误
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func newError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// statusOf 错误码对应的 HTTP 状态码
+func statusOf(code string) int {
+	switch code {
+	case CodeInvalidAccessKeyId, CodeSignatureDoesNotMatch:
+		return http.StatusUnauthorized
+	case CodeKeyNotFound, CodeSecretNotFound:
+		return http.StatusNotFound
+	case CodeThrottling:
+		return http.StatusTooManyRequests
+	case CodeInternalFailure:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// handlerFunc 解析请求体并返回响应
+type handlerFunc func(ctx context.Context, body []byte) (proto.Message, error)
+
+// Server 模拟器的 HTTP 处理器
+type Server struct {
+	store    *Store
+	handlers map[string]handlerFunc
+	logf     func(format string, args ...interface{})
+
+	mu     sync.Mutex
+	faults map[string][]string // 接口名 -> 待返回的错误码
+}
+
+// NewServer 创建模拟器
+func NewServer(store *Store) *Server {
+	s := &Server{store: store, logf: log.Printf, faults: map[string][]string{}}
+	s.handlers = map[string]handlerFunc{
+		"Encrypt":                s.encrypt,
+		"Decrypt":                s.decrypt,
+		"GenerateDataKey":        s.generateDataKey,
+		"AdvanceEncrypt":         s.advanceEncrypt,
+		"AdvanceDecrypt":         s.advanceDecrypt,
+		"AdvanceGenerateDataKey": s.advanceGenerateDataKey,
+		"GetSecretValue":         s.getSecretValue,
+	}
+	return s
+}
+
+// SetLogger 设置请求日志，nil 时不输出
+func (s *Server) SetLogger(logf func(format string, args ...interface{})) {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	s.logf = logf
+}
+
+// FailNext 之后 n 次调用 apiName（为空时为任意接口）返回错误码 code，用于测试重试和熔断
+func (s *Server) FailNext(apiName, code string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults[apiName] = append(s.faults[apiName], code)
+	}
+}
+
+// takeFault 取出一个注入的错误
+func (s *Server) takeFault(apiName string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range []string{apiName, ""} {
+		if codes := s.faults[name]; len(codes) > 0 {
+			s.faults[name] = codes[1:]
+			return codes[0], true
+		}
+	}
+	return "", false
+}
+
+// Listen 在 addr 上监听 HTTPS，服务端证书由 ca 为 hosts 签发（默认 localhost 和回环地址）
+// 客户端提供 ClientKey 证书时必须是 ca 签发的
+func (s *Server) Listen(ca *CA, addr string, hosts ...string) (net.Listener, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	cert, err := ca.ServerCertificate(hosts...)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.CertPool(),
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// ServeHTTP 处理 SDK 请求
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := newRequestID()
+	apiName := r.Header.Get("x-kms-apiname")
+	resp, err := s.serve(r, apiName)
+	if err != nil {
+		var ae *apiError
+		if !errors.As(err, &ae) {
+			ae = newError(http.StatusInternalServerError, CodeInternalFailure, "%v", err)
+		}
+		s.logf("dkms emulator: %s %s %s: %s", requestID, r.Header.Get("x-kms-acccesskeyid"), apiName, ae)
+		body, _ := proto.Marshal(&api.Error{
+			StatusCode:   int32(ae.status),
+			ErrorCode:    ae.code,
+			ErrorMessage: ae.message,
+			RequestId:    requestID,
+		})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(ae.status)
+		w.Write(body)
+		return
+	}
+	// 各响应的 RequestId 字段编号不同，统一通过反射设置
+	if field := resp.ProtoReflect().Descriptor().Fields().ByName("RequestId"); field != nil {
+		resp.ProtoReflect().Set(field, protoreflect.ValueOfString(requestID))
+	}
+	body, err := proto.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logf("dkms emulator: %s %s %s: ok", requestID, r.Header.Get("x-kms-acccesskeyid"), apiName)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
+
+func (s *Server) serve(r *http.Request, apiName string) (proto.Message, error) {
+	if r.Method != http.MethodPost {
+		return nil, newError(http.StatusMethodNotAllowed, CodeInvalidParameter, "method %s not allowed", r.Method)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, CodeInvalidParameter, "read body: %v", err)
+	}
+	if err := s.authenticate(r, body); err != nil {
+		return nil, err
+	}
+	if code, ok := s.takeFault(apiName); ok {
+		return nil, newError(statusOf(code), code, "injected fault")
+	}
+	handler, ok := s.handlers[apiName]
+	if !ok {
+		return nil, newError(http.StatusBadRequest, CodeUnsupportedOperation, "api %q is not supported by the emulator", apiName)
+	}
+	return handler(r.Context(), body)
+}
+
+// stringToSign 与 dedicatedkmsopenapiutil.GetStringToSign 相同：
+// METHOD\ncontent-sha256\ncontent-type\ndate\n + 按名称排序的 x-kms-* 头（name:value\n）+ "/"
+func stringToSign(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n" + r.Header.Get("content-sha256") + "\n" + r.Header.Get("content-type") + "\n" + r.Header.Get("date") + "\n")
+	var names []string
+	for name := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-kms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(name + ":" + strings.TrimSpace(r.Header.Get(name)) + "\n")
+	}
+	b.WriteString("/")
+	return b.String()
+}
+
+// authenticate 校验请求体摘要、时间和 ClientKey 签名
+func (s *Server) authenticate(r *http.Request, body []byte) error {
+	sum := sha256.Sum256(body)
+	if !strings.EqualFold(r.Header.Get("content-sha256"), hex.EncodeToString(sum[:])) {
+		return newError(http.StatusBadRequest, CodeInvalidParameter, "content-sha256 does not match body")
+	}
+	date, err := http.ParseTime(r.Header.Get("date"))
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeInvalidParameter, "invalid date header")
+	}
+	if skew := time.Since(date); skew > maxClockSkew || skew < -maxClockSkew {
+		return newError(http.StatusUnauthorized, CodeSignatureDoesNotMatch, "request date out of range")
+	}
+
+	clientID := r.Header.Get("x-kms-acccesskeyid")
+	cert, ok := s.store.clientCert(clientID)
+	if !ok {
+		return newError(http.StatusUnauthorized, CodeInvalidAccessKeyId, "client key %q not found", clientID)
+	}
+	// TLS 层提供了证书时必须与 ClientKey 一致
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && !r.TLS.PeerCertificates[0].Equal(cert) {
+		return newError(http.StatusUnauthorized, CodeSignatureDoesNotMatch, "tls client certificate does not match client key")
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return newError(http.StatusUnauthorized, CodeSignatureDoesNotMatch, "client key is not rsa")
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("authorization"), "Bearer "))
+	if err != nil {
+		return newError(http.StatusUnauthorized, CodeSignatureDoesNotMatch, "invalid authorization header")
+	}
+	hashed := sha256.Sum256([]byte(stringToSign(r)))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature); err != nil {
+		return newError(http.StatusUnauthorized, CodeSignatureDoesNotMatch, "signature does not match")
+	}
+	return nil
+}
+
+// packBlob 密文 = 1 字节版本长度 + 版本 ID + AES-GCM 密文，Decrypt 时不需要客户端提供版本
+// 版本 ID 由密钥环生成（vN），不会超过 255 字节
+func packBlob(blob *kms.EncryptedBlob) []byte {
+	out := []byte{byte(len(blob.KeyVersionID))}
+	out = append(out, blob.KeyVersionID...)
+	return append(out, blob.CiphertextBlob...)
+}
+
+func unpackBlob(data []byte) (version string, ciphertext []byte, err error) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "", nil, newError(http.StatusBadRequest, CodeInvalidCiphertext, "ciphertext blob is malformed")
+	}
+	n := int(data[0])
+	return string(data[1 : 1+n]), data[1+n:], nil
+}
+
+// keyError 将 KeyringProvider 的错误转换为错误码
+func (s *Server) keyError(keyID string, err error) error {
+	switch {
+	case errors.Is(err, kms.ErrKeyNotFound) && !s.store.keyring.HasKey(keyID):
+		return newError(http.StatusNotFound, CodeKeyNotFound, "key %q not found", keyID)
+	case errors.Is(err, kms.ErrKeyNotFound):
+		return newError(http.StatusBadRequest, CodeInvalidCiphertext, "%v", err)
+	}
+	return newError(http.StatusBadRequest, CodeInvalidParameter, "%v", err)
+}
+
+func (s *Server) encryptBlob(ctx context.Context, keyID string, plaintext, aad []byte) (*kms.EncryptedBlob, error) {
+	if keyID == "" || len(plaintext) == 0 || len(plaintext) > 6*1024 {
+		return nil, newError(http.StatusBadRequest, CodeInvalidParameter, "KeyId and Plaintext (at most 6KB) are required")
+	}
+	blob, err := s.store.keyring.Encrypt(ctx, keyID, plaintext, aad)
+	if err != nil {
+		return nil, s.keyError(keyID, err)
+	}
+	return blob, nil
+}
+
+func (s *Server) decryptBlob(ctx context.Context, keyID string, ciphertext, iv, aad []byte) ([]byte, string, error) {
+	version, sealed, err := unpackBlob(ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext, err := s.store.keyring.Decrypt(ctx, &kms.EncryptedBlob{KeyID: keyID, KeyVersionID: version, CiphertextBlob: sealed, Iv: iv}, aad)
+	if err != nil {
+		if errors.Is(err, kms.ErrKeyNotFound) || !s.store.keyring.HasKey(keyID) {
+			return nil, "", s.keyError(keyID, err)
+		}
+		// 认证失败：密文、Iv 或 Aad 不匹配
+		return nil, "", newError(http.StatusBadRequest, CodeInvalidCiphertext, "decrypt failed")
+	}
+	return plaintext, version, nil
+}
+
+func (s *Server) dataKey(ctx context.Context, keyID string, numberOfBytes int32, aad []byte) (*kms.DataKey, error) {
+	if numberOfBytes == 0 {
+		numberOfBytes = 32
+	}
+	if keyID == "" || numberOfBytes < 1 || numberOfBytes > 1024 {
+		return nil, newError(http.StatusBadRequest, CodeInvalidParameter, "KeyId is required and NumberOfBytes must be in [1, 1024]")
+	}
+	dk, err := s.store.keyring.GenerateDataKey(ctx, keyID, int(numberOfBytes), aad)
+	if err != nil {
+		return nil, s.keyError(keyID, err)
+	}
+	return dk, nil
+}
+
+// unmarshal 解析请求体
+func unmarshal(body []byte, m proto.Message) error {
+	if err := proto.Unmarshal(body, m); err != nil {
+		return newError(http.StatusBadRequest, CodeInvalidParameter, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) encrypt(ctx context.Context, body []byte) (proto.Message, error) {
+	req := &api.EncryptRequest{}
+	if err := unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	blob, err := s.encryptBlob(ctx, req.KeyId, req.Plaintext, req.Aad)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EncryptResponse{KeyId: req.KeyId, CiphertextBlob: packBlob(blob), Iv: blob.Iv, Algorithm: algorithmAESGCM}, nil
+}
+
+func (s *Server) advanceEncrypt(ctx context.Context, body []byte) (proto.Message, error) {
+	req := &api.AdvanceEncryptRequest{}
+	if err := unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	blob, err := s.encryptBlob(ctx, req.KeyId, req.Plaintext, req.Aad)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AdvanceEncryptResponse{
+		KeyId: req.KeyId, CiphertextBlob: packBlob(blob), Iv: blob.Iv, Algorithm: algorithmAESGCM, KeyVersionId: blob.KeyVersionID,
+	}, nil
+}
+
+func (s *Server) decrypt(ctx context.Context, body []byte) (proto.Message, error) {
+	req := &api.DecryptRequest{}
+	if err := unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	plaintext, _, err := s.decryptBlob(ctx, req.KeyId, req.CiphertextBlob, req.Iv, req.Aad)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DecryptResponse{KeyId: req.KeyId, Plaintext: plaintext, Algorithm: algorithmAESGCM}, nil
+}
+
+func (s *Server) advanceDecrypt(ctx context.Context, body []byte) (proto.Message, error) {
+	req := &api.AdvanceDecryptRequest{}
+	if err := unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	plaintext, version, err := s.decryptBlob(ctx, req.KeyId, req.CiphertextBlob, req.Iv, req.Aad)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AdvanceDecryptResponse{KeyId: req.KeyId, Plaintext: plaintext, Algorithm: algorithmAESGCM, KeyVersionId: version}, nil
+}
+
+func (s *Server) generateDataKey(ctx context.Context, body []byte) (proto.Message, error) {
+	req := &api.GenerateDataKeyRequest{}
+	if err := unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	dk, err := s.dataKey(ctx, req.KeyId, req.NumberOfBytes, req.Aad)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GenerateDataKeyResponse{
+		KeyId: req.KeyId, Iv: dk.Iv, Plaintext: dk.Plaintext, CiphertextBlob: packBlob(&dk.EncryptedBlob), Algorithm: algorithmAESGCM,
+	}, nil
+}
+
+func (s *Server) advanceGenerateDataKey(ctx context.Context, body []byte) (proto.Message, error) {
+	req := &api.AdvanceGenerateDataKeyRequest{}
+	if err := unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	dk, err := s.dataKey(ctx, req.KeyId, req.NumberOfBytes, req.Aad)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AdvanceGenerateDataKeyResponse{
+		KeyId: req.KeyId, Iv: dk.Iv, Plaintext: dk.Plaintext, CiphertextBlob: packBlob(&dk.EncryptedBlob),
+		Algorithm: algorithmAESGCM, KeyVersionId: dk.KeyVersionID,
+	}, nil
+}
+
+func (s *Server) getSecretValue(ctx context.Context, body []byte) (proto.Message, error) {
+	req := &api.GetSecretValueRequest{}
+	if err := unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	secret, version, ok := s.store.secretVersion(req.SecretName, req.VersionId, req.VersionStage)
+	if !ok {
+		return nil, newError(http.StatusNotFound, CodeSecretNotFound, "secret %q version %q stage %q not found", req.SecretName, req.VersionId, req.VersionStage)
+	}
+	return &api.GetSecretValueResponse{
+		SecretName:        secret.Name,
+		SecretType:        secret.Type,
+		SecretData:        version.Data,
+		SecretDataType:    "text",
+		VersionStages:     version.Stages,
+		VersionId:         version.ID,
+		CreateTime:        version.Created.Format(time.RFC3339),
+		AutomaticRotation: "Disabled",
+	}, nil
+}
@@ -0,0 +1,262 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	dedicatedkmsopenapi "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi"
+	dedicatedkmsopenapiutil "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi-util"
+	dedicatedkmssdk "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/sdk"
+
+	"ali-kms/kms"
+)
+
+// startEmulator 启动模拟器并返回使用新签发 ClientKey 的 SDK 客户端
+func startEmulator(t *testing.T) (*Server, *dedicatedkmssdk.Client, *CA, string) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateKey("orders", kms.KeySpecAES256); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutSecret("db-password", "v1-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutSecret("db-password", "v2-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(store)
+	srv.SetLogger(t.Logf)
+	ln, err := srv.Listen(ca, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: srv}
+	go httpServer.Serve(ln)
+	t.Cleanup(func() { httpServer.Close() })
+
+	clientKey, err := store.CreateClientKey(ca, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, newSDKClient(t, ln.Addr().String(), string(ca.PEM), clientKey, "password"), ca, dir
+}
+
+func newSDKClient(t *testing.T, endpoint, ca, clientKey, password string) *dedicatedkmssdk.Client {
+	t.Helper()
+	client, err := dedicatedkmssdk.NewClient(&dedicatedkmsopenapi.Config{
+		Protocol:         tea.String("https"),
+		Endpoint:         tea.String(endpoint),
+		ClientKeyContent: tea.String(clientKey),
+		Password:         tea.String(password),
+		Ca:               tea.String(ca),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// sdkCode SDK 错误中的错误码
+func sdkCode(err error) string {
+	var sdkErr *tea.SDKError
+	if errors.As(err, &sdkErr) {
+		return tea.StringValue(sdkErr.Code)
+	}
+	return ""
+}
+
+// TestEmulatorEnvelope 通过真实的 SDK 和 DKMSProvider 完成信封加解密
+func TestEmulatorEnvelope(t *testing.T) {
+	ctx := context.Background()
+	_, client, _, _ := startEmulator(t)
+	p := kms.NewDKMSProvider(client, nil)
+	ec := kms.EncryptionContext{"tenant": "t1"}
+
+	obj, err := kms.EnvelopeEncrypt(ctx, p, "orders", []byte("hello dkms"), ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.KeyVersionID != "v1" {
+		t.Errorf("期望密钥版本 v1，得到 %q", obj.KeyVersionID)
+	}
+	plaintext, err := kms.EnvelopeDecrypt(ctx, p, obj, ec)
+	if err != nil || string(plaintext) != "hello dkms" {
+		t.Fatalf("解密得到 %q %v", plaintext, err)
+	}
+
+	// 旧接口 Encrypt/Decrypt/GenerateDataKey
+	enc, err := client.Encrypt(&dedicatedkmssdk.EncryptRequest{KeyId: tea.String("orders"), Plaintext: []byte("legacy"), Aad: []byte("aad")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := client.Decrypt(&dedicatedkmssdk.DecryptRequest{KeyId: tea.String("orders"), CiphertextBlob: enc.CiphertextBlob, Iv: enc.Iv, Aad: []byte("aad")})
+	if err != nil || string(dec.Plaintext) != "legacy" {
+		t.Fatalf("Decrypt 得到 %q %v", dec.Plaintext, err)
+	}
+	dk, err := client.GenerateDataKey(&dedicatedkmssdk.GenerateDataKeyRequest{KeyId: tea.String("orders"), NumberOfBytes: tea.Int32(16)})
+	if err != nil || len(dk.Plaintext) != 16 || tea.StringValue(dk.RequestId) == "" {
+		t.Fatalf("GenerateDataKey 得到 %d 字节 %v", len(dk.Plaintext), err)
+	}
+
+	cases := []struct {
+		name string
+		call func() error
+		code string
+	}{
+		{"不存在的密钥", func() error {
+			_, err := p.Encrypt(ctx, "missing", []byte("x"), nil)
+			return err
+		}, CodeKeyNotFound},
+		{"Aad 不一致", func() error {
+			_, err := p.Decrypt(ctx, obj.EncryptedDataKeyOf(), []byte("other"))
+			return err
+		}, CodeInvalidCiphertext},
+		{"密文被篡改", func() error {
+			_, err := client.Decrypt(&dedicatedkmssdk.DecryptRequest{KeyId: tea.String("orders"), CiphertextBlob: []byte{9}, Iv: enc.Iv})
+			return err
+		}, CodeInvalidCiphertext},
+	}
+	for _, c := range cases {
+		if code := sdkCode(c.call()); code != c.code {
+			t.Errorf("%s: 期望错误码 %s，得到 %q", c.name, c.code, code)
+		}
+	}
+}
+
+// TestEmulatorSecretsAndAuth 凭据版本、ClientKey 校验和错误注入
+func TestEmulatorSecretsAndAuth(t *testing.T) {
+	srv, client, ca, dir := startEmulator(t)
+
+	for _, c := range []struct {
+		stage, version, expect string
+	}{
+		{"", "", "v2-secret"},
+		{StagePrevious, "", "v1-secret"},
+		{"", "v1", "v1-secret"},
+	} {
+		resp, err := client.GetSecretValue(&dedicatedkmssdk.GetSecretValueRequest{
+			SecretName: tea.String("db-password"), VersionStage: tea.String(c.stage), VersionId: tea.String(c.version),
+		})
+		if err != nil || tea.StringValue(resp.SecretData) != c.expect {
+			t.Errorf("%s/%s: 期望 %s，得到 %v %v", c.stage, c.version, c.expect, resp, err)
+		}
+	}
+	if _, err := client.GetSecretValue(&dedicatedkmssdk.GetSecretValueRequest{SecretName: tea.String("missing")}); sdkCode(err) != CodeSecretNotFound {
+		t.Errorf("期望 %s，得到 %v", CodeSecretNotFound, err)
+	}
+
+	// 重新打开数据目录，已签发的 ClientKey 和密钥仍然有效；其他 CA 签发的 ClientKey 被拒绝
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Keyring().HasKey("orders") {
+		t.Error("重新打开后密钥丢失")
+	}
+	otherDir := t.TempDir()
+	otherStore, err := OpenStore(otherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := LoadOrCreateCA(otherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreignKey, err := otherStore.CreateClientKey(otherCA, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := tea.StringValue(client.Endpoint)
+	foreign := newSDKClient(t, endpoint, string(ca.PEM), foreignKey, "password")
+	if _, err := foreign.GenerateDataKey(&dedicatedkmssdk.GenerateDataKeyRequest{KeyId: tea.String("orders")}); err == nil {
+		t.Error("未登记的 ClientKey 应被拒绝")
+	}
+
+	srv.FailNext("GenerateDataKey", CodeThrottling, 1)
+	srv.FailNext("GenerateDataKey", CodeInvalidParameter, 1)
+	if _, err := client.GenerateDataKey(&dedicatedkmssdk.GenerateDataKeyRequest{KeyId: tea.String("orders")}); sdkCode(err) != CodeInvalidParameter {
+		t.Errorf("限流应由 SDK 重试，随后返回注入的 %s，得到 %v", CodeInvalidParameter, err)
+	}
+	if _, err := client.GenerateDataKey(&dedicatedkmssdk.GenerateDataKeyRequest{KeyId: tea.String("orders")}); err != nil {
+		t.Errorf("注入的错误用完后应成功，得到 %v", err)
+	}
+}
+
+// TestDKMSErrorMapping SDK 错误码转换为类型错误，限流由 RetryingProvider 重试
+func TestDKMSErrorMapping(t *testing.T) {
+	ctx := context.Background()
+	srv, client, _, _ := startEmulator(t)
+	p := kms.NewDKMSProvider(client, &dedicatedkmsopenapiutil.RuntimeOptions{Autoretry: tea.Bool(false)})
+	blob, err := p.Encrypt(ctx, "orders", []byte("data key"), []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		call   func() error
+		expect error
+	}{
+		{"密钥不存在", func() error {
+			_, err := p.Encrypt(ctx, "missing", []byte("x"), nil)
+			return err
+		}, kms.ErrKeyNotFound},
+		{"Aad 不一致", func() error {
+			_, err := p.Decrypt(ctx, blob, []byte("other"))
+			return err
+		}, kms.ErrInvalidCiphertext},
+		{"限流", func() error {
+			srv.FailNext("AdvanceEncrypt", CodeThrottling, 1)
+			_, err := p.Encrypt(ctx, "orders", []byte("x"), nil)
+			return err
+		}, kms.ErrThrottled},
+		{"签名错误", func() error {
+			srv.FailNext("AdvanceEncrypt", CodeSignatureDoesNotMatch, 1)
+			_, err := p.Encrypt(ctx, "orders", []byte("x"), nil)
+			return err
+		}, kms.ErrAccessDenied},
+		{"ctx 已取消", func() error {
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := p.Encrypt(canceled, "orders", []byte("x"), nil)
+			return err
+		}, context.Canceled},
+	}
+	for _, c := range cases {
+		if err := c.call(); !errors.Is(err, c.expect) {
+			t.Errorf("%s: 期望 %v，得到 %v", c.name, c.expect, err)
+		}
+	}
+	var dkmsErr *kms.DKMSError
+	var sdkErr *tea.SDKError
+	if _, err := p.Encrypt(ctx, "missing", []byte("x"), nil); !errors.As(err, &dkmsErr) || dkmsErr.Code != CodeKeyNotFound || !errors.As(err, &sdkErr) {
+		t.Errorf("期望 DKMSError 和 SDKError，得到 %v", err)
+	}
+
+	breaker := kms.NewCircuitBreaker(3, time.Minute)
+	r := kms.NewRetryingProvider(p, kms.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}, breaker)
+	srv.FailNext("AdvanceDecrypt", CodeThrottling, 2)
+	if plaintext, err := r.Decrypt(ctx, blob, []byte("aad")); err != nil || string(plaintext) != "data key" {
+		t.Errorf("限流两次后应重试成功，得到 %q %v", plaintext, err)
+	}
+	srv.FailNext("AdvanceDecrypt", CodeInternalFailure, 3)
+	if _, err := r.Decrypt(ctx, blob, []byte("aad")); !errors.Is(err, kms.ErrUnavailable) || !breaker.Open() {
+		t.Errorf("连续失败后应熔断，得到 %v", err)
+	}
+	if _, err := r.Decrypt(ctx, blob, []byte("aad")); !errors.Is(err, kms.ErrCircuitOpen) {
+		t.Errorf("熔断期间期望 ErrCircuitOpen，得到 %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package emulator
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+
+	"ali-kms/kms"
+)
+
+/*
+Store 模拟器的数据目录：
+
+	ca.pem / ca-key.pem  自建 CA（见 ca.go）
+	keyring.json         主密钥，格式与 kms.LoadKeyring 相同，也可以直接给 KeyringProvider 离线使用
+	secrets.json         凭据（GetSecretValue）
+	clients.json         已签发的 ClientKey 证书，用于校验请求签名
+
+所有修改立即写回文件，文件权限 0600。
+*/
+type Store struct {
+	dir     string
+	keyring *kms.KeyringProvider
+
+	mu      sync.RWMutex
+	secrets map[string]*Secret
+	clients map[string]*ClientKey
+}
+
+// Secret 凭据及其版本
+type Secret struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"` // Generic
+	Versions []SecretVersion `json:"versions"`
+}
+
+// SecretVersion 凭据的一个版本，Stages 为 ACSCurrent/ACSPrevious
+type SecretVersion struct {
+	ID      string    `json:"id"`
+	Data    string    `json:"data"`
+	Stages  []string  `json:"stages,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// 凭据版本状态
+const (
+	StageCurrent  = "ACSCurrent"
+	StagePrevious = "ACSPrevious"
+)
+
+// ClientKey 已签发的应用身份凭证（ClientKey），只保存证书
+type ClientKey struct {
+	ID      string    `json:"id"`
+	CertPEM string    `json:"cert"`
+	Created time.Time `json:"created"`
+
+	cert *x509.Certificate
+}
+
+const (
+	keyringFile = "keyring.json"
+	secretsFile = "secrets.json"
+	clientsFile = "clients.json"
+)
+
+// OpenStore 打开数据目录，不存在时创建
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, keyring: kms.NewKeyringProvider(), secrets: map[string]*Secret{}, clients: map[string]*ClientKey{}}
+	if _, err := os.Stat(filepath.Join(dir, keyringFile)); err == nil {
+		if s.keyring, err = kms.LoadKeyring(filepath.Join(dir, keyringFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	var secrets []*Secret
+	if err := readJSON(filepath.Join(dir, secretsFile), &secrets); err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets {
+		s.secrets[secret.Name] = secret
+	}
+	var clients []*ClientKey
+	if err := readJSON(filepath.Join(dir, clientsFile), &clients); err != nil {
+		return nil, err
+	}
+	for _, c := range clients {
+		block, _ := pem.Decode([]byte(c.CertPEM))
+		if block == nil {
+			return nil, fmt.Errorf("%s: client key %s: invalid certificate", clientsFile, c.ID)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: client key %s: %w", clientsFile, c.ID, err)
+		}
+		c.cert = cert
+		s.clients[c.ID] = c
+	}
+	return s, nil
+}
+
+// readJSON 文件不存在时保持 v 不变
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSON 先写临时文件再改名，避免写到一半时进程退出
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Dir 数据目录
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Keyring 主密钥，模拟器的加解密都由它完成
+func (s *Store) Keyring() *kms.KeyringProvider {
+	return s.keyring
+}
+
+// CreateKey 新建主密钥（spec 为 kms.KeySpecAES256 或 kms.KeySpecECP256）
+func (s *Store) CreateKey(id, spec string) error {
+	if err := s.keyring.CreateKey(id, spec); err != nil {
+		return err
+	}
+	return s.keyring.Save(filepath.Join(s.dir, keyringFile))
+}
+
+// RotateKey 轮转主密钥，返回新版本 ID
+func (s *Store) RotateKey(id string) (string, error) {
+	version, err := s.keyring.Rotate(id)
+	if err != nil {
+		return "", err
+	}
+	return version, s.keyring.Save(filepath.Join(s.dir, keyringFile))
+}
+
+// PutSecret 写入凭据的新版本并设为 ACSCurrent，原 ACSCurrent 变为 ACSPrevious，返回版本 ID
+func (s *Store) PutSecret(name, data string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		secret = &Secret{Name: name, Type: "Generic"}
+		s.secrets[name] = secret
+	}
+	for i := range secret.Versions {
+		v := &secret.Versions[i]
+		switch {
+		case hasStage(v.Stages, StageCurrent):
+			v.Stages = []string{StagePrevious}
+		case hasStage(v.Stages, StagePrevious):
+			v.Stages = nil
+		}
+	}
+	id := fmt.Sprintf("v%d", len(secret.Versions)+1)
+	secret.Versions = append(secret.Versions, SecretVersion{ID: id, Data: data, Stages: []string{StageCurrent}, Created: time.Now().UTC()})
+	return id, s.saveSecrets()
+}
+
+func hasStage(stages []string, stage string) bool {
+	for _, s := range stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// saveSecrets 调用时持有 s.mu
+func (s *Store) saveSecrets() error {
+	secrets := make([]*Secret, 0, len(s.secrets))
+	for _, secret := range s.secrets {
+		secrets = append(secrets, secret)
+	}
+	return writeJSON(filepath.Join(s.dir, secretsFile), secrets)
+}
+
+// secretVersion 按版本 ID 或状态查找，两者都为空时返回 ACSCurrent
+func (s *Store) secretVersion(name, versionID, stage string) (*Secret, *SecretVersion, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		return nil, nil, false
+	}
+	if versionID == "" && stage == "" {
+		stage = StageCurrent
+	}
+	for i := range secret.Versions {
+		v := &secret.Versions[i]
+		if (versionID == "" || v.ID == versionID) && (stage == "" || hasStage(v.Stages, stage)) {
+			copied := *v
+			return secret, &copied, true
+		}
+	}
+	return nil, nil, false
+}
+
+// ClientKeyContent SDK 的 Config.ClientKeyContent，与控制台下载的 ClientKey 文件格式相同
+type ClientKeyContent struct {
+	KeyId          string
+	PrivateKeyData string // base64 编码的 PKCS#12
+}
+
+// CreateClientKey 签发新的 ClientKey，私钥只出现在返回的内容中（以 password 加密），模拟器只保存证书
+func (s *Store) CreateClientKey(ca *CA, password string) (string, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	id := newClientKeyID()
+	cert, err := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: id},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		NotAfter:    time.Now().AddDate(5, 0, 0),
+	}, &priv.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	// SDK 使用 golang.org/x/crypto/pkcs12 解析，只支持旧的 3DES 加密方式
+	pfx, err := pkcs12.LegacyDES.Encode(priv, cert, nil, password)
+	if err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(ClientKeyContent{KeyId: id, PrivateKeyData: base64.StdEncoding.EncodeToString(pfx)})
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[id] = &ClientKey{
+		ID:      id,
+		CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		Created: time.Now().UTC(),
+		cert:    cert,
+	}
+	clients := make([]*ClientKey, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	if err := writeJSON(filepath.Join(s.dir, clientsFile), clients); err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// newClientKeyID 格式与控制台生成的 KAAP.<uuid> 相同
+func newClientKeyID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	h := hex.EncodeToString(b)
+	return "KAAP." + h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// clientCert 查找 ClientKey 的证书
+func (s *Store) clientCert(id string) (*x509.Certificate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.clients[id]
+	if !ok {
+		return nil, false
+	}
+	return c.cert, true
+}
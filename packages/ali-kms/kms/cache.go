@@ -0,0 +1,316 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+/*
+数据密钥缓存
+
+高频写入时每条数据都调用 GenerateDataKey 代价较高，CachingMaterials 在限制内复用数据密钥：
+- 加密：同一主密钥 + 加密上下文复用一个数据密钥，超过 MaxAge、MaxMessages 或 MaxBytes 后重新生成
+- 解密：按数据密钥密文 + 加密上下文缓存明文，超过 MaxAge 后重新调用 KMS
+- 共享数据密钥（EnvelopeEncryptShared）：数据密钥以较粗的 keyEC（例如只有表名）生成和缓存，多条记录共用，
+  每条记录的密文仍绑定完整的 ec（例如表名 + 主键），解密时两者都必须相同
+缓存中的明文密钥在淘汰时清零，对外只返回副本，调用方用完后可以自行清零。
+*/
+
+// 缓存策略的默认值
+const (
+	DefaultCacheCapacity = 1000
+	DefaultCacheMaxAge   = 5 * time.Minute
+	// DefaultCacheMaxMessages 随机 96 位 IV 下同一密钥建议的最大加密次数
+	DefaultCacheMaxMessages = 1 << 32
+)
+
+// CachePolicy 数据密钥的缓存限制，零值字段使用默认值
+type CachePolicy struct {
+	Capacity    int           // 最多缓存的数据密钥数
+	MaxAge      time.Duration // 数据密钥从生成（或解密）起的最长缓存时间
+	MaxMessages uint64        // 每个数据密钥最多加密的消息数
+	MaxBytes    uint64        // 每个数据密钥最多加密的明文字节数，0 为不限制
+}
+
+// CacheStats 缓存统计
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // 过期、超出用量或容量而被淘汰（清零）的数据密钥
+	Entries   int    `json:"entries"`
+}
+
+// cacheEntry 缓存的数据密钥及其用量，解密缓存只使用 Plaintext
+type cacheEntry struct {
+	dataKey  *DataKey
+	created  time.Time
+	messages uint64
+	bytes    uint64
+}
+
+// CachingMaterials 带缓存的数据密钥管理，可以并发使用
+type CachingMaterials struct {
+	provider KeyProvider
+	policy   CachePolicy
+	now      func() time.Time
+
+	mu    sync.Mutex
+	lru   *simplelru.LRU
+	stats CacheStats
+}
+
+// NewCachingMaterials 创建数据密钥缓存
+func NewCachingMaterials(p KeyProvider, policy CachePolicy) (*CachingMaterials, error) {
+	if policy.Capacity <= 0 {
+		policy.Capacity = DefaultCacheCapacity
+	}
+	if policy.MaxAge <= 0 {
+		policy.MaxAge = DefaultCacheMaxAge
+	}
+	if policy.MaxMessages == 0 {
+		policy.MaxMessages = DefaultCacheMaxMessages
+	}
+	m := &CachingMaterials{provider: p, policy: policy, now: time.Now}
+	cache, err := simplelru.NewLRU(policy.Capacity, func(_, value interface{}) {
+		// 淘汰时清零明文密钥，调用时已持有 m.mu
+		clear(value.(*cacheEntry).dataKey.Plaintext)
+		m.stats.Evictions++
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.lru = cache
+	return m, nil
+}
+
+// Provider 底层的密钥提供方
+func (m *CachingMaterials) Provider() KeyProvider {
+	return m.provider
+}
+
+// cacheKey 各字段加长度前缀后取 SHA-256，避免拼接歧义且不在内存中保留过长的 key
+func cacheKey(kind byte, fields ...[]byte) string {
+	h := sha256.New()
+	h.Write([]byte{kind})
+	for _, f := range fields {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(f)))
+		h.Write(n[:])
+		h.Write(f)
+	}
+	return string(h.Sum(nil))
+}
+
+// copyDataKey 返回副本，调用方修改或清零不影响缓存
+func copyDataKey(dk *DataKey) *DataKey {
+	return &DataKey{
+		EncryptedBlob: EncryptedBlob{
+			KeyID:          dk.KeyID,
+			KeyVersionID:   dk.KeyVersionID,
+			CiphertextBlob: bytes.Clone(dk.CiphertextBlob),
+			Iv:             bytes.Clone(dk.Iv),
+		},
+		Plaintext: bytes.Clone(dk.Plaintext),
+	}
+}
+
+// lookup 查找未过期的缓存，过期的直接淘汰，调用时持有 m.mu
+func (m *CachingMaterials) lookup(key string) (*cacheEntry, bool) {
+	value, ok := m.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := value.(*cacheEntry)
+	if m.now().Sub(e.created) >= m.policy.MaxAge {
+		m.lru.Remove(key)
+		return nil, false
+	}
+	return e, true
+}
+
+// store 放入缓存，替换同 key 的旧数据密钥时先将其淘汰清零，调用时持有 m.mu
+func (m *CachingMaterials) store(key string, e *cacheEntry) {
+	m.lru.Remove(key)
+	m.lru.Add(key, e)
+}
+
+// EncryptionMaterials 获取用于加密 size 字节明文的数据密钥（副本）
+// 缓存的数据密钥加上本次用量后仍在 MaxMessages/MaxBytes 内时复用，否则重新生成；单条超过 MaxBytes 的数据不缓存
+func (m *CachingMaterials) EncryptionMaterials(ctx context.Context, keyID string, ec EncryptionContext, size uint64) (*DataKey, error) {
+	aad := ec.Canonical()
+	if m.policy.MaxBytes != 0 && size > m.policy.MaxBytes {
+		m.mu.Lock()
+		m.stats.Misses++
+		m.mu.Unlock()
+		return m.provider.GenerateDataKey(ctx, keyID, DataKeyLength, aad)
+	}
+	key := cacheKey('e', []byte(keyID), aad)
+
+	m.mu.Lock()
+	if e, ok := m.lookup(key); ok {
+		if e.messages < m.policy.MaxMessages && (m.policy.MaxBytes == 0 || e.bytes+size <= m.policy.MaxBytes) {
+			e.messages++
+			e.bytes += size
+			m.stats.Hits++
+			dk := copyDataKey(e.dataKey)
+			m.mu.Unlock()
+			return dk, nil
+		}
+		m.lru.Remove(key)
+	}
+	m.stats.Misses++
+	m.mu.Unlock()
+
+	// 调用 KMS 时不持有锁
+	dataKey, err := m.provider.GenerateDataKey(ctx, keyID, DataKeyLength, aad)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.store(key, &cacheEntry{dataKey: copyDataKey(dataKey), created: m.now(), messages: 1, bytes: size})
+	m.mu.Unlock()
+	return dataKey, nil
+}
+
+// DecryptionMaterials 解密密文中的数据密钥（副本），ec 必须与加密时相同
+func (m *CachingMaterials) DecryptionMaterials(ctx context.Context, obj *EnvelopeCipherObj, ec EncryptionContext) ([]byte, error) {
+	if err := obj.checkContext(ec); err != nil {
+		return nil, err
+	}
+	return m.decryptDataKey(ctx, obj, ec)
+}
+
+// decryptDataKey 以 keyEC 作为 Aad 解密数据密钥，不检查密文绑定的上下文
+func (m *CachingMaterials) decryptDataKey(ctx context.Context, obj *EnvelopeCipherObj, keyEC EncryptionContext) ([]byte, error) {
+	aad := keyEC.Canonical()
+	blob := obj.EncryptedDataKeyOf()
+	key := cacheKey('d', []byte(blob.KeyID), []byte(blob.KeyVersionID), blob.CiphertextBlob, blob.Iv, aad)
+
+	m.mu.Lock()
+	if e, ok := m.lookup(key); ok {
+		m.stats.Hits++
+		plaintext := bytes.Clone(e.dataKey.Plaintext)
+		m.mu.Unlock()
+		return plaintext, nil
+	}
+	m.stats.Misses++
+	m.mu.Unlock()
+
+	plaintext, err := m.provider.Decrypt(ctx, blob, aad)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.store(key, &cacheEntry{dataKey: &DataKey{Plaintext: bytes.Clone(plaintext)}, created: m.now()})
+	m.mu.Unlock()
+	return plaintext, nil
+}
+
+// EnvelopeEncrypt 使用缓存的数据密钥进行信封加密
+func (m *CachingMaterials) EnvelopeEncrypt(ctx context.Context, keyID string, data []byte, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	dataKey, err := m.EncryptionMaterials(ctx, keyID, ec, uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dataKey.Plaintext)
+	return EnvelopeEncryptWithDataKey(dataKey, data, ec)
+}
+
+// EnvelopeDecrypt 使用缓存的数据密钥进行信封解密
+func (m *CachingMaterials) EnvelopeDecrypt(ctx context.Context, obj *EnvelopeCipherObj, ec EncryptionContext) ([]byte, error) {
+	plainDataKey, err := m.DecryptionMaterials(ctx, obj, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plainDataKey)
+	return DecryptWithDataKey(plainDataKey, obj, ec)
+}
+
+// EnvelopeEncryptShared 使用以 keyEC 生成的共享数据密钥加密，密文绑定 ec；ec 必须包含 keyEC 的全部字段
+// 适合大量小记录（例如数据库字段）：同一张表的记录共用数据密钥，不必每条记录调用一次 KMS
+func (m *CachingMaterials) EnvelopeEncryptShared(ctx context.Context, keyID string, data []byte, keyEC, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	if !ec.Contains(keyEC) {
+		return nil, fmt.Errorf("%w: context does not contain the data key context", ErrContextMismatch)
+	}
+	dataKey, err := m.EncryptionMaterials(ctx, keyID, keyEC, uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dataKey.Plaintext)
+	return EnvelopeEncryptWithDataKey(dataKey, data, ec)
+}
+
+// EnvelopeDecryptShared 解密 EnvelopeEncryptShared 的结果，keyEC 和 ec 都必须与加密时相同
+func (m *CachingMaterials) EnvelopeDecryptShared(ctx context.Context, obj *EnvelopeCipherObj, keyEC, ec EncryptionContext) ([]byte, error) {
+	if !ec.Contains(keyEC) {
+		return nil, fmt.Errorf("%w: context does not contain the data key context", ErrContextMismatch)
+	}
+	if err := obj.checkContext(ec); err != nil {
+		return nil, err
+	}
+	plainDataKey, err := m.decryptDataKey(ctx, obj, keyEC)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plainDataKey)
+	return DecryptWithDataKey(plainDataKey, obj, ec)
+}
+
+// RewrapShared 使用缓存的提供方重新包装 EnvelopeEncryptShared 的结果，见包级函数 RewrapShared
+func (m *CachingMaterials) RewrapShared(ctx context.Context, obj *EnvelopeCipherObj, targetKeyID string, keyEC, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	return RewrapShared(ctx, m.provider, obj, targetKeyID, keyEC, ec)
+}
+
+// RewrapShared 重新包装 EnvelopeEncryptShared 的结果：数据密钥以 keyEC 解密和重新加密，ec 用于校验密文的上下文摘要
+// 重新包装后每条记录的数据密钥密文各自独立，仍然可以用 EnvelopeDecryptShared 解密
+func RewrapShared(ctx context.Context, p KeyProvider, obj *EnvelopeCipherObj, targetKeyID string, keyEC, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	if !ec.Contains(keyEC) {
+		return nil, fmt.Errorf("%w: context does not contain the data key context", ErrContextMismatch)
+	}
+	if err := obj.checkContext(ec); err != nil {
+		return nil, err
+	}
+	if targetKeyID == "" {
+		targetKeyID = obj.KeyID
+	}
+	aad := keyEC.Canonical()
+	plainDataKey, err := p.Decrypt(ctx, obj.EncryptedDataKeyOf(), aad)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plainDataKey)
+	blob, err := p.Encrypt(ctx, targetKeyID, plainDataKey, aad)
+	if err != nil {
+		return nil, err
+	}
+	out := *obj
+	out.Version = EnvelopeVersion // 旧格式重新包装后以当前格式编码
+	out.KeyID = blob.KeyID
+	out.KeyVersionID = blob.KeyVersionID
+	out.DataKeyIV = blob.Iv
+	out.EncryptedDataKey = blob.CiphertextBlob
+	return &out, nil
+}
+
+// Stats 缓存统计
+func (m *CachingMaterials) Stats() CacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.Entries = m.lru.Len()
+	return stats
+}
+
+// Purge 清空缓存并清零所有明文密钥，例如主密钥轮转后
+func (m *CachingMaterials) Purge() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Purge()
+}
@@ -0,0 +1,182 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingProvider 统计对底层提供方的调用次数
+type countingProvider struct {
+	KeyProvider
+	generate, decrypt int
+}
+
+func (p *countingProvider) GenerateDataKey(ctx context.Context, keyID string, n int, aad []byte) (*DataKey, error) {
+	p.generate++
+	return p.KeyProvider.GenerateDataKey(ctx, keyID, n, aad)
+}
+
+func (p *countingProvider) Decrypt(ctx context.Context, blob *EncryptedBlob, aad []byte) ([]byte, error) {
+	p.decrypt++
+	return p.KeyProvider.Decrypt(ctx, blob, aad)
+}
+
+// TestCachingMaterialsLimits 在用量限制内复用数据密钥，超过任一限制后重新生成
+func TestCachingMaterialsLimits(t *testing.T) {
+	ctx := context.Background()
+	p := &countingProvider{KeyProvider: newTestKeyring(t)}
+	m, err := NewCachingMaterials(p, CachePolicy{MaxAge: time.Minute, MaxMessages: 3, MaxBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+	ec := EncryptionContext{"tenant": "t1"}
+
+	steps := []struct {
+		name     string
+		keyID    string
+		ec       EncryptionContext
+		size     int
+		advance  time.Duration
+		generate int // 执行后累计的 GenerateDataKey 次数
+	}{
+		{"首次生成", "orders", ec, 10, 0, 1},
+		{"复用", "orders", ec, 10, 0, 1},
+		{"第三条消息仍复用", "orders", ec, 10, 0, 1},
+		{"超过消息数", "orders", ec, 10, 0, 2},
+		{"超过字节数", "orders", ec, 95, 0, 3},
+		{"单条超过字节数不缓存", "orders", ec, 200, 0, 4},
+		{"上一条不影响缓存", "orders", ec, 1, 0, 4},
+		{"其他上下文", "orders", EncryptionContext{"tenant": "t2"}, 1, 0, 5},
+		{"其他主密钥", "users", ec, 1, 0, 6},
+		{"过期", "orders", ec, 1, time.Minute, 7},
+	}
+	for _, s := range steps {
+		now = now.Add(s.advance)
+		obj, err := m.EnvelopeEncrypt(ctx, s.keyID, make([]byte, s.size), s.ec)
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if p.generate != s.generate {
+			t.Errorf("%s: 期望累计生成 %d 次，得到 %d", s.name, s.generate, p.generate)
+		}
+		if _, err := m.EnvelopeDecrypt(ctx, obj, s.ec); err != nil {
+			t.Errorf("%s: 解密失败 %v", s.name, err)
+		}
+	}
+
+	stats := m.Stats()
+	if stats.Hits == 0 || stats.Misses == 0 || stats.Evictions == 0 {
+		t.Errorf("统计不正确: %+v", stats)
+	}
+}
+
+// TestCachingMaterialsDecrypt 解密缓存按上下文区分，命中时不调用 KMS
+func TestCachingMaterialsDecrypt(t *testing.T) {
+	ctx := context.Background()
+	p := &countingProvider{KeyProvider: newTestKeyring(t)}
+	m, err := NewCachingMaterials(p, CachePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := EncryptionContext{"id": "1"}
+	obj, err := EnvelopeEncrypt(ctx, p, "orders", []byte("data"), ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if plaintext, err := m.EnvelopeDecrypt(ctx, obj, ec); err != nil || string(plaintext) != "data" {
+			t.Fatalf("解密得到 %q %v", plaintext, err)
+		}
+	}
+	if p.decrypt != 1 {
+		t.Errorf("期望只调用一次 Decrypt，得到 %d", p.decrypt)
+	}
+	if _, err := m.EnvelopeDecrypt(ctx, obj, EncryptionContext{"id": "2"}); !errors.Is(err, ErrContextMismatch) {
+		t.Errorf("期望 ErrContextMismatch，得到 %v", err)
+	}
+	if stats := m.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("统计不正确: %+v", stats)
+	}
+}
+
+// TestEnvelopeShared 多条记录共用以 keyEC 生成的数据密钥，每条记录的密文仍绑定各自的 ec
+func TestEnvelopeShared(t *testing.T) {
+	ctx := context.Background()
+	p := &countingProvider{KeyProvider: newTestKeyring(t)}
+	m, err := NewCachingMaterials(p, CachePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyEC := EncryptionContext{"table": "users"}
+	var objs []*EnvelopeCipherObj
+	for _, id := range []string{"1", "2", "3"} {
+		obj, err := m.EnvelopeEncryptShared(ctx, "orders", []byte("pii-"+id), keyEC, EncryptionContext{"table": "users", "id": id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, obj)
+	}
+	for i, obj := range objs {
+		ec := EncryptionContext{"table": "users", "id": fmt.Sprint(i + 1)}
+		if plaintext, err := m.EnvelopeDecryptShared(ctx, obj, keyEC, ec); err != nil || string(plaintext) != fmt.Sprintf("pii-%d", i+1) {
+			t.Errorf("解密得到 %q %v", plaintext, err)
+		}
+	}
+	if p.generate != 1 || p.decrypt != 1 {
+		t.Errorf("期望共用一个数据密钥，GenerateDataKey %d 次，Decrypt %d 次", p.generate, p.decrypt)
+	}
+
+	cases := []struct {
+		name      string
+		keyEC, ec EncryptionContext
+	}{
+		{"挪到其他记录", keyEC, EncryptionContext{"table": "users", "id": "2"}},
+		{"数据密钥上下文不同", EncryptionContext{"table": "users", "id": "1"}, EncryptionContext{"table": "users", "id": "1"}},
+		{"ec 不包含 keyEC", keyEC, EncryptionContext{"id": "1"}},
+	}
+	for _, c := range cases {
+		if _, err := m.EnvelopeDecryptShared(ctx, objs[0], c.keyEC, c.ec); err == nil {
+			t.Errorf("%s: 应解密失败", c.name)
+		}
+	}
+	if _, err := m.EnvelopeEncryptShared(ctx, "orders", []byte("x"), keyEC, EncryptionContext{"table": "orders"}); !errors.Is(err, ErrContextMismatch) {
+		t.Errorf("期望 ErrContextMismatch，得到 %v", err)
+	}
+}
+
+// TestCachingMaterialsZeroize 淘汰时清零缓存中的明文密钥，返回给调用方的是副本
+func TestCachingMaterialsZeroize(t *testing.T) {
+	ctx := context.Background()
+	m, err := NewCachingMaterials(newTestKeyring(t), CachePolicy{Capacity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := m.EncryptionMaterials(ctx, "orders", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, _ := m.lru.GetOldest()
+	cached := value.(*cacheEntry).dataKey.Plaintext
+	clear(dk.Plaintext)
+	if bytes.Equal(cached, make([]byte, len(cached))) {
+		t.Fatal("调用方清零副本不应影响缓存")
+	}
+
+	// 容量为 1，缓存其他主密钥时淘汰 orders
+	if _, err := m.EncryptionMaterials(ctx, "users", nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, make([]byte, len(cached))) {
+		t.Error("淘汰后缓存中的明文密钥应清零")
+	}
+	m.Purge()
+	if stats := m.Stats(); stats.Entries != 0 || stats.Evictions != 2 {
+		t.Errorf("统计不正确: %+v", stats)
+	}
+}
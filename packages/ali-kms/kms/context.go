@@ -0,0 +1,67 @@
+package kms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// ErrContextMismatch 解密时的加密上下文与加密时不一致
+var ErrContextMismatch = errors.New("kms: encryption context mismatch")
+
+// EncryptionContext 加密上下文，例如 {"tenant": "t1", "table": "orders", "id": "42", "purpose": "pii"}
+//
+// 上下文不保存在密文中，只保存它的 SHA-256 摘要（AADDigest），解密时必须传入相同的上下文：
+// - 规范编码作为本地 AES-GCM 的附加认证数据（分段加密时通过头部中的摘要绑定）
+// - 规范编码作为 Aad 传给 KMS 生成/解密数据密钥
+// 因此密文被挪到其他记录或租户下时无法解密。nil 和空 map 等价，与没有上下文的旧密文兼容。
+type EncryptionContext map[string]string
+
+// Canonical 规范编码：按 key 排序，每个 key 和 value 前加 4 字节大端长度，空上下文返回 nil
+func (ec EncryptionContext) Canonical() []byte {
+	if len(ec) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(ec))
+	for k := range ec {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf []byte
+	for _, k := range keys {
+		for _, s := range []string{k, ec[k]} {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+			buf = append(buf, s...)
+		}
+	}
+	return buf
+}
+
+// Digest 规范编码的 SHA-256 摘要，空上下文返回 nil
+func (ec EncryptionContext) Digest() []byte {
+	if len(ec) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(ec.Canonical())
+	return sum[:]
+}
+
+// Contains ec 是否包含 sub 的全部字段且值相同，空的 sub 总是被包含
+func (ec EncryptionContext) Contains(sub EncryptionContext) bool {
+	for k, v := range sub {
+		if value, ok := ec[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// checkContext 在调用 KMS 之前比较摘要，尽早给出明确的错误
+func (eo *EnvelopeCipherObj) checkContext(ec EncryptionContext) error {
+	if !bytes.Equal(eo.AADDigest, ec.Digest()) {
+		return ErrContextMismatch
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestEncryptionContextCanonical 规范编码与 map 顺序无关，且不会因拼接产生歧义
+func TestEncryptionContextCanonical(t *testing.T) {
+	a := EncryptionContext{"tenant": "t1", "table": "orders", "id": "42"}
+	b := EncryptionContext{"id": "42", "table": "orders", "tenant": "t1"}
+	if !bytes.Equal(a.Canonical(), b.Canonical()) {
+		t.Error("相同的上下文应得到相同的编码")
+	}
+	if bytes.Equal(EncryptionContext{"ab": "c"}.Canonical(), EncryptionContext{"a": "bc"}.Canonical()) {
+		t.Error("不同的上下文不应得到相同的编码")
+	}
+	if EncryptionContext(nil).Digest() != nil || (EncryptionContext{}).Digest() != nil {
+		t.Error("空上下文的摘要应为 nil")
+	}
+}
+
+// TestEnvelopeContext 密文只能以加密时的上下文解密
+func TestEnvelopeContext(t *testing.T) {
+	ctx := context.Background()
+	static, err := NewStaticKeyProvider([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := EncryptionContext{"tenant": "t1", "table": "orders", "id": "42", "purpose": "pii"}
+	wrong := []struct {
+		name string
+		ec   EncryptionContext
+	}{
+		{"没有上下文", nil},
+		{"其他租户", EncryptionContext{"tenant": "t2", "table": "orders", "id": "42", "purpose": "pii"}},
+		{"其他记录", EncryptionContext{"tenant": "t1", "table": "orders", "id": "43", "purpose": "pii"}},
+		{"多出字段", EncryptionContext{"tenant": "t1", "table": "orders", "id": "42", "purpose": "pii", "x": ""}},
+	}
+
+	for name, p := range map[string]KeyProvider{"static": static, "keyring": newTestKeyring(t)} {
+		obj, err := EnvelopeEncrypt(ctx, p, "orders", []byte("secret"), ec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(obj.AADDigest) != AADDigestLength {
+			t.Fatalf("%s: 期望记录上下文摘要，得到 %x", name, obj.AADDigest)
+		}
+		text, err := obj.EncodeToString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded EnvelopeCipherObj
+		if err := decoded.Decode(text); err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, err := EnvelopeDecrypt(ctx, p, &decoded, ec); err != nil || string(plaintext) != "secret" {
+			t.Errorf("%s: 相同上下文应解密成功，得到 %q %v", name, plaintext, err)
+		}
+		for _, c := range wrong {
+			if _, err := EnvelopeDecrypt(ctx, p, &decoded, c.ec); !errors.Is(err, ErrContextMismatch) {
+				t.Errorf("%s/%s: 期望 ErrContextMismatch，得到 %v", name, c.name, err)
+			}
+		}
+
+		// 同时篡改摘要和上下文也无法通过 KMS 和 AES-GCM 的认证
+		forged := decoded
+		forged.AADDigest = wrong[1].ec.Digest()
+		if _, err := EnvelopeDecrypt(ctx, p, &forged, wrong[1].ec); err == nil {
+			t.Errorf("%s: 伪造摘要后不应解密成功", name)
+		}
+
+		var out bytes.Buffer
+		w, err := NewEncryptWriter(ctx, p, "orders", &out, ec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "stream secret")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := NewDecryptReader(ctx, p, bytes.NewReader(out.Bytes()), wrong[2].ec); !errors.Is(err, ErrContextMismatch) {
+			t.Errorf("%s: 流式解密期望 ErrContextMismatch，得到 %v", name, err)
+		}
+		r, _, err := NewDecryptReader(ctx, p, bytes.NewReader(out.Bytes()), ec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, err := io.ReadAll(r); err != nil || string(plaintext) != "stream secret" {
+			t.Errorf("%s: 流式解密得到 %q %v", name, plaintext, err)
+		}
+	}
+}
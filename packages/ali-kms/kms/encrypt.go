@@ -0,0 +1,99 @@
+package kms
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// DataKeyLength 信封加密使用的数据密钥长度（AES-256）
+const DataKeyLength = 32
+
+// newGCM 以数据密钥创建 AES-GCM
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EnvelopeEncrypt 信封加密：每次生成新的数据密钥，ec 为加密上下文，可以为 nil
+func EnvelopeEncrypt(ctx context.Context, p KeyProvider, keyID string, data []byte, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	dataKey, err := p.GenerateDataKey(ctx, keyID, DataKeyLength, ec.Canonical())
+	if err != nil {
+		return nil, err
+	}
+	return EnvelopeEncryptWithDataKey(dataKey, data, ec)
+}
+
+// EnvelopeEncryptWithDataKey 信封加密：使用已有的数据密钥，数据密钥必须是以相同的 ec 生成的
+func EnvelopeEncryptWithDataKey(dataKey *DataKey, data []byte, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	gcm, err := newGCM(dataKey.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, GcmIvLength) // 加密初始向量，解密时需要传入
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return &EnvelopeCipherObj{
+		Version:          EnvelopeVersion,
+		Algorithm:        AlgAESGCM,
+		KeyID:            dataKey.KeyID,
+		KeyVersionID:     dataKey.KeyVersionID,
+		DataKeyIV:        dataKey.Iv,
+		EncryptedDataKey: dataKey.CiphertextBlob,
+		Iv:               iv,
+		AADDigest:        ec.Digest(),
+		CipherText:       gcm.Seal(nil, iv, data, ec.Canonical()),
+	}, nil
+}
+
+// EncryptedDataKeyOf 密文中记录的数据密钥密文
+func (eo *EnvelopeCipherObj) EncryptedDataKeyOf() *EncryptedBlob {
+	return &EncryptedBlob{
+		KeyID:          eo.KeyID,
+		KeyVersionID:   eo.KeyVersionID,
+		CiphertextBlob: eo.EncryptedDataKey,
+		Iv:             eo.DataKeyIV,
+	}
+}
+
+// EnvelopeDecrypt 信封解密：先由提供方解密数据密钥，再在本地解密数据
+// ec 必须与加密时相同，否则返回 ErrContextMismatch
+func EnvelopeDecrypt(ctx context.Context, p KeyProvider, obj *EnvelopeCipherObj, ec EncryptionContext) ([]byte, error) {
+	if err := obj.checkContext(ec); err != nil {
+		return nil, err
+	}
+	plainDataKey, err := p.Decrypt(ctx, obj.EncryptedDataKeyOf(), ec.Canonical())
+	if err != nil {
+		return nil, err
+	}
+	return DecryptWithDataKey(plainDataKey, obj, ec)
+}
+
+// DecryptWithDataKey 使用已解密的数据密钥解密数据，分段密文在内存中整体解密
+func DecryptWithDataKey(plainDataKey []byte, obj *EnvelopeCipherObj, ec EncryptionContext) ([]byte, error) {
+	if err := obj.checkContext(ec); err != nil {
+		return nil, err
+	}
+	switch obj.Algorithm {
+	case AlgAESGCM:
+	case AlgAESGCMStream:
+		return openStream(plainDataKey, obj)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, obj.Algorithm)
+	}
+	gcm, err := newGCM(plainDataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, obj.Iv, obj.CipherText, ec.Canonical())
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
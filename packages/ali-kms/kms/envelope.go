@@ -0,0 +1,305 @@
+// Package kms 信封加密的密文格式、数据密钥的获取与缓存
+package kms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+信封密文格式
+
+二进制格式（version 1），整数均为大端序：
+
+	magic            4 字节 "AKEV"
+	version          1 字节，当前为 1
+	algorithm        1 字节，数据加密算法，见 Algorithm
+	flags            1 字节，保留，必须为 0
+	keyId            2 字节长度 + 内容，主密钥（CMK）ID 或别名
+	keyVersionId     2 字节长度 + 内容，主密钥版本 ID（AdvanceGenerateDataKey 返回），可以为空
+	dataKeyIv        2 字节长度 + 内容，KMS 加密数据密钥时使用的初始向量
+	encryptedDataKey 2 字节长度 + 内容，数据密钥密文
+	iv               2 字节长度 + 内容，本地加密数据的初始向量
+	aadDigest        2 字节长度 + 内容，加密上下文（EncryptionContext）规范编码的 SHA-256 摘要，没有上下文时长度为 0
+	cipherText       剩余全部字节
+
+cipherText 之前的部分称为头部，可以用 ReadHeader 从流中单独读取；流式加密（AlgAESGCMStream）先写头部，
+再逐段写入密文，见 stream.go。
+
+文本格式为 "ake:" + base64url(二进制格式)，不带填充。
+
+解码是严格的：magic、版本、算法、保留位、各字段长度不符合要求，或者 base64 不是规范编码时都返回错误，
+因此一个文本/二进制串只对应一个密文对象。
+
+兼容旧格式：4 段以 "." 连接的 base64（dataKeyIv.encryptedDataKey.iv.cipherText），解码后 Version 为 0，
+Algorithm 为 AlgAESGCM，没有 keyId；重新编码时输出新格式。
+*/
+
+const (
+	// EnvelopeVersion 当前的密文格式版本
+	EnvelopeVersion = 1
+	// envelopeMagic 二进制格式的开头
+	envelopeMagic = "AKEV"
+	// envelopeTextPrefix 文本格式的前缀，":" 不在 base64 字母表中，不会与旧格式混淆
+	envelopeTextPrefix = "ake:"
+
+	// GcmIvLength AES-GCM 初始向量长度
+	GcmIvLength = 12
+	// gcmTagLength AES-GCM 认证标签长度
+	gcmTagLength = 16
+	// AADDigestLength AAD 摘要长度（SHA-256）
+	AADDigestLength = 32
+
+	maxKeyIDLength        = 256
+	maxDataKeyIVLength    = 64
+	maxEncryptedKeyLength = 4096
+)
+
+// Algorithm 数据加密算法标识
+type Algorithm uint8
+
+const (
+	// AlgAESGCM AES-GCM，密钥长度由数据密钥决定（16/24/32 字节）
+	AlgAESGCM Algorithm = 1
+	// AlgAESGCMStream 分段 AES-GCM，每段明文 64 KiB，iv 为 7 字节的 nonce 前缀
+	AlgAESGCMStream Algorithm = 2
+)
+
+// String 算法名称
+func (a Algorithm) String() string {
+	switch a {
+	case AlgAESGCM:
+		return "AES_GCM"
+	case AlgAESGCMStream:
+		return "AES_GCM_STREAM_64K"
+	}
+	return fmt.Sprintf("Algorithm(%d)", uint8(a))
+}
+
+// Valid 是否为已知算法
+func (a Algorithm) Valid() bool {
+	return a == AlgAESGCM || a == AlgAESGCMStream
+}
+
+// ivLength 算法要求的 iv 长度
+func (a Algorithm) ivLength() int {
+	if a == AlgAESGCMStream {
+		return streamNoncePrefixLength
+	}
+	return GcmIvLength
+}
+
+var (
+	// ErrInvalidEnvelope 密文格式错误
+	ErrInvalidEnvelope = errors.New("kms: invalid envelope")
+	// ErrUnsupportedVersion 不支持的密文格式版本
+	ErrUnsupportedVersion = errors.New("kms: unsupported envelope version")
+	// ErrUnknownAlgorithm 未知的数据加密算法
+	ErrUnknownAlgorithm = errors.New("kms: unknown envelope algorithm")
+)
+
+// EnvelopeCipherObj 信封加密的密文对象，可以按二进制或文本格式持久化
+type EnvelopeCipherObj struct {
+	Version          uint8     // 解码旧格式时为 0，编码时总是输出 EnvelopeVersion
+	Algorithm        Algorithm // 数据加密算法
+	KeyID            string    // 主密钥 ID
+	KeyVersionID     string    // 主密钥版本 ID，可以为空
+	DataKeyIV        []byte    // KMS 加密数据密钥时使用的初始向量，解密数据密钥时需要传入
+	EncryptedDataKey []byte    // 数据密钥密文
+	Iv               []byte    // 本地加密数据的初始向量
+	AADDigest        []byte    // 加密上下文的 SHA-256 摘要，没有时为空，见 context.go
+	CipherText       []byte    // 数据密文（含认证标签）
+}
+
+// validateHeader 检查头部字段是否满足格式要求
+func (eo *EnvelopeCipherObj) validateHeader() error {
+	if !eo.Algorithm.Valid() {
+		return fmt.Errorf("%w: %d", ErrUnknownAlgorithm, uint8(eo.Algorithm))
+	}
+	switch {
+	case len(eo.KeyID) > maxKeyIDLength:
+		return fmt.Errorf("%w: key id too long", ErrInvalidEnvelope)
+	case len(eo.KeyVersionID) > maxKeyIDLength:
+		return fmt.Errorf("%w: key version id too long", ErrInvalidEnvelope)
+	case len(eo.DataKeyIV) > maxDataKeyIVLength:
+		return fmt.Errorf("%w: data key iv too long", ErrInvalidEnvelope)
+	case len(eo.EncryptedDataKey) == 0 || len(eo.EncryptedDataKey) > maxEncryptedKeyLength:
+		return fmt.Errorf("%w: encrypted data key length %d", ErrInvalidEnvelope, len(eo.EncryptedDataKey))
+	case len(eo.Iv) != eo.Algorithm.ivLength():
+		return fmt.Errorf("%w: iv length %d", ErrInvalidEnvelope, len(eo.Iv))
+	case len(eo.AADDigest) != 0 && len(eo.AADDigest) != AADDigestLength:
+		return fmt.Errorf("%w: aad digest length %d", ErrInvalidEnvelope, len(eo.AADDigest))
+	}
+	return nil
+}
+
+// validate 检查完整的密文对象，编码和解码共用
+// 两种算法的密文都至少包含一个认证标签（流式加密的最后一段可以没有明文）
+func (eo *EnvelopeCipherObj) validate() error {
+	if err := eo.validateHeader(); err != nil {
+		return err
+	}
+	if len(eo.CipherText) < gcmTagLength {
+		return fmt.Errorf("%w: ciphertext too short", ErrInvalidEnvelope)
+	}
+	return nil
+}
+
+// appendHeader 追加头部的二进制编码
+func (eo *EnvelopeCipherObj) appendHeader(buf []byte) []byte {
+	buf = append(buf, envelopeMagic...)
+	buf = append(buf, EnvelopeVersion, byte(eo.Algorithm), 0)
+	for _, field := range [][]byte{
+		[]byte(eo.KeyID), []byte(eo.KeyVersionID), eo.DataKeyIV, eo.EncryptedDataKey, eo.Iv, eo.AADDigest,
+	} {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// MarshalHeader 只编码头部（不含密文），流式加密时先写入头部
+func (eo *EnvelopeCipherObj) MarshalHeader() ([]byte, error) {
+	if err := eo.validateHeader(); err != nil {
+		return nil, err
+	}
+	return eo.appendHeader(nil), nil
+}
+
+// MarshalBinary 编码为二进制格式
+func (eo *EnvelopeCipherObj) MarshalBinary() ([]byte, error) {
+	if err := eo.validate(); err != nil {
+		return nil, err
+	}
+	size := len(envelopeMagic) + 3 + 6*2 + len(eo.KeyID) + len(eo.KeyVersionID) +
+		len(eo.DataKeyIV) + len(eo.EncryptedDataKey) + len(eo.Iv) + len(eo.AADDigest) + len(eo.CipherText)
+	buf := eo.appendHeader(make([]byte, 0, size))
+	return append(buf, eo.CipherText...), nil
+}
+
+// readHeader 从 r 中读取并校验头部，返回头部和它的原始字节
+func readHeader(r io.Reader) (*EnvelopeCipherObj, []byte, error) {
+	raw := make([]byte, len(envelopeMagic)+3, 128)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated header", ErrInvalidEnvelope)
+	}
+	if string(raw[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, nil, fmt.Errorf("%w: bad magic", ErrInvalidEnvelope)
+	}
+	fixed := raw[len(envelopeMagic):]
+	if fixed[0] != EnvelopeVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, fixed[0])
+	}
+	if fixed[2] != 0 {
+		return nil, nil, fmt.Errorf("%w: reserved flags %#x", ErrInvalidEnvelope, fixed[2])
+	}
+	obj := &EnvelopeCipherObj{Version: fixed[0], Algorithm: Algorithm(fixed[1])}
+	if !obj.Algorithm.Valid() {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnknownAlgorithm, fixed[1])
+	}
+
+	fields := make([][]byte, 6)
+	var length [2]byte
+	for i := range fields {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, nil, fmt.Errorf("%w: truncated header", ErrInvalidEnvelope)
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, nil, fmt.Errorf("%w: truncated header", ErrInvalidEnvelope)
+		}
+		raw = append(append(raw, length[:]...), field...)
+		if n > 0 {
+			fields[i] = field
+		}
+	}
+	obj.KeyID, obj.KeyVersionID = string(fields[0]), string(fields[1])
+	obj.DataKeyIV, obj.EncryptedDataKey, obj.Iv, obj.AADDigest = fields[2], fields[3], fields[4], fields[5]
+	if err := obj.validateHeader(); err != nil {
+		return nil, nil, err
+	}
+	return obj, raw, nil
+}
+
+// ReadHeader 从流中读取头部，不读取密文，可用于查看密文的元数据
+func ReadHeader(r io.Reader) (*EnvelopeCipherObj, error) {
+	obj, _, err := readHeader(r)
+	return obj, err
+}
+
+// UnmarshalBinary 严格解码二进制格式
+func (eo *EnvelopeCipherObj) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	obj, _, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	obj.CipherText = data[len(data)-r.Len():]
+	if len(obj.CipherText) == 0 {
+		obj.CipherText = nil
+	} else {
+		obj.CipherText = append([]byte(nil), obj.CipherText...)
+	}
+	if err := obj.validate(); err != nil {
+		return err
+	}
+	*eo = *obj
+	return nil
+}
+
+// EncodeToString 编码为文本格式
+func (eo *EnvelopeCipherObj) EncodeToString() (string, error) {
+	data, err := eo.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return envelopeTextPrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Decode 解码文本格式，兼容旧的 4 段格式
+func (eo *EnvelopeCipherObj) Decode(encodedStr string) error {
+	if rest, ok := strings.CutPrefix(encodedStr, envelopeTextPrefix); ok {
+		data, err := base64.RawURLEncoding.Strict().DecodeString(rest)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+		}
+		return eo.UnmarshalBinary(data)
+	}
+	return eo.decodeLegacy(encodedStr)
+}
+
+// decodeLegacy 解码旧格式 dataKeyIv.encryptedDataKey.iv.cipherText
+func (eo *EnvelopeCipherObj) decodeLegacy(encodedStr string) error {
+	arrs := strings.Split(encodedStr, ".")
+	if len(arrs) != 4 {
+		return fmt.Errorf("%w: unrecognized format", ErrInvalidEnvelope)
+	}
+	parts := make([][]byte, len(arrs))
+	for i, s := range arrs {
+		b, err := base64.RawStdEncoding.Strict().DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+		}
+		if len(b) > 0 {
+			parts[i] = b
+		}
+	}
+	obj := EnvelopeCipherObj{
+		Algorithm:        AlgAESGCM,
+		DataKeyIV:        parts[0],
+		EncryptedDataKey: parts[1],
+		Iv:               parts[2],
+		CipherText:       parts[3],
+	}
+	if err := obj.validate(); err != nil {
+		return err
+	}
+	*eo = obj
+	return nil
+}
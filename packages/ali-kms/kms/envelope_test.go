@@ -0,0 +1,171 @@
+package kms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func sampleEnvelope() *EnvelopeCipherObj {
+	return &EnvelopeCipherObj{
+		Version:          EnvelopeVersion,
+		Algorithm:        AlgAESGCM,
+		KeyID:            "key-6a1b2c",
+		KeyVersionID:     "ver-0001",
+		DataKeyIV:        bytes.Repeat([]byte{1}, GcmIvLength),
+		EncryptedDataKey: bytes.Repeat([]byte{2}, 48),
+		Iv:               bytes.Repeat([]byte{3}, GcmIvLength),
+		AADDigest:        bytes.Repeat([]byte{4}, AADDigestLength),
+		CipherText:       bytes.Repeat([]byte{5}, 40),
+	}
+}
+
+// encodeLegacy 按旧的 4 段格式编码
+func encodeLegacy(eo *EnvelopeCipherObj) string {
+	return strings.Join([]string{
+		base64.RawStdEncoding.EncodeToString(eo.DataKeyIV),
+		base64.RawStdEncoding.EncodeToString(eo.EncryptedDataKey),
+		base64.RawStdEncoding.EncodeToString(eo.Iv),
+		base64.RawStdEncoding.EncodeToString(eo.CipherText),
+	}, ".")
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	noOptional := sampleEnvelope()
+	noOptional.KeyVersionID, noOptional.DataKeyIV, noOptional.AADDigest = "", nil, nil
+
+	for name, obj := range map[string]*EnvelopeCipherObj{"完整字段": sampleEnvelope(), "可选字段为空": noOptional} {
+		text, err := obj.EncodeToString()
+		if err != nil {
+			t.Fatalf("%s: 编码失败 %v", name, err)
+		}
+		if !strings.HasPrefix(text, "ake:") {
+			t.Errorf("%s: 文本格式应以 ake: 开头，得到 %q", name, text)
+		}
+		var got EnvelopeCipherObj
+		if err := got.Decode(text); err != nil {
+			t.Fatalf("%s: 解码失败 %v", name, err)
+		}
+		if !reflect.DeepEqual(&got, obj) {
+			t.Errorf("%s: 往返结果不一致\n期望 %+v\n得到 %+v", name, obj, &got)
+		}
+	}
+}
+
+// TestEnvelopeLegacy 旧格式可以解码，重新编码后输出新格式
+func TestEnvelopeLegacy(t *testing.T) {
+	obj := sampleEnvelope()
+	var got EnvelopeCipherObj
+	if err := got.Decode(encodeLegacy(obj)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 0 || got.Algorithm != AlgAESGCM || got.KeyID != "" ||
+		!bytes.Equal(got.DataKeyIV, obj.DataKeyIV) || !bytes.Equal(got.EncryptedDataKey, obj.EncryptedDataKey) ||
+		!bytes.Equal(got.Iv, obj.Iv) || !bytes.Equal(got.CipherText, obj.CipherText) {
+		t.Errorf("旧格式解码结果不正确: %+v", got)
+	}
+
+	text, err := got.EncodeToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upgraded EnvelopeCipherObj
+	if err := upgraded.Decode(text); err != nil || upgraded.Version != EnvelopeVersion {
+		t.Errorf("旧格式重新编码后应为新格式，得到 %+v %v", upgraded, err)
+	}
+}
+
+// TestEnvelopeStrictDecode 格式不符合要求时返回对应的错误
+func TestEnvelopeStrictDecode(t *testing.T) {
+	valid, err := sampleEnvelope().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutate := func(f func(b []byte) []byte) string {
+		b := f(append([]byte(nil), valid...))
+		return "ake:" + base64.RawURLEncoding.EncodeToString(b)
+	}
+	legacy := encodeLegacy(sampleEnvelope())
+	// 长度除以 3 余 1 时最后一个字符只有 2 位有效，低 4 位必须为 0
+	short := valid[:len(valid)-(len(valid)+2)%3]
+	raw := base64.RawURLEncoding.EncodeToString(short)
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	nonCanonical := raw[:len(raw)-1] + string(alphabet[strings.IndexByte(alphabet, raw[len(raw)-1])|1])
+
+	cases := []struct {
+		name   string
+		input  string
+		expect error
+	}{
+		{"错误的 magic", mutate(func(b []byte) []byte { b[0] = 'X'; return b }), ErrInvalidEnvelope},
+		{"未知版本", mutate(func(b []byte) []byte { b[4] = 9; return b }), ErrUnsupportedVersion},
+		{"未知算法", mutate(func(b []byte) []byte { b[5] = 200; return b }), ErrUnknownAlgorithm},
+		{"保留位非 0", mutate(func(b []byte) []byte { b[6] = 1; return b }), ErrInvalidEnvelope},
+		{"头部被截断", mutate(func(b []byte) []byte { return b[:20] }), ErrInvalidEnvelope},
+		{"密文过短", mutate(func(b []byte) []byte { return b[:len(b)-30] }), ErrInvalidEnvelope},
+		{"带填充的 base64", "ake:" + base64.URLEncoding.EncodeToString(short), ErrInvalidEnvelope},
+		{"非规范 base64", "ake:" + nonCanonical, ErrInvalidEnvelope},
+		{"旧格式段数错误", legacy + ".AAAA", ErrInvalidEnvelope},
+		{"旧格式 iv 长度错误", "AQ.AQ.AQ." + strings.Split(legacy, ".")[3], ErrInvalidEnvelope},
+		{"空字符串", "", ErrInvalidEnvelope},
+	}
+	for _, c := range cases {
+		var obj EnvelopeCipherObj
+		if err := obj.Decode(c.input); !errors.Is(err, c.expect) {
+			t.Errorf("%s: 期望 %v，得到 %v", c.name, c.expect, err)
+		}
+	}
+}
+
+func FuzzEnvelopeDecode(f *testing.F) {
+	obj := sampleEnvelope()
+	text, _ := obj.EncodeToString()
+	f.Add(text)
+	f.Add(encodeLegacy(obj))
+	f.Add("ake:")
+	f.Add("a.b.c.d")
+	f.Fuzz(func(t *testing.T, input string) {
+		var decoded EnvelopeCipherObj
+		if err := decoded.Decode(input); err != nil {
+			return
+		}
+		// 能解码的输入重新编码后必须得到相同的对象
+		text, err := decoded.EncodeToString()
+		if err != nil {
+			t.Fatalf("解码成功的对象无法编码: %v", err)
+		}
+		var again EnvelopeCipherObj
+		if err := again.Decode(text); err != nil {
+			t.Fatalf("重新编码的结果无法解码: %v", err)
+		}
+		decoded.Version = EnvelopeVersion
+		if !reflect.DeepEqual(&again, &decoded) {
+			t.Fatalf("往返结果不一致\n%+v\n%+v", &decoded, &again)
+		}
+		if strings.HasPrefix(input, "ake:") && text != input {
+			t.Fatalf("同一个对象存在两种编码: %q %q", input, text)
+		}
+	})
+}
+
+func FuzzEnvelopeUnmarshalBinary(f *testing.F) {
+	valid, _ := sampleEnvelope().MarshalBinary()
+	f.Add(valid)
+	f.Add([]byte("AKEV\x01\x01\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var obj EnvelopeCipherObj
+		if err := obj.UnmarshalBinary(data); err != nil {
+			return
+		}
+		out, err := obj.MarshalBinary()
+		if err != nil {
+			t.Fatalf("解码成功的对象无法编码: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("编码不是唯一的: %x != %x", out, data)
+		}
+	})
+}
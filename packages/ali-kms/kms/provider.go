@@ -0,0 +1,66 @@
+package kms
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+密钥提供方
+
+信封加密只依赖 KeyProvider：由它生成数据密钥、加密和解密数据密钥，数据本身始终在本地用 AES-GCM 加密。
+- DKMSProvider      阿里云专属 KMS（dedicatedkmssdk.Client）
+- StaticKeyProvider 本地固定密钥，用于本地开发（原 KmsConfig.IsDev/DevCMK）
+- KeyringProvider   本地密钥环文件，支持多个命名密钥和多个版本，用于离线测试
+RetryingProvider 可以包装任意提供方，增加重试和熔断（见 retry.go）。
+签名是可选能力，实现了 Signer 的提供方才支持 Sign/Verify。
+*/
+
+var (
+	// ErrKeyNotFound 主密钥或密钥版本不存在
+	ErrKeyNotFound = errors.New("kms: key not found")
+	// ErrSignNotSupported 提供方或密钥不支持签名
+	ErrSignNotSupported = errors.New("kms: sign not supported")
+	// ErrInvalidSignature 签名校验失败
+	ErrInvalidSignature = errors.New("kms: invalid signature")
+	// ErrInvalidCiphertext 密文、Iv 或 aad 不匹配，无法解密
+	ErrInvalidCiphertext = errors.New("kms: invalid ciphertext")
+	// ErrThrottled KMS 限流，重试次数用完后仍被限流时返回
+	ErrThrottled = errors.New("kms: throttled")
+	// ErrAccessDenied ClientKey 无效、请求签名错误或没有权限
+	ErrAccessDenied = errors.New("kms: access denied")
+	// ErrUnavailable KMS 暂时不可用（网络错误、服务端内部错误），可以重试
+	ErrUnavailable = errors.New("kms: service unavailable")
+)
+
+// EncryptedBlob KMS 加密的结果，解密时原样传回
+type EncryptedBlob struct {
+	KeyID          string // 主密钥 ID
+	KeyVersionID   string // 主密钥版本 ID，提供方不区分版本时为空
+	CiphertextBlob []byte
+	Iv             []byte // KMS 加密时使用的初始向量
+}
+
+// DataKey 数据密钥的明文和密文
+type DataKey struct {
+	EncryptedBlob
+	Plaintext []byte
+}
+
+// KeyProvider 主密钥的持有方
+// aad 为附加认证数据（通常是 EncryptionContext 的规范编码），没有时为 nil，解密时必须传入加密时的值
+type KeyProvider interface {
+	// GenerateDataKey 生成长度为 numberOfBytes 的数据密钥，同时返回它在 keyID 下的密文
+	GenerateDataKey(ctx context.Context, keyID string, numberOfBytes int, aad []byte) (*DataKey, error)
+	// Encrypt 用主密钥加密（通常是数据密钥）
+	Encrypt(ctx context.Context, keyID string, plaintext, aad []byte) (*EncryptedBlob, error)
+	// Decrypt 解密 Encrypt/GenerateDataKey 的结果
+	Decrypt(ctx context.Context, blob *EncryptedBlob, aad []byte) ([]byte, error)
+}
+
+// Signer 可选的签名能力，digest 为 SHA-256 摘要
+type Signer interface {
+	Sign(ctx context.Context, keyID string, digest []byte) ([]byte, error)
+	// Verify 签名不匹配时返回 ErrInvalidSignature
+	Verify(ctx context.Context, keyID string, digest, signature []byte) error
+}
@@ -0,0 +1,240 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	dedicatedkmsopenapiutil "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi-util"
+	dedicatedkmssdk "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/sdk"
+)
+
+// DKMSProvider 阿里云专属 KMS
+// 新数据使用 Advance 系列接口，返回的密文中带有密钥版本；KeyVersionID 为空的旧密文使用普通 Decrypt 解密
+type DKMSProvider struct {
+	client  *dedicatedkmssdk.Client
+	runtime *dedicatedkmsopenapiutil.RuntimeOptions
+}
+
+// NewDKMSProvider runtime 可以为 nil，用于设置服务端证书校验（Verify）或超时
+// SDK 默认会自行重试（不感知 ctx），使用 RetryingProvider 时应设置 Autoretry 为 false
+func NewDKMSProvider(client *dedicatedkmssdk.Client, runtime *dedicatedkmsopenapiutil.RuntimeOptions) *DKMSProvider {
+	if runtime == nil {
+		runtime = &dedicatedkmsopenapiutil.RuntimeOptions{}
+	}
+	return &DKMSProvider{client: client, runtime: runtime}
+}
+
+// GenerateDataKey 调用 AdvanceGenerateDataKey
+func (p *DKMSProvider) GenerateDataKey(ctx context.Context, keyID string, numberOfBytes int, aad []byte) (*DataKey, error) {
+	if err := checkDataKeyLength(numberOfBytes); err != nil {
+		return nil, err
+	}
+	runtime, err := p.runtimeFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.AdvanceGenerateDataKeyWithOptions(&dedicatedkmssdk.AdvanceGenerateDataKeyRequest{
+		KeyId:         tea.String(keyID),
+		NumberOfBytes: tea.Int32(int32(numberOfBytes)),
+		Aad:           aad,
+	}, runtime)
+	if err != nil {
+		return nil, dkmsError(ctx, err)
+	}
+	return &DataKey{
+		EncryptedBlob: EncryptedBlob{
+			KeyID:          keyIDOr(resp.KeyId, keyID),
+			KeyVersionID:   tea.StringValue(resp.KeyVersionId),
+			CiphertextBlob: resp.CiphertextBlob,
+			Iv:             resp.Iv,
+		},
+		Plaintext: resp.Plaintext,
+	}, nil
+}
+
+// Encrypt 调用 AdvanceEncrypt
+func (p *DKMSProvider) Encrypt(ctx context.Context, keyID string, plaintext, aad []byte) (*EncryptedBlob, error) {
+	runtime, err := p.runtimeFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.AdvanceEncryptWithOptions(&dedicatedkmssdk.AdvanceEncryptRequest{
+		KeyId:     tea.String(keyID),
+		Plaintext: plaintext,
+		Aad:       aad,
+	}, runtime)
+	if err != nil {
+		return nil, dkmsError(ctx, err)
+	}
+	return &EncryptedBlob{
+		KeyID:          keyIDOr(resp.KeyId, keyID),
+		KeyVersionID:   tea.StringValue(resp.KeyVersionId),
+		CiphertextBlob: resp.CiphertextBlob,
+		Iv:             resp.Iv,
+	}, nil
+}
+
+// Decrypt 有密钥版本时调用 AdvanceDecrypt，否则调用 Decrypt
+func (p *DKMSProvider) Decrypt(ctx context.Context, blob *EncryptedBlob, aad []byte) ([]byte, error) {
+	runtime, err := p.runtimeFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if blob.KeyVersionID != "" {
+		resp, err := p.client.AdvanceDecryptWithOptions(&dedicatedkmssdk.AdvanceDecryptRequest{
+			KeyId:          tea.String(blob.KeyID),
+			CiphertextBlob: blob.CiphertextBlob,
+			Iv:             blob.Iv,
+			Aad:            aad,
+		}, runtime)
+		if err != nil {
+			return nil, dkmsError(ctx, err)
+		}
+		return resp.Plaintext, nil
+	}
+	resp, err := p.client.DecryptWithOptions(&dedicatedkmssdk.DecryptRequest{
+		KeyId:          tea.String(blob.KeyID),
+		CiphertextBlob: blob.CiphertextBlob,
+		Iv:             blob.Iv,
+		Aad:            aad,
+	}, runtime)
+	if err != nil {
+		return nil, dkmsError(ctx, err)
+	}
+	return resp.Plaintext, nil
+}
+
+// Sign 对摘要签名（MessageType 为 DIGEST，算法由密钥决定）
+func (p *DKMSProvider) Sign(ctx context.Context, keyID string, digest []byte) ([]byte, error) {
+	runtime, err := p.runtimeFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.SignWithOptions(&dedicatedkmssdk.SignRequest{
+		KeyId:       tea.String(keyID),
+		Message:     digest,
+		MessageType: tea.String("DIGEST"),
+	}, runtime)
+	if err != nil {
+		return nil, dkmsError(ctx, err)
+	}
+	return resp.Signature, nil
+}
+
+// Verify 校验摘要签名
+func (p *DKMSProvider) Verify(ctx context.Context, keyID string, digest, signature []byte) error {
+	runtime, err := p.runtimeFor(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.VerifyWithOptions(&dedicatedkmssdk.VerifyRequest{
+		KeyId:       tea.String(keyID),
+		Message:     digest,
+		MessageType: tea.String("DIGEST"),
+		Signature:   signature,
+	}, runtime)
+	if err != nil {
+		return dkmsError(ctx, err)
+	}
+	if !tea.BoolValue(resp.Value) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// keyIDOr 响应中的 KeyId 为空时（例如使用别名调用）沿用请求中的 keyID
+func keyIDOr(resp *string, keyID string) string {
+	if id := tea.StringValue(resp); id != "" {
+		return id
+	}
+	return keyID
+}
+
+// runtimeFor 按 ctx 的截止时间收紧本次请求的超时；SDK 的请求不能中途取消，只能依靠超时结束
+func (p *DKMSProvider) runtimeFor(ctx context.Context) (*dedicatedkmsopenapiutil.RuntimeOptions, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return p.runtime, nil
+	}
+	ms := int(time.Until(deadline) / time.Millisecond)
+	if ms <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	runtime := *p.runtime
+	if runtime.ReadTimeout == nil || *runtime.ReadTimeout > ms {
+		runtime.ReadTimeout = tea.Int(ms)
+	}
+	if runtime.ConnectTimeout == nil || *runtime.ConnectTimeout > ms {
+		runtime.ConnectTimeout = tea.Int(ms)
+	}
+	return &runtime, nil
+}
+
+// DKMSError 专属 KMS 调用失败，errors.Is 可以匹配 ErrKeyNotFound、ErrThrottled 等类型错误，
+// errors.As 可以取到 SDK 原始的 *tea.SDKError
+type DKMSError struct {
+	Code    string // 服务端错误码，网络错误时为空
+	Message string
+
+	kind error
+	err  error
+}
+
+func (e *DKMSError) Error() string {
+	prefix := "kms: dkms"
+	if e.kind != nil {
+		prefix = e.kind.Error()
+	}
+	if e.Code == "" {
+		return prefix + ": " + e.Message
+	}
+	return prefix + ": " + e.Code + ": " + e.Message
+}
+
+func (e *DKMSError) Unwrap() []error {
+	if e.kind == nil {
+		return []error{e.err}
+	}
+	return []error{e.kind, e.err}
+}
+
+// dkmsError 将 SDK 错误转换为 *DKMSError；ctx 已取消或超时时返回 ctx 的错误
+func dkmsError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	var sdkErr *tea.SDKError
+	if !errors.As(err, &sdkErr) {
+		// 没有错误码：网络错误或服务端返回了无法解析的响应
+		return &DKMSError{Message: err.Error(), kind: ErrUnavailable, err: err}
+	}
+	code := tea.StringValue(sdkErr.Code)
+	return &DKMSError{Code: code, Message: tea.StringValue(sdkErr.Message), kind: dkmsErrorKind(code), err: err}
+}
+
+// dkmsErrorKind 错误码对应的类型错误，未知错误码（如 InvalidParameter）返回 nil
+func dkmsErrorKind(code string) error {
+	switch code {
+	case "Rejected.Throttling":
+		return ErrThrottled
+	case "ServiceUnavailableTemporary", "InternalFailure":
+		return ErrUnavailable
+	case "Forbidden.KeyNotFound", "Forbidden.ResourceNotFound":
+		return ErrKeyNotFound
+	case "InvalidCiphertext":
+		return ErrInvalidCiphertext
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch":
+		return ErrAccessDenied
+	}
+	if strings.HasPrefix(code, "Forbidden.") {
+		return ErrAccessDenied
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package kms
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// MaxDataKeyBytes 数据密钥的最大长度，与阿里云 KMS GenerateDataKey 的 NumberOfBytes 上限一致
+const MaxDataKeyBytes = 1024
+
+// checkDataKeyLength 数据密钥长度需在 [1, MaxDataKeyBytes] 之间
+func checkDataKeyLength(numberOfBytes int) error {
+	if numberOfBytes <= 0 || numberOfBytes > MaxDataKeyBytes {
+		return fmt.Errorf("kms: numberOfBytes must be in [1, %d], got %d", MaxDataKeyBytes, numberOfBytes)
+	}
+	return nil
+}
+
+// newDataKeyPlaintext 生成数据密钥明文
+func newDataKeyPlaintext(numberOfBytes int) ([]byte, error) {
+	if err := checkDataKeyLength(numberOfBytes); err != nil {
+		return nil, err
+	}
+	return randomBytes(numberOfBytes)
+}
+
+// randomBytes 生成 n 字节随机数
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// sealLocal 本地主密钥加密，aad 用于绑定密钥 ID 和版本
+func sealLocal(key, plaintext, aad []byte) (ciphertext, iv []byte, err error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if iv, err = randomBytes(GcmIvLength); err != nil {
+		return nil, nil, err
+	}
+	return gcm.Seal(nil, iv, plaintext, aad), iv, nil
+}
+
+// openLocal 本地主密钥解密
+func openLocal(key, ciphertext, iv, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, fmt.Errorf("kms: invalid iv length %d", len(iv))
+	}
+	plaintext, err := gcm.Open(nil, iv, ciphertext, aad)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+// StaticKeyProvider 本地固定主密钥（本地&dev无法访问kms时使用），不区分 keyID
+type StaticKeyProvider struct {
+	key []byte
+}
+
+// NewStaticKeyProvider key 长度必须为 16/24/32
+func NewStaticKeyProvider(key []byte) (*StaticKeyProvider, error) {
+	if !(len(key) == 16 || len(key) == 24 || len(key) == 32) {
+		return nil, errors.New("key length must be 16/24/32")
+	}
+	return &StaticKeyProvider{key: append([]byte(nil), key...)}, nil
+}
+
+// GenerateDataKey 生成随机数据密钥并用固定主密钥加密
+func (p *StaticKeyProvider) GenerateDataKey(ctx context.Context, keyID string, numberOfBytes int, aad []byte) (*DataKey, error) {
+	plaintext, err := newDataKeyPlaintext(numberOfBytes)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := p.Encrypt(ctx, keyID, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{EncryptedBlob: *blob, Plaintext: plaintext}, nil
+}
+
+// Encrypt 用固定主密钥加密
+func (p *StaticKeyProvider) Encrypt(ctx context.Context, keyID string, plaintext, aad []byte) (*EncryptedBlob, error) {
+	ciphertext, iv, err := sealLocal(p.key, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedBlob{KeyID: keyID, CiphertextBlob: ciphertext, Iv: iv}, nil
+}
+
+// Decrypt 用固定主密钥解密
+func (p *StaticKeyProvider) Decrypt(ctx context.Context, blob *EncryptedBlob, aad []byte) ([]byte, error) {
+	return openLocal(p.key, blob.CiphertextBlob, blob.Iv, aad)
+}
+
+// 密钥环中的密钥类型
+const (
+	KeySpecAES256 = "AES_256" // 对称加密
+	KeySpecECP256 = "EC_P256" // 签名（ECDSA P-256）
+)
+
+// KeyVersion 密钥的一个版本，Material 为 AES 密钥或 PKCS#8 DER 编码的私钥
+type KeyVersion struct {
+	ID       string `json:"id"`
+	Material []byte `json:"material"`
+}
+
+// KeyringKey 密钥环中的一个命名密钥
+type KeyringKey struct {
+	ID       string       `json:"id"`
+	Spec     string       `json:"spec,omitempty"` // 为空时为 AES_256
+	Primary  string       `json:"primary"`        // 加密/签名使用的版本
+	Versions []KeyVersion `json:"versions"`
+}
+
+func (k *KeyringKey) spec() string {
+	if k.Spec == "" {
+		return KeySpecAES256
+	}
+	return k.Spec
+}
+
+func (k *KeyringKey) version(id string) (*KeyVersion, error) {
+	if id == "" {
+		id = k.Primary
+	}
+	for i := range k.Versions {
+		if k.Versions[i].ID == id {
+			return &k.Versions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s version %s", ErrKeyNotFound, k.ID, id)
+}
+
+// validate 检查密钥 ID、版本 ID 不为空且不重复，主版本存在，密钥材料与类型匹配
+func (k *KeyringKey) validate() error {
+	if k.ID == "" {
+		return errors.New("key without id")
+	}
+	if k.spec() != KeySpecAES256 && k.spec() != KeySpecECP256 {
+		return fmt.Errorf("key %s: unknown spec %q", k.ID, k.Spec)
+	}
+	seen := map[string]bool{}
+	for _, v := range k.Versions {
+		if v.ID == "" || seen[v.ID] {
+			return fmt.Errorf("key %s: empty or duplicate version id %q", k.ID, v.ID)
+		}
+		seen[v.ID] = true
+		switch k.spec() {
+		case KeySpecAES256:
+			if len(v.Material) != 32 {
+				return fmt.Errorf("key %s version %s: AES_256 material must be 32 bytes, got %d", k.ID, v.ID, len(v.Material))
+			}
+		case KeySpecECP256:
+			if _, err := parseSigningKey(k.ID, v.Material); err != nil {
+				return fmt.Errorf("key %s version %s: %w", k.ID, v.ID, err)
+			}
+		}
+	}
+	_, err := k.version(k.Primary)
+	return err
+}
+
+// KeyringProvider 本地密钥环文件，每个密钥可以有多个版本，加密使用主版本，解密按密文中的版本查找
+//
+// 文件格式（material 为 base64）：
+//
+//	{"keys": [{"id": "orders", "primary": "v2", "versions": [{"id": "v1", "material": "..."}, {"id": "v2", "material": "..."}]}]}
+type KeyringProvider struct {
+	mu   sync.RWMutex
+	keys map[string]*KeyringKey
+}
+
+// NewKeyringProvider 创建空的密钥环
+func NewKeyringProvider() *KeyringProvider {
+	return &KeyringProvider{keys: map[string]*KeyringKey{}}
+}
+
+// LoadKeyring 读取密钥环文件，密钥或版本 ID 重复、主版本不存在、密钥材料长度不对时返回错误
+func LoadKeyring(path string) (*KeyringProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []*KeyringKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p := NewKeyringProvider()
+	for _, k := range file.Keys {
+		if err := k.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if _, ok := p.keys[k.ID]; ok {
+			return nil, fmt.Errorf("%s: duplicate key id %s", path, k.ID)
+		}
+		p.keys[k.ID] = k
+	}
+	return p, nil
+}
+
+// Save 写入密钥环文件（权限 0600）
+func (p *KeyringProvider) Save(path string) error {
+	p.mu.RLock()
+	file := struct {
+		Keys []*KeyringKey `json:"keys"`
+	}{}
+	for _, k := range p.keys {
+		file.Keys = append(file.Keys, k)
+	}
+	sort.Slice(file.Keys, func(i, j int) bool { return file.Keys[i].ID < file.Keys[j].ID })
+	data, err := json.MarshalIndent(file, "", "  ")
+	p.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// newKeyMaterial 按类型生成密钥材料
+func newKeyMaterial(spec string) ([]byte, error) {
+	switch spec {
+	case KeySpecAES256:
+		return randomBytes(32)
+	case KeySpecECP256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(priv)
+	}
+	return nil, fmt.Errorf("kms: unknown key spec %q", spec)
+}
+
+// CreateKey 新建密钥，初始版本为 v1
+func (p *KeyringProvider) CreateKey(id, spec string) error {
+	if spec == "" {
+		spec = KeySpecAES256
+	}
+	material, err := newKeyMaterial(spec)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.keys[id]; ok {
+		return fmt.Errorf("kms: key %s already exists", id)
+	}
+	p.keys[id] = &KeyringKey{ID: id, Spec: spec, Primary: "v1", Versions: []KeyVersion{{ID: "v1", Material: material}}}
+	return nil
+}
+
+// Rotate 为密钥生成新版本并设为主版本，旧版本保留用于解密，返回新版本 ID
+func (p *KeyringProvider) Rotate(id string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k, ok := p.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	material, err := newKeyMaterial(k.spec())
+	if err != nil {
+		return "", err
+	}
+	version := fmt.Sprintf("v%d", len(k.Versions)+1)
+	k.Versions = append(k.Versions, KeyVersion{ID: version, Material: material})
+	k.Primary = version
+	return version, nil
+}
+
+// HasKey 密钥是否存在（不区分类型）
+func (p *KeyringProvider) HasKey(id string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.keys[id]
+	return ok
+}
+
+// lookup 查找密钥版本，versionID 为空时返回主版本
+func (p *KeyringProvider) lookup(keyID, versionID, spec string) (*KeyVersion, string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	k, ok := p.keys[keyID]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrKeyNotFound, keyID)
+	}
+	if k.spec() != spec {
+		if spec == KeySpecECP256 {
+			return nil, "", fmt.Errorf("%w: key %s is %s", ErrSignNotSupported, keyID, k.spec())
+		}
+		return nil, "", fmt.Errorf("kms: key %s is %s, not %s", keyID, k.spec(), spec)
+	}
+	v, err := k.version(versionID)
+	if err != nil {
+		return nil, "", err
+	}
+	return v, v.ID, nil
+}
+
+// keyringAAD 密文与密钥 ID、版本以及调用方的 aad 绑定，不能挪到其他密钥下解密
+func keyringAAD(keyID, versionID string, aad []byte) []byte {
+	buf := []byte(keyID + "\x00" + versionID)
+	if len(aad) > 0 {
+		buf = append(append(buf, 0), aad...)
+	}
+	return buf
+}
+
+// GenerateDataKey 生成随机数据密钥并用主版本加密
+func (p *KeyringProvider) GenerateDataKey(ctx context.Context, keyID string, numberOfBytes int, aad []byte) (*DataKey, error) {
+	plaintext, err := newDataKeyPlaintext(numberOfBytes)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := p.Encrypt(ctx, keyID, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{EncryptedBlob: *blob, Plaintext: plaintext}, nil
+}
+
+// Encrypt 用主版本加密
+func (p *KeyringProvider) Encrypt(ctx context.Context, keyID string, plaintext, aad []byte) (*EncryptedBlob, error) {
+	v, versionID, err := p.lookup(keyID, "", KeySpecAES256)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, iv, err := sealLocal(v.Material, plaintext, keyringAAD(keyID, versionID, aad))
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedBlob{KeyID: keyID, KeyVersionID: versionID, CiphertextBlob: ciphertext, Iv: iv}, nil
+}
+
+// Decrypt 按密文中的版本解密；版本为空时（如旧格式信封）从新到旧依次尝试每个版本，
+// 而不是只用主版本，否则轮转后旧密文会报出难以理解的认证失败
+func (p *KeyringProvider) Decrypt(ctx context.Context, blob *EncryptedBlob, aad []byte) ([]byte, error) {
+	if blob.KeyVersionID != "" {
+		v, versionID, err := p.lookup(blob.KeyID, blob.KeyVersionID, KeySpecAES256)
+		if err != nil {
+			return nil, err
+		}
+		return openLocal(v.Material, blob.CiphertextBlob, blob.Iv, keyringAAD(blob.KeyID, versionID, aad))
+	}
+	if _, _, err := p.lookup(blob.KeyID, "", KeySpecAES256); err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	versions := p.keys[blob.KeyID].Versions
+	p.mu.RUnlock()
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if plaintext, err := openLocal(v.Material, blob.CiphertextBlob, blob.Iv, keyringAAD(blob.KeyID, v.ID, aad)); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, ErrInvalidCiphertext
+}
+
+// parseSigningKey 解析 PKCS#8 编码的 ECDSA 私钥
+func parseSigningKey(keyID string, material []byte) (*ecdsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(material)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: key %s is not ecdsa", ErrSignNotSupported, keyID)
+	}
+	return priv, nil
+}
+
+// Sign 用主版本对摘要签名（ASN.1 DER 编码）
+func (p *KeyringProvider) Sign(ctx context.Context, keyID string, digest []byte) ([]byte, error) {
+	v, _, err := p.lookup(keyID, "", KeySpecECP256)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parseSigningKey(keyID, v.Material)
+	if err != nil {
+		return nil, err
+	}
+	return ecdsa.SignASN1(rand.Reader, priv, digest)
+}
+
+// Verify 校验签名，轮转前旧版本签发的签名仍然有效
+func (p *KeyringProvider) Verify(ctx context.Context, keyID string, digest, signature []byte) error {
+	if _, _, err := p.lookup(keyID, "", KeySpecECP256); err != nil {
+		return err
+	}
+	p.mu.RLock()
+	versions := p.keys[keyID].Versions
+	p.mu.RUnlock()
+	for _, v := range versions {
+		priv, err := parseSigningKey(keyID, v.Material)
+		if err != nil {
+			return err
+		}
+		if ecdsa.VerifyASN1(&priv.PublicKey, digest, signature) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
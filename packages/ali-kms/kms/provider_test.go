@@ -0,0 +1,186 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T) *KeyringProvider {
+	t.Helper()
+	p := NewKeyringProvider()
+	for id, spec := range map[string]string{"orders": KeySpecAES256, "users": KeySpecAES256, "signing": KeySpecECP256} {
+		if err := p.CreateKey(id, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// TestEnvelopeWithProviders 各个本地提供方的信封加密往返
+func TestEnvelopeWithProviders(t *testing.T) {
+	ctx := context.Background()
+	static, err := NewStaticKeyProvider([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]KeyProvider{"static": static, "keyring": newTestKeyring(t)}
+	for name, p := range providers {
+		obj, err := EnvelopeEncrypt(ctx, p, "orders", []byte("hello kms"), nil)
+		if err != nil {
+			t.Fatalf("%s: 加密失败 %v", name, err)
+		}
+		text, err := obj.EncodeToString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded EnvelopeCipherObj
+		if err := decoded.Decode(text); err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := EnvelopeDecrypt(ctx, p, &decoded, nil)
+		if err != nil || string(plaintext) != "hello kms" {
+			t.Errorf("%s: 期望解密得到原文，得到 %q %v", name, plaintext, err)
+		}
+	}
+}
+
+// TestKeyringRotation 轮转后新数据使用新版本，旧版本的密文仍可解密，密文不能挪到其他密钥下
+func TestKeyringRotation(t *testing.T) {
+	ctx := context.Background()
+	p := newTestKeyring(t)
+	before, err := EnvelopeEncrypt(ctx, p, "orders", []byte("v1 data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := p.Rotate("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := EnvelopeEncrypt(ctx, p, "orders", []byte("v2 data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.KeyVersionID != "v1" || after.KeyVersionID != version || version != "v2" {
+		t.Errorf("期望版本 v1 -> v2，得到 %q -> %q", before.KeyVersionID, after.KeyVersionID)
+	}
+
+	// 保存后重新加载，两个版本的密文都能解密
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	if err := p.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range []*EnvelopeCipherObj{before, after} {
+		if _, err := EnvelopeDecrypt(ctx, loaded, obj, nil); err != nil {
+			t.Errorf("版本 %s 的密文解密失败: %v", obj.KeyVersionID, err)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		mutate func(o *EnvelopeCipherObj)
+		expect error
+	}{
+		{"挪到其他密钥", func(o *EnvelopeCipherObj) { o.KeyID = "users" }, nil},
+		{"不存在的密钥", func(o *EnvelopeCipherObj) { o.KeyID = "missing" }, ErrKeyNotFound},
+		{"不存在的版本", func(o *EnvelopeCipherObj) { o.KeyVersionID = "v9" }, ErrKeyNotFound},
+		{"签名密钥不能解密", func(o *EnvelopeCipherObj) { o.KeyID = "signing" }, nil},
+	}
+	for _, c := range cases {
+		obj := *before
+		c.mutate(&obj)
+		_, err := EnvelopeDecrypt(ctx, loaded, &obj, nil)
+		if err == nil || (c.expect != nil && !errors.Is(err, c.expect)) {
+			t.Errorf("%s: 期望解密失败（%v），得到 %v", c.name, c.expect, err)
+		}
+	}
+}
+
+// TestKeyringSign 签名密钥轮转后旧签名仍然有效，对称密钥不支持签名
+func TestKeyringSign(t *testing.T) {
+	ctx := context.Background()
+	p := newTestKeyring(t)
+	var signer Signer = p
+	digest := sha256.Sum256([]byte("message"))
+
+	sig, err := signer.Sign(ctx, "signing", digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Rotate("signing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Verify(ctx, "signing", digest[:], sig); err != nil {
+		t.Errorf("轮转前的签名应校验通过，得到 %v", err)
+	}
+	other := sha256.Sum256([]byte("other"))
+	if err := signer.Verify(ctx, "signing", other[:], sig); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("摘要不匹配期望 ErrInvalidSignature，得到 %v", err)
+	}
+	if _, err := signer.Sign(ctx, "orders", digest[:]); !errors.Is(err, ErrSignNotSupported) {
+		t.Errorf("对称密钥签名期望 ErrSignNotSupported，得到 %v", err)
+	}
+
+	// 静态密钥提供方没有签名能力
+	static, _ := NewStaticKeyProvider(bytes.Repeat([]byte{1}, 32))
+	if _, ok := interface{}(static).(Signer); ok {
+		t.Error("StaticKeyProvider 不应实现 Signer")
+	}
+}
+
+// TestKeyringValidation 数据密钥长度、没有版本的密文以及密钥环文件的校验
+func TestKeyringValidation(t *testing.T) {
+	ctx := context.Background()
+	p := newTestKeyring(t)
+	for _, n := range []int{-1, 0, MaxDataKeyBytes + 1} {
+		if _, err := p.GenerateDataKey(ctx, "orders", n, nil); err == nil {
+			t.Errorf("numberOfBytes=%d 期望返回错误", n)
+		}
+	}
+
+	// 没有版本的密文（旧格式信封）轮转后仍能解密
+	blob, err := p.Encrypt(ctx, "orders", []byte("legacy"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Rotate("orders"); err != nil {
+		t.Fatal(err)
+	}
+	blob.KeyVersionID = ""
+	if plaintext, err := p.Decrypt(ctx, blob, nil); err != nil || string(plaintext) != "legacy" {
+		t.Errorf("没有版本的密文期望逐个版本尝试解密，得到 %q %v", plaintext, err)
+	}
+	blob.CiphertextBlob[0] ^= 1
+	if _, err := p.Decrypt(ctx, blob, nil); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Errorf("篡改的密文期望 ErrInvalidCiphertext，得到 %v", err)
+	}
+
+	material := `"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="` // 32 字节
+	cases := []struct {
+		name string
+		keys string
+	}{
+		{"密钥长度错误", `{"id": "a", "primary": "v1", "versions": [{"id": "v1", "material": "MDEyMzQ1Njc4OWFiY2RlZg=="}]}`},
+		{"重复的版本", `{"id": "a", "primary": "v1", "versions": [{"id": "v1", "material": ` + material + `}, {"id": "v1", "material": ` + material + `}]}`},
+		{"重复的密钥", `{"id": "a", "primary": "v1", "versions": [{"id": "v1", "material": ` + material + `}]}, {"id": "a", "primary": "v1", "versions": [{"id": "v1", "material": ` + material + `}]}`},
+		{"主版本不存在", `{"id": "a", "primary": "v2", "versions": [{"id": "v1", "material": ` + material + `}]}`},
+		{"签名密钥不是私钥", `{"id": "a", "spec": "EC_P256", "primary": "v1", "versions": [{"id": "v1", "material": ` + material + `}]}`},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "keyring.json")
+		if err := os.WriteFile(path, []byte(`{"keys": [`+c.keys+`]}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKeyring(path); err == nil {
+			t.Errorf("%s: 期望加载失败", c.name)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen 熔断器打开，请求没有发往 KMS
+var ErrCircuitOpen = errors.New("kms: circuit breaker open")
+
+// RetryPolicy 重试策略，零值使用默认值
+// 第 n 次重试前等待 [0, min(MaxDelay, BaseDelay*2^n)) 之间的随机时长（full jitter），避免大量客户端同时重试
+type RetryPolicy struct {
+	MaxAttempts int           // 最多调用次数（含第一次），默认 3
+	BaseDelay   time.Duration // 默认 100ms
+	MaxDelay    time.Duration // 默认 2s
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 100 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 2 * time.Second
+	}
+	return p
+}
+
+// backoff 第 attempt 次重试（从 1 开始）前的等待时长
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if shift := attempt - 1; shift < 30 {
+		if d := p.BaseDelay << uint(shift); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// IsRetryable 限流和服务暂时不可用可以重试；密钥不存在、密文错误、无权限以及 ctx 取消都不重试
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrThrottled) || errors.Is(err, ErrUnavailable)
+}
+
+/*
+CircuitBreaker 熔断器
+
+连续 threshold 次可重试的失败（限流、服务不可用）后打开，cooldown 内的请求直接返回 ErrCircuitOpen；
+冷却结束后放行一个探测请求（半开），成功则关闭，失败则重新打开。
+密钥不存在、密文错误等业务错误说明 KMS 可用，不计入失败。
+*/
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker threshold 默认 5，cooldown 默认 30s
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow 请求前调用，熔断时返回 ErrCircuitOpen
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// Record 请求结束后调用
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// 调用方放弃了请求，不能说明 KMS 是否可用
+		return
+	}
+	if !IsRetryable(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// Open 熔断器当前是否打开
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && b.now().Before(b.openUntil)
+}
+
+// RetryingProvider 为 KeyProvider 增加重试和熔断，ctx 取消或超时时立即返回
+// 包装 DKMSProvider 时应关闭 SDK 自带的重试（RuntimeOptions.Autoretry），否则重试次数相乘
+type RetryingProvider struct {
+	p       KeyProvider
+	policy  RetryPolicy
+	breaker *CircuitBreaker
+}
+
+// NewRetryingProvider breaker 为 nil 时不熔断，多个 RetryingProvider 可以共用一个熔断器
+func NewRetryingProvider(p KeyProvider, policy RetryPolicy, breaker *CircuitBreaker) *RetryingProvider {
+	return &RetryingProvider{p: p, policy: policy.withDefaults(), breaker: breaker}
+}
+
+// do 调用 fn 直到成功、遇到不可重试的错误、次数用完或 ctx 结束
+func (r *RetryingProvider) do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < r.policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(r.policy.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if r.breaker != nil {
+			if openErr := r.breaker.Allow(); openErr != nil {
+				if err != nil {
+					return errors.Join(openErr, err)
+				}
+				return openErr
+			}
+		}
+		err = fn()
+		if r.breaker != nil {
+			r.breaker.Record(err)
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// GenerateDataKey 见 KeyProvider
+func (r *RetryingProvider) GenerateDataKey(ctx context.Context, keyID string, numberOfBytes int, aad []byte) (dk *DataKey, err error) {
+	err = r.do(ctx, func() error {
+		dk, err = r.p.GenerateDataKey(ctx, keyID, numberOfBytes, aad)
+		return err
+	})
+	return dk, err
+}
+
+// Encrypt 见 KeyProvider
+func (r *RetryingProvider) Encrypt(ctx context.Context, keyID string, plaintext, aad []byte) (blob *EncryptedBlob, err error) {
+	err = r.do(ctx, func() error {
+		blob, err = r.p.Encrypt(ctx, keyID, plaintext, aad)
+		return err
+	})
+	return blob, err
+}
+
+// Decrypt 见 KeyProvider
+func (r *RetryingProvider) Decrypt(ctx context.Context, blob *EncryptedBlob, aad []byte) (plaintext []byte, err error) {
+	err = r.do(ctx, func() error {
+		plaintext, err = r.p.Decrypt(ctx, blob, aad)
+		return err
+	})
+	return plaintext, err
+}
+
+// Sign 被包装的提供方未实现 Signer 时返回 ErrSignNotSupported
+func (r *RetryingProvider) Sign(ctx context.Context, keyID string, digest []byte) (signature []byte, err error) {
+	signer, ok := r.p.(Signer)
+	if !ok {
+		return nil, ErrSignNotSupported
+	}
+	err = r.do(ctx, func() error {
+		signature, err = signer.Sign(ctx, keyID, digest)
+		return err
+	})
+	return signature, err
+}
+
+// Verify 被包装的提供方未实现 Signer 时返回 ErrSignNotSupported
+func (r *RetryingProvider) Verify(ctx context.Context, keyID string, digest, signature []byte) error {
+	signer, ok := r.p.(Signer)
+	if !ok {
+		return ErrSignNotSupported
+	}
+	return r.do(ctx, func() error {
+		return signer.Verify(ctx, keyID, digest, signature)
+	})
+}
@@ -0,0 +1,87 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyProvider 前 failures 次调用返回 err
+type flakyProvider struct {
+	KeyProvider
+	failures int
+	err      error
+	calls    int
+}
+
+func (p *flakyProvider) GenerateDataKey(ctx context.Context, keyID string, n int, aad []byte) (*DataKey, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return nil, p.err
+	}
+	return p.KeyProvider.GenerateDataKey(ctx, keyID, n, aad)
+}
+
+// TestRetryingProvider 只重试限流和服务不可用，次数用完后返回最后一次的错误
+func TestRetryingProvider(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	cases := []struct {
+		name     string
+		failures int
+		err      error
+		calls    int
+		expect   error
+	}{
+		{"成功", 0, nil, 1, nil},
+		{"限流后成功", 2, ErrThrottled, 3, nil},
+		{"服务不可用超过重试次数", 5, ErrUnavailable, 3, ErrUnavailable},
+		{"密钥不存在不重试", 5, ErrKeyNotFound, 1, ErrKeyNotFound},
+		{"无权限不重试", 5, ErrAccessDenied, 1, ErrAccessDenied},
+	}
+	for _, c := range cases {
+		flaky := &flakyProvider{KeyProvider: newTestKeyring(t), failures: c.failures, err: c.err}
+		r := NewRetryingProvider(flaky, policy, nil)
+		_, err := r.GenerateDataKey(context.Background(), "orders", 32, nil)
+		if !errors.Is(err, c.expect) || (c.expect == nil && err != nil) || flaky.calls != c.calls {
+			t.Errorf("%s: 期望 %v 调用 %d 次，得到 %v 调用 %d 次", c.name, c.expect, c.calls, err, flaky.calls)
+		}
+	}
+
+	// 等待重试时 ctx 超时立即返回
+	flaky := &flakyProvider{KeyProvider: newTestKeyring(t), failures: 5, err: ErrThrottled}
+	r := NewRetryingProvider(flaky, RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: time.Second}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.GenerateDataKey(ctx, "orders", 32, nil); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("期望 ctx 超时后立即返回，得到 %v，耗时 %v", err, time.Since(start))
+	}
+}
+
+// TestCircuitBreaker 连续失败后打开，冷却结束后放行一个探测请求
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(3, time.Minute)
+	now := time.Unix(1700000000, 0)
+	b.now = func() time.Time { return now }
+
+	flaky := &flakyProvider{KeyProvider: newTestKeyring(t), failures: 4, err: ErrUnavailable}
+	r := NewRetryingProvider(flaky, RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond}, b)
+	if _, err := r.GenerateDataKey(context.Background(), "orders", 32, nil); !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrUnavailable) || flaky.calls != 3 {
+		t.Fatalf("期望第 3 次失败后熔断，得到 %v 调用 %d 次", err, flaky.calls)
+	}
+	if _, err := r.GenerateDataKey(context.Background(), "orders", 32, nil); !errors.Is(err, ErrCircuitOpen) || flaky.calls != 3 {
+		t.Errorf("熔断期间不应调用提供方，得到 %v 调用 %d 次", err, flaky.calls)
+	}
+
+	// 冷却结束：探测失败重新打开，下一次探测成功后关闭
+	now = now.Add(time.Minute)
+	r = NewRetryingProvider(flaky, RetryPolicy{MaxAttempts: 1}, b)
+	if _, err := r.GenerateDataKey(context.Background(), "orders", 32, nil); !errors.Is(err, ErrUnavailable) || !b.Open() {
+		t.Errorf("探测失败后应重新打开，得到 %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := r.GenerateDataKey(context.Background(), "orders", 32, nil); err != nil || b.Open() {
+		t.Errorf("探测成功后应关闭，得到 %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+重新包装（re-wrap）
+
+主密钥轮转或迁移到新主密钥时，只需要用新密钥重新加密数据密钥，数据密文保持不变：
+
+	Rewrap:       旧主密钥 Decrypt(数据密钥密文) -> 新主密钥 Encrypt(数据密钥明文) -> 替换头部中的密钥字段
+	RewrapStream: 对流式密文只读取并替换头部，分段密文原样复制，内存占用与文件大小无关
+	RewrapShared: 共享数据密钥（EnvelopeEncryptShared）的密文，数据密钥以 keyEC 解密和重新加密（见 cache.go）
+	RewrapAll:    从迭代器读取记录，并发 Rewrap 后写回，按顺序记录断点，DryRun 时只生成报告
+
+分段加密（AlgAESGCMStream）每段的附加认证数据不包含密钥字段（见 stream.go），与普通信封一样可以重新包装。
+*/
+
+// Rewrap 用 targetKeyID 的当前版本重新加密数据密钥，返回新的密文对象，obj 不变
+// ec 必须与加密时相同；targetKeyID 为空时使用原主密钥（轮转后切换到主版本）
+// 共享数据密钥（EnvelopeEncryptShared）加密的密文使用 RewrapShared
+func Rewrap(ctx context.Context, p KeyProvider, obj *EnvelopeCipherObj, targetKeyID string, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	return RewrapShared(ctx, p, obj, targetKeyID, ec, ec)
+}
+
+// RewrapStream 重新包装 r 中的流式密文并写入 w：替换头部，分段密文原样复制，返回新的头部
+func RewrapStream(ctx context.Context, p KeyProvider, r io.Reader, w io.Writer, targetKeyID string, ec EncryptionContext) (*EnvelopeCipherObj, error) {
+	header, _, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.Algorithm != AlgAESGCMStream {
+		return nil, fmt.Errorf("%w: %s is not a stream algorithm", ErrUnknownAlgorithm, header.Algorithm)
+	}
+	rewrapped, err := Rewrap(ctx, p, header, targetKeyID, ec)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := rewrapped.MarshalHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	return rewrapped, nil
+}
+
+// RewrapRecord 待重新包装的一条记录
+type RewrapRecord struct {
+	ID       string             // 记录 ID，用作断点
+	Envelope *EnvelopeCipherObj // 当前密文
+	Context  EncryptionContext  // 加密时的上下文
+}
+
+// RewrapIterator 按固定顺序返回记录，没有更多记录时返回 io.EOF
+// 断点续跑时由调用方从 Checkpoint 的记录之后开始构造迭代器
+type RewrapIterator interface {
+	Next(ctx context.Context) (*RewrapRecord, error)
+}
+
+// sliceIterator 内存中的记录列表
+type sliceIterator struct {
+	records []*RewrapRecord
+}
+
+// NewSliceIterator 按切片顺序返回记录
+func NewSliceIterator(records []*RewrapRecord) RewrapIterator {
+	return &sliceIterator{records: records}
+}
+
+func (it *sliceIterator) Next(ctx context.Context) (*RewrapRecord, error) {
+	if len(it.records) == 0 {
+		return nil, io.EOF
+	}
+	rec := it.records[0]
+	it.records = it.records[1:]
+	return rec, nil
+}
+
+// RewrapOptions 批量重新包装的参数
+type RewrapOptions struct {
+	TargetKeyID string // 目标主密钥，为空时使用各记录原来的主密钥
+	// TargetVersionID 非空时，已经在 TargetKeyID 的该版本下的记录直接跳过
+	TargetVersionID string
+	// KeyContext 非空时按共享数据密钥（EnvelopeEncryptShared）处理：数据密钥以 KeyContext 解密，
+	// 各记录的 Context 只用于校验密文，见 RewrapShared
+	KeyContext  EncryptionContext
+	Concurrency int  // 并发数，默认 4
+	DryRun      bool // 只解密/重新加密数据密钥并生成报告，不调用 Store 和 Checkpoint
+	// Store 写回新的密文，DryRun 时不调用
+	Store func(ctx context.Context, rec *RewrapRecord, obj *EnvelopeCipherObj) error
+	// Checkpoint 迭代顺序中该记录及之前的记录都已成功处理（或跳过）时调用，失败的记录会阻止断点前进
+	Checkpoint      func(id string) error
+	CheckpointEvery int // 每处理多少条记录保存一次断点，默认 100，结束时总会保存
+	MaxErrors       int // 报告中最多保留的错误数，默认 100
+}
+
+// RewrapError 一条记录的失败原因
+type RewrapError struct {
+	ID  string `json:"id"`
+	Err string `json:"error"`
+}
+
+// RewrapReport 批量重新包装的结果
+type RewrapReport struct {
+	DryRun     bool           `json:"dry_run"`
+	Total      int            `json:"total"`
+	Rewrapped  int            `json:"rewrapped"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	BySource   map[string]int `json:"by_source"` // 处理前的 "主密钥/版本" -> 记录数
+	Errors     []RewrapError  `json:"errors,omitempty"`
+	Checkpoint string         `json:"checkpoint,omitempty"` // 最后保存的断点
+}
+
+// rewrapResult 一条记录的处理结果，seq 为迭代顺序
+type rewrapResult struct {
+	seq     int
+	id      string
+	source  string
+	skipped bool
+	err     error
+}
+
+// RewrapAll 批量重新包装，迭代器出错或 ctx 取消时停止并返回已有的报告
+func RewrapAll(ctx context.Context, p KeyProvider, it RewrapIterator, opts RewrapOptions) (*RewrapReport, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if opts.CheckpointEvery <= 0 {
+		opts.CheckpointEvery = 100
+	}
+	if opts.MaxErrors <= 0 {
+		opts.MaxErrors = 100
+	}
+	if opts.Store == nil && !opts.DryRun {
+		return nil, errors.New("kms: rewrap store is required unless dry run")
+	}
+
+	type job struct {
+		seq int
+		rec *RewrapRecord
+	}
+	jobs := make(chan job)
+	results := make(chan rewrapResult)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- rewrapOne(ctx, p, j.seq, j.rec, &opts)
+			}
+		}()
+	}
+
+	// 读取迭代器
+	var iterErr error
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(results)
+		}()
+		for seq := 0; ; seq++ {
+			rec, err := it.Next(ctx)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				iterErr = err
+				return
+			}
+			select {
+			case jobs <- job{seq: seq, rec: rec}:
+			case <-ctx.Done():
+				iterErr = ctx.Err()
+				return
+			}
+		}
+	}()
+
+	// 汇总结果，按迭代顺序推进断点
+	report := &RewrapReport{DryRun: opts.DryRun, BySource: map[string]int{}}
+	cp := &rewrapCheckpoint{opts: &opts, report: report, pending: map[int]rewrapResult{}}
+	for res := range results {
+		report.Total++
+		report.BySource[res.source]++
+		switch {
+		case res.err != nil:
+			report.Failed++
+			if len(report.Errors) < opts.MaxErrors {
+				report.Errors = append(report.Errors, RewrapError{ID: res.id, Err: res.err.Error()})
+			}
+		case res.skipped:
+			report.Skipped++
+		default:
+			report.Rewrapped++
+		}
+		cp.add(res)
+	}
+	cp.save()
+	if iterErr != nil {
+		return report, iterErr
+	}
+	return report, cp.err
+}
+
+// rewrapCheckpoint 按迭代顺序推进断点：乱序到达的结果暂存在 pending 中，
+// 遇到失败的记录后断点不再前进，之后的结果不再暂存，内存占用不随批量大小增长
+type rewrapCheckpoint struct {
+	opts    *RewrapOptions
+	report  *RewrapReport
+	pending map[int]rewrapResult
+	next    int // 下一条等待的迭代序号
+	since   int // 上次保存断点后处理的记录数
+	blocked bool
+	lastID  string
+	err     error
+}
+
+// add 记录一条结果，并尽可能推进断点
+func (cp *rewrapCheckpoint) add(res rewrapResult) {
+	if cp.blocked {
+		return
+	}
+	cp.pending[res.seq] = res
+	for {
+		r, ok := cp.pending[cp.next]
+		if !ok {
+			return
+		}
+		delete(cp.pending, cp.next)
+		cp.next++
+		if r.err != nil {
+			cp.blocked = true
+			clear(cp.pending)
+			return
+		}
+		cp.lastID = r.id
+		if cp.since++; cp.since >= cp.opts.CheckpointEvery {
+			cp.save()
+		}
+	}
+}
+
+// save 保存断点，DryRun、未设置 Checkpoint 或断点未变化时不调用
+func (cp *rewrapCheckpoint) save() {
+	if cp.opts.DryRun || cp.opts.Checkpoint == nil || cp.lastID == "" || cp.lastID == cp.report.Checkpoint || cp.err != nil {
+		return
+	}
+	if cp.err = cp.opts.Checkpoint(cp.lastID); cp.err == nil {
+		cp.report.Checkpoint = cp.lastID
+	}
+	cp.since = 0
+}
+
+// rewrapOne 处理一条记录
+func rewrapOne(ctx context.Context, p KeyProvider, seq int, rec *RewrapRecord, opts *RewrapOptions) rewrapResult {
+	res := rewrapResult{seq: seq, id: rec.ID}
+	if rec.Envelope == nil {
+		res.err = fmt.Errorf("%w: missing envelope", ErrInvalidEnvelope)
+		return res
+	}
+	obj := rec.Envelope
+	res.source = obj.KeyID + "/" + obj.KeyVersionID
+	target := opts.TargetKeyID
+	if target == "" {
+		target = obj.KeyID
+	}
+	if opts.TargetVersionID != "" && obj.KeyID == target && obj.KeyVersionID == opts.TargetVersionID {
+		res.skipped = true
+		return res
+	}
+	keyEC := rec.Context
+	if opts.KeyContext != nil {
+		keyEC = opts.KeyContext
+	}
+	out, err := RewrapShared(ctx, p, obj, opts.TargetKeyID, keyEC, rec.Context)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if !opts.DryRun {
+		res.err = opts.Store(ctx, rec, out)
+	}
+	return res
+}
@@ -0,0 +1,253 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestRewrap 只替换数据密钥，数据密文不变
+func TestRewrap(t *testing.T) {
+	ctx := context.Background()
+	p := newTestKeyring(t)
+	ec := EncryptionContext{"id": "1"}
+	obj, err := EnvelopeEncrypt(ctx, p, "orders", []byte("data"), ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Rotate("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name, target, keyID, version string
+	}{
+		{"轮转后切换到主版本", "", "orders", "v2"},
+		{"迁移到其他主密钥", "users", "users", "v1"},
+	}
+	for _, c := range cases {
+		out, err := Rewrap(ctx, p, obj, c.target, ec)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if out.KeyID != c.keyID || out.KeyVersionID != c.version || !bytes.Equal(out.CipherText, obj.CipherText) {
+			t.Errorf("%s: 得到 %s/%s，密文是否不变 %v", c.name, out.KeyID, out.KeyVersionID, bytes.Equal(out.CipherText, obj.CipherText))
+		}
+		if plaintext, err := EnvelopeDecrypt(ctx, p, out, ec); err != nil || string(plaintext) != "data" {
+			t.Errorf("%s: 解密得到 %q %v", c.name, plaintext, err)
+		}
+	}
+	if obj.KeyVersionID != "v1" {
+		t.Error("Rewrap 不应修改原对象")
+	}
+
+	if _, err := Rewrap(ctx, p, obj, "", nil); !errors.Is(err, ErrContextMismatch) {
+		t.Errorf("期望 ErrContextMismatch，得到 %v", err)
+	}
+	if _, err := RewrapStream(ctx, p, bytes.NewReader(obj.CipherText), &bytes.Buffer{}, "", ec); err == nil {
+		t.Error("非流式密文期望 RewrapStream 失败")
+	}
+}
+
+// TestRewrapStream 流式密文只替换头部，分段密文原样复制，重新包装后可以解密
+func TestRewrapStream(t *testing.T) {
+	ctx := context.Background()
+	p := newTestKeyring(t)
+	data := bytes.Repeat([]byte("0123456789"), StreamSegmentSize/4)
+	ciphertext := encryptStream(t, p, data, 1000)
+	if _, err := p.Rotate("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	header, err := RewrapStream(ctx, p, bytes.NewReader(ciphertext), &out, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.KeyVersionID != "v2" {
+		t.Errorf("期望切换到 v2，得到 %s", header.KeyVersionID)
+	}
+	if plaintext, err := decryptStream(p, out.Bytes()); err != nil || !bytes.Equal(plaintext, data) {
+		t.Errorf("重新包装后解密失败: %v", err)
+	}
+
+	// 一次性读入内存的流式密文也可以用 Rewrap
+	obj := &EnvelopeCipherObj{}
+	if err := obj.UnmarshalBinary(ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, err := Rewrap(ctx, p, obj, "users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := EnvelopeDecrypt(ctx, p, rewrapped, nil); err != nil || !bytes.Equal(plaintext, data) {
+		t.Errorf("迁移到其他主密钥后解密失败: %v", err)
+	}
+}
+
+// TestRewrapAll 并发批量重新包装：dry run 不写回，失败的记录阻止断点前进，已在目标版本的记录跳过
+func TestRewrapAll(t *testing.T) {
+	ctx := context.Background()
+	p := newTestKeyring(t)
+	var records []*RewrapRecord
+	for i := 0; i < 50; i++ {
+		ec := EncryptionContext{"id": fmt.Sprint(i)}
+		obj, err := EnvelopeEncrypt(ctx, p, "orders", []byte("data"), ec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, &RewrapRecord{ID: fmt.Sprintf("%03d", i), Envelope: obj, Context: ec})
+	}
+	records[10].Context = EncryptionContext{"id": "wrong"}
+	if _, err := p.Rotate("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	stored := map[string]*EnvelopeCipherObj{}
+	var checkpoints []string
+	opts := RewrapOptions{
+		Concurrency:     8,
+		CheckpointEvery: 5,
+		Store: func(ctx context.Context, rec *RewrapRecord, obj *EnvelopeCipherObj) error {
+			mu.Lock()
+			defer mu.Unlock()
+			stored[rec.ID] = obj
+			return nil
+		},
+		Checkpoint: func(id string) error {
+			checkpoints = append(checkpoints, id)
+			return nil
+		},
+	}
+
+	dry := opts
+	dry.DryRun = true
+	report, err := RewrapAll(ctx, p, NewSliceIterator(records), dry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 50 || report.Rewrapped != 49 || report.Failed != 1 || len(stored) != 0 || len(checkpoints) != 0 {
+		t.Errorf("dry run 报告不正确 %+v，写回 %d 条，断点 %v", report, len(stored), checkpoints)
+	}
+	if report.BySource["orders/v1"] != 50 || len(report.Errors) != 1 || report.Errors[0].ID != "010" {
+		t.Errorf("dry run 统计不正确 %+v", report)
+	}
+
+	report, err = RewrapAll(ctx, p, NewSliceIterator(records), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rewrapped != 49 || len(stored) != 49 {
+		t.Errorf("期望写回 49 条，得到 %+v %d", report, len(stored))
+	}
+	if report.Checkpoint != "009" || checkpoints[len(checkpoints)-1] != "009" {
+		t.Errorf("断点应停在失败记录之前，得到 %s %v", report.Checkpoint, checkpoints)
+	}
+	for id, obj := range stored {
+		if obj.KeyVersionID != "v2" {
+			t.Errorf("%s: 期望 v2，得到 %s", id, obj.KeyVersionID)
+		}
+	}
+
+	// 写回后再跑一次，已在目标版本的记录跳过
+	for _, rec := range records {
+		if obj, ok := stored[rec.ID]; ok {
+			rec.Envelope = obj
+		}
+	}
+	records[10].Context = EncryptionContext{"id": "10"}
+	opts.TargetKeyID, opts.TargetVersionID = "orders", "v2"
+	report, err = RewrapAll(ctx, p, NewSliceIterator(records), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 49 || report.Rewrapped != 1 || report.Checkpoint != "049" {
+		t.Errorf("第二次运行报告不正确 %+v", report)
+	}
+}
+
+// TestRewrapCheckpointBounded 失败的记录阻止断点前进后，之后的结果不再暂存
+func TestRewrapCheckpointBounded(t *testing.T) {
+	var checkpoints []string
+	opts := &RewrapOptions{CheckpointEvery: 1, Checkpoint: func(id string) error {
+		checkpoints = append(checkpoints, id)
+		return nil
+	}}
+	cp := &rewrapCheckpoint{opts: opts, report: &RewrapReport{}, pending: map[int]rewrapResult{}}
+	// 乱序到达：1、2 先于 0，3 失败
+	for _, seq := range []int{1, 2, 0, 5, 4} {
+		cp.add(rewrapResult{seq: seq, id: fmt.Sprint(seq)})
+	}
+	cp.add(rewrapResult{seq: 3, id: "3", err: errors.New("boom")})
+	if len(cp.pending) != 0 || !cp.blocked {
+		t.Fatalf("失败后期望清空暂存结果，剩余 %d 条", len(cp.pending))
+	}
+	for seq := 6; seq < 10000; seq++ {
+		cp.add(rewrapResult{seq: seq, id: fmt.Sprint(seq)})
+		if len(cp.pending) != 0 {
+			t.Fatalf("第 %d 条: 失败后不应再暂存结果，得到 %d 条", seq, len(cp.pending))
+		}
+	}
+	if cp.report.Checkpoint != "2" || len(checkpoints) != 3 {
+		t.Errorf("断点应停在失败记录之前，得到 %s %v", cp.report.Checkpoint, checkpoints)
+	}
+}
+
+// TestRewrapShared 共享数据密钥的密文：数据密钥以 keyEC 重新包装，逐条或批量都可以
+func TestRewrapShared(t *testing.T) {
+	ctx := context.Background()
+	p := newTestKeyring(t)
+	m, err := NewCachingMaterials(p, CachePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyEC := EncryptionContext{"table": "users"}
+	var records []*RewrapRecord
+	for i := 0; i < 3; i++ {
+		ec := EncryptionContext{"table": "users", "column": "email", "id": fmt.Sprint(i)}
+		obj, err := m.EnvelopeEncryptShared(ctx, "orders", []byte(fmt.Sprint("data", i)), keyEC, ec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, &RewrapRecord{ID: fmt.Sprint(i), Envelope: obj, Context: ec})
+	}
+	if _, err := p.Rotate("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Rewrap(ctx, p, records[0].Envelope, "", records[0].Context); err == nil {
+		t.Error("以行上下文作为数据密钥上下文期望失败")
+	}
+	if _, err := RewrapShared(ctx, p, records[0].Envelope, "", EncryptionContext{"table": "orders"}, records[0].Context); !errors.Is(err, ErrContextMismatch) {
+		t.Errorf("keyEC 不是 ec 的子集期望 ErrContextMismatch，得到 %v", err)
+	}
+	out, err := RewrapShared(ctx, p, records[0].Envelope, "", keyEC, records[0].Context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := m.EnvelopeDecryptShared(ctx, out, keyEC, records[0].Context); err != nil || string(plaintext) != "data0" || out.KeyVersionID != "v2" {
+		t.Errorf("重新包装后得到 %s %q %v", out.KeyVersionID, plaintext, err)
+	}
+
+	stored := map[string]*EnvelopeCipherObj{}
+	report, err := RewrapAll(ctx, p, NewSliceIterator(records), RewrapOptions{
+		KeyContext: keyEC,
+		Store: func(ctx context.Context, rec *RewrapRecord, obj *EnvelopeCipherObj) error {
+			stored[rec.ID] = obj
+			return nil
+		},
+		Concurrency: 1,
+	})
+	if err != nil || report.Rewrapped != 3 {
+		t.Fatalf("批量重新包装期望 3 条，得到 %+v %v", report, err)
+	}
+	for _, rec := range records {
+		if plaintext, err := m.EnvelopeDecryptShared(ctx, stored[rec.ID], keyEC, rec.Context); err != nil || string(plaintext) != "data"+rec.ID {
+			t.Errorf("%s: 解密得到 %q %v", rec.ID, plaintext, err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package kms
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+流式信封加密（AlgAESGCMStream）
+
+大文件按 64 KiB 明文分段，每段单独用 AES-GCM 加密，内存占用与输入大小无关：
+
+	头部 | 段 0 | 段 1 | ... | 最后一段
+
+- 每段密文 = 明文 + 16 字节认证标签，除最后一段外明文都是满 64 KiB，最后一段可以为空
+- nonce = 7 字节前缀（头部的 iv 字段）+ 4 字节段序号（大端）+ 1 字节结束标记（最后一段为 1）
+- 每段的附加认证数据只包含头部中不会变化的字段：magic、版本、算法、nonce 前缀、段长度和加密上下文摘要，
+  这些字段被篡改时所有段都无法解密；主密钥 ID、版本和数据密钥密文不在其中，重新包装（rewrap）时
+  只需替换头部，分段密文原样复制（数据密钥密文被替换成其他密钥时解密出的数据密钥不同，同样无法解密）
+
+段序号防止段被重排或删除，结束标记防止在段边界被截断或在末尾追加数据。
+*/
+
+const (
+	// StreamSegmentSize 每段明文的长度
+	StreamSegmentSize = 64 << 10
+	// streamNoncePrefixLength nonce 前缀长度，剩余 5 字节为段序号和结束标记
+	streamNoncePrefixLength = 7
+)
+
+// ErrStreamCorrupted 分段密文被截断、重排或篡改
+var ErrStreamCorrupted = errors.New("kms: stream truncated or tampered")
+
+// streamAAD 每段的附加认证数据，见文件开头的说明
+func streamAAD(header *EnvelopeCipherObj) []byte {
+	buf := append([]byte(envelopeMagic), EnvelopeVersion, byte(header.Algorithm))
+	buf = binary.BigEndian.AppendUint32(buf, StreamSegmentSize)
+	for _, field := range [][]byte{header.Iv, header.AADDigest} {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// streamNonce 计算第 counter 段的 nonce
+func streamNonce(dst, prefix []byte, counter uint32, last bool) []byte {
+	dst = append(dst[:0], prefix...)
+	dst = binary.BigEndian.AppendUint32(dst, counter)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// encryptWriter 分段加密的 io.WriteCloser
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte // streamAAD
+	counter uint32
+	nonce   []byte
+	buf     []byte // 尚未加密的明文，最多一段
+	out     []byte // 复用的密文缓冲区
+	err     error
+	closed  bool
+}
+
+// NewEncryptWriter 生成数据密钥，写入头部，返回的 WriteCloser 在 Close 时写入最后一段
+// Close 之前的数据不构成完整密文
+func NewEncryptWriter(ctx context.Context, p KeyProvider, keyID string, w io.Writer, ec EncryptionContext) (io.WriteCloser, error) {
+	dataKey, err := p.GenerateDataKey(ctx, keyID, DataKeyLength, ec.Canonical())
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptWriterWithDataKey(dataKey, w, ec)
+}
+
+// NewEncryptWriterWithDataKey 使用已有的数据密钥进行流式加密，数据密钥必须是以相同的 ec 生成的
+func NewEncryptWriterWithDataKey(dataKey *DataKey, w io.Writer, ec EncryptionContext) (io.WriteCloser, error) {
+	aead, err := newGCM(dataKey.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := randomBytes(streamNoncePrefixLength)
+	if err != nil {
+		return nil, err
+	}
+	header := &EnvelopeCipherObj{
+		Version:          EnvelopeVersion,
+		Algorithm:        AlgAESGCMStream,
+		KeyID:            dataKey.KeyID,
+		KeyVersionID:     dataKey.KeyVersionID,
+		DataKeyIV:        dataKey.Iv,
+		EncryptedDataKey: dataKey.CiphertextBlob,
+		Iv:               prefix,
+		AADDigest:        ec.Digest(),
+	}
+	raw, err := header.MarshalHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		aad:    streamAAD(header),
+		buf:    make([]byte, 0, StreamSegmentSize),
+		out:    make([]byte, 0, StreamSegmentSize+gcmTagLength),
+	}, nil
+}
+
+// flush 加密并写出缓冲区中的一段
+func (ew *encryptWriter) flush(last bool) error {
+	if ew.counter == math.MaxUint32 && !last {
+		return errors.New("kms: stream too long")
+	}
+	ew.nonce = streamNonce(ew.nonce, ew.prefix, ew.counter, last)
+	ew.out = ew.aead.Seal(ew.out[:0], ew.nonce, ew.buf, ew.aad)
+	if _, err := ew.w.Write(ew.out); err != nil {
+		return err
+	}
+	ew.counter++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Write 缓冲明文，满一段且还有后续数据时才写出，保证最后一段在 Close 时确定
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	if ew.closed {
+		return 0, errors.New("kms: write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(ew.buf) == StreamSegmentSize {
+			if ew.err = ew.flush(false); ew.err != nil {
+				return written, ew.err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):StreamSegmentSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close 写出最后一段，不关闭底层 Writer
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return ew.err
+	}
+	ew.closed = true
+	if ew.err != nil {
+		return ew.err
+	}
+	ew.err = ew.flush(true)
+	return ew.err
+}
+
+// decryptReader 分段解密的 io.Reader
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	counter uint32
+	nonce   []byte
+	in      []byte // 复用的密文缓冲区
+	plain   []byte // 当前段尚未读取的明文
+	done    bool
+	err     error
+}
+
+// NewDecryptReader 读取头部并解密数据密钥，返回明文 Reader 和头部，ec 必须与加密时相同
+// Reader 在读到最后一段并校验通过后才返回 io.EOF，密文被截断或篡改时返回 ErrStreamCorrupted
+func NewDecryptReader(ctx context.Context, p KeyProvider, r io.Reader, ec EncryptionContext) (io.Reader, *EnvelopeCipherObj, error) {
+	br := bufio.NewReaderSize(r, StreamSegmentSize+gcmTagLength+1)
+	header, _, err := readHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Algorithm != AlgAESGCMStream {
+		return nil, header, fmt.Errorf("%w: %s is not a stream algorithm", ErrUnknownAlgorithm, header.Algorithm)
+	}
+	if err := header.checkContext(ec); err != nil {
+		return nil, header, err
+	}
+	plainDataKey, err := p.Decrypt(ctx, header.EncryptedDataKeyOf(), ec.Canonical())
+	if err != nil {
+		return nil, header, err
+	}
+	dr, err := newDecryptReader(plainDataKey, header, br)
+	return dr, header, err
+}
+
+func newDecryptReader(plainDataKey []byte, header *EnvelopeCipherObj, br *bufio.Reader) (*decryptReader, error) {
+	aead, err := newGCM(plainDataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      br,
+		aead:   aead,
+		prefix: header.Iv,
+		aad:    streamAAD(header),
+		in:     make([]byte, StreamSegmentSize+gcmTagLength),
+	}, nil
+}
+
+// next 读取并解密下一段；读满一段后再看是否还有数据来判断它是不是最后一段
+func (dr *decryptReader) next() error {
+	n, err := io.ReadFull(dr.r, dr.in)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := dr.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < gcmTagLength {
+		return ErrStreamCorrupted
+	}
+	dr.nonce = streamNonce(dr.nonce, dr.prefix, dr.counter, last)
+	plain, err := dr.aead.Open(dr.in[:0], dr.nonce, dr.in[:n], dr.aad)
+	if err != nil {
+		return ErrStreamCorrupted
+	}
+	dr.counter++
+	dr.plain = plain
+	dr.done = last
+	return nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		if dr.err = dr.next(); dr.err != nil {
+			return 0, dr.err
+		}
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// openStream 在内存中解密完整的分段密文
+func openStream(plainDataKey []byte, obj *EnvelopeCipherObj) ([]byte, error) {
+	dr, err := newDecryptReader(plainDataKey, obj, bufio.NewReaderSize(bytes.NewReader(obj.CipherText), StreamSegmentSize+gcmTagLength+1))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dr)
+}
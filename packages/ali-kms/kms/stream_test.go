@@ -0,0 +1,149 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// encryptStream 以每次 chunk 字节的小块写入
+func encryptStream(t *testing.T, p KeyProvider, data []byte, chunk int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewEncryptWriter(context.Background(), p, "orders", &out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := min(chunk, len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decryptStream(p KeyProvider, ciphertext []byte) ([]byte, error) {
+	r, _, err := NewDecryptReader(context.Background(), p, bytes.NewReader(ciphertext), nil)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// TestStreamRoundTrip 各种边界长度的往返，并且可以用 UnmarshalBinary + EnvelopeDecrypt 在内存中解密
+func TestStreamRoundTrip(t *testing.T) {
+	p := newTestKeyring(t)
+	for _, size := range []int{0, 1, StreamSegmentSize - 1, StreamSegmentSize, StreamSegmentSize + 1, 3*StreamSegmentSize + 5} {
+		data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+		ciphertext := encryptStream(t, p, data, 1000)
+
+		header, err := ReadHeader(bytes.NewReader(ciphertext))
+		if err != nil || header.Algorithm != AlgAESGCMStream || header.KeyID != "orders" {
+			t.Fatalf("%d: 头部解析错误 %+v %v", size, header, err)
+		}
+		plaintext, err := decryptStream(p, ciphertext)
+		if err != nil || !bytes.Equal(plaintext, data) {
+			t.Errorf("%d: 流式解密结果不一致 %v", size, err)
+		}
+
+		var obj EnvelopeCipherObj
+		if err := obj.UnmarshalBinary(ciphertext); err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		plaintext, err = EnvelopeDecrypt(context.Background(), p, &obj, nil)
+		if err != nil || !bytes.Equal(plaintext, data) {
+			t.Errorf("%d: 内存解密结果不一致 %v", size, err)
+		}
+	}
+}
+
+// TestStreamTamper 截断、重排、篡改、追加都要解密失败
+func TestStreamTamper(t *testing.T) {
+	p := newTestKeyring(t)
+	data := bytes.Repeat([]byte{7}, 3*StreamSegmentSize+5)
+	ciphertext := encryptStream(t, p, data, StreamSegmentSize)
+	header, err := ReadHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := header.MarshalHeader()
+	headerLen := len(raw)
+	seg := StreamSegmentSize + gcmTagLength
+
+	cases := []struct {
+		name   string
+		mutate func(b []byte) []byte
+	}{
+		{"在段边界截断", func(b []byte) []byte { return b[:headerLen+2*seg] }},
+		{"截断最后一段", func(b []byte) []byte { return b[:len(b)-1] }},
+		{"只剩头部", func(b []byte) []byte { return b[:headerLen] }},
+		{"交换前两段", func(b []byte) []byte {
+			out := append([]byte(nil), b[:headerLen]...)
+			out = append(out, b[headerLen+seg:headerLen+2*seg]...)
+			out = append(out, b[headerLen:headerLen+seg]...)
+			return append(out, b[headerLen+2*seg:]...)
+		}},
+		{"翻转一个字节", func(b []byte) []byte { b[headerLen+seg+10] ^= 1; return b }},
+		{"末尾追加数据", func(b []byte) []byte { return append(b, 0) }},
+		{"篡改头部", func(b []byte) []byte { b[headerLen-1] ^= 1; return b }},
+	}
+	for _, c := range cases {
+		tampered := c.mutate(append([]byte(nil), ciphertext...))
+		plaintext, err := decryptStream(p, tampered)
+		if err == nil {
+			t.Errorf("%s: 期望解密失败，得到 %d 字节明文", c.name, len(plaintext))
+			continue
+		}
+		if c.name != "篡改头部" && !errors.Is(err, ErrStreamCorrupted) {
+			t.Errorf("%s: 期望 ErrStreamCorrupted，得到 %v", c.name, err)
+		}
+	}
+}
+
+// TestStreamMemory 加解密 32MB 数据时内存分配与数据大小无关
+func TestStreamMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short")
+	}
+	p := newTestKeyring(t)
+	const size = 32 << 20
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := NewEncryptWriter(context.Background(), p, "orders", pw, nil)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		chunk := make([]byte, 4096)
+		for written := 0; written < size; written += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	r, _, err := NewDecryptReader(context.Background(), p, pr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != size {
+		t.Fatalf("期望解密 %d 字节，得到 %d %v", size, n, err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4<<20 {
+		t.Errorf("流式加解密分配了 %d 字节，应与数据大小无关", alloc)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	alikmsopenapi "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi"
+	alikmsopenapiutil "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi-util"
+	alikmssdk "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/sdk"
+
+	"ali-kms/kms"
+)
+
+// Config kmsctl 的配置，JSON 字段名与 department_demo 的 KmsConfig 相同，可以共用配置文件
+type Config struct {
+	Endpoint         string `json:"endpoint"`
+	CaFilePath       string `json:"ca_filepath"`
+	ClientKeyContent string `json:"clientkey_content"`
+	ClientKeyFile    string `json:"clientkey_file"` // ClientKey 文件路径，设置后优先于 ClientKeyContent
+	Password         string `json:"password"`
+
+	DevCMK      string `json:"dev_cmk"`      // 本地固定密钥
+	KeyringFile string `json:"keyring_file"` // 本地密钥环文件，设置后优先于 DevCMK 和 Endpoint
+
+	KeyID string `json:"key_id"` // 默认主密钥
+}
+
+// envVars 环境变量，优先于配置文件
+// 口令和本地固定密钥只能通过环境变量或配置文件设置，避免出现在进程参数中
+var envVars = []struct {
+	name  string
+	field func(*Config) *string
+}{
+	{"KMS_ENDPOINT", func(c *Config) *string { return &c.Endpoint }},
+	{"KMS_CA_FILE", func(c *Config) *string { return &c.CaFilePath }},
+	{"KMS_CLIENT_KEY_FILE", func(c *Config) *string { return &c.ClientKeyFile }},
+	{"KMS_CLIENT_KEY_PASSWORD", func(c *Config) *string { return &c.Password }},
+	{"KMS_DEV_CMK", func(c *Config) *string { return &c.DevCMK }},
+	{"KMS_KEYRING_FILE", func(c *Config) *string { return &c.KeyringFile }},
+	{"KMS_KEY_ID", func(c *Config) *string { return &c.KeyID }},
+}
+
+// configFlags 所有子命令共用的参数，优先于环境变量
+type configFlags struct {
+	config, endpoint, ca, clientKey, keyring, key string
+	timeout                                       time.Duration
+}
+
+func (f *configFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "config", "", "JSON 配置文件，默认读取环境变量 KMSCTL_CONFIG")
+	fs.StringVar(&f.endpoint, "endpoint", "", "专属KMS实例地址 (KMS_ENDPOINT)")
+	fs.StringVar(&f.ca, "ca", "", "专属KMS实例的 CA 证书 (KMS_CA_FILE)")
+	fs.StringVar(&f.clientKey, "client-key", "", "ClientKey 文件，口令通过 KMS_CLIENT_KEY_PASSWORD 设置 (KMS_CLIENT_KEY_FILE)")
+	fs.StringVar(&f.keyring, "keyring", "", "本地密钥环文件 (KMS_KEYRING_FILE)")
+	fs.StringVar(&f.key, "key", "", "主密钥 ID (KMS_KEY_ID)")
+	fs.DurationVar(&f.timeout, "timeout", 30*time.Second, "KMS 请求的超时时间")
+}
+
+// load 依次读取配置文件、环境变量和命令行参数，后者覆盖前者
+func (f *configFlags) load(getenv func(string) string) (*Config, error) {
+	c := &Config{}
+	path := f.config
+	if path == "" {
+		path = getenv("KMSCTL_CONFIG")
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, v := range envVars {
+		if value := getenv(v.name); value != "" {
+			*v.field(c) = value
+		}
+	}
+	for _, v := range []struct {
+		value string
+		field *string
+	}{
+		{f.endpoint, &c.Endpoint},
+		{f.ca, &c.CaFilePath},
+		{f.clientKey, &c.ClientKeyFile},
+		{f.keyring, &c.KeyringFile},
+		{f.key, &c.KeyID},
+	} {
+		if v.value != "" {
+			*v.field = v.value
+		}
+	}
+	return c, nil
+}
+
+// newProvider 按配置选择密钥提供方：本地密钥环 > 本地固定密钥 > 专属KMS
+func newProvider(c *Config) (kms.KeyProvider, error) {
+	switch {
+	case c.KeyringFile != "":
+		return kms.LoadKeyring(c.KeyringFile)
+	case c.DevCMK != "":
+		return kms.NewStaticKeyProvider([]byte(c.DevCMK))
+	case c.Endpoint == "":
+		return nil, errors.New("no key provider configured: set -keyring, KMS_DEV_CMK or -endpoint")
+	}
+
+	clientKey := c.ClientKeyContent
+	if c.ClientKeyFile != "" {
+		data, err := os.ReadFile(c.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		clientKey = string(data)
+	}
+	config := &alikmsopenapi.Config{
+		Protocol:         tea.String("https"),
+		Endpoint:         tea.String(c.Endpoint),
+		ClientKeyContent: tea.String(clientKey),
+		Password:         tea.String(c.Password),
+	}
+	if c.CaFilePath != "" {
+		config.CaFilePath = tea.String(c.CaFilePath)
+	}
+	client, err := alikmssdk.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	runtime := &alikmsopenapiutil.RuntimeOptions{Autoretry: tea.Bool(false)}
+	return kms.NewRetryingProvider(kms.NewDKMSProvider(client, runtime), kms.RetryPolicy{}, kms.NewCircuitBreaker(0, 0)), nil
+}
@@ -0,0 +1,480 @@
+package main
+
+/*
+kmsctl 信封加密命令行工具
+
+	kmsctl encrypt     -key <keyId> [-context k=v,...] [-text] [-in file] [-out file]
+	kmsctl decrypt     [-key <keyId>] [-context k=v,...] [-in file] [-out file]
+	kmsctl rewrap      [-key <targetKeyId>] [-context k=v,...] [-in file] [-out file]
+	kmsctl inspect     [-context k=v,...] [-in file]
+	kmsctl gen-datakey -key <keyId> [-bytes 32] [-context k=v,...]
+
+-in/-out 默认为标准输入/输出，-out 为文件时先写临时文件，成功后才改名，失败时不留下不完整的输出
+（标准输出无法撤回，流式解密失败时已输出的部分应丢弃）。
+encrypt 默认输出流式二进制格式（内存占用与输入大小无关），-text 时输出 "ake:" 文本格式；
+decrypt/rewrap/inspect 自动识别二进制、文本、流式和旧的 4 段格式；rewrap 流式密文时只替换头部。
+旧的 4 段格式没有 keyId，decrypt/rewrap 时使用 -key 指定的主密钥。Ctrl-C 后读取输入立即停止。
+
+密钥提供方和主密钥的配置见 config.go：命令行参数 > 环境变量 > 配置文件。
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"ali-kms/kms"
+)
+
+// binaryMagic 二进制信封格式的开头，见 kms/envelope.go
+const binaryMagic = "AKEV"
+
+// contextFlag -context k=v,k2=v2，可以重复指定
+type contextFlag kms.EncryptionContext
+
+func (f contextFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f contextFlag) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("invalid context %q, want key=value", pair)
+		}
+		f[k] = v
+	}
+	return nil
+}
+
+// command 子命令
+type command struct {
+	summary string
+	run     func(c *cli, ctx context.Context) error
+}
+
+var commands = map[string]command{
+	"encrypt":     {"信封加密", (*cli).encrypt},
+	"decrypt":     {"信封解密", (*cli).decrypt},
+	"rewrap":      {"用目标主密钥（默认原主密钥的当前版本）重新加密数据密钥", (*cli).rewrap},
+	"inspect":     {"查看信封头部，不解密", (*cli).inspect},
+	"gen-datakey": {"生成数据密钥，输出明文和密文（JSON）", (*cli).genDataKey},
+}
+
+// cli 一次命令执行的参数
+type cli struct {
+	config   *Config
+	provider kms.KeyProvider
+	ec       kms.EncryptionContext
+	text     bool
+	bytes    int
+	in, out  string
+
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	// interrupt Ctrl-C 时取消，读取输入时检查；不受 -timeout 限制，大文件的复制可以超过 KMS 请求的超时时间
+	interrupt context.Context
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr, os.Getenv); err != nil {
+		fmt.Fprintln(os.Stderr, "kmsctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: kmsctl <command> [flags]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w, "run 'kmsctl <command> -h' for flags")
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer, getenv func(string) string) error {
+	if len(args) == 0 {
+		usage(stderr)
+		return errors.New("missing command")
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	c := &cli{ec: kms.EncryptionContext{}, stdin: stdin, stdout: stdout, stderr: stderr, interrupt: ctx}
+	fs := flag.NewFlagSet("kmsctl "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var cf configFlags
+	cf.register(fs)
+	fs.Var(contextFlag(c.ec), "context", "加密上下文 k=v,k2=v2，解密时必须与加密时相同")
+	fs.StringVar(&c.in, "in", "-", "输入文件，- 为标准输入")
+	fs.StringVar(&c.out, "out", "-", "输出文件，- 为标准输出")
+	fs.BoolVar(&c.text, "text", false, "encrypt: 输出文本格式（整体读入内存）")
+	fs.IntVar(&c.bytes, "bytes", kms.DataKeyLength, "gen-datakey: 数据密钥长度")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	var err error
+	if c.config, err = cf.load(getenv); err != nil {
+		return err
+	}
+	// inspect 不访问 KMS
+	if args[0] != "inspect" {
+		if c.provider, err = newProvider(c.config); err != nil {
+			return err
+		}
+	}
+	if cf.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cf.timeout)
+		defer cancel()
+	}
+	return cmd.run(c, ctx)
+}
+
+// keyID -key、KMS_KEY_ID 或配置文件中的主密钥
+func (c *cli) keyID() (string, error) {
+	if c.config.KeyID == "" {
+		return "", errors.New("missing -key")
+	}
+	return c.config.KeyID, nil
+}
+
+// ctxReader 每次读取前检查 ctx，Ctrl-C 后大文件的复制立即停止
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// input 打开输入，Ctrl-C 后读取返回 context.Canceled，调用方负责关闭
+func (c *cli) input() (io.ReadCloser, error) {
+	if c.in == "-" {
+		return io.NopCloser(ctxReader{c.interrupt, c.stdin}), nil
+	}
+	f, err := os.Open(c.in)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{ctxReader{c.interrupt, f}, f}, nil
+}
+
+// withDefaultKeyID 旧的 4 段格式没有 keyId，使用 -key 指定的主密钥
+func (c *cli) withDefaultKeyID(obj *kms.EnvelopeCipherObj) {
+	if obj.KeyID == "" {
+		obj.KeyID = c.config.KeyID
+	}
+}
+
+// output -out 为文件时写入同目录下的临时文件，commit 时改名
+type output struct {
+	io.Writer
+	file *os.File
+	path string
+}
+
+func (c *cli) output() (*output, error) {
+	if c.out == "-" {
+		return &output{Writer: c.stdout}, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.out), ".kmsctl-*")
+	if err != nil {
+		return nil, err
+	}
+	return &output{Writer: f, file: f, path: c.out}, nil
+}
+
+func (o *output) commit() error {
+	if o.file == nil {
+		return nil
+	}
+	if err := o.file.Sync(); err != nil {
+		o.abort()
+		return err
+	}
+	if err := o.file.Close(); err != nil {
+		os.Remove(o.file.Name())
+		return err
+	}
+	return os.Rename(o.file.Name(), o.path)
+}
+
+// abort 删除临时文件，commit 之后调用无效
+func (o *output) abort() {
+	if o.file == nil {
+		return
+	}
+	if o.file.Close() == nil {
+		os.Remove(o.file.Name())
+	}
+}
+
+// writeOutput 写入并提交输出
+func (c *cli) writeOutput(write func(w io.Writer) error) error {
+	out, err := c.output()
+	if err != nil {
+		return err
+	}
+	if err := write(out); err != nil {
+		out.abort()
+		return err
+	}
+	return out.commit()
+}
+
+// isStream 输入是否为流式二进制格式，只查看不消耗输入
+func isStream(br *bufio.Reader) bool {
+	head, _ := br.Peek(len(binaryMagic) + 2)
+	return len(head) == len(binaryMagic)+2 && string(head[:len(binaryMagic)]) == binaryMagic &&
+		kms.Algorithm(head[len(binaryMagic)+1]) == kms.AlgAESGCMStream
+}
+
+// readEnvelope 读取完整的二进制或文本格式信封，text 表示输入是否为文本格式
+func readEnvelope(r io.Reader) (obj *kms.EnvelopeCipherObj, text bool, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	obj = &kms.EnvelopeCipherObj{}
+	if bytes.HasPrefix(data, []byte(binaryMagic)) {
+		return obj, false, obj.UnmarshalBinary(data)
+	}
+	return obj, true, obj.Decode(strings.TrimSpace(string(data)))
+}
+
+func (c *cli) encrypt(ctx context.Context) error {
+	keyID, err := c.keyID()
+	if err != nil {
+		return err
+	}
+	in, err := c.input()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if c.text {
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		obj, err := kms.EnvelopeEncrypt(ctx, c.provider, keyID, data, c.ec)
+		if err != nil {
+			return err
+		}
+		encoded, err := obj.EncodeToString()
+		if err != nil {
+			return err
+		}
+		return c.writeOutput(func(w io.Writer) error {
+			_, err := fmt.Fprintln(w, encoded)
+			return err
+		})
+	}
+	return c.writeOutput(func(w io.Writer) error {
+		ew, err := kms.NewEncryptWriter(ctx, c.provider, keyID, w, c.ec)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ew, in); err != nil {
+			return err
+		}
+		return ew.Close()
+	})
+}
+
+func (c *cli) decrypt(ctx context.Context) error {
+	in, err := c.input()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+
+	if isStream(br) {
+		r, _, err := kms.NewDecryptReader(ctx, c.provider, br, c.ec)
+		if err != nil {
+			return err
+		}
+		return c.writeOutput(func(w io.Writer) error {
+			_, err := io.Copy(w, r)
+			return err
+		})
+	}
+	obj, _, err := readEnvelope(br)
+	if err != nil {
+		return err
+	}
+	c.withDefaultKeyID(obj)
+	plaintext, err := kms.EnvelopeDecrypt(ctx, c.provider, obj, c.ec)
+	if err != nil {
+		return err
+	}
+	return c.writeOutput(func(w io.Writer) error {
+		_, err := w.Write(plaintext)
+		return err
+	})
+}
+
+func (c *cli) rewrap(ctx context.Context) error {
+	in, err := c.input()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	if isStream(br) {
+		return c.writeOutput(func(w io.Writer) error {
+			_, err := kms.RewrapStream(ctx, c.provider, br, w, c.config.KeyID, c.ec)
+			return err
+		})
+	}
+	obj, text, err := readEnvelope(br)
+	if err != nil {
+		return err
+	}
+	c.withDefaultKeyID(obj)
+	rewrapped, err := kms.Rewrap(ctx, c.provider, obj, c.config.KeyID, c.ec)
+	if err != nil {
+		return err
+	}
+	return c.writeOutput(func(w io.Writer) error {
+		if text {
+			encoded, err := rewrapped.EncodeToString()
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(w, encoded)
+			return err
+		}
+		data, err := rewrapped.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+}
+
+func (c *cli) inspect(ctx context.Context) error {
+	in, err := c.input()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+
+	var (
+		obj            *kms.EnvelopeCipherObj
+		format         string
+		cipherTextSize int64
+	)
+	if head, _ := br.Peek(len(binaryMagic)); string(head) == binaryMagic {
+		// 只解析头部，密文只统计长度
+		if obj, err = kms.ReadHeader(br); err != nil {
+			return err
+		}
+		if cipherTextSize, err = io.Copy(io.Discard, br); err != nil {
+			return err
+		}
+		format = "binary"
+	} else {
+		var text bool
+		if obj, text, err = readEnvelope(br); err != nil {
+			return err
+		}
+		cipherTextSize = int64(len(obj.CipherText))
+		format = "text"
+		if text && obj.Version == 0 {
+			format = "legacy"
+		}
+	}
+
+	w := c.stdout
+	fmt.Fprintf(w, "format:             %s\n", format)
+	fmt.Fprintf(w, "version:            %d\n", obj.Version)
+	fmt.Fprintf(w, "algorithm:          %s\n", obj.Algorithm)
+	fmt.Fprintf(w, "key id:             %s\n", obj.KeyID)
+	fmt.Fprintf(w, "key version id:     %s\n", obj.KeyVersionID)
+	fmt.Fprintf(w, "encrypted data key: %d bytes\n", len(obj.EncryptedDataKey))
+	fmt.Fprintf(w, "ciphertext:         %d bytes\n", cipherTextSize)
+	if len(obj.AADDigest) == 0 {
+		fmt.Fprintf(w, "context digest:     none\n")
+	} else {
+		fmt.Fprintf(w, "context digest:     %s\n", hex.EncodeToString(obj.AADDigest))
+	}
+	// 指定 -context 时检查是否与密文绑定的上下文一致
+	if len(c.ec) > 0 {
+		match := bytes.Equal(c.ec.Digest(), obj.AADDigest)
+		fmt.Fprintf(w, "context match:      %v\n", match)
+	}
+	return nil
+}
+
+// dataKeyOutput gen-datakey 的输出，字段名与 SDK 的 GenerateDataKey 响应相同，[]byte 为 base64
+type dataKeyOutput struct {
+	KeyId          string
+	KeyVersionId   string `json:",omitempty"`
+	Plaintext      []byte
+	CiphertextBlob []byte
+	Iv             []byte
+}
+
+func (c *cli) genDataKey(ctx context.Context) error {
+	keyID, err := c.keyID()
+	if err != nil {
+		return err
+	}
+	dk, err := c.provider.GenerateDataKey(ctx, keyID, c.bytes, c.ec.Canonical())
+	if err != nil {
+		return err
+	}
+	return c.writeOutput(func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dataKeyOutput{
+			KeyId:          dk.KeyID,
+			KeyVersionId:   dk.KeyVersionID,
+			Plaintext:      dk.Plaintext,
+			CiphertextBlob: dk.CiphertextBlob,
+			Iv:             dk.Iv,
+		})
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ali-kms/kms"
+)
+
+// newTestEnv 本地密钥环配置的环境变量
+func newTestEnv(t *testing.T) (dir string, keyring *kms.KeyringProvider, getenv func(string) string) {
+	t.Helper()
+	dir = t.TempDir()
+	keyring = kms.NewKeyringProvider()
+	if err := keyring.CreateKey("orders", kms.KeySpecAES256); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keyring.json")
+	if err := keyring.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"KMS_KEYRING_FILE": path, "KMS_KEY_ID": "orders"}
+	return dir, keyring, func(name string) string { return env[name] }
+}
+
+func runCmd(t *testing.T, getenv func(string) string, stdin []byte, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), args, bytes.NewReader(stdin), &stdout, &stderr, getenv)
+	return stdout.String(), err
+}
+
+// TestEncryptDecrypt 流式和文本格式的往返，上下文不一致时失败且不留下输出文件
+func TestEncryptDecrypt(t *testing.T) {
+	dir, _, getenv := newTestEnv(t)
+	plaintext := bytes.Repeat([]byte("kmsctl "), 20000)
+	if err := os.WriteFile(filepath.Join(dir, "plain"), plaintext, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range [][]string{nil, {"-text"}} {
+		enc := filepath.Join(dir, "enc")
+		args := append([]string{"encrypt", "-context", "tenant=t1", "-in", filepath.Join(dir, "plain"), "-out", enc}, format...)
+		if _, err := runCmd(t, getenv, nil, args...); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		out, err := runCmd(t, getenv, nil, "decrypt", "-context", "tenant=t1", "-in", enc)
+		if err != nil || out != string(plaintext) {
+			t.Errorf("%v: 解密结果不一致 %v", format, err)
+		}
+
+		dec := filepath.Join(dir, "dec")
+		if _, err := runCmd(t, getenv, nil, "decrypt", "-context", "tenant=t2", "-in", enc, "-out", dec); !errors.Is(err, kms.ErrContextMismatch) {
+			t.Errorf("%v: 期望 ErrContextMismatch，得到 %v", format, err)
+		}
+		if _, err := os.Stat(dec); !os.IsNotExist(err) {
+			t.Errorf("%v: 失败时不应留下输出文件", format)
+		}
+	}
+}
+
+// TestInspectAndRewrap inspect 不访问 KMS，rewrap 后切换到主版本，流式密文同样可以 rewrap
+func TestInspectAndRewrap(t *testing.T) {
+	dir, keyring, getenv := newTestEnv(t)
+	encoded, err := runCmd(t, getenv, []byte("secret"), "encrypt", "-text", "-context", "id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := runCmd(t, getenv, []byte("data"), "encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Rotate("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Save(filepath.Join(dir, "keyring.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := runCmd(t, getenv, []byte(encoded), "rewrap", "-context", "id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := runCmd(t, func(string) string { return "" }, []byte(rewrapped), "inspect", "-context", "id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"format:             text", "key id:             orders", "key version id:     v2", "context match:      true"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("inspect 输出缺少 %q:\n%s", want, info)
+		}
+	}
+	if out, err := runCmd(t, getenv, []byte(rewrapped), "decrypt", "-context", "id=1"); err != nil || out != "secret" {
+		t.Errorf("rewrap 后解密得到 %q %v", out, err)
+	}
+
+	streamRewrapped, err := runCmd(t, getenv, []byte(stream), "rewrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = runCmd(t, func(string) string { return "" }, []byte(streamRewrapped), "inspect")
+	if err != nil || !strings.Contains(info, "key version id:     v2") {
+		t.Errorf("流式密文 rewrap 后期望 v2，得到 %v:\n%s", err, info)
+	}
+	if out, err := runCmd(t, getenv, []byte(streamRewrapped), "decrypt"); err != nil || out != "data" {
+		t.Errorf("流式密文 rewrap 后解密得到 %q %v", out, err)
+	}
+}
+
+// TestLegacyEnvelope 旧的 4 段格式没有 keyId，decrypt/rewrap 使用 -key 指定的主密钥
+func TestLegacyEnvelope(t *testing.T) {
+	_, _, getenv := newTestEnv(t)
+	encoded, err := runCmd(t, getenv, []byte("legacy"), "encrypt", "-text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &kms.EnvelopeCipherObj{}
+	if err := obj.Decode(strings.TrimSpace(encoded)); err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	for _, b := range [][]byte{obj.DataKeyIV, obj.EncryptedDataKey, obj.Iv, obj.CipherText} {
+		parts = append(parts, base64.RawStdEncoding.EncodeToString(b))
+	}
+	legacy := []byte(strings.Join(parts, "."))
+
+	if out, err := runCmd(t, getenv, legacy, "decrypt"); err != nil || out != "legacy" {
+		t.Errorf("旧格式解密得到 %q %v", out, err)
+	}
+	rewrapped, err := runCmd(t, getenv, legacy, "rewrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runCmd(t, getenv, []byte(rewrapped), "decrypt"); err != nil || out != "legacy" {
+		t.Errorf("旧格式 rewrap 后解密得到 %q %v", out, err)
+	}
+	noKey := func(name string) string {
+		if name == "KMS_KEY_ID" {
+			return ""
+		}
+		return getenv(name)
+	}
+	if _, err := runCmd(t, noKey, legacy, "decrypt"); err == nil {
+		t.Error("旧格式未指定 -key 时期望失败")
+	}
+}
+
+// endlessReader 无限输出数据，读取 n 次后取消 ctx
+type endlessReader struct {
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	if r.n--; r.n == 0 {
+		r.cancel()
+	}
+	return len(p), nil
+}
+
+// TestInterrupt Ctrl-C 后复制立即停止，不会等到输入读完
+func TestInterrupt(t *testing.T) {
+	_, _, getenv := newTestEnv(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	err := run(ctx, []string{"encrypt"}, &endlessReader{n: 10, cancel: cancel}, &stdout, &stderr, getenv)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("期望 context.Canceled，得到 %v", err)
+	}
+}
+
+// TestConfigPrecedence 命令行参数 > 环境变量 > 配置文件
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"endpoint": "file", "key_id": "file", "password": "file"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"KMSCTL_CONFIG": path, "KMS_KEY_ID": "env", "KMS_ENDPOINT": "env"}
+	cf := configFlags{endpoint: "flag"}
+	c, err := cf.load(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Endpoint != "flag" || c.KeyID != "env" || c.Password != "file" {
+		t.Errorf("优先级不正确 %+v", c)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+/*
+命令行管理工具，直接操作配置的数据库（DB_DSN），不需要启动 HTTP 服务：
+
+	gin-demo admin migrate                                           迁移表结构
+	gin-demo admin seed [-tenant t] [-file users.json]               写入初始用户（默认使用内置 fixtures/users.json）
+	gin-demo admin users list [-tenant t]                            列出用户
+	gin-demo admin users create -name Tom [-password p]              创建用户
+	gin-demo admin users passwd -name Tom [-password p]              重置密码，不指定时随机生成并输出
+	gin-demo admin export [-format json|csv] [-o file]               导出用户
+	gin-demo admin import [-format json|csv] -file users.csv         导入用户（带 id 且已存在时更新名称）
+	gin-demo admin token -name svc-billing [-ttl 24h] [-scopes a,b]  为服务账号签发 JWT（与服务端使用同一签名配置）
+	                                                                 第一行输出 token，第二行输出 expires_at
+	                                                                 -tenant 需在 TENANTS 中（与服务端一致）
+
+所有用户相关命令都按 -tenant 隔离，默认 defaultTenant。执行任何命令前都会先迁移表结构，新数据库可以直接使用。
+*/
+
+//go:embed fixtures/users.json
+var fixtureFS embed.FS
+
+// initialUsers 内存存储的初始用户，/users/reset 也会恢复到这份数据
+var initialUsers = mustLoadFixtureUsers()
+
+func mustLoadFixtureUsers() []User {
+	data, err := fixtureFS.ReadFile("fixtures/users.json")
+	if err != nil {
+		panic(err)
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		panic("invalid fixtures/users.json: " + err.Error())
+	}
+	return users
+}
+
+// openDB 连接 DB_DSN 指定的数据库
+// _busy_timeout 让后台 worker 与请求并发写入时等待锁，而不是直接返回 database is locked
+func openDB() (*gorm.DB, error) {
+	return gorm.Open(sqlite.Open(getenv("DB_DSN", "test.db?_busy_timeout=5000")), &gorm.Config{})
+}
+
+// migrate 迁移全部表结构，服务启动和 admin migrate 共用
+func migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&GormUser{}, &Job{}, &APIKey{}, &ShortLink{}, &Session{}, &PolicyRule{})
+}
+
+// hashPassword 使用 bcrypt 生成密码哈希
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword 校验密码，没有设置密码的用户一律校验失败
+func checkPassword(hash, password string) bool {
+	return hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// randomPassword 生成随机密码
+func randomPassword() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// runAdmin 执行 admin 子命令，输出写到 out；与服务启动一样先迁移表结构
+func runAdmin(db *gorm.DB, args []string, out io.Writer) error {
+	if err := RegisterTenantScope(db); err != nil {
+		return err
+	}
+	fields, err := LoadFieldEncryptor()
+	if err != nil {
+		return err
+	}
+	if err := RegisterFieldEncryption(db, fields); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("usage: gin-demo admin <migrate|seed|users|import|export|token> [flags]")
+	}
+	if err := migrate(db); err != nil {
+		return err
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "migrate":
+		fmt.Fprintln(out, "migrated")
+		return nil
+	case "seed":
+		return adminSeed(db, args, out)
+	case "users":
+		return adminUsers(db, args, out)
+	case "import":
+		return adminImport(db, args, out)
+	case "export":
+		return adminExport(db, args, out)
+	case "token":
+		return adminToken(db, args, out)
+	}
+	return fmt.Errorf("unknown admin command %q", cmd)
+}
+
+// newAdminFlags 创建子命令的 flag 集合，所有子命令都支持 -tenant
+func newAdminFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("admin "+name, flag.ContinueOnError)
+	tenant := fs.String("tenant", defaultTenant, "租户 ID")
+	return fs, tenant
+}
+
+// tenantDB 返回限定在指定租户内的 db
+func tenantDB(db *gorm.DB, tenant string) (*gorm.DB, error) {
+	if !tenantPattern.MatchString(tenant) {
+		return nil, fmt.Errorf("invalid tenant %q", tenant)
+	}
+	return db.WithContext(WithTenant(context.Background(), tenant)), nil
+}
+
+func adminSeed(db *gorm.DB, args []string, out io.Writer) error {
+	fs, tenant := newAdminFlags("seed")
+	file := fs.String("file", "", "JSON 格式的用户列表，默认使用内置 fixtures/users.json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	users := initialUsers
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		users = nil
+		if err := json.Unmarshal(data, &users); err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+	}
+	rows := make([]GormUser, 0, len(users))
+	for _, u := range users {
+		rows = append(rows, GormUser{Name: u.Name})
+	}
+	n, err := importUsers(db, *tenant, rows, true)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "seeded %d users into tenant %s\n", n, *tenant)
+	return nil
+}
+
+func adminUsers(db *gorm.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: gin-demo admin users <list|create|passwd> [flags]")
+	}
+	sub, args := args[0], args[1:]
+	fs, tenant := newAdminFlags("users " + sub)
+	name := fs.String("name", "", "用户名")
+	password := fs.String("password", "", "密码，passwd 时不指定则随机生成")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	orm, err := tenantDB(db, *tenant)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		var users []GormUser
+		if err := orm.Order("id").Find(&users).Error; err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPASSWORD")
+		for _, u := range users {
+			fmt.Fprintf(w, "%d\t%s\t%v\n", u.ID, u.Name, u.PasswordHash != "")
+		}
+		return w.Flush()
+	case "create":
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+		user := GormUser{Name: *name}
+		if *password != "" {
+			if user.PasswordHash, err = hashPassword(*password); err != nil {
+				return err
+			}
+		}
+		if err := orm.Create(&user).Error; err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created user %d %s\n", user.ID, user.Name)
+		return nil
+	case "passwd":
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+		var user GormUser
+		if err := orm.Where("name = ?", *name).First(&user).Error; err != nil {
+			return fmt.Errorf("user %q: %w", *name, err)
+		}
+		generated := *password == ""
+		if generated {
+			if *password, err = randomPassword(); err != nil {
+				return err
+			}
+		}
+		hash, err := hashPassword(*password)
+		if err != nil {
+			return err
+		}
+		if err := orm.Model(&user).Update("password_hash", hash).Error; err != nil {
+			return err
+		}
+		if generated {
+			fmt.Fprintf(out, "password for %s: %s\n", user.Name, *password)
+		} else {
+			fmt.Fprintf(out, "password updated for %s\n", user.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown users command %q", sub)
+}
+
+// userRecordHeader CSV 导入导出的表头
+var userRecordHeader = []string{"id", "name"}
+
+func adminExport(db *gorm.DB, args []string, out io.Writer) error {
+	fs, tenant := newAdminFlags("export")
+	format := fs.String("format", "json", "json 或 csv")
+	output := fs.String("o", "", "输出文件，默认标准输出")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	orm, err := tenantDB(db, *tenant)
+	if err != nil {
+		return err
+	}
+	var users []GormUser
+	if err := orm.Order("id").Find(&users).Error; err != nil {
+		return err
+	}
+
+	w := out
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(userRecordHeader)
+		for _, u := range users {
+			cw.Write([]string{strconv.FormatUint(uint64(u.ID), 10), u.Name})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func adminImport(db *gorm.DB, args []string, out io.Writer) error {
+	fs, tenant := newAdminFlags("import")
+	format := fs.String("format", "", "json 或 csv，默认按文件扩展名判断")
+	file := fs.String("file", "", "导入文件")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	if *format == "" {
+		*format = "json"
+		if strings.HasSuffix(strings.ToLower(*file), ".csv") {
+			*format = "csv"
+		}
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rows []GormUser
+	switch *format {
+	case "json":
+		if err := json.NewDecoder(f).Decode(&rows); err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+	case "csv":
+		if rows, err = readUserCSV(f); err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	n, err := importUsers(db, *tenant, rows, false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "imported %d users into tenant %s\n", n, *tenant)
+	return nil
+}
+
+// readUserCSV 解析带表头的 CSV，列顺序不限，id 列可选
+func readUserCSV(r io.Reader) ([]GormUser, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	cols := map[string]int{}
+	for i, name := range records[0] {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	nameCol, ok := cols["name"]
+	if !ok {
+		return nil, errors.New("missing name column")
+	}
+	idCol, hasID := cols["id"]
+	rows := make([]GormUser, 0, len(records)-1)
+	for line, rec := range records[1:] {
+		row := GormUser{Name: rec[nameCol]}
+		if hasID && rec[idCol] != "" {
+			id, err := strconv.ParseUint(rec[idCol], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid id %q", line+2, rec[idCol])
+			}
+			row.ID = uint(id)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// importUsers 在一个事务内写入用户，返回新增或更新的条数
+// 带 id 且当前租户下已存在时更新名称，否则新建；skipExisting 为 true 时同名用户直接跳过（用于 seed 可重复执行）
+func importUsers(db *gorm.DB, tenant string, rows []GormUser, skipExisting bool) (int, error) {
+	orm, err := tenantDB(db, tenant)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = orm.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			if row.Name == "" {
+				return errors.New("user name is required")
+			}
+			if skipExisting {
+				var count int64
+				if err := tx.Model(&GormUser{}).Where("name = ?", row.Name).Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					continue
+				}
+			}
+			if row.ID != 0 {
+				var existing GormUser
+				res := tx.Limit(1).Find(&existing, row.ID)
+				if res.Error != nil {
+					return res.Error
+				}
+				if res.RowsAffected == 1 {
+					if err := tx.Model(&existing).Update("name", row.Name).Error; err != nil {
+						return err
+					}
+					n++
+					continue
+				}
+			}
+			user := GormUser{ID: row.ID, Name: row.Name}
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("user %d %s: %w", row.ID, row.Name, err)
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func adminToken(db *gorm.DB, args []string, out io.Writer) error {
+	fs, tenant := newAdminFlags("token")
+	name := fs.String("name", "", "服务账号名称，写入 name claim")
+	id := fs.Int("id", 0, "写入 id claim 的用户 ID")
+	ttl := fs.Duration("ttl", 0, "有效期，默认与服务端 JWT_TIMEOUT 一致")
+	scopes := fs.String("scopes", "", "逗号分隔的权限范围，如 users:read,users:write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	if !tenantPattern.MatchString(*tenant) {
+		return fmt.Errorf("invalid tenant %q", *tenant)
+	}
+	// 与 TenantMiddleware 一致，只给 TENANTS 中的租户签发 token
+	tenants, err := LoadTenantSet()
+	if err != nil {
+		return err
+	}
+	if !tenants.Has(*tenant) {
+		return fmt.Errorf("unknown tenant %q", *tenant)
+	}
+	mw, err := newAuthMiddleware(db)
+	if err != nil {
+		return err
+	}
+	if *ttl > 0 {
+		mw.Timeout = *ttl
+	}
+	token, expire, err := mw.TokenGenerator(&Principal{
+		ID:     *id,
+		Name:   *name,
+		Tenant: *tenant,
+		Kind:   PrincipalService,
+		Scopes: splitScopes(*scopes),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, token)
+	fmt.Fprintf(out, "expires_at: %s\n", expire.Format(time.RFC3339))
+	return nil
+}
+
+// splitScopes 解析逗号分隔的 scope 列表
+func splitScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// TestAdminImportExport CSV 导入后再导出，并且只影响指定租户
+func TestAdminImportExport(t *testing.T) {
+	app, _ := newTestApp(t)
+	dir := t.TempDir()
+
+	in := filepath.Join(dir, "users.csv")
+	os.WriteFile(in, []byte("name,id\nTom,\nJerry,\n"), 0o644)
+	var out bytes.Buffer
+	if err := runAdmin(app.DB, []string{"import", "-tenant", "acme", "-file", in}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := runAdmin(app.DB, []string{"export", "-tenant", "acme", "-format", "csv"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "id,name\n") || !strings.Contains(out.String(), ",Tom\n") || !strings.Contains(out.String(), ",Jerry\n") {
+		t.Errorf("导出内容不符合预期: %q", out.String())
+	}
+
+	// 带 id 重新导入时更新名称而不是新建
+	out.Reset()
+	runAdmin(app.DB, []string{"export", "-tenant", "acme"}, &out)
+	var exported []GormUser
+	if err := json.Unmarshal(out.Bytes(), &exported); err != nil || len(exported) != 2 {
+		t.Fatalf("JSON 导出期望 2 条，得到 %s", out.String())
+	}
+	exported[0].Name = "Thomas"
+	data, _ := json.Marshal(exported)
+	os.WriteFile(filepath.Join(dir, "users.json"), data, 0o644)
+	if err := runAdmin(app.DB, []string{"import", "-tenant", "acme", "-file", filepath.Join(dir, "users.json")}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	acme, _ := tenantDB(app.DB, "acme")
+	acme.Model(&GormUser{}).Count(&count)
+	if count != 2 {
+		t.Errorf("按 id 导入期望仍为 2 条，得到 %d", count)
+	}
+
+	// seed 可以重复执行
+	for i := 0; i < 2; i++ {
+		if err := runAdmin(app.DB, []string{"seed", "-tenant", "globex"}, &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	globex, _ := tenantDB(app.DB, "globex")
+	globex.Model(&GormUser{}).Count(&count)
+	if count != int64(len(initialUsers)) {
+		t.Errorf("重复 seed 期望 %d 条，得到 %d", len(initialUsers), count)
+	}
+}
+
+// TestAdminPasswordAndToken 设置密码后可以登录，admin token 签发的 JWT 能被服务端验证
+func TestAdminPasswordAndToken(t *testing.T) {
+	app, h := newTestApp(t)
+	var out bytes.Buffer
+	if err := runAdmin(app.DB, []string{"users", "create", "-tenant", "acme", "-name", "tom"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runAdmin(app.DB, []string{"users", "passwd", "-tenant", "acme", "-name", "tom"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	password := strings.TrimSpace(out.String()[strings.LastIndex(out.String(), ":")+1:])
+
+	login := func(tenant, password string) int {
+		req := httptest.NewRequest("POST", "/login-jwt", strings.NewReader("username=tom&password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := login("acme", password); code != 200 {
+		t.Errorf("使用新密码登录期望 200，得到 %d", code)
+	}
+	if code := login("acme", "wrong"); code != 401 {
+		t.Errorf("错误密码期望 401，得到 %d", code)
+	}
+	if code := login("globex", password); code != 401 {
+		t.Errorf("其他租户的同名用户不存在，期望 401，得到 %d", code)
+	}
+
+	out.Reset()
+	if err := runAdmin(app.DB, []string{"token", "-tenant", "acme", "-name", "svc-billing", "-ttl", "5m", "-scopes", "users:read"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := runAdmin(app.DB, []string{"token", "-tenant", "initech", "-name", "svc-billing"}, &out); err == nil || !strings.Contains(err.Error(), "unknown tenant") {
+		t.Errorf("未知租户期望报错 unknown tenant，得到 %v", err)
+	}
+	var profile struct {
+		User Principal `json:"user"`
+	}
+	token, expires, _ := strings.Cut(strings.TrimSpace(out.String()), "\n")
+	if !strings.HasPrefix(expires, "expires_at: ") {
+		t.Errorf("第二行期望输出过期时间，得到 %q", expires)
+	}
+	if code := doJSON(t, h, "GET", "/auth/profile", "", &profile, "Authorization", "Bearer "+token); code != 200 {
+		t.Fatalf("服务账号 token 期望 200，得到 %d", code)
+	}
+	if profile.User.Name != "svc-billing" || profile.User.Tenant != "acme" || profile.User.Kind != PrincipalService || !profile.User.HasScope("users:read") {
+		t.Errorf("token 身份不符合预期: %+v", profile.User)
+	}
+}
+
+// TestLoginSkipsPasswordlessDuplicate 同名的无密码记录（例如通过 /gorm/users 创建）不影响设置了密码的账号登录
+func TestLoginSkipsPasswordlessDuplicate(t *testing.T) {
+	app, h := newTestApp(t)
+	acme, _ := tenantDB(app.DB, "acme")
+	acme.Create(&GormUser{Name: "tom"})
+	var out bytes.Buffer
+	if err := runAdmin(app.DB, []string{"users", "create", "-tenant", "acme", "-name", "tom", "-password", "s3cret-pass"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var user GormUser
+	acme.Where("name = ? AND password_hash <> ''", "tom").First(&user)
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if code := doJSON(t, h, "POST", "/login-jwt", `{"username":"tom","password":"s3cret-pass"}`, &resp, "X-Tenant", "acme"); code != 200 {
+		t.Fatalf("设置了密码的账号期望 200，得到 %d", code)
+	}
+	var profile struct {
+		User Principal `json:"user"`
+	}
+	doJSON(t, h, "GET", "/auth/profile", "", &profile, "Authorization", "Bearer "+resp.Token)
+	if profile.User.ID != int(user.ID) || profile.User.Kind != PrincipalUser {
+		t.Errorf("期望以用户 %d 登录，得到 %+v", user.ID, profile.User)
+	}
+}
+
+// TestAdminFreshDatabase 新数据库不需要先执行 migrate
+func TestAdminFreshDatabase(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runAdmin(db, []string{"users", "create", "-name", "tom"}, &out); err != nil {
+		t.Fatalf("新数据库创建用户失败: %v", err)
+	}
+	out.Reset()
+	if err := runAdmin(db, []string{"users", "list"}, &out); err != nil || !strings.Contains(out.String(), "tom") {
+		t.Errorf("期望列出 tom，得到 %v %q", err, out.String())
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+服务间调用的 API Key
+
+明文格式为 gd.<tenant>.<prefix>.<secret>：
+- tenant 用于在租户隔离下查找记录，查询始终带 tenant_id 条件
+- prefix 为公开的随机标识，用于定位记录，也会出现在列表中方便辨认
+- secret 只在创建时返回一次，数据库中只保存 SHA-256 哈希（secret 本身是 32 字节随机数，不需要慢哈希）
+
+请求方式：X-API-Key: gd.xxx 或 Authorization: ApiKey gd.xxx
+*/
+
+const apiKeyScheme = "gd"
+
+var (
+	// ErrInvalidAPIKey API Key 格式错误、不存在或 secret 不匹配
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrAPIKeyExpired API Key 已过期或已吊销
+	ErrAPIKeyExpired = errors.New("api key expired or revoked")
+)
+
+// APIKey 持久化的 API Key，按租户隔离
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	TenantID   string     `gorm:"index;not null" json:"tenant_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `gorm:"uniqueIndex;not null" json:"prefix"`
+	SecretHash string     `gorm:"not null" json:"-"`
+	Scopes     []string   `gorm:"serializer:json" json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Active 是否未过期且未吊销
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// APIKeyStore API Key 的创建、查询、吊销与校验
+type APIKeyStore struct {
+	db *gorm.DB
+	// touchInterval 距上次使用超过该时长才更新 last_used_at，避免每个请求都写库
+	touchInterval time.Duration
+	now           func() time.Time
+}
+
+// NewAPIKeyStore 创建存储并迁移 api_keys 表
+func NewAPIKeyStore(db *gorm.DB) (*APIKeyStore, error) {
+	if err := db.AutoMigrate(&APIKey{}); err != nil {
+		return nil, err
+	}
+	return &APIKeyStore{db: db, touchInterval: time.Minute, now: time.Now}, nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create 在 ctx 所属租户下创建 API Key，返回记录和只展示一次的明文
+// ttl 为 0 表示不过期
+func (s *APIKeyStore) Create(ctx context.Context, name string, scopes []string, ttl time.Duration) (*APIKey, string, error) {
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		return nil, "", ErrMissingTenant
+	}
+	buf := make([]byte, 4+32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	prefix := hex.EncodeToString(buf[:4])
+	secret := base64.RawURLEncoding.EncodeToString(buf[4:])
+
+	key := &APIKey{
+		Name:       name,
+		Prefix:     prefix,
+		SecretHash: hashAPIKeySecret(secret),
+		Scopes:     scopes,
+	}
+	if ttl > 0 {
+		expires := s.now().Add(ttl)
+		key.ExpiresAt = &expires
+	}
+	if err := s.db.WithContext(ctx).Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, strings.Join([]string{apiKeyScheme, tenant, prefix, secret}, "."), nil
+}
+
+// List 列出 ctx 所属租户的全部 API Key
+func (s *APIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	err := s.db.WithContext(ctx).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// Revoke 吊销 API Key，已吊销的保持原吊销时间；不存在时返回 gorm.ErrRecordNotFound
+func (s *APIKeyStore) Revoke(ctx context.Context, id uint) (*APIKey, error) {
+	orm := s.db.WithContext(ctx)
+	var key APIKey
+	if err := orm.First(&key, id).Error; err != nil {
+		return nil, err
+	}
+	if key.RevokedAt == nil {
+		now := s.now()
+		if err := orm.Model(&key).Update("revoked_at", now).Error; err != nil {
+			return nil, err
+		}
+		key.RevokedAt = &now
+	}
+	return &key, nil
+}
+
+// Authenticate 校验明文 API Key 并返回对应身份
+func (s *APIKeyStore) Authenticate(ctx context.Context, plaintext string) (*Principal, error) {
+	parts := strings.Split(plaintext, ".")
+	if len(parts) != 4 || parts[0] != apiKeyScheme || !tenantPattern.MatchString(parts[1]) {
+		return nil, ErrInvalidAPIKey
+	}
+	tenant, prefix, secret := parts[1], parts[2], parts[3]
+
+	// 按 key 中的租户查询，仍然经过租户隔离回调
+	orm := s.db.WithContext(WithTenant(ctx, tenant))
+	var key APIKey
+	res := orm.Where("prefix = ?", prefix).Limit(1).Find(&key)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 || subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := s.now()
+	if !key.Active(now) {
+		return nil, ErrAPIKeyExpired
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= s.touchInterval {
+		// 只影响统计，失败不拒绝请求
+		orm.Model(&key).Update("last_used_at", now)
+	}
+	return &Principal{
+		ID:     int(key.ID),
+		Name:   key.Name,
+		Tenant: key.TenantID,
+		Kind:   PrincipalAPIKey,
+		Scopes: key.Scopes,
+	}, nil
+}
+
+// apiKeyFromRequest 读取 X-API-Key 或 Authorization: ApiKey xxx
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if scheme, key, ok := strings.Cut(c.GetHeader("Authorization"), " "); ok && strings.EqualFold(scheme, "ApiKey") {
+		return strings.TrimSpace(key)
+	}
+	return ""
+}
+
+// APIKeyMiddleware 请求携带 API Key 时校验并记录身份，无效的 key 直接返回 401；需放在 TenantMiddleware 之前
+func APIKeyMiddleware(store *APIKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		plaintext := apiKeyFromRequest(c)
+		if plaintext == "" {
+			c.Next()
+			return
+		}
+		p, err := store.Authenticate(c.Request.Context(), plaintext)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if !errors.Is(err, ErrInvalidAPIKey) && !errors.Is(err, ErrAPIKeyExpired) {
+				status = http.StatusInternalServerError
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		setPrincipal(c, p)
+		c.Next()
+	}
+}
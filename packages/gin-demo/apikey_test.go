@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAPIKeyLifecycle 创建、使用、吊销 API Key，身份与 JWT 一样通过 c.Get(identityKey) 读取
+func TestAPIKeyLifecycle(t *testing.T) {
+	app, h := newTestApp(t)
+	acme, globex := loginToken(t, h, "acme"), loginToken(t, h, "globex")
+
+	var created struct {
+		Key    string `json:"key"`
+		APIKey APIKey `json:"api_key"`
+	}
+	code := doJSON(t, h, "POST", "/admin/api-keys", `{"name":"billing","scopes":["users:read"]}`, &created, "Authorization", "Bearer "+acme)
+	if code != 201 || !strings.HasPrefix(created.Key, "gd.acme.") {
+		t.Fatalf("创建 API Key 期望 201，得到 %d %+v", code, created)
+	}
+
+	var profile struct {
+		User Principal `json:"user"`
+	}
+	if code := doJSON(t, h, "GET", "/auth/profile", "", &profile, "X-API-Key", created.Key); code != 200 {
+		t.Fatalf("使用 API Key 期望 200，得到 %d", code)
+	}
+	if p := profile.User; p.Kind != PrincipalAPIKey || p.Tenant != "acme" || p.Name != "billing" || !p.HasScope("users:read") || p.HasScope("users:write") {
+		t.Errorf("API Key 身份不符合预期: %+v", p)
+	}
+	if code := doJSON(t, h, "GET", "/auth/profile", "", nil, "Authorization", "ApiKey "+created.Key); code != 200 {
+		t.Errorf("Authorization: ApiKey 期望 200，得到 %d", code)
+	}
+
+	cases := []struct {
+		name       string
+		headers    []string
+		expectCode int
+	}{
+		{"secret 错误", []string{"X-API-Key", created.Key + "x"}, 401},
+		{"格式错误", []string{"X-API-Key", "not-a-key"}, 401},
+		{"其他租户下不存在", []string{"X-API-Key", strings.Replace(created.Key, ".acme.", ".globex.", 1)}, 401},
+		{"请求头与 key 的租户不一致", []string{"X-API-Key", created.Key, "X-Tenant", "globex"}, 403},
+	}
+	for _, c := range cases {
+		if code := doJSON(t, h, "GET", "/auth/profile", "", nil, c.headers...); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d", c.name, c.expectCode, code)
+		}
+	}
+
+	// 列表按租户隔离，不返回哈希，记录了最近使用时间
+	var list []map[string]interface{}
+	doJSON(t, h, "GET", "/admin/api-keys", "", &list, "Authorization", "Bearer "+acme)
+	if len(list) != 1 || list[0]["last_used_at"] == nil || list[0]["secret_hash"] != nil || list[0]["SecretHash"] != nil {
+		t.Errorf("列表不符合预期: %+v", list)
+	}
+	doJSON(t, h, "GET", "/admin/api-keys", "", &list, "Authorization", "Bearer "+globex)
+	if len(list) != 0 {
+		t.Errorf("其他租户不应看到 acme 的 API Key: %+v", list)
+	}
+
+	id := strconv.Itoa(int(created.APIKey.ID))
+	if code := doJSON(t, h, "DELETE", "/admin/api-keys/"+id, "", nil, "Authorization", "Bearer "+globex); code != 404 {
+		t.Errorf("跨租户吊销期望 404，得到 %d", code)
+	}
+	if code := doJSON(t, h, "DELETE", "/admin/api-keys/"+id, "", nil, "Authorization", "Bearer "+acme); code != 200 {
+		t.Fatalf("吊销期望 200，得到 %d", code)
+	}
+	if code := doJSON(t, h, "GET", "/ping", "", nil, "X-API-Key", created.Key); code != 401 {
+		t.Errorf("吊销后期望 401，得到 %d", code)
+	}
+
+	// 过期
+	ctx := WithTenant(context.Background(), "acme")
+	_, plaintext, err := app.APIKeys.Create(ctx, "short", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.APIKeys.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := app.APIKeys.Authenticate(context.Background(), plaintext); err != ErrAPIKeyExpired {
+		t.Errorf("过期后期望 ErrAPIKeyExpired，得到 %v", err)
+	}
+}
+
+// TestAPIKeyScopes 只读 API Key 不能写入，普通用户和没有 admin scope 的 key 不能访问管理接口
+func TestAPIKeyScopes(t *testing.T) {
+	app, h := newTestApp(t)
+	_, readOnly, err := app.APIKeys.Create(WithTenant(context.Background(), "acme"), "reader", []string{ScopeUsersRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writer, err := app.APIKeys.Create(WithTenant(context.Background(), "acme"), "writer", []string{ScopeUsersRead, ScopeUsersWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	req := httptest.NewRequest("POST", "/login-jwt", strings.NewReader("username=alice&password=123456"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &login)
+
+	cases := []struct {
+		name         string
+		method, path string
+		body         string
+		headers      []string
+		expectCode   int
+	}{
+		{"只读 key 读取", "GET", "/gorm/users", "", []string{"X-API-Key", readOnly}, 200},
+		{"只读 key 写入", "POST", "/gorm/users", `{"name":"Eve"}`, []string{"X-API-Key", readOnly}, 403},
+		{"只读 key 删除内存用户", "DELETE", "/api/v1/users/1", "", []string{"X-API-Key", readOnly}, 403},
+		{"读写 key 写入", "POST", "/gorm/users", `{"name":"Bob"}`, []string{"X-API-Key", writer}, 200},
+		{"key 没有 admin scope", "GET", "/admin/api-keys", "", []string{"X-API-Key", writer}, 403},
+		{"普通用户访问管理接口", "GET", "/admin/api-keys", "", []string{"Authorization", "Bearer " + login.Token}, 403},
+		{"普通用户写入", "POST", "/gorm/users", `{"name":"Carol"}`, []string{"Authorization", "Bearer " + login.Token}, 200},
+		{"旧的 X-Auth 请求头不再有效", "GET", "/admin/api-keys", "", []string{"X-Auth", "secret"}, 401},
+	}
+	for _, c := range cases {
+		if code := doJSON(t, h, c.method, c.path, c.body, nil, c.headers...); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d", c.name, c.expectCode, code)
+		}
+	}
+}
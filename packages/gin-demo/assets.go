@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+静态资源（编译进二进制）
+
+- static 目录通过 embed.FS 打包，运行时不依赖工作目录；设置 STATIC_DIR 后改为读取磁盘目录（开发时修改即生效）
+- 每个文件按内容计算哈希，/static/app.<hash>.js 形式的地址带 Cache-Control: immutable 长期缓存，
+  原始地址 /static/app.js 仍可访问，但每次需要用 ETag / Last-Modified 协商
+- index.html 作为模板渲染，{{asset "app.js"}} 输出带哈希的地址，内容变化后地址随之变化
+- 存在 app.js.br / app.js.gz 预压缩文件时按 Accept-Encoding 直接返回
+- SPA 回退：浏览器（Accept 含 text/html）访问未注册的页面路径时返回 index.html，/api/ 与 /static/ 下仍返回 JSON 404
+*/
+
+//go:embed static
+var staticFS embed.FS
+
+const (
+	immutableCache  = "public, max-age=31536000, immutable"
+	revalidateCache = "no-cache"
+)
+
+// precompressedExts 预压缩文件扩展名，按服务端优先级排列
+var precompressedExts = []struct{ encoding, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+// assetManifest 一次扫描的结果
+type assetManifest struct {
+	hashes  map[string]string // 逻辑路径 -> 内容哈希
+	hashed  map[string]string // 带哈希的路径 -> 逻辑路径
+	modTime map[string]time.Time
+	index   []byte // 渲染后的 index.html
+}
+
+// AssetServer 静态资源服务
+type AssetServer struct {
+	fsys    fs.FS
+	dev     bool // 磁盘目录模式：每次请求重新扫描，不使用长期缓存
+	started time.Time
+	cached  *assetManifest
+}
+
+// LoadAssetServer 默认使用编译进二进制的资源，设置 STATIC_DIR 时使用磁盘目录
+func LoadAssetServer() (*AssetServer, error) {
+	if dir := os.Getenv("STATIC_DIR"); dir != "" {
+		return NewAssetServer(os.DirFS(dir), true)
+	}
+	sub, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		return nil, err
+	}
+	return NewAssetServer(sub, false)
+}
+
+// NewAssetServer 扫描资源并渲染 index.html
+func NewAssetServer(fsys fs.FS, dev bool) (*AssetServer, error) {
+	s := &AssetServer{fsys: fsys, dev: dev, started: time.Now()}
+	m, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	if !dev {
+		s.cached = m
+	}
+	return s, nil
+}
+
+// hashedName app.js -> app.<hash>.js
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash[:12] + ext
+}
+
+func isPrecompressed(name string) bool {
+	for _, p := range precompressedExts {
+		if strings.HasSuffix(name, p.ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *AssetServer) scan() (*assetManifest, error) {
+	m := &assetManifest{hashes: map[string]string{}, hashed: map[string]string{}, modTime: map[string]time.Time{}}
+	err := fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(s.fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		m.hashes[name] = hex.EncodeToString(sum[:])
+		// index.html 引用其他资源，本身不做长期缓存
+		if !isPrecompressed(name) && name != "index.html" {
+			m.hashed[hashedName(name, m.hashes[name])] = name
+		}
+		// embed.FS 没有修改时间，使用服务启动时间
+		m.modTime[name] = s.started
+		if info, err := d.Info(); err == nil && !info.ModTime().IsZero() {
+			m.modTime[name] = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan static assets: %w", err)
+	}
+
+	if _, ok := m.hashes["index.html"]; ok {
+		raw, err := fs.ReadFile(s.fsys, "index.html")
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New("index.html").Funcs(template.FuncMap{"asset": m.url}).Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("parse index.html: %w", err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, nil); err != nil {
+			return nil, fmt.Errorf("render index.html: %w", err)
+		}
+		m.index = buf.Bytes()
+	}
+	return m, nil
+}
+
+// url 资源的带哈希地址，未知资源返回原始地址
+func (m *assetManifest) url(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if hash, ok := m.hashes[name]; ok {
+		return "/static/" + hashedName(name, hash)
+	}
+	return "/static/" + name
+}
+
+func (s *AssetServer) manifest() (*assetManifest, error) {
+	if s.cached != nil {
+		return s.cached, nil
+	}
+	return s.scan()
+}
+
+// URL 资源的带哈希地址，供模板和接口使用
+func (s *AssetServer) URL(name string) string {
+	m, err := s.manifest()
+	if err != nil {
+		return "/static/" + name
+	}
+	return m.url(name)
+}
+
+// Handler 处理 /static/*filepath
+func (s *AssetServer) Handler(c *gin.Context) {
+	m, err := s.manifest()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+c.Param("filepath")), "/")
+	cacheControl := revalidateCache
+	if logical, ok := m.hashed[name]; ok {
+		name = logical
+		if !s.dev {
+			cacheControl = immutableCache
+		}
+	}
+	hash, ok := m.hashes[name]
+	if !ok || name == "." {
+		c.JSON(404, gin.H{"error": "资源不存在"})
+		return
+	}
+	if name == "index.html" && m.index != nil {
+		serveIndex(c, m)
+		return
+	}
+	c.Header("Cache-Control", cacheControl)
+	addVary(c.Writer.Header(), "Accept-Encoding")
+
+	if c.GetHeader("Range") == "" {
+		for _, p := range precompressedExts {
+			if _, ok := m.hashes[name+p.ext]; ok && negotiateEncoding(c.GetHeader("Accept-Encoding"), []string{p.encoding}) != "" {
+				c.Header("Content-Encoding", p.encoding)
+				s.serveFile(c, m, name+p.ext, name, fmt.Sprintf(`"%s-%s"`, hash[:32], p.encoding))
+				return
+			}
+		}
+	}
+	s.serveFile(c, m, name, name, `"`+hash[:32]+`"`)
+}
+
+// serveFile 由 http.ServeContent 处理 If-None-Match / If-Modified-Since 和范围请求，typeName 决定 Content-Type
+func (s *AssetServer) serveFile(c *gin.Context, m *assetManifest, name, typeName, etag string) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "资源不存在"})
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		c.JSON(500, gin.H{"error": "asset is not seekable"})
+		return
+	}
+	if ct := mime.TypeByExtension(path.Ext(typeName)); ct != "" {
+		c.Header("Content-Type", ct)
+	}
+	c.Header("ETag", etag)
+	http.ServeContent(c.Writer, c.Request, typeName, m.modTime[name], content)
+}
+
+// ServeIndex SPA 回退：浏览器访问前端路由时返回 index.html，返回 false 表示不处理
+func (s *AssetServer) ServeIndex(c *gin.Context) bool {
+	p := c.Request.URL.Path
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+	if strings.HasPrefix(p, "/api/") || p == "/api" || strings.HasPrefix(p, "/static/") {
+		return false
+	}
+	if !strings.Contains(c.GetHeader("Accept"), "text/html") {
+		return false
+	}
+	m, err := s.manifest()
+	if err != nil || m.index == nil {
+		return false
+	}
+	serveIndex(c, m)
+	return true
+}
+
+// serveIndex 返回渲染后的 index.html，每次协商缓存
+func serveIndex(c *gin.Context, m *assetManifest) {
+	sum := sha256.Sum256(m.index)
+	c.Header("Cache-Control", revalidateCache)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(c.Writer, c.Request, "index.html", m.modTime["index.html"], bytes.NewReader(m.index))
+}
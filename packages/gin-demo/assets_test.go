@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestEmbeddedAssets 内嵌资源的哈希地址、缓存头、协商缓存和 SPA 回退
+func TestEmbeddedAssets(t *testing.T) {
+	_, h := newTestApp(t)
+	get := func(path string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// 浏览器访问前端路由返回渲染后的 index.html，其中引用带哈希的资源地址
+	w := get("/dashboard/settings", "Accept", "text/html,application/xhtml+xml")
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("SPA 回退期望 200 text/html，得到 %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	jsURL := regexp.MustCompile(`/static/app\.[0-9a-f]{12}\.js`).FindString(w.Body.String())
+	if jsURL == "" || strings.Contains(w.Body.String(), "{{") {
+		t.Fatalf("index.html 应引用带哈希的 app.js，得到 %s", w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("index.html 期望 no-cache，得到 %q", w.Header().Get("Cache-Control"))
+	}
+
+	cases := []struct {
+		name        string
+		path        string
+		headers     []string
+		expectCode  int
+		expectCache string
+	}{
+		{"带哈希地址长期缓存", jsURL, nil, 200, "public, max-age=31536000, immutable"},
+		{"原始地址协商缓存", "/static/app.js", nil, 200, "no-cache"},
+		{"index.html 返回渲染结果", "/static/index.html", nil, 200, "no-cache"},
+		{"不存在的资源", "/static/missing.js", []string{"Accept", "text/html"}, 404, ""},
+		{"接口路径不回退", "/api/missing", []string{"Accept", "text/html"}, 404, ""},
+		{"非浏览器请求不回退", "/dashboard", nil, 404, ""},
+	}
+	for _, c := range cases {
+		w := get(c.path, c.headers...)
+		if w.Code != c.expectCode || w.Header().Get("Cache-Control") != c.expectCache {
+			t.Errorf("%s: 期望 %d %q，得到 %d %q", c.name, c.expectCode, c.expectCache, w.Code, w.Header().Get("Cache-Control"))
+		}
+		if c.expectCode == 404 && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			t.Errorf("%s: 404 期望返回 JSON，得到 %q", c.name, w.Header().Get("Content-Type"))
+		}
+	}
+
+	// ETag / Last-Modified 协商
+	w = get("/static/app.js")
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("期望 ETag 和 Last-Modified，得到 %q %q", etag, lastModified)
+	}
+	if w := get("/static/app.js", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match 命中期望 304，得到 %d", w.Code)
+	}
+	if w := get("/static/app.js", "If-Modified-Since", lastModified); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since 命中期望 304，得到 %d", w.Code)
+	}
+}
+
+// TestAssetsFromDisk STATIC_DIR 模式下修改文件立即生效，并优先返回预压缩文件
+func TestAssetsFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	css := strings.Repeat("body { color: red; }\n", 100)
+	write("index.html", `<link rel="stylesheet" href="{{asset "app.css"}}">`)
+	write("app.css", css)
+	write("app.css.br", "precompressed-br")
+	write("app.css.gz", "precompressed-gz")
+	t.Setenv("STATIC_DIR", dir)
+	assets, err := LoadAssetServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(Compress(CompressConfig{Encodings: []string{"zstd", "br", "gzip"}, MinSize: 16}))
+	r.GET("/static/*filepath", assets.Handler)
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	cases := []struct {
+		acceptEncoding string
+		expectEncoding string
+		expectBody     string
+	}{
+		{"br, gzip", "br", "precompressed-br"},
+		{"gzip", "gzip", "precompressed-gz"},
+		{"zstd", "zstd", css}, // 没有 .zst 文件时由中间件实时压缩
+		{"", "", css},
+	}
+	for _, c := range cases {
+		w := get("/static/app.css", c.acceptEncoding)
+		got := w.Body.String()
+		if c.expectEncoding == "zstd" {
+			got = string(decodeBody(t, "zstd", w.Body))
+		}
+		if w.Header().Get("Content-Encoding") != c.expectEncoding || got != c.expectBody {
+			t.Errorf("Accept-Encoding %q: 期望 %q，得到 %q %.20q", c.acceptEncoding, c.expectEncoding, w.Header().Get("Content-Encoding"), got)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+			t.Errorf("Accept-Encoding %q: 期望 text/css，得到 %q", c.acceptEncoding, ct)
+		}
+	}
+
+	// 开发模式不使用长期缓存，修改后哈希地址随之变化
+	before := assets.URL("app.css")
+	if w := get(before, ""); w.Code != 200 || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("开发模式期望 no-cache，得到 %d %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	write("app.css", "body { color: blue; }")
+	if after := assets.URL("app.css"); after == before {
+		t.Errorf("修改文件后哈希地址应变化，仍为 %s", after)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+响应压缩
+
+- Compress 中间件按 Accept-Encoding（含 q 值）协商 zstd / br / gzip，服务端按 COMPRESS_ENCODINGS 的顺序优先
+- 响应先缓冲到 COMPRESS_MIN_SIZE，不足的小响应原样返回；已压缩的类型（图片、音视频、压缩包等）和已设置 Content-Encoding 的响应不再压缩
+- 流式响应（SSE、c.Stream）调用 Flush 时立即决定是否压缩，之后每次 Flush 都会把已压缩的数据推给客户端
+- 静态资源优先返回预压缩的 .br / .gz 同名文件（见 assets.go），由构建时生成，运行时不再压缩
+
+配置：
+- COMPRESS_ENCODINGS  默认 "zstd,br,gzip"，设为 "none" 关闭压缩
+- COMPRESS_MIN_SIZE   最小压缩字节数，默认 1024
+*/
+
+// CompressConfig 压缩配置
+type CompressConfig struct {
+	Encodings []string // 服务端支持的编码，按优先级排列
+	MinSize   int
+}
+
+// LoadCompressConfig 从环境变量读取压缩配置
+func LoadCompressConfig() CompressConfig {
+	var encodings []string
+	for _, e := range strings.Split(getenv("COMPRESS_ENCODINGS", "zstd,br,gzip"), ",") {
+		if e = strings.TrimSpace(e); e != "" && e != "none" {
+			encodings = append(encodings, e)
+		}
+	}
+	return CompressConfig{Encodings: encodings, MinSize: getenvInt("COMPRESS_MIN_SIZE", 1024)}
+}
+
+// encoder 各压缩算法 writer 的公共方法
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// encoderPools 复用压缩器，zstd / brotli 的初始化开销较大
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	"br": {New: func() interface{} { return brotli.NewWriterLevel(nil, 5) }},
+	"zstd": {New: func() interface{} {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return w
+	}},
+}
+
+// negotiateEncoding 按 Accept-Encoding 选择编码，没有可用编码时返回空串
+func negotiateEncoding(header string, supported []string) string {
+	if header == "" {
+		return ""
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	// 客户端 q 值最高的编码中取服务端优先级最高的
+	best, bestQ := "", 0.0
+	for _, enc := range supported {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// incompressible 已经压缩过的内容类型，再压缩只会浪费 CPU
+func incompressible(contentType string) bool {
+	ct, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case ct == "image/svg+xml":
+		return false
+	case strings.HasPrefix(ct, "image/"), strings.HasPrefix(ct, "video/"), strings.HasPrefix(ct, "audio/"), strings.HasPrefix(ct, "font/woff"):
+		return true
+	}
+	switch ct {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd", "application/x-brotli",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/pdf", "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+// Compress 响应压缩中间件，应注册在 TracingMiddleware 之前，
+// 让 traceErrorWriter 看到未压缩的错误响应并追加 trace_id
+func Compress(cfg CompressConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(cfg.Encodings) == 0 {
+			c.Next()
+			return
+		}
+		addVary(c.Writer.Header(), "Accept-Encoding")
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"), cfg.Encodings)
+		// 范围请求和协议升级不压缩
+		if encoding == "" || c.GetHeader("Range") != "" || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: cfg.MinSize}
+		c.Writer = w
+		// handler panic 时同样写出缓冲的数据并归还压缩器，再交给外层的 Recovery 处理
+		defer func() {
+			w.close()
+			c.Writer = w.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// compressWriter 缓冲响应开头，达到阈值或 Flush 时决定是否压缩
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+	buf      []byte
+	decided  bool
+	enc      encoder
+}
+
+// decide 根据状态码、内容类型决定压缩还是原样输出，并写出已缓冲的数据
+func (w *compressWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	status := w.Status()
+	if len(w.buf) > 0 && h.Get("Content-Encoding") == "" && status != http.StatusNoContent &&
+		status != http.StatusNotModified && status >= http.StatusOK && !incompressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		w.enc = encoderPools[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.write(buf)
+	return err
+}
+
+func (w *compressWriter) write(p []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		return w.write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeaderNow 没有响应体时（如 AbortWithStatus）原样输出
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.decided && len(w.buf) == 0 {
+		w.decided = true
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Written 缓冲中有数据也算已写，避免外层中间件重复写响应
+func (w *compressWriter) Written() bool {
+	return len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+// Flush 流式响应：立即决定是否压缩，并把压缩器中的数据推给客户端
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// close 写出剩余数据并归还压缩器
+func (w *compressWriter) close() {
+	if !w.decided {
+		// 小于阈值的响应原样输出
+		w.decided = true
+		if len(w.buf) > 0 {
+			w.ResponseWriter.Write(w.buf)
+			w.buf = nil
+		}
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(nil)
+		encoderPools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// addVary 追加 Vary 头，已存在时不重复添加
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decodeBody 按 Content-Encoding 解压响应体
+func decodeBody(t *testing.T, encoding string, body io.Reader) []byte {
+	var r io.Reader
+	switch encoding {
+	case "":
+		r = body
+	case "gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case "br":
+		r = brotli.NewReader(body)
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		t.Fatalf("未知的 Content-Encoding %q", encoding)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestCompressNegotiation 按 Accept-Encoding 协商编码，小响应和已压缩类型不压缩
+func TestCompressNegotiation(t *testing.T) {
+	app, h := newTestApp(t)
+	token := loginToken(t, h, "acme")
+	acme, _ := tenantDB(app.DB, "acme")
+	for i := 0; i < 100; i++ {
+		acme.Create(&GormUser{Name: fmt.Sprintf("user-%03d", i)})
+	}
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	plain := get("/gorm/users", "").Body.Bytes()
+
+	cases := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		expectEncoding string
+	}{
+		{"不带 Accept-Encoding", "/gorm/users", "", ""},
+		{"gzip", "/gorm/users", "gzip", "gzip"},
+		{"服务端优先 zstd", "/gorm/users", "gzip, deflate, br, zstd", "zstd"},
+		{"q 值优先", "/gorm/users", "gzip;q=1.0, br;q=0.5", "gzip"},
+		{"q=0 排除", "/gorm/users", "zstd;q=0, br", "br"},
+		{"通配符", "/gorm/query?page_size=100", "*", "zstd"},
+		{"不支持的编码", "/gorm/users", "deflate", ""},
+		{"小响应不压缩", "/ping", "gzip", ""},
+	}
+	for _, c := range cases {
+		w := get(c.path, c.acceptEncoding)
+		if got := w.Header().Get("Content-Encoding"); got != c.expectEncoding {
+			t.Errorf("%s: 期望 Content-Encoding %q，得到 %q", c.name, c.expectEncoding, got)
+			continue
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: 期望 Vary: Accept-Encoding，得到 %q", c.name, w.Header().Get("Vary"))
+		}
+		body := decodeBody(t, c.expectEncoding, w.Body)
+		if c.path == "/gorm/users" && !bytes.Equal(body, plain) {
+			t.Errorf("%s: 解压后内容与未压缩响应不一致", c.name)
+		}
+	}
+
+	// 已压缩的内容类型原样返回
+	r := gin.New()
+	r.Use(Compress(CompressConfig{Encodings: []string{"gzip"}, MinSize: 16}))
+	r.GET("/image", func(c *gin.Context) {
+		c.Data(200, "image/png", bytes.Repeat([]byte{0x89}, 4096))
+	})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/image", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 4096 {
+		t.Errorf("image/png 不应压缩，得到 %q %d 字节", w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+}
+
+// TestCompressStreaming 流式响应每次 Flush 后客户端都能解压出已发送的数据
+func TestCompressStreaming(t *testing.T) {
+	next := make(chan struct{}, 1)
+	r := gin.New()
+	r.Use(Compress(CompressConfig{Encodings: []string{"gzip"}, MinSize: 1024}))
+	r.GET("/events", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(c.Writer, "data: %d\n\n", i)
+			c.Writer.Flush()
+			<-next
+		}
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("期望流式响应使用 gzip，得到 %q", resp.Header.Get("Content-Encoding"))
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewReader(gr)
+	for i := 0; i < 3; i++ {
+		// 服务端还在等待，读到的数据只能来自 Flush
+		line, err := lines.ReadString('\n')
+		if err != nil || line != fmt.Sprintf("data: %d\n", i) {
+			t.Fatalf("第 %d 条事件期望 %q，得到 %q %v", i, fmt.Sprintf("data: %d\n", i), line, err)
+		}
+		lines.ReadString('\n')
+		next <- struct{}{}
+	}
+}
+
+// TestCompressPanic handler panic 时已压缩的数据完整写出，压缩器被归还
+func TestCompressPanic(t *testing.T) {
+	r := gin.New()
+	r.Use(gin.Recovery(), Compress(CompressConfig{Encodings: []string{"gzip"}, MinSize: 16}))
+	payload := bytes.Repeat([]byte("gin-demo "), 64)
+	r.GET("/panic", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/plain", payload)
+		panic("boom")
+	})
+
+	req := httptest.NewRequest("GET", "/panic", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("期望 gzip 压缩，得到 %q", w.Header().Get("Content-Encoding"))
+	}
+	if got := decodeBody(t, "gzip", w.Body); !bytes.Equal(got, payload) {
+		t.Errorf("panic 前写入的数据应完整写出，得到 %d 字节", len(got))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 配置统一从环境变量读取，与 PORT 的用法保持一致
+
+// getenv 读取字符串配置，未设置时返回默认值
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// getenvInt 读取整数配置，未设置或格式错误时返回默认值
+func getenvInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// getenvDuration 读取时长配置（如 "30s"、"5m"），未设置或格式错误时返回默认值
+func getenvDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// getenvSecret 按顺序读取第一个已设置的密钥；都未设置时生成进程内随机密钥（重启后失效），
+// 不使用固定的默认值，否则任何人都能伪造签名
+func getenvSecret(keys ...string) []byte {
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return []byte(v)
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("generate secret: %v", err)
+	}
+	log.Printf("%s not set, using a random per-process secret", keys[0])
+	return secret
+}
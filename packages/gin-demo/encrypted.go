@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/alibabacloud-go/tea/tea"
+	alikmsopenapi "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi"
+	alikmsopenapiutil "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/openapi-util"
+	alikmssdk "github.com/aliyun/alibabacloud-dkms-gcs-go-sdk/sdk"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+
+	"ali-kms/kms"
+)
+
+/*
+字段级加密
+
+EncryptedString / EncryptedJSON[T] 用于 GORM 模型中的敏感字段（手机号、证件号等），
+数据库中保存 ali-kms 的信封文本（"ake:..."，见 ali-kms/kms/envelope.go）：
+
+	type Customer struct {
+		ID      uint `gorm:"primaryKey"`
+		Phone   EncryptedString
+		Address EncryptedJSON[Address]
+	}
+
+- 加密上下文为 {table, column, id}，id 为主键值，密文被复制到其他行、其他列或其他表时无法解密
+- 数据密钥按表共享并缓存（kms.CachingMaterials.EnvelopeEncryptShared），读写大量行时不必每行调用 KMS
+- 加解密由 RegisterFieldEncryption 注册的 GORM 回调完成：
+  - 创建：主键已知时在 INSERT 前加密；自增主键先写 NULL，拿到主键后在同一事务中 UPDATE 为密文
+  - 更新：通过 Save 或 Updates(&model) 写入，明文变化时重新加密，未变化时沿用原密文
+  - 查询：扫描后逐行解密，查询的列中必须包含主键
+- Scan/Value 只搬运密文：没有经过回调加密的非空明文在 Value 时返回 ErrFieldNotSealed，明文不会写入数据库
+- 空字符串和 JSON null 保存为 NULL，不加密；加密列不能用于查询条件、排序和索引
+- 主密钥轮转后用 FieldEncryptor.RewrapColumn 逐行重新包装数据密钥（kms.RewrapShared），数据密文不变
+*/
+
+var (
+	// ErrFieldNotSealed 非空明文没有经过加密回调（例如 Updates(map) 或未注册 RegisterFieldEncryption）
+	ErrFieldNotSealed = errors.New("field encryption: value is not encrypted")
+	// ErrFieldEncryptionDisabled 模型中有非空的加密字段，但没有配置 KMS_KEY_ID
+	ErrFieldEncryptionDisabled = errors.New("field encryption: not configured")
+	// ErrFieldMissingPrimaryKey 加密字段所在的记录没有主键（例如查询时没有选择主键列）
+	ErrFieldMissingPrimaryKey = errors.New("field encryption: primary key required")
+)
+
+// sealedValue 加密字段在数据库中的状态
+type sealedValue struct {
+	text     string // 信封文本，为空时对应 NULL
+	plain    string // text 对应的明文，用于判断明文是否被修改
+	unopened bool   // text 由 Scan 读入，尚未解密
+	pending  bool   // 自增主键的记录在 INSERT 时先写 NULL
+}
+
+func (s *sealedValue) scan(src interface{}) error {
+	*s = sealedValue{}
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s.text = v
+	case []byte:
+		s.text = string(v)
+	default:
+		return fmt.Errorf("field encryption: cannot scan %T", src)
+	}
+	s.unopened = s.text != ""
+	return nil
+}
+
+// value plain 为当前明文，空字符串写入 NULL
+func (s sealedValue) value(plain string) (driver.Value, error) {
+	switch {
+	case s.unopened:
+		return nil, ErrFieldNotSealed
+	case plain == "":
+		return nil, nil
+	case plain == s.plain && s.text != "":
+		return s.text, nil
+	case s.pending:
+		return nil, nil
+	}
+	return nil, ErrFieldNotSealed
+}
+
+// encryptedField 由 *EncryptedString 和 *EncryptedJSON 实现
+type encryptedField interface {
+	state() *sealedValue
+	plaintext() (string, error)
+	setPlaintext(plain string) error
+}
+
+var encryptedFieldType = reflect.TypeOf((*encryptedField)(nil)).Elem()
+
+// EncryptedString 加密的字符串字段，零值为空字符串（NULL）
+type EncryptedString struct {
+	String string // 明文
+	sealed sealedValue
+}
+
+// NewEncryptedString 以明文创建字段
+func NewEncryptedString(s string) EncryptedString {
+	return EncryptedString{String: s}
+}
+
+func (s *EncryptedString) state() *sealedValue        { return &s.sealed }
+func (s *EncryptedString) plaintext() (string, error) { return s.String, nil }
+func (s *EncryptedString) setPlaintext(plain string) error {
+	s.String = plain
+	return nil
+}
+
+// Scan 实现 sql.Scanner，只读入密文，解密由查询回调完成
+func (s *EncryptedString) Scan(src interface{}) error {
+	s.String = ""
+	return s.sealed.scan(src)
+}
+
+// Value 实现 driver.Valuer，返回回调加密后的密文
+func (s EncryptedString) Value() (driver.Value, error) {
+	return s.sealed.value(s.String)
+}
+
+// GormDataType 列类型
+func (EncryptedString) GormDataType() string {
+	return string(schema.String)
+}
+
+// MarshalJSON 输出明文，和普通字符串字段一样出现在 API 响应中
+func (s EncryptedString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String)
+}
+
+// UnmarshalJSON 只修改明文，保存时由回调判断是否需要重新加密
+func (s *EncryptedString) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &s.String)
+}
+
+// EncryptedJSON 以 JSON 编码后加密的字段，Data 编码为 null 时保存为 NULL
+type EncryptedJSON[T any] struct {
+	Data   T // 明文
+	sealed sealedValue
+}
+
+// NewEncryptedJSON 以明文创建字段
+func NewEncryptedJSON[T any](data T) EncryptedJSON[T] {
+	return EncryptedJSON[T]{Data: data}
+}
+
+func (j *EncryptedJSON[T]) state() *sealedValue { return &j.sealed }
+
+func (j *EncryptedJSON[T]) plaintext() (string, error) {
+	data, err := json.Marshal(j.Data)
+	if err != nil || string(data) == "null" {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (j *EncryptedJSON[T]) setPlaintext(plain string) error {
+	var data T
+	if err := json.Unmarshal([]byte(plain), &data); err != nil {
+		return err
+	}
+	j.Data = data
+	return nil
+}
+
+// Scan 实现 sql.Scanner，只读入密文，解密由查询回调完成
+func (j *EncryptedJSON[T]) Scan(src interface{}) error {
+	var zero T
+	j.Data = zero
+	return j.sealed.scan(src)
+}
+
+// Value 实现 driver.Valuer，返回回调加密后的密文
+func (j EncryptedJSON[T]) Value() (driver.Value, error) {
+	plain, err := j.plaintext()
+	if err != nil {
+		return nil, err
+	}
+	return j.sealed.value(plain)
+}
+
+// GormDataType 列类型
+func (EncryptedJSON[T]) GormDataType() string {
+	return string(schema.String)
+}
+
+// MarshalJSON 输出明文
+func (j EncryptedJSON[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Data)
+}
+
+// UnmarshalJSON 只修改明文
+func (j *EncryptedJSON[T]) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &j.Data)
+}
+
+// FieldEncryptor 字段加密使用的主密钥和数据密钥缓存
+type FieldEncryptor struct {
+	materials *kms.CachingMaterials
+	keyID     string
+}
+
+// NewFieldEncryptor keyID 为主密钥，materials 中的数据密钥按表共享
+func NewFieldEncryptor(materials *kms.CachingMaterials, keyID string) *FieldEncryptor {
+	return &FieldEncryptor{materials: materials, keyID: keyID}
+}
+
+// LoadFieldEncryptor 从环境变量读取配置，未设置 KMS_KEY_ID 时返回 nil（不启用字段加密）
+// 环境变量与 ali-kms 的 kmsctl 相同，密钥提供方按以下顺序选择：
+//   - KMS_KEYRING_FILE 本地密钥环
+//   - KMS_DEV_CMK 本地固定密钥（16/24/32 字节）
+//   - KMS_ENDPOINT 专属KMS，另需 KMS_CA_FILE、KMS_CLIENT_KEY_FILE、KMS_CLIENT_KEY_PASSWORD
+func LoadFieldEncryptor() (*FieldEncryptor, error) {
+	keyID := getenv("KMS_KEY_ID", "")
+	if keyID == "" {
+		return nil, nil
+	}
+	var (
+		provider kms.KeyProvider
+		err      error
+	)
+	switch {
+	case getenv("KMS_KEYRING_FILE", "") != "":
+		provider, err = kms.LoadKeyring(getenv("KMS_KEYRING_FILE", ""))
+	case getenv("KMS_DEV_CMK", "") != "":
+		provider, err = kms.NewStaticKeyProvider([]byte(getenv("KMS_DEV_CMK", "")))
+	case getenv("KMS_ENDPOINT", "") != "":
+		provider, err = newDKMSProvider()
+	default:
+		return nil, errors.New("field encryption: KMS_KEY_ID is set but no key provider is configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+	materials, err := kms.NewCachingMaterials(provider, kms.CachePolicy{
+		MaxAge: getenvDuration("KMS_DATAKEY_MAX_AGE", kms.DefaultCacheMaxAge),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewFieldEncryptor(materials, keyID), nil
+}
+
+// newDKMSProvider 专属KMS，SDK 自带的重试不感知 ctx，由 kms.RetryingProvider 重试和熔断
+func newDKMSProvider() (kms.KeyProvider, error) {
+	var clientKey string
+	if path := getenv("KMS_CLIENT_KEY_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		clientKey = string(data)
+	}
+	config := &alikmsopenapi.Config{
+		Protocol:         tea.String("https"),
+		Endpoint:         tea.String(getenv("KMS_ENDPOINT", "")),
+		ClientKeyContent: tea.String(clientKey),
+		Password:         tea.String(getenv("KMS_CLIENT_KEY_PASSWORD", "")),
+	}
+	if ca := getenv("KMS_CA_FILE", ""); ca != "" {
+		config.CaFilePath = tea.String(ca)
+	}
+	client, err := alikmssdk.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	runtime := &alikmsopenapiutil.RuntimeOptions{Autoretry: tea.Bool(false)}
+	return kms.NewRetryingProvider(kms.NewDKMSProvider(client, runtime), kms.RetryPolicy{}, kms.NewCircuitBreaker(0, 0)), nil
+}
+
+// Stats 数据密钥缓存统计
+func (e *FieldEncryptor) Stats() kms.CacheStats {
+	return e.materials.Stats()
+}
+
+// RegisterFieldEncryption 注册加解密回调，enc 为 nil 时遇到非空的加密字段返回 ErrFieldEncryptionDisabled
+// 重复调用时不会重复注册
+func RegisterFieldEncryption(db *gorm.DB, enc *FieldEncryptor) error {
+	cb := db.Callback()
+	if cb.Query().Get("crypto:query") != nil {
+		return nil
+	}
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("crypto:before_create", enc.beforeCreate),
+		cb.Create().After("gorm:create").Register("crypto:after_create", enc.afterCreate),
+		cb.Update().Before("gorm:update").Register("crypto:update", enc.beforeUpdate),
+		cb.Query().After("gorm:query").Register("crypto:query", enc.afterQuery),
+	)
+}
+
+// encryptedFields 模型中的加密字段，没有时返回 nil
+func encryptedFields(tx *gorm.DB) []*schema.Field {
+	stmt := tx.Statement
+	if tx.Error != nil || stmt.Schema == nil {
+		return nil
+	}
+	var fields []*schema.Field
+	for _, f := range stmt.Schema.Fields {
+		if f.DBName != "" && reflect.PointerTo(f.FieldType).Implements(encryptedFieldType) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// eachRow 对单条记录或切片中的每条记录调用 fn，出错时记录到 tx 并停止
+func eachRow(tx *gorm.DB, fn func(row reflect.Value) error) {
+	rv := tx.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if row := reflect.Indirect(rv.Index(i)); row.Kind() == reflect.Struct {
+				if err := fn(row); err != nil {
+					tx.AddError(err)
+					return
+				}
+			}
+		}
+	case reflect.Struct:
+		if err := fn(rv); err != nil {
+			tx.AddError(err)
+		}
+	}
+}
+
+// fieldOf 记录中的加密字段，row 必须可寻址
+func fieldOf(ctx context.Context, f *schema.Field, row reflect.Value) encryptedField {
+	return f.ReflectValueOf(ctx, row).Addr().Interface().(encryptedField)
+}
+
+// tableKeyContext 数据密钥的加密上下文，同一张表共用数据密钥
+func tableKeyContext(table string) kms.EncryptionContext {
+	return kms.EncryptionContext{"table": table}
+}
+
+// fieldContext 字段密文的加密上下文，包含数据密钥的上下文
+func fieldContext(table, column, id string) kms.EncryptionContext {
+	return kms.EncryptionContext{"table": table, "column": column, "id": id}
+}
+
+// keyContext 当前语句所在表的数据密钥上下文
+func keyContext(tx *gorm.DB) kms.EncryptionContext {
+	return tableKeyContext(tx.Statement.Schema.Table)
+}
+
+// rowContext 字段的加密上下文，主键为零值时返回 false
+func rowContext(tx *gorm.DB, f *schema.Field, row reflect.Value) (kms.EncryptionContext, bool) {
+	stmt := tx.Statement
+	ids := make([]string, 0, len(stmt.Schema.PrimaryFields))
+	for _, pk := range stmt.Schema.PrimaryFields {
+		v, zero := pk.ValueOf(stmt.Context, row)
+		if zero {
+			return nil, false
+		}
+		ids = append(ids, fmt.Sprint(v))
+	}
+	if len(ids) == 0 {
+		return nil, false
+	}
+	return fieldContext(stmt.Schema.Table, f.DBName, strings.Join(ids, ",")), true
+}
+
+// seal 明文变化时重新加密；allowPending 为 true 且主键未知时标记为待加密
+func (e *FieldEncryptor) seal(tx *gorm.DB, f *schema.Field, row reflect.Value, allowPending bool) error {
+	field := fieldOf(tx.Statement.Context, f, row)
+	st := field.state()
+	if st.unopened {
+		return fmt.Errorf("%w: %s was loaded without decryption", ErrFieldNotSealed, f.DBName)
+	}
+	plain, err := field.plaintext()
+	if err != nil {
+		return err
+	}
+	if plain == "" || (plain == st.plain && st.text != "") {
+		return nil
+	}
+	ec, ok := rowContext(tx, f, row)
+	if !ok {
+		if !allowPending {
+			return fmt.Errorf("%w: %s.%s", ErrFieldMissingPrimaryKey, tx.Statement.Schema.Table, f.DBName)
+		}
+		st.pending = true
+		return nil
+	}
+	if e == nil {
+		return fmt.Errorf("%w: %s.%s", ErrFieldEncryptionDisabled, tx.Statement.Schema.Table, f.DBName)
+	}
+	obj, err := e.materials.EnvelopeEncryptShared(tx.Statement.Context, e.keyID, []byte(plain), keyContext(tx), ec)
+	if err != nil {
+		return err
+	}
+	text, err := obj.EncodeToString()
+	if err != nil {
+		return err
+	}
+	*st = sealedValue{text: text, plain: plain}
+	return nil
+}
+
+// open 解密 Scan 读入的密文
+func (e *FieldEncryptor) open(tx *gorm.DB, f *schema.Field, row reflect.Value) error {
+	field := fieldOf(tx.Statement.Context, f, row)
+	st := field.state()
+	if !st.unopened {
+		return nil
+	}
+	ec, ok := rowContext(tx, f, row)
+	if !ok {
+		return fmt.Errorf("%w: select the primary key to decrypt %s.%s", ErrFieldMissingPrimaryKey, tx.Statement.Schema.Table, f.DBName)
+	}
+	if e == nil {
+		return fmt.Errorf("%w: %s.%s", ErrFieldEncryptionDisabled, tx.Statement.Schema.Table, f.DBName)
+	}
+	var obj kms.EnvelopeCipherObj
+	if err := obj.Decode(st.text); err != nil {
+		return fmt.Errorf("%s.%s: %w", tx.Statement.Schema.Table, f.DBName, err)
+	}
+	plaintext, err := e.materials.EnvelopeDecryptShared(tx.Statement.Context, &obj, keyContext(tx), ec)
+	if err != nil {
+		return fmt.Errorf("%s.%s: %w", tx.Statement.Schema.Table, f.DBName, err)
+	}
+	if err := field.setPlaintext(string(plaintext)); err != nil {
+		return err
+	}
+	st.plain, st.unopened = string(plaintext), false
+	return nil
+}
+
+func (e *FieldEncryptor) beforeCreate(tx *gorm.DB) {
+	fields := encryptedFields(tx)
+	if len(fields) == 0 {
+		return
+	}
+	eachRow(tx, func(row reflect.Value) error {
+		for _, f := range fields {
+			if err := e.seal(tx, f, row, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// afterCreate 自增主键的记录拿到主键后加密，在同一事务中写回
+func (e *FieldEncryptor) afterCreate(tx *gorm.DB) {
+	fields := encryptedFields(tx)
+	if len(fields) == 0 {
+		return
+	}
+	stmt := tx.Statement
+	eachRow(tx, func(row reflect.Value) error {
+		updates := map[string]interface{}{}
+		for _, f := range fields {
+			st := fieldOf(stmt.Context, f, row).state()
+			if !st.pending {
+				continue
+			}
+			st.pending = false
+			if err := e.seal(tx, f, row, false); err != nil {
+				return err
+			}
+			updates[f.DBName] = st.text
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		where := map[string]interface{}{}
+		for _, pk := range stmt.Schema.PrimaryFields {
+			where[pk.DBName], _ = pk.ValueOf(stmt.Context, row)
+		}
+		return tx.Session(&gorm.Session{NewDB: true, SkipHooks: true}).
+			Table(stmt.Schema.Table).Where(where).UpdateColumns(updates).Error
+	})
+}
+
+func (e *FieldEncryptor) beforeUpdate(tx *gorm.DB) {
+	fields := encryptedFields(tx)
+	if len(fields) == 0 {
+		return
+	}
+	eachRow(tx, func(row reflect.Value) error {
+		for _, f := range fields {
+			if err := e.seal(tx, f, row, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *FieldEncryptor) afterQuery(tx *gorm.DB) {
+	fields := encryptedFields(tx)
+	if len(fields) == 0 {
+		return
+	}
+	eachRow(tx, func(row reflect.Value) error {
+		for _, f := range fields {
+			if err := e.open(tx, f, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rewrapBatchSize RewrapColumn 每批读取的行数
+const rewrapBatchSize = 100
+
+// RewrapColumn 主密钥轮转后重新包装 model 对应表中 column 列的数据密钥，数据密文不变，返回重新包装的行数
+// 跨所有租户执行，只支持单列主键；每行以主键和原密文为条件写回，期间被修改的行保留新值。
+// 同一个数据密钥只调用一次 KMS，重新包装后原来共用数据密钥的行仍然共用，读取时可以命中缓存
+func (e *FieldEncryptor) RewrapColumn(ctx context.Context, db *gorm.DB, model interface{}, column string) (int, error) {
+	if e == nil {
+		return 0, ErrFieldEncryptionDisabled
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return 0, err
+	}
+	table := stmt.Schema.Table
+	f := stmt.Schema.LookUpField(column)
+	if f == nil || f.DBName == "" || !reflect.PointerTo(f.FieldType).Implements(encryptedFieldType) {
+		return 0, fmt.Errorf("field encryption: %s.%s is not an encrypted column", table, column)
+	}
+	if len(stmt.Schema.PrimaryFields) != 1 {
+		return 0, fmt.Errorf("%w: %s must have a single primary key column", ErrFieldMissingPrimaryKey, table)
+	}
+	pk := stmt.Schema.PrimaryFields[0].DBName
+	// 不带模型的语句不会触发租户和加解密回调
+	raw := db.Session(&gorm.Session{NewDB: true, SkipHooks: true}).WithContext(ctx)
+
+	type sealedRow struct {
+		id   interface{}
+		text string
+	}
+	var (
+		last  interface{}
+		count int
+		// rewrapped 原数据密钥密文 -> 重新包装后的密钥字段
+		rewrapped = map[string]*kms.EnvelopeCipherObj{}
+	)
+	for {
+		q := raw.Table(table).Select(pk, f.DBName).Where(clause.Neq{Column: f.DBName, Value: nil})
+		if last != nil {
+			q = q.Where(clause.Gt{Column: pk, Value: last})
+		}
+		rows, err := q.Order(pk).Limit(rewrapBatchSize).Rows()
+		if err != nil {
+			return count, err
+		}
+		var batch []sealedRow
+		for rows.Next() {
+			var r sealedRow
+			if err := rows.Scan(&r.id, &r.text); err != nil {
+				rows.Close()
+				return count, err
+			}
+			if b, ok := r.id.([]byte); ok {
+				r.id = string(b)
+			}
+			batch = append(batch, r)
+		}
+		if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+			return count, err
+		}
+		for _, r := range batch {
+			var obj kms.EnvelopeCipherObj
+			if err := obj.Decode(r.text); err != nil {
+				return count, fmt.Errorf("%s.%s %v: %w", table, f.DBName, r.id, err)
+			}
+			ec := fieldContext(table, f.DBName, fmt.Sprint(r.id))
+			source := fmt.Sprintf("%q/%q/%x/%x", obj.KeyID, obj.KeyVersionID, obj.EncryptedDataKey, obj.DataKeyIV)
+			out, ok := rewrapped[source]
+			if ok {
+				if !bytes.Equal(obj.AADDigest, ec.Digest()) {
+					return count, fmt.Errorf("%s.%s %v: %w", table, f.DBName, r.id, kms.ErrContextMismatch)
+				}
+				key := out
+				out = &obj
+				out.Version, out.KeyID, out.KeyVersionID = key.Version, key.KeyID, key.KeyVersionID
+				out.DataKeyIV, out.EncryptedDataKey = key.DataKeyIV, key.EncryptedDataKey
+			} else {
+				if out, err = e.materials.RewrapShared(ctx, &obj, e.keyID, tableKeyContext(table), ec); err != nil {
+					return count, fmt.Errorf("%s.%s %v: %w", table, f.DBName, r.id, err)
+				}
+				rewrapped[source] = out
+			}
+			text, err := out.EncodeToString()
+			if err != nil {
+				return count, err
+			}
+			res := raw.Table(table).Where(map[string]interface{}{pk: r.id, f.DBName: r.text}).UpdateColumn(f.DBName, text)
+			if res.Error != nil {
+				return count, res.Error
+			}
+			count += int(res.RowsAffected)
+		}
+		if len(batch) < rewrapBatchSize {
+			return count, nil
+		}
+		last = batch[len(batch)-1].id
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"ali-kms/kms"
+)
+
+// encryptedCustomer 测试用模型
+type encryptedCustomer struct {
+	ID      uint `gorm:"primaryKey"`
+	Name    string
+	Phone   EncryptedString
+	Profile EncryptedJSON[map[string]string]
+}
+
+// newEncryptedDB 内存数据库，enc 为 nil 时不启用字段加密
+func newEncryptedDB(t *testing.T, enc *FieldEncryptor) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&encryptedCustomer{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterFieldEncryption(db, enc); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestFieldEncryptor(t *testing.T) *FieldEncryptor {
+	provider, err := kms.NewStaticKeyProvider([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	materials, err := kms.NewCachingMaterials(provider, kms.CachePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFieldEncryptor(materials, "test-key")
+}
+
+// storedColumn 数据库中保存的原始值
+func storedColumn(t *testing.T, db *gorm.DB, id uint, column string) *string {
+	var v *string
+	if err := db.Table("encrypted_customers").Select(column).Where("id = ?", id).Row().Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// TestEncryptedFieldRoundTrip 创建、查询、更新时自动加解密，数据库中只有密文
+func TestEncryptedFieldRoundTrip(t *testing.T) {
+	enc := newTestFieldEncryptor(t)
+	db := newEncryptedDB(t, enc)
+
+	c := encryptedCustomer{
+		Name:    "alice",
+		Phone:   NewEncryptedString("13800000000"),
+		Profile: NewEncryptedJSON(map[string]string{"city": "杭州"}),
+	}
+	if err := db.Create(&c).Error; err != nil {
+		t.Fatal(err)
+	}
+	phone := storedColumn(t, db, c.ID, "phone")
+	if phone == nil || !strings.HasPrefix(*phone, "ake:") || strings.Contains(*phone, "13800000000") {
+		t.Fatalf("数据库中应保存信封密文，得到 %v", phone)
+	}
+
+	var got encryptedCustomer
+	if err := db.First(&got, c.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.Phone.String != "13800000000" || got.Profile.Data["city"] != "杭州" {
+		t.Fatalf("解密结果不一致: %+v", got)
+	}
+
+	// 明文未变化时沿用原密文
+	got.Name = "alice2"
+	if err := db.Save(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if after := storedColumn(t, db, c.ID, "phone"); after == nil || *after != *phone {
+		t.Fatalf("明文未变化时不应重新加密")
+	}
+
+	got.Phone.String = "13900000000"
+	if err := db.Save(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	var again encryptedCustomer
+	if err := db.First(&again, c.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if again.Phone.String != "13900000000" {
+		t.Fatalf("更新后期望新明文，得到 %q", again.Phone.String)
+	}
+
+	// 空值保存为 NULL
+	again.Phone.String = ""
+	if err := db.Save(&again).Error; err != nil {
+		t.Fatal(err)
+	}
+	if v := storedColumn(t, db, c.ID, "phone"); v != nil {
+		t.Fatalf("空字符串应保存为 NULL，得到 %q", *v)
+	}
+}
+
+// TestEncryptedFieldSharedDataKey 同一张表的多行共用一个数据密钥
+func TestEncryptedFieldSharedDataKey(t *testing.T) {
+	enc := newTestFieldEncryptor(t)
+	db := newEncryptedDB(t, enc)
+
+	rows := []encryptedCustomer{
+		{Name: "a", Phone: NewEncryptedString("1")},
+		{Name: "b", Phone: NewEncryptedString("2")},
+		{Name: "c", Phone: NewEncryptedString("3")},
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if s := enc.Stats(); s.Misses != 1 {
+		t.Fatalf("批量创建期望只生成一次数据密钥，得到 %+v", s)
+	}
+
+	var got []encryptedCustomer
+	if err := db.Order("id").Find(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range got {
+		if c.Phone.String != rows[i].Phone.String {
+			t.Fatalf("第 %d 行期望 %q，得到 %q", i, rows[i].Phone.String, c.Phone.String)
+		}
+	}
+}
+
+// TestEncryptedFieldErrors 密文错位、绕过回调写入和缺少主键时都返回错误
+func TestEncryptedFieldErrors(t *testing.T) {
+	enc := newTestFieldEncryptor(t)
+	db := newEncryptedDB(t, enc)
+
+	rows := []encryptedCustomer{
+		{Name: "a", Phone: NewEncryptedString("1")},
+		{Name: "b", Phone: NewEncryptedString("2")},
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{"密文复制到其他行", func() error {
+			stolen := storedColumn(t, db, rows[0].ID, "phone")
+			if err := db.Table("encrypted_customers").Where("id = ?", rows[1].ID).Update("phone", *stolen).Error; err != nil {
+				return err
+			}
+			var c encryptedCustomer
+			return db.First(&c, rows[1].ID).Error
+		}, kms.ErrContextMismatch},
+		{"Updates(map) 写入明文", func() error {
+			return db.Model(&encryptedCustomer{ID: rows[0].ID}).Updates(map[string]interface{}{"phone": NewEncryptedString("x")}).Error
+		}, ErrFieldNotSealed},
+		{"查询时没有选择主键", func() error {
+			var c encryptedCustomer
+			return db.Select("phone").First(&c, rows[0].ID).Error
+		}, ErrFieldMissingPrimaryKey},
+	}
+	for _, tt := range tests {
+		if err := tt.run(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: 期望 %v，得到 %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+// TestEncryptedFieldDisabled 未配置 KMS_KEY_ID 时空值可以写入，非空值拒绝写入
+func TestEncryptedFieldDisabled(t *testing.T) {
+	db := newEncryptedDB(t, nil)
+	if err := db.Create(&encryptedCustomer{Name: "a"}).Error; err != nil {
+		t.Fatalf("空的加密字段不需要密钥: %v", err)
+	}
+	err := db.Create(&encryptedCustomer{ID: 10, Phone: NewEncryptedString("1")}).Error
+	if !errors.Is(err, ErrFieldEncryptionDisabled) {
+		t.Fatalf("期望 ErrFieldEncryptionDisabled，得到 %v", err)
+	}
+}
+
+// TestEncryptedFieldRewrap 主密钥轮转后重新包装加密列，数据密文不变，查询仍能解密
+func TestEncryptedFieldRewrap(t *testing.T) {
+	provider := kms.NewKeyringProvider()
+	if err := provider.CreateKey("test-key", kms.KeySpecAES256); err != nil {
+		t.Fatal(err)
+	}
+	materials, err := kms.NewCachingMaterials(provider, kms.CachePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewFieldEncryptor(materials, "test-key")
+	db := newEncryptedDB(t, enc)
+
+	rows := make([]encryptedCustomer, rewrapBatchSize+20)
+	for i := range rows {
+		rows[i] = encryptedCustomer{Name: fmt.Sprint(i), Phone: NewEncryptedString(fmt.Sprint("138", i))}
+	}
+	rows[0].Phone = EncryptedString{} // NULL 不处理
+	if err := db.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	before := storedColumn(t, db, rows[1].ID, "phone")
+	if _, err := provider.Rotate("test-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := enc.RewrapColumn(context.Background(), db, &encryptedCustomer{}, "name"); err == nil {
+		t.Error("非加密列期望失败")
+	}
+	count, err := enc.RewrapColumn(context.Background(), db, &encryptedCustomer{}, "phone")
+	if err != nil || count != len(rows)-1 {
+		t.Fatalf("期望重新包装 %d 行，得到 %d %v", len(rows)-1, count, err)
+	}
+	var oldObj, newObj kms.EnvelopeCipherObj
+	oldObj.Decode(*before)
+	if err := newObj.Decode(*storedColumn(t, db, rows[1].ID, "phone")); err != nil {
+		t.Fatal(err)
+	}
+	if newObj.KeyVersionID != "v2" || !bytes.Equal(newObj.CipherText, oldObj.CipherText) {
+		t.Errorf("期望切换到 v2 且数据密文不变，得到 %s", newObj.KeyVersionID)
+	}
+
+	// 原来共用数据密钥的行重新包装后仍然共用，读取时只解密一次数据密钥
+	var texts []string
+	db.Table("encrypted_customers").Where("phone IS NOT NULL").Pluck("phone", &texts)
+	keys := map[string]bool{}
+	for _, text := range texts {
+		var obj kms.EnvelopeCipherObj
+		obj.Decode(text)
+		keys[string(obj.EncryptedDataKey)] = true
+	}
+	if len(keys) != 1 {
+		t.Errorf("期望各行共用 1 个数据密钥密文，得到 %d 个", len(keys))
+	}
+	materials.Purge()
+	misses := materials.Stats().Misses
+	var got []encryptedCustomer
+	if err := db.Order("id").Find(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n := materials.Stats().Misses - misses; n != 1 {
+		t.Errorf("期望读取全部行只解密 1 次数据密钥，得到 %d 次", n)
+	}
+	for i, c := range got {
+		if want := rows[i].Phone.String; c.Phone.String != want {
+			t.Fatalf("第 %d 行期望 %q，得到 %q", i, want, c.Phone.String)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+后台任务队列
+
+任务持久化在 GORM 数据库的 jobs 表中，进程重启后不会丢失：
+- pending  等待执行（包括退避等待中的重试任务，由 run_at 控制何时可以执行）
+- running  已被某个 worker 领取
+- succeeded 执行成功
+- dead     重试次数耗尽，进入死信状态，只能由管理员手动重试
+
+worker 通过条件更新（UPDATE ... WHERE status = 'pending'）领取任务，多个 worker 不会重复执行同一任务。
+失败后按指数退避（带随机抖动）重新排队：base * 2^(attempts-1)，最大不超过 maxBackoff。
+
+任务属于入队时 context 中的租户（Job.Tenant，没有租户时为空，表示系统任务），处理函数在该租户的 context 中执行。
+worker 需要跨租户领取任务，所以字段不叫 TenantID、不走租户回调；查询和重试通过 ForTenant 显式按租户过滤，
+一个租户的管理员看不到、也不能重试其他租户的任务。
+*/
+
+// 任务状态
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+// Job 持久化的任务记录
+type Job struct {
+	ID          uint            `gorm:"primaryKey" json:"id"`
+	Tenant      string          `gorm:"index" json:"tenant"`
+	Type        string          `gorm:"index" json:"type"`
+	Payload     json.RawMessage `gorm:"type:text" json:"payload"`
+	Status      string          `gorm:"index" json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	RunAt       time.Time       `gorm:"index" json:"run_at"`
+	LockedAt    *time.Time      `json:"locked_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// Decode 将任务参数解析到 v
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// JobHandler 任务处理函数，返回 error 表示执行失败，会按退避策略重试
+type JobHandler func(ctx context.Context, job *Job) error
+
+// JobQueueConfig 任务队列配置
+type JobQueueConfig struct {
+	Workers      int           // 并发 worker 数量
+	MaxAttempts  int           // 默认最大尝试次数
+	PollInterval time.Duration // 没有任务时的轮询间隔
+	BaseBackoff  time.Duration // 第一次重试的等待时间
+	MaxBackoff   time.Duration // 重试等待时间上限
+	JobTimeout   time.Duration // 单个任务的执行超时
+	LockTimeout  time.Duration // running 状态超过该时长视为 worker 已崩溃，任务会被重新排队
+}
+
+// defaultJobQueueConfig 未配置或配置非法（如时长 <= 0）时使用的默认值
+var defaultJobQueueConfig = JobQueueConfig{
+	Workers:      4,
+	MaxAttempts:  5,
+	PollInterval: time.Second,
+	BaseBackoff:  2 * time.Second,
+	MaxBackoff:   10 * time.Minute,
+	JobTimeout:   time.Minute,
+	LockTimeout:  10 * time.Minute,
+}
+
+// LoadJobQueueConfig 从环境变量读取任务队列配置，非法的值在 NewJobQueue 中回退为默认值
+func LoadJobQueueConfig() JobQueueConfig {
+	d := defaultJobQueueConfig
+	return JobQueueConfig{
+		Workers:      getenvInt("JOB_WORKERS", d.Workers),
+		MaxAttempts:  getenvInt("JOB_MAX_ATTEMPTS", d.MaxAttempts),
+		PollInterval: getenvDuration("JOB_POLL_INTERVAL", d.PollInterval),
+		BaseBackoff:  getenvDuration("JOB_BASE_BACKOFF", d.BaseBackoff),
+		MaxBackoff:   getenvDuration("JOB_MAX_BACKOFF", d.MaxBackoff),
+		JobTimeout:   getenvDuration("JOB_TIMEOUT", d.JobTimeout),
+		LockTimeout:  getenvDuration("JOB_LOCK_TIMEOUT", d.LockTimeout),
+	}
+}
+
+// withDefaults 非正数的时长回退为默认值，避免 time.NewTicker 因 PollInterval <= 0 panic
+func (cfg JobQueueConfig) withDefaults() JobQueueConfig {
+	d := defaultJobQueueConfig
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	for _, v := range []struct {
+		field *time.Duration
+		def   time.Duration
+	}{
+		{&cfg.PollInterval, d.PollInterval},
+		{&cfg.BaseBackoff, d.BaseBackoff},
+		{&cfg.MaxBackoff, d.MaxBackoff},
+		{&cfg.JobTimeout, d.JobTimeout},
+		{&cfg.LockTimeout, d.LockTimeout},
+	} {
+		if *v.field <= 0 {
+			*v.field = v.def
+		}
+	}
+	if cfg.MaxBackoff < cfg.BaseBackoff {
+		cfg.MaxBackoff = cfg.BaseBackoff
+	}
+	return cfg
+}
+
+// ErrUnknownJobType 没有注册对应处理函数的任务类型
+var ErrUnknownJobType = errors.New("unknown job type")
+
+// JobQueue 基于数据库的任务队列与 worker 池
+type JobQueue struct {
+	db       *gorm.DB
+	cfg      JobQueueConfig
+	handlers map[string]JobHandler
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewJobQueue 创建任务队列并迁移 jobs 表
+func NewJobQueue(db *gorm.DB, cfg JobQueueConfig) (*JobQueue, error) {
+	cfg = cfg.withDefaults()
+	if err := db.AutoMigrate(&Job{}); err != nil {
+		return nil, err
+	}
+	return &JobQueue{
+		db:       db,
+		cfg:      cfg,
+		handlers: map[string]JobHandler{},
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// Register 注册任务处理函数，需在 Start 之前调用
+func (q *JobQueue) Register(jobType string, handler JobHandler) {
+	q.handlers[jobType] = handler
+}
+
+// Enqueue 创建一个立即可执行的任务
+func (q *JobQueue) Enqueue(ctx context.Context, jobType string, payload interface{}) (*Job, error) {
+	return q.EnqueueAt(ctx, jobType, payload, time.Now())
+}
+
+// EnqueueAt 创建一个在 runAt 之后执行的任务
+func (q *JobQueue) EnqueueAt(ctx context.Context, jobType string, payload interface{}, runAt time.Time) (*Job, error) {
+	if _, ok := q.handlers[jobType]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownJobType, jobType)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	tenant, _ := TenantFrom(ctx)
+	job := &Job{
+		Tenant:      tenant,
+		Type:        jobType,
+		Payload:     data,
+		Status:      JobPending,
+		MaxAttempts: q.cfg.MaxAttempts,
+		RunAt:       runAt,
+	}
+	if err := q.db.WithContext(ctx).Create(job).Error; err != nil {
+		return nil, err
+	}
+	q.notify()
+	return job, nil
+}
+
+// ForTenant ctx 中租户的任务，没有租户时只包含系统任务
+func (q *JobQueue) ForTenant(ctx context.Context) *gorm.DB {
+	tenant, _ := TenantFrom(ctx)
+	return q.db.WithContext(ctx).Model(&Job{}).Where("tenant = ?", tenant)
+}
+
+// Retry 将 ctx 中租户的失败或死信任务重置为待执行，并清零尝试次数
+func (q *JobQueue) Retry(ctx context.Context, id uint) (*Job, error) {
+	var job Job
+	if err := q.ForTenant(ctx).First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	orm := q.db.WithContext(ctx)
+	if job.Status == JobRunning {
+		return nil, fmt.Errorf("job %d is running", id)
+	}
+	err := orm.Model(&job).Updates(map[string]interface{}{
+		"status":      JobPending,
+		"attempts":    0,
+		"run_at":      time.Now(),
+		"locked_at":   nil,
+		"finished_at": nil,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	q.notify()
+	if err := orm.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start 恢复超时未完成的任务并启动 worker
+func (q *JobQueue) Start() error {
+	err := q.db.Model(&Job{}).
+		Where("status = ? AND locked_at < ?", JobRunning, time.Now().Add(-q.cfg.LockTimeout)).
+		Updates(map[string]interface{}{"status": JobPending, "locked_at": nil}).Error
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+	return nil
+}
+
+// Shutdown 停止领取新任务，并等待正在执行的任务完成
+// ctx 到期时直接返回，未完成的任务保持 running 状态，下次启动超过 LockTimeout 后会被重新排队
+func (q *JobQueue) Shutdown(ctx context.Context) error {
+	if q.cancel == nil {
+		return nil
+	}
+	q.cancel()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work 单个 worker 的主循环
+func (q *JobQueue) work(ctx context.Context) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		// 有任务就连续处理，直到队列为空
+		for ctx.Err() == nil {
+			job, err := q.claim()
+			if err != nil {
+				log.Println("job claim:", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			q.run(job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim 领取一个到期的任务，没有可执行任务时返回 nil
+func (q *JobQueue) claim() (*Job, error) {
+	for {
+		var job Job
+		err := q.db.Where("status = ? AND run_at <= ?", JobPending, time.Now()).
+			Order("run_at, id").Limit(1).Find(&job).Error
+		if err != nil || job.ID == 0 {
+			return nil, err
+		}
+		now := time.Now()
+		res := q.db.Model(&Job{}).
+			Where("id = ? AND status = ?", job.ID, JobPending).
+			Updates(map[string]interface{}{"status": JobRunning, "locked_at": now, "attempts": job.Attempts + 1})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			job.Status = JobRunning
+			job.LockedAt = &now
+			job.Attempts++
+			return &job, nil
+		}
+		// 被其他 worker 抢先领取，继续找下一个
+	}
+}
+
+// run 执行任务并记录结果
+// 执行过程不受 Shutdown 取消影响，保证优雅关停时已领取的任务能够执行完
+func (q *JobQueue) run(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.cfg.JobTimeout)
+	defer cancel()
+
+	err := q.invoke(ctx, job)
+	now := time.Now()
+	updates := map[string]interface{}{"locked_at": nil}
+	switch {
+	case err == nil:
+		updates["status"] = JobSucceeded
+		updates["last_error"] = ""
+		updates["finished_at"] = now
+	case job.Attempts >= job.MaxAttempts:
+		updates["status"] = JobDead
+		updates["last_error"] = err.Error()
+		updates["finished_at"] = now
+		log.Printf("job %d (%s) dead after %d attempts: %v", job.ID, job.Type, job.Attempts, err)
+	default:
+		updates["status"] = JobPending
+		updates["last_error"] = err.Error()
+		updates["run_at"] = now.Add(q.backoff(job.Attempts))
+	}
+	if err := q.db.Model(&Job{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+		log.Printf("job %d: save result: %v", job.ID, err)
+	}
+}
+
+// invoke 调用处理函数，并把 panic 转换为错误
+func (q *JobQueue) invoke(ctx context.Context, job *Job) (err error) {
+	handler, ok := q.handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownJobType, job.Type)
+	}
+	if job.Tenant != "" {
+		ctx = WithTenant(ctx, job.Tenant)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// backoff 计算第 attempts 次失败后的等待时间，带 ±20% 抖动
+func (q *JobQueue) backoff(attempts int) time.Duration {
+	d := q.cfg.BaseBackoff
+	for i := 1; i < attempts && d < q.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.cfg.MaxBackoff {
+		d = q.cfg.MaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestQueue(t *testing.T) (*JobQueue, *gorm.DB) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewJobQueue(db, JobQueueConfig{
+		Workers:      2,
+		MaxAttempts:  3,
+		PollInterval: 10 * time.Millisecond,
+		BaseBackoff:  time.Millisecond,
+		MaxBackoff:   5 * time.Millisecond,
+		JobTimeout:   time.Second,
+		LockTimeout:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue, db
+}
+
+// waitJob 等待任务进入期望状态
+func waitJob(t *testing.T, db *gorm.DB, id uint, status string) Job {
+	var job Job
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		db.First(&job, id)
+		if job.Status == status {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("任务 %d 期望状态 %s，实际 %s", id, status, job.Status)
+	return job
+}
+
+// TestJobQueueRetryAndDeadLetter 失败任务按次数重试，耗尽后进入死信，手动重试后可以成功
+func TestJobQueueRetryAndDeadLetter(t *testing.T) {
+	queue, db := newTestQueue(t)
+	var calls, healthy atomic.Int32
+	queue.Register("flaky", func(ctx context.Context, job *Job) error {
+		calls.Add(1)
+		if healthy.Load() == 1 {
+			return nil
+		}
+		return errors.New("boom")
+	})
+	if err := queue.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown(context.Background())
+
+	job, err := queue.Enqueue(context.Background(), "flaky", map[string]int{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := waitJob(t, db, job.ID, JobDead)
+	if dead.Attempts != 3 || calls.Load() != 3 || dead.LastError != "boom" {
+		t.Errorf("期望尝试 3 次后进入死信，得到 attempts=%d calls=%d err=%q", dead.Attempts, calls.Load(), dead.LastError)
+	}
+
+	healthy.Store(1)
+	if _, err := queue.Retry(context.Background(), job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if done := waitJob(t, db, job.ID, JobSucceeded); done.Attempts != 1 {
+		t.Errorf("手动重试后期望 attempts=1，得到 %d", done.Attempts)
+	}
+
+	if _, err := queue.Enqueue(context.Background(), "missing", nil); !errors.Is(err, ErrUnknownJobType) {
+		t.Errorf("未注册的任务类型期望 ErrUnknownJobType，得到 %v", err)
+	}
+}
+
+// TestJobQueueShutdownDrains 关停时等待已领取的任务执行完成
+func TestJobQueueShutdownDrains(t *testing.T) {
+	queue, db := newTestQueue(t)
+	started := make(chan struct{})
+	queue.Register("slow", func(ctx context.Context, job *Job) error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	if err := queue.Start(); err != nil {
+		t.Fatal(err)
+	}
+	job, _ := queue.Enqueue(context.Background(), "slow", nil)
+	<-started
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got Job
+	db.First(&got, job.ID)
+	if got.Status != JobSucceeded {
+		t.Errorf("关停后期望任务已完成，实际状态 %s", got.Status)
+	}
+}
+
+// TestJobQueueConfigDefaults 非法的配置回退为默认值，PollInterval <= 0 时 worker 不会 panic
+func TestJobQueueConfigDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  JobQueueConfig
+	}{
+		{"零值", JobQueueConfig{}},
+		{"负数", JobQueueConfig{Workers: -1, PollInterval: -time.Second, BaseBackoff: -1, MaxBackoff: -1, JobTimeout: -1, LockTimeout: -1}},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg.withDefaults()
+		if cfg.Workers < 1 || cfg.MaxAttempts < 1 || cfg.PollInterval <= 0 || cfg.JobTimeout <= 0 || cfg.LockTimeout <= 0 || cfg.MaxBackoff < cfg.BaseBackoff {
+			t.Errorf("%s: 回退后的配置不合法 %+v", tt.name, cfg)
+		}
+	}
+
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewJobQueue(db, JobQueueConfig{PollInterval: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWelcomeJobPayload 欢迎通知只保存用户 ID 和租户，加密的邮箱不以明文写入 jobs 表
+func TestWelcomeJobPayload(t *testing.T) {
+	t.Setenv("KMS_KEY_ID", "test-key")
+	t.Setenv("KMS_DEV_CMK", "0123456789abcdef0123456789abcdef")
+	app, h := newTestApp(t)
+	auth := []string{"Authorization", "Bearer " + loginToken(t, h, "acme")}
+	if code := doJSON(t, h, "POST", "/gorm/users", `{"name":"Tom","email":"tom@example.com"}`, nil, auth...); code != 200 {
+		t.Fatalf("创建用户期望 200，得到 %d", code)
+	}
+	var job Job
+	if err := app.DB.Where("type = ?", "welcome_notification").First(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(job.Payload), "tom@example.com") {
+		t.Errorf("任务参数不应包含邮箱明文: %s", job.Payload)
+	}
+	var p welcomePayload
+	if err := job.Decode(&p); err != nil || p.ID == 0 || job.Tenant != "acme" {
+		t.Errorf("任务参数不符合预期: %s", job.Payload)
+	}
+	if err := app.Queue.invoke(context.Background(), &job); err != nil {
+		t.Errorf("执行时期望重新读取用户，得到 %v", err)
+	}
+}
+
+// TestJobTenantIsolation 任务属于入队时的租户，管理接口只能查看和重试本租户的任务
+func TestJobTenantIsolation(t *testing.T) {
+	app, h := newTestApp(t)
+	app.Queue.Register("noop", func(ctx context.Context, job *Job) error {
+		if tenant, _ := TenantFrom(ctx); tenant != "acme" {
+			return fmt.Errorf("期望在 acme 下执行，得到 %q", tenant)
+		}
+		return nil
+	})
+	job, err := app.Queue.Enqueue(WithTenant(context.Background(), "acme"), "noop", map[string]string{"secret": "acme-only"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Queue.invoke(context.Background(), job); err != nil {
+		t.Error(err)
+	}
+	app.DB.Model(&Job{}).Where("id = ?", job.ID).Update("status", JobDead)
+
+	acme := []string{"Authorization", "Bearer " + loginToken(t, h, "acme")}
+	globex := []string{"Authorization", "Bearer " + loginToken(t, h, "globex")}
+	id := fmt.Sprint(job.ID)
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		headers    []string
+		expectCode int
+	}{
+		{"其他租户查看", "GET", "/admin/jobs/" + id, globex, 404},
+		{"其他租户重试", "POST", "/admin/jobs/" + id + "/retry", globex, 404},
+		{"本租户查看", "GET", "/admin/jobs/" + id, acme, 200},
+		{"本租户重试", "POST", "/admin/jobs/" + id + "/retry", acme, 200},
+	}
+	for _, c := range cases {
+		if code := doJSON(t, h, c.method, c.path, "", nil, c.headers...); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d", c.name, c.expectCode, code)
+		}
+	}
+	var list struct {
+		Total int64 `json:"total"`
+	}
+	doJSON(t, h, "GET", "/admin/jobs", "", &list, globex...)
+	if list.Total != 0 {
+		t.Errorf("其他租户的任务列表应为空，得到 %d", list.Total)
+	}
+}
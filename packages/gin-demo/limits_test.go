@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestBodyLimit 声明长度和分块传输的超限请求都返回 413
+func TestBodyLimit(t *testing.T) {
+	t.Setenv("BODY_LIMIT", "64")
+	_, h := newTestApp(t)
+	big := strings.Repeat("a", 100)
+
+	cases := []struct {
+		name       string
+		path       string
+		body       io.Reader
+		chunked    bool
+		expectCode int
+	}{
+		{"未超限", "/raw-body", strings.NewReader("rawdata=abc"), false, 200},
+		{"Content-Length 超限", "/raw-body", strings.NewReader(big), false, 413},
+		{"分块传输超限", "/raw-body", strings.NewReader(big), true, 413},
+		{"表单超限", "/all-params", strings.NewReader("a=" + big), true, 413},
+		{"JSON 超限", "/gorm/batch", strings.NewReader(`[{"name":"` + big + `"}]`), true, 413},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", c.path, c.body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.chunked {
+			// 未声明长度，只能在读取时发现超限
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d %s", c.name, c.expectCode, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestTimeout 超时中断 GORM 查询返回 504，handler 忽略超时时由中间件兜底
+func TestTimeout(t *testing.T) {
+	app, _ := newTestApp(t)
+	r := gin.New()
+	r.Use(Timeout(50 * time.Millisecond))
+	r.GET("/slow-query", func(c *gin.Context) {
+		// 无限递归的 CTE，只能被 context 中断
+		var n int64
+		err := app.DB.WithContext(c.Request.Context()).
+			Raw("WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT count(*) FROM c").Scan(&n).Error
+		if err != nil {
+			abortWithError(c, err, 500)
+			return
+		}
+		c.JSON(200, n)
+	})
+	r.GET("/slow-handler", func(c *gin.Context) {
+		<-c.Request.Context().Done()
+	})
+
+	for _, path := range []string{"/slow-query", "/slow-handler"} {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: 期望 504，得到 %d %s", path, w.Code, w.Body.String())
+		}
+		if cost := time.Since(start); cost > 2*time.Second {
+			t.Errorf("%s: 超时后应尽快返回，耗时 %v", path, cost)
+		}
+	}
+
+	// 客户端断开（context 被取消）映射为 503
+	if code := errorStatus(context.Canceled, 500); code != http.StatusServiceUnavailable {
+		t.Errorf("context.Canceled 期望 503，得到 %d", code)
+	}
+}
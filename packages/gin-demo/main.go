@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -13,9 +15,10 @@ import (
 	"time"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -25,13 +28,6 @@ type User struct {
 	Name string `json:"name"`
 }
 
-var initialUsers = []User{
-	{ID: 1, Name: "Alice"},
-	{ID: 2, Name: "Bob"},
-}
-
-var users = append([]User{}, initialUsers...)
-
 // Logger 是一个简单的中间件示例
 func Logger() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -50,30 +46,429 @@ type LoginForm struct {
 var identityKey = "id"
 
 // GORM模型定义（可与 User 结构体一致或更丰富）
+// TenantID 由租户回调自动维护，所有查询都会附加 tenant_id 条件
+// PasswordHash 为 bcrypt 哈希，由 admin users create/passwd 设置，不会出现在 JSON 响应中
+// OIDCIssuer/OIDCSubject 记录关联的 OIDC 账号，见 oidc.go
+// Email 加密保存（见 encrypted.go），未配置 KMS_KEY_ID 时只能为空
 type GormUser struct {
-	ID   uint   `gorm:"primaryKey" json:"id"`
-	Name string `json:"name"`
+	ID           uint            `gorm:"primaryKey" json:"id"`
+	Name         string          `json:"name"`
+	TenantID     string          `gorm:"index;not null;default:default" json:"tenant_id"`
+	PasswordHash string          `json:"-"`
+	Email        EncryptedString `json:"email"`
+	OIDCIssuer   string          `gorm:"column:oidc_issuer;index:idx_gorm_users_oidc" json:"-"`
+	OIDCSubject  string          `gorm:"column:oidc_subject;index:idx_gorm_users_oidc" json:"-"`
 }
 
 func main() {
 	// 设置 Gin 运行模式，可选 gin.DebugMode/gin.ReleaseMode/gin.TestMode
 	gin.SetMode(gin.ReleaseMode)
 
+	// 初始化 GORM（以 SQLite 为例，实际可用 MySQL/Postgres），连接串通过环境变量 DB_DSN 配置
+	db, err := openDB()
+	if err != nil {
+		log.Fatal("failed to connect database:", err)
+	}
+
+	// 命令行管理工具: gin-demo admin <command>，见 admin.go
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdmin(db, os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "admin:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := migrate(db); err != nil {
+		log.Fatal("failed to migrate database:", err)
+	}
+
+	// 初始化链路追踪（OTEL_TRACES_EXPORTER / OTEL_EXPORTER_OTLP_ENDPOINT，见 tracing.go）
+	shutdownTracing, err := InitTracing(context.Background())
+	if err != nil {
+		log.Fatal("failed to init tracing:", err)
+	}
+
+	app, err := NewApp(db)
+	if err != nil {
+		log.Fatal("failed to init app:", err)
+	}
+	r := setupRouter(app)
+
+	// 通过环境变量 PORT 设置端口（默认 8080），超时、TLS、mTLS、h2c 见 server.go
+	serverCfg, err := LoadServerConfig()
+	if err != nil {
+		log.Fatal("invalid server config:", err)
+	}
+	srv, certs, err := NewServer(serverCfg, r)
+	if err != nil {
+		log.Fatal("failed to init server:", err)
+	}
+	// 证书和策略规则热加载：文件变化或收到 SIGHUP 时重新读取
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if certs != nil {
+		go certs.Watch(watchCtx, serverCfg.ReloadInterval)
+	}
+	go app.Policies.Watch(watchCtx)
+	go app.Sessions.Watch(watchCtx) // 定期清理内存存储中的过期会话
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := app.Policies.Reload(watchCtx); err != nil {
+				log.Println("reload policies:", err)
+			}
+			if certs == nil {
+				continue
+			}
+			if err := certs.Reload(); err != nil {
+				log.Println("reload tls certificate:", err)
+				continue
+			}
+			log.Println("tls certificate reloaded")
+		}
+	}()
+
+	// 启动后台任务 worker
+	if err := app.Queue.Start(); err != nil {
+		log.Fatal("failed to start job queue:", err)
+	}
+
+	// 启动 HTTP 服务（非阻塞）
+	go func() {
+		var err error
+		if certs != nil {
+			// 证书由 TLSConfig 提供，这里不需要再传文件名
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("listen: %s\n", err)
+		}
+	}()
+	fmt.Println("服务已启动，监听地址:", serverCfg.Addr, describeTLS(serverCfg))
+
+	// 等待中断信号以优雅关停
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	fmt.Println("收到退出信号，正在优雅关停...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatal("Server Shutdown:", err)
+	}
+
+	// HTTP 服务停止后不会再产生新任务，等待 worker 执行完已领取的任务
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), getenvDuration("JOB_DRAIN_TIMEOUT", 30*time.Second))
+	defer drainCancel()
+	if err := app.Queue.Shutdown(drainCtx); err != nil {
+		log.Println("Job queue shutdown:", err)
+	}
+	// 最后刷新尚未导出的 span
+	if err := shutdownTracing(drainCtx); err != nil {
+		log.Println("Tracing shutdown:", err)
+	}
+	fmt.Println("服务已安全关闭")
+}
+
+// welcomePayload 欢迎通知任务的参数：只保存用户 ID（租户记录在 Job.Tenant），执行时重新读取用户，
+// 邮箱等加密字段的明文不会写入 jobs 表，也不会出现在 /admin/jobs 的响应中
+type welcomePayload struct {
+	ID uint `json:"id"`
+}
+
+// App 汇总路由依赖的组件，main 和测试都通过 NewApp + setupRouter 构造完整服务
+type App struct {
+	DB       *gorm.DB
+	Users    *TenantStores
+	Tenants  TenantSet // 已知租户（TENANTS）
+	Searcher UserSearcher
+	Queue    *JobQueue
+	Auth     *jwt.GinJWTMiddleware
+	Limiter  *TenantRateLimiter
+	Tracer   trace.TracerProvider
+	APIKeys  *APIKeyStore
+	Limits   RouteLimits // 各路由分组的请求体上限和超时
+	Assets   *AssetServer
+	Sessions *SessionManager
+	Policies *PolicyEngine
+	// Redirects 重定向白名单与签名，Links 短链接
+	Redirects *Redirector
+	Links     *ShortLinkStore
+	OIDC      *OIDCLogin // 未配置 OIDC_ISSUER 时为 nil
+	// CertIdentities 客户端证书 subject 到身份的映射（双向 TLS）
+	CertIdentities ClientCertIdentities
+}
+
+// NewApp 初始化检索、任务队列和 JWT 等组件，db 需已完成连接
+func NewApp(db *gorm.DB) (*App, error) {
+	// 多租户隔离：GORM 回调自动附加 tenant_id 条件
+	if err := RegisterTenantScope(db); err != nil {
+		return nil, err
+	}
+	// 字段级加密：EncryptedString/EncryptedJSON 字段读写时自动加解密（见 encrypted.go）
+	fields, err := LoadFieldEncryptor()
+	if err != nil {
+		return nil, err
+	}
+	if err := RegisterFieldEncryption(db, fields); err != nil {
+		return nil, err
+	}
+	// 链路追踪：每次 GORM 调用生成子 span
+	tp := otel.GetTracerProvider()
+	if err := db.Use(NewGormTracing(tp)); err != nil && !errors.Is(err, gorm.ErrRegistered) {
+		return nil, err
+	}
+	certIdentities, err := LoadClientCertIdentities()
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := LoadTenantSet()
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := LoadTenantRateLimiter()
+	if err != nil {
+		return nil, err
+	}
+
+	// 初始化全文检索（FTS5 不可用时自动退化为倒排索引）
+	searcher, err := NewUserSearcher(db)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("用户检索引擎:", searcher.Engine())
+
+	// 初始化后台任务队列（任务持久化在 jobs 表，失败按指数退避重试，耗尽次数后进入死信）
+	queue, err := NewJobQueue(db, LoadJobQueueConfig())
+	if err != nil {
+		return nil, err
+	}
+	// 新用户欢迎通知（演示：仅打印日志，实际可替换为邮件/短信发送）
+	queue.Register("welcome_notification", func(ctx context.Context, job *Job) error {
+		var p welcomePayload
+		if err := job.Decode(&p); err != nil {
+			return err
+		}
+		var user GormUser
+		if err := db.WithContext(ctx).First(&user, p.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil // 用户已删除，不再通知
+			}
+			return err
+		}
+		fmt.Printf("发送欢迎通知: 用户 %d %s\n", user.ID, user.Name)
+		return nil
+	})
+	// 重建全文检索索引
+	queue.Register("search_reindex", func(ctx context.Context, job *Job) error {
+		return searcher.Reindex(db.WithContext(ctx))
+	})
+
+	// 服务间调用的 API Key（哈希存储在 api_keys 表）
+	apiKeys, err := NewAPIKeyStore(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// 短链接（short_links 表）
+	links, err := NewShortLinkStore(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cookie 会话（SESSION_STORE 选择 cookie / memory / db）
+	sessions, err := LoadSessionManager(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// 请求策略（POLICY_FILE 和 policy_rules 表中的 expr 规则）
+	policies, err := LoadPolicyEngine(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// 静态资源（默认使用编译进二进制的 static 目录）
+	assets, err := LoadAssetServer()
+	if err != nil {
+		return nil, err
+	}
+
+	// gin-jwt 中间件实例
+	authMiddleware, err := newAuthMiddleware(db)
+	if err != nil {
+		return nil, err
+	}
+	// OIDC 登录，成功后签发同样的 gin-jwt token
+	var oidcLogin *OIDCLogin
+	if cfg := LoadOIDCConfig(); cfg != nil {
+		oidcLogin = NewOIDCLogin(*cfg, db, authMiddleware)
+		oidcLogin.storeEmail = fields != nil
+	}
+
+	return &App{
+		DB:       db,
+		Users:    NewTenantStores(initialUsers),
+		Tenants:  tenants,
+		Searcher: searcher,
+		Queue:    queue,
+		Auth:     authMiddleware,
+		Limiter:  limiter,
+		Tracer:   tp,
+		APIKeys:  apiKeys,
+		OIDC:     oidcLogin,
+		Limits:   LoadRouteLimits(),
+		Assets:   assets,
+		Sessions: sessions,
+		Policies: policies,
+
+		Redirects: LoadRedirector(),
+		Links:     links,
+
+		CertIdentities: certIdentities,
+	}, nil
+}
+
+// newAuthMiddleware gin-jwt 认证中间件配置，服务端与 admin token 共用同一份签名配置
+// 签名密钥和有效期通过环境变量 JWT_SECRET / JWT_TIMEOUT / JWT_MAX_REFRESH 配置
+func newAuthMiddleware(db *gorm.DB) (*jwt.GinJWTMiddleware, error) {
+	return jwt.New(&jwt.GinJWTMiddleware{
+		Realm:       "example zone",
+		Key:         []byte(getenv("JWT_SECRET", "secret key")),
+		Timeout:     getenvDuration("JWT_TIMEOUT", time.Hour),
+		MaxRefresh:  getenvDuration("JWT_MAX_REFRESH", time.Hour),
+		IdentityKey: identityKey,
+		PayloadFunc: func(data interface{}) jwt.MapClaims {
+			if v, ok := data.(*Principal); ok {
+				claims := jwt.MapClaims{
+					identityKey: v.ID,
+					"name":      v.Name,
+					tenantClaim: v.Tenant,
+					"kind":      v.Kind,
+				}
+				if v.Role != "" {
+					claims["role"] = v.Role
+				}
+				if len(v.Scopes) > 0 {
+					claims["scopes"] = v.Scopes
+				}
+				return claims
+			}
+			return jwt.MapClaims{}
+		},
+		IdentityHandler: func(c *gin.Context) interface{} {
+			if p, ok := principalFromClaims(jwt.ExtractClaims(c)); ok {
+				return p
+			}
+			return nil
+		},
+		Authenticator: func(c *gin.Context) (interface{}, error) {
+			var loginVals LoginForm
+			if err := c.ShouldBind(&loginVals); err != nil {
+				return "", jwt.ErrMissingLoginValues
+			}
+			username := loginVals.Username
+			password := loginVals.Password
+
+			// 先查当前租户下设置了密码的用户（admin users create/passwd）
+			// 名称不唯一，只在设置了密码的行中查找，避免同名的无密码记录遮住真正的账号
+			var user GormUser
+			res := db.WithContext(c.Request.Context()).Where("name = ? AND password_hash <> ''", username).Order("id").Limit(1).Find(&user)
+			if res.Error != nil {
+				return nil, res.Error
+			}
+			if res.RowsAffected == 1 {
+				if !checkPassword(user.PasswordHash, password) {
+					return nil, jwt.ErrFailedAuthentication
+				}
+				return &Principal{
+					ID:     int(user.ID),
+					Name:   user.Name,
+					Tenant: c.GetString(tenantKey),
+					Kind:   PrincipalUser,
+					Role:   "user",
+				}, nil
+			}
+
+			// 演示账号，admin 的角色为 admin，可在策略规则中通过 user.role 判断
+			if (username == "admin" && password == "123456") || (username == "alice" && password == "123456") {
+				role := "user"
+				if username == "admin" {
+					role = "admin"
+				}
+				// 登录时的租户由 TenantMiddleware 根据 X-Tenant 请求头确定（须在 TENANTS 中），写入 token 后不可更改
+				return &Principal{
+					ID:     1,
+					Name:   username,
+					Tenant: c.GetString(tenantKey),
+					Kind:   PrincipalUser,
+					Role:   role,
+				}, nil
+			}
+			return nil, jwt.ErrFailedAuthentication
+		},
+		Authorizator: func(data interface{}, c *gin.Context) bool {
+			// 细粒度的授权由策略规则统一判断（所有身份来源都适用），见 policy.go
+			if _, ok := data.(*Principal); ok {
+				return true
+			}
+			return false
+		},
+		Unauthorized: func(c *gin.Context, code int, message string) {
+			c.JSON(code, gin.H{"error": message})
+		},
+		TokenLookup:   "header: Authorization, query: token, cookie: jwt",
+		TokenHeadName: "Bearer",
+		TimeFunc:      time.Now,
+	})
+
+}
+
+// setupRouter 注册全局中间件与全部路由
+func setupRouter(app *App) *gin.Engine {
+	db, users, searcher, queue, authMiddleware := app.DB, app.Users, app.Searcher, app.Queue, app.Auth
+	limits := app.Limits
+
 	// r := gin.Default() // 原有代码
 	r := gin.New() // 使用 gin.New() 不自动注册 Logger/Recovery
+	// 只信任 TRUSTED_PROXIES 中的代理转发的 X-Forwarded-For，否则客户端可以伪造 IP 绕过按 IP 的限流
+	var proxies []string
+	if v := getenv("TRUSTED_PROXIES", ""); v != "" {
+		proxies = strings.Split(v, ",")
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		log.Println("invalid TRUSTED_PROXIES:", err)
+	}
 
 	// 注册全局中间件
+	r.Use(Compress(LoadCompressConfig())) // 响应压缩（zstd / br / gzip），包在最外层，压缩的是追加 trace_id 后的响应，见 compress.go
+	r.Use(TracingMiddleware(app.Tracer))  // 链路追踪，需放在其他中间件之前，后续中间件和 handler 都能拿到 trace
 	r.Use(Logger())
-	r.Use(gin.Recovery())     // 推荐加上 Recovery 中间件，防止 panic 导致服务崩溃
-	r.Use(TimingMiddleware()) // 请求耗时统计中间件
+	r.Use(gin.Recovery())                           // 推荐加上 Recovery 中间件，防止 panic 导致服务崩溃
+	r.Use(TimingMiddleware())                       // 请求耗时统计中间件
+	r.Use(ClientCertMiddleware(app.CertIdentities)) // 双向 TLS：客户端证书映射为身份
+	r.Use(APIKeyMiddleware(app.APIKeys))            // 服务间调用：X-API-Key / Authorization: ApiKey
+	r.Use(app.Sessions.Middleware())                // Cookie 会话：已登录的会话作为当前身份
+	// 解析租户（已认证身份中的租户，匿名请求只能在登录入口通过 X-Tenant 请求头选择），见 tenant.go
+	r.Use(TenantMiddleware(authMiddleware, app.Tenants, "/login-jwt", "/login-session", "/login/oidc"))
+	r.Use(RateLimitMiddleware(app.Limiter)) // 已认证按租户限流，匿名按客户端 IP 限流
+	r.Use(app.Policies.Middleware())        // 策略规则（expr 表达式），/admin/policies 不受规则约束，见 policy.go
 	// r.Use(AuthMiddleware()) // 简单鉴权中间件
 
-	// 静态文件服务，将 ./static 目录映射到 /static 路径
-	// 访问方式: http://localhost:8080/static/文件名
-	r.Static("/static", "./static")
+	// 静态资源服务（编译进二进制，STATIC_DIR 可改为读取磁盘目录），见 assets.go
+	// 带哈希的地址长期缓存: curl -i http://localhost:8080/static/app.<hash>.js
+	// 原始地址按 ETag 协商: curl -i http://localhost:8080/static/app.js
+	r.GET("/static/*filepath", app.Assets.Handler)
+	r.HEAD("/static/*filepath", app.Assets.Handler)
 
-	// 路由分组示例
-	api := r.Group("/api")
+	// 路由分组示例；请求体上限和超时按分组设置，见 limits.go
+	api := r.Group("/api", BodyLimit(limits.Body), Timeout(limits.Timeout))
 	{
 		// 示例: GET http://localhost:8080/api/ping
 		api.GET("/ping", func(c *gin.Context) {
@@ -121,117 +516,31 @@ func main() {
 		})
 	})
 
-	// 获取用户列表
-	// 调用方式: curl http://localhost:8080/users
-	r.GET("/users", func(c *gin.Context) {
-		c.JSON(http.StatusOK, users)
-	})
-
-	// 添加用户
-	// 调用方式: curl -X POST -H "Content-Type: application/json" -d '{"id":3,"name":"Charlie"}' http://localhost:8080/users
-	r.POST("/users", func(c *gin.Context) {
-		var newUser User
-		if err := c.ShouldBindJSON(&newUser); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		users = append(users, newUser)
-		c.JSON(http.StatusOK, newUser)
-	})
-
-	// 根据用户ID获取用户详情
-	// 调用方式: curl http://localhost:8080/users/1
-	r.GET("/users/:id", func(c *gin.Context) {
-		idStr := c.Param("id")
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
-			return
-		}
-		for _, user := range users {
-			if user.ID == id {
-				c.JSON(http.StatusOK, user)
-				return
-			}
-		}
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-	})
-
-	// 删除用户
-	// 调用方式: curl -X DELETE http://localhost:8080/users/1
-	r.DELETE("/users/:id", func(c *gin.Context) {
-		idStr := c.Param("id")
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
-			return
-		}
-		for i, user := range users {
-			if user.ID == id {
-				// 从切片中删除该用户
-				users = append(users[:i], users[i+1:]...)
-				c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
-				return
-			}
-		}
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-	})
-
-	// 更新用户信息
-	// 调用方式: curl -X PUT -H "Content-Type: application/json" -d '{"name":"NewName"}' http://localhost:8080/users/1
-	r.PUT("/users/:id", func(c *gin.Context) {
-		idStr := c.Param("id")
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
-			return
-		}
-		var updateData struct {
-			Name string `json:"name"`
-		}
-		if err := c.ShouldBindJSON(&updateData); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		for i, user := range users {
-			if user.ID == id {
-				users[i].Name = updateData.Name
-				c.JSON(http.StatusOK, users[i])
-				return
-			}
-		}
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	// 用户资源（内存存储），同一套 handler 挂载到多个 API 版本下，见 versioning.go
+	// 路径指定版本: curl http://localhost:8080/api/v1/users
+	//              curl http://localhost:8080/api/v2/users
+	// 按媒体类型协商: curl -H "Accept: application/vnd.gin-demo.v1+json" http://localhost:8080/api/users
+	// 旧路径 /users 保持 v1 的响应格式，只带废弃响应头（API_LEGACY_MODE=redirect 时 308 重定向到 /api/v1）
+	// v1 已废弃，响应中带 Deprecation / Sunset / Link 头: curl -i http://localhost:8080/api/v1/users
+	// 携带身份的请求需要 users:read / users:write，见 principal.go
+	versions := newAPIVersions()
+	userRoutes := userResourceRoutes(users)
+	userScopes := RequireScopes(ScopeUsersRead, ScopeUsersWrite)
+	versions.Mount(api.Group("", userScopes), userRoutes)
+	versions.MountLegacy(r.Group("", userScopes), "/api", userRoutes)
+
+	// 查看已支持的 API 版本及废弃信息
+	// 调用方式: curl http://localhost:8080/api/versions
+	api.GET("/versions", func(c *gin.Context) {
+		c.JSON(http.StatusOK, versions.Describe())
 	})
 
-	// 按用户名模糊查询用户
+	// 按用户名全文检索用户（倒排索引，支持相关度排序、前缀匹配、拼写容错和高亮）
 	// 调用方式: curl "http://localhost:8080/search?name=al"
-	r.GET("/search", func(c *gin.Context) {
-		query := c.Query("name")
-		var result []User
-		for _, user := range users {
-			if strings.Contains(strings.ToLower(user.Name), strings.ToLower(query)) {
-				result = append(result, user)
-			}
-		}
-		c.JSON(http.StatusOK, result)
-	})
-
-	// 统计用户数量
-	// 调用方式: curl http://localhost:8080/users/count
-	r.GET("/users/count", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"count": len(users),
-		})
-	})
-
-	// 重置用户列表为初始状态
-	// 调用方式: curl -X POST http://localhost:8080/users/reset
-	r.POST("/users/reset", func(c *gin.Context) {
-		users = append([]User{}, initialUsers...)
-		c.JSON(http.StatusOK, gin.H{
-			"message": "User list reset",
-			"users":   users,
-		})
+	// 关闭前缀/容错: curl "http://localhost:8080/search?q=alice&prefix=false&fuzzy=false"
+	r.GET("/search", userScopes, func(c *gin.Context) {
+		hits, _ := users.Of(c).Search(ParseSearchQuery(c))
+		c.JSON(http.StatusOK, hits)
 	})
 
 	// 参数绑定示例接口
@@ -257,18 +566,118 @@ func main() {
 		c.JSON(200, gin.H{"token": token})
 	})
 
-	// 重定向示例
-	// 调用方式: curl -i http://localhost:8080/redirect
+	// 安全重定向，目标需在 REDIRECT_ALLOWED_HOSTS 白名单中或为站内路径，见 redirect.go
+	// 调用方式: curl -i http://localhost:8080/redirect （默认跳转到 REDIRECT_DEFAULT_URL）
+	// curl -i "http://localhost:8080/redirect?url=https://www.baidu.com/s?wd=gin"
+	// 签名链接（白名单之外的地址）: curl -i "http://localhost:8080/redirect?token=<token>"
 	r.GET("/redirect", func(c *gin.Context) {
-		c.Redirect(302, "https://www.baidu.com")
+		var target string
+		var err error
+		switch {
+		case c.Query("token") != "":
+			target, err = app.Redirects.Verify(c.Query("token"))
+		case c.Query("url") != "":
+			target, err = app.Redirects.Check(c.Query("url"))
+		default:
+			target = app.Redirects.defaultURL
+		}
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.Redirect(302, target)
+	})
+
+	// 短链接跳转，每次访问点击数加一
+	// 调用方式: curl -i http://localhost:8080/r/abc1234
+	r.GET("/r/:code", func(c *gin.Context) {
+		link, err := app.Links.Resolve(c.Request.Context(), c.Param("code"))
+		switch {
+		case errors.Is(err, ErrShortLinkNotFound):
+			c.JSON(404, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrShortLinkExpired):
+			c.JSON(410, gin.H{"error": err.Error()})
+		case err != nil:
+			abortWithError(c, err, 500)
+		default:
+			c.Redirect(302, link.TargetURL)
+		}
 	})
 
+	// 短链接管理，需要登录（JWT / API Key / 客户端证书），API Key 需要 links:read / links:write
+	links := r.Group("/links", RequireIdentity(authMiddleware), RequireScopes(ScopeLinksRead, ScopeLinksWrite), BodyLimit(limits.Body), Timeout(limits.Timeout))
+	{
+		// 创建短链接，目标地址同样受白名单限制；code 为空时随机生成，expires_in 为空表示不过期
+		// curl -X POST -H "Authorization: Bearer <token>" -H "Content-Type: application/json" -d '{"url":"https://www.baidu.com","code":"baidu","expires_in":"24h"}' http://localhost:8080/links
+		links.POST("", func(c *gin.Context) {
+			var req struct {
+				URL       string `json:"url" binding:"required"`
+				Code      string `json:"code"`
+				ExpiresIn string `json:"expires_in"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				abortWithError(c, err, 400)
+				return
+			}
+			target, err := app.Redirects.Check(req.URL)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			var ttl time.Duration
+			if req.ExpiresIn != "" {
+				if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+					c.JSON(400, gin.H{"error": "invalid expires_in"})
+					return
+				}
+			}
+			// 记录创建者，格式 name@tenant
+			var createdBy string
+			if v, _ := c.Get(identityKey); v != nil {
+				if p, ok := v.(*Principal); ok {
+					createdBy = p.Name + "@" + p.Tenant
+				}
+			}
+			link, err := app.Links.Create(c.Request.Context(), target, req.Code, createdBy, ttl)
+			if errors.Is(err, ErrShortLinkExists) {
+				c.JSON(409, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, 400)
+				return
+			}
+			c.JSON(201, gin.H{"short_url": "/r/" + link.Code, "link": link})
+		})
+
+		// 查看短链接和点击数，只能查看自己创建的短链接（租户管理员可以查看租户内全部），其他人的短链接同样返回 404
+		// curl -H "Authorization: Bearer <token>" http://localhost:8080/links/baidu
+		links.GET("/:code", func(c *gin.Context) {
+			link, err := app.Links.Get(c.Request.Context(), c.Param("code"))
+			if err == nil {
+				p, _ := c.Get(identityKey)
+				if principal, _ := p.(*Principal); !link.Visible(principal) {
+					err = ErrShortLinkNotFound
+				}
+			}
+			if errors.Is(err, ErrShortLinkNotFound) {
+				c.JSON(404, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, link)
+		})
+	}
+
 	// 单文件上传示例
 	// 调用方式: curl -F "file=@/path/to/your/file.txt" http://localhost:8080/upload
-	r.POST("/upload", func(c *gin.Context) {
+	r.POST("/upload", BodyLimit(limits.UploadBody), func(c *gin.Context) {
 		file, err := c.FormFile("file")
 		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+			abortWithError(c, err, 400)
 			return
 		}
 		// 保存文件到当前目录
@@ -312,7 +721,7 @@ func main() {
 	// 获取所有请求头、所有查询参数、所有表单参数的演示接口
 	// 调用方式:
 	// curl -X POST "http://localhost:8080/all-params?foo=bar&baz=qux" -H "X-Test: testval" -d "a=1&b=2"
-	r.POST("/all-params", func(c *gin.Context) {
+	r.POST("/all-params", BodyLimit(limits.Body), func(c *gin.Context) {
 		// 获取所有请求头
 		headers := map[string]string{}
 		for k, v := range c.Request.Header {
@@ -324,7 +733,10 @@ func main() {
 			querys[k] = strings.Join(v, ",")
 		}
 		// 获取所有表单参数
-		c.Request.ParseForm()
+		if err := c.Request.ParseForm(); err != nil {
+			abortWithError(c, err, 400)
+			return
+		}
 		forms := map[string]string{}
 		for k, v := range c.Request.PostForm {
 			forms[k] = strings.Join(v, ",")
@@ -365,6 +777,126 @@ func main() {
 		c.JSON(200, gin.H{"mycookie": val})
 	})
 
+	// Cookie 会话，存储方式由 SESSION_STORE 决定，见 session.go
+	// 写入会话数据（没有会话时创建匿名会话）:
+	// curl -c jar -b jar -X PUT -d 'blue' http://localhost:8080/session/values/theme
+	r.PUT("/session/values/:key", BodyLimit(4<<10), func(c *gin.Context) {
+		value, err := c.GetRawData()
+		if err != nil {
+			abortWithError(c, err, 400)
+			return
+		}
+		s, err := app.Sessions.Set(c, c.Param("key"), string(value))
+		switch {
+		case errors.Is(err, ErrTooManySessions):
+			c.JSON(503, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, ErrTooManySessionValues):
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			abortWithError(c, err, 500)
+			return
+		}
+		c.JSON(200, s)
+	})
+
+	// 查看当前会话: curl -b jar http://localhost:8080/session
+	r.GET("/session", func(c *gin.Context) {
+		s, ok := SessionFrom(c)
+		if !ok {
+			c.JSON(404, gin.H{"error": ErrSessionNotFound.Error()})
+			return
+		}
+		c.JSON(200, s)
+	})
+
+	// 会话登录，账号校验与 /login-jwt 相同；成功后更换会话 ID，防止会话固定
+	// curl -c jar -b jar -X POST -d "username=admin&password=123456" http://localhost:8080/login-session
+	r.POST("/login-session", func(c *gin.Context) {
+		data, err := authMiddleware.Authenticator(c)
+		if err != nil {
+			c.JSON(401, gin.H{"error": err.Error()})
+			return
+		}
+		p, ok := data.(*Principal)
+		if !ok {
+			c.JSON(401, gin.H{"error": jwt.ErrFailedAuthentication.Error()})
+			return
+		}
+		s, err := app.Sessions.Login(c, p)
+		if errors.Is(err, ErrTooManySessions) {
+			c.JSON(503, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			abortWithError(c, err, 500)
+			return
+		}
+		c.JSON(200, gin.H{"session": s.PublicID(), "user": p, "expires_at": s.ExpiresAt})
+	})
+
+	// 注销会话，同时清除 gin-jwt 的 jwt cookie
+	// curl -c jar -b jar -X POST http://localhost:8080/logout-session
+	r.POST("/logout-session", func(c *gin.Context) {
+		if err := app.Sessions.Logout(c); err != nil {
+			abortWithError(c, err, 500)
+			return
+		}
+		c.SetCookie(authMiddleware.CookieName, "", -1, "/", "", c.Request.TLS != nil, true)
+		c.JSON(200, gin.H{"message": "logged out"})
+	})
+
+	// 当前用户的会话管理（会话或 JWT 登录均可），仅服务端存储（memory / db）支持
+	sessions := r.Group("/sessions", RequireIdentity(authMiddleware))
+	{
+		// 列出会话: curl -b jar http://localhost:8080/sessions
+		sessions.GET("", func(c *gin.Context) {
+			v, _ := c.Get(identityKey)
+			p, _ := v.(*Principal)
+			list, err := app.Sessions.List(c.Request.Context(), p)
+			if errors.Is(err, ErrSessionListUnsupported) {
+				c.JSON(501, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			current, _ := SessionFrom(c)
+			out := make([]gin.H, 0, len(list))
+			for _, s := range list {
+				out = append(out, gin.H{
+					"id":           s.PublicID(),
+					"current":      current != nil && current.ID == s.ID,
+					"user_agent":   s.UserAgent,
+					"ip":           s.IP,
+					"created_at":   s.CreatedAt,
+					"last_seen_at": s.LastSeenAt,
+					"expires_at":   s.ExpiresAt,
+				})
+			}
+			c.JSON(200, out)
+		})
+
+		// 吊销会话: curl -b jar -X DELETE http://localhost:8080/sessions/<id>
+		sessions.DELETE("/:id", func(c *gin.Context) {
+			v, _ := c.Get(identityKey)
+			p, _ := v.(*Principal)
+			err := app.Sessions.Revoke(c.Request.Context(), p, c.Param("id"))
+			switch {
+			case errors.Is(err, ErrSessionListUnsupported):
+				c.JSON(501, gin.H{"error": err.Error()})
+			case errors.Is(err, ErrSessionNotFound):
+				c.JSON(404, gin.H{"error": err.Error()})
+			case err != nil:
+				abortWithError(c, err, 500)
+			default:
+				c.JSON(200, gin.H{"message": "revoked"})
+			}
+		})
+	}
+
 	// 演示如何获取和设置自定义 context 变量（在中间件和 handler 之间传递数据）
 	// 调用方式: curl http://localhost:8080/context-demo
 	r.GET("/context-demo", func(c *gin.Context) {
@@ -383,10 +915,11 @@ func main() {
 
 	// 演示如何获取原始请求体（raw body）
 	// 调用方式: curl -X POST http://localhost:8080/raw-body -d 'rawdata=abc'
-	r.POST("/raw-body", func(c *gin.Context) {
+	// 超过 BODY_LIMIT 返回 413
+	r.POST("/raw-body", BodyLimit(limits.Body), func(c *gin.Context) {
 		body, err := c.GetRawData()
 		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+			abortWithError(c, err, 400)
 			return
 		}
 		c.JSON(200, gin.H{"raw_body": string(body)})
@@ -402,89 +935,32 @@ func main() {
 	})
 
 	// 统一处理未匹配的路由
+	// 浏览器访问前端路由（如 http://localhost:8080/dashboard）时返回 index.html，接口调用仍返回 JSON
 	r.NoRoute(func(c *gin.Context) {
+		if app.Assets.ServeIndex(c) {
+			return
+		}
 		c.JSON(404, gin.H{"error": "接口不存在"})
 	})
 
-	// 通过环境变量 PORT 设置端口，默认 8080
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: r,
-	}
-
-	// gin-jwt 中间件实例
-	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
-		Realm:       "example zone",
-		Key:         []byte("secret key"),
-		Timeout:     time.Hour,
-		MaxRefresh:  time.Hour,
-		IdentityKey: identityKey,
-		PayloadFunc: func(data interface{}) jwt.MapClaims {
-			if v, ok := data.(*User); ok {
-				return jwt.MapClaims{
-					identityKey: v.ID,
-					"name":      v.Name,
-				}
-			}
-			return jwt.MapClaims{}
-		},
-		IdentityHandler: func(c *gin.Context) interface{} {
-			claims := jwt.ExtractClaims(c)
-			return &User{
-				ID:   int(claims[identityKey].(float64)),
-				Name: claims["name"].(string),
-			}
-		},
-		Authenticator: func(c *gin.Context) (interface{}, error) {
-			var loginVals LoginForm
-			if err := c.ShouldBind(&loginVals); err != nil {
-				return "", jwt.ErrMissingLoginValues
-			}
-			username := loginVals.Username
-			password := loginVals.Password
-
-			// 简单演示，实际应查数据库
-			if (username == "admin" && password == "123456") || (username == "alice" && password == "123456") {
-				return &User{
-					ID:   1,
-					Name: username,
-				}, nil
-			}
-			return nil, jwt.ErrFailedAuthentication
-		},
-		Authorizator: func(data interface{}, c *gin.Context) bool {
-			// 可自定义权限
-			if _, ok := data.(*User); ok {
-				return true
-			}
-			return false
-		},
-		Unauthorized: func(c *gin.Context, code int, message string) {
-			c.JSON(code, gin.H{"error": message})
-		},
-		TokenLookup:   "header: Authorization, query: token, cookie: jwt",
-		TokenHeadName: "Bearer",
-		TimeFunc:      time.Now,
-	})
-	if err != nil {
-		log.Fatal("JWT Error:" + err.Error())
-	}
-
 	// 登录接口（自动生成token）
 	// curl -X POST -d "username=admin&password=123456" http://localhost:8080/login-jwt
 	r.POST("/login-jwt", authMiddleware.LoginHandler)
 
+	// OIDC 登录（授权码 + PKCE），需配置 OIDC_ISSUER 等环境变量，见 oidc.go
+	// 浏览器访问: http://localhost:8080/login/oidc （可带 X-Tenant 请求头指定租户）
+	// 提供方回调: /login/oidc/callback?code=...&state=...，返回与 /login-jwt 相同的 token
+	if app.OIDC != nil {
+		r.GET("/login/oidc", app.OIDC.Start)
+		r.GET("/login/oidc/callback", app.OIDC.Callback)
+	}
+
 	// 刷新token接口
 	r.GET("/refresh-token", authMiddleware.RefreshHandler)
 
 	// 受保护的路由分组
 	auth := r.Group("/auth")
-	auth.Use(authMiddleware.MiddlewareFunc())
+	auth.Use(RequireIdentity(authMiddleware)) // JWT 或已映射身份的客户端证书
 	{
 		// curl -H "Authorization: Bearer <token>" http://localhost:8080/auth/profile
 		auth.GET("/profile", func(c *gin.Context) {
@@ -496,120 +972,37 @@ func main() {
 		})
 	}
 
-	// 路由分组示例：以 /api/v1 为前缀，分组管理 RESTful 资源
-	v1 := r.Group("/api/v1")
-	{
-		// 用户资源 RESTful 路由
-		// GET /api/v1/users      - 获取用户列表
-		// POST /api/v1/users     - 创建用户
-		// GET /api/v1/users/:id  - 获取单个用户
-		// PUT /api/v1/users/:id  - 更新用户
-		// DELETE /api/v1/users/:id - 删除用户
-
-		v1.GET("/users", func(c *gin.Context) {
-			// ...可复用上面 /users 逻辑...
-			c.JSON(http.StatusOK, users)
-		})
-
-		v1.POST("/users", func(c *gin.Context) {
-			var newUser User
-			if err := c.ShouldBindJSON(&newUser); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-			users = append(users, newUser)
-			c.JSON(http.StatusOK, newUser)
-		})
-
-		v1.GET("/users/:id", func(c *gin.Context) {
-			idStr := c.Param("id")
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
-				return
-			}
-			for _, user := range users {
-				if user.ID == id {
-					c.JSON(http.StatusOK, user)
-					return
-				}
-			}
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		})
-
-		v1.PUT("/users/:id", func(c *gin.Context) {
-			idStr := c.Param("id")
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
-				return
-			}
-			var updateData struct {
-				Name string `json:"name"`
-			}
-			if err := c.ShouldBindJSON(&updateData); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-			for i, user := range users {
-				if user.ID == id {
-					users[i].Name = updateData.Name
-					c.JSON(http.StatusOK, users[i])
-					return
-				}
-			}
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		})
-
-		v1.DELETE("/users/:id", func(c *gin.Context) {
-			idStr := c.Param("id")
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
-				return
-			}
-			for i, user := range users {
-				if user.ID == id {
-					users = append(users[:i], users[i+1:]...)
-					c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
-					return
-				}
-			}
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		})
-	}
-
-	// 初始化 GORM（以 SQLite 为例，实际可用 MySQL/Postgres）
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
-	if err != nil {
-		log.Fatal("failed to connect database:", err)
-	}
-	db.AutoMigrate(&GormUser{})
-
 	// GORM 高级API分组
-	gormApi := r.Group("/gorm")
+	// 查询使用 db.WithContext(c.Request.Context())，超时（REQUEST_TIMEOUT）或客户端断开时中断 SQL
+	gormApi := r.Group("/gorm", userScopes, BodyLimit(limits.Body), Timeout(limits.Timeout))
 	{
 		// 创建用户
 		// curl -X POST -H "Content-Type: application/json" -d '{"name":"Tom"}' http://localhost:8080/gorm/users
 		gormApi.POST("/users", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var user GormUser
 			if err := c.ShouldBindJSON(&user); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
+				abortWithError(c, err, 400)
 				return
 			}
-			if err := db.Create(&user).Error; err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			if err := orm.Create(&user).Error; err != nil {
+				abortWithError(c, err, 500)
 				return
 			}
+			// 欢迎通知放到后台执行，不阻塞请求；用户已创建，客户端断开也要入队
+			if _, err := queue.Enqueue(context.WithoutCancel(c.Request.Context()), "welcome_notification", welcomePayload{ID: user.ID}); err != nil {
+				log.Println("enqueue welcome_notification:", err)
+			}
 			c.JSON(200, user)
 		})
 
 		// 查询所有用户
 		// curl http://localhost:8080/gorm/users
 		gormApi.GET("/users", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var users []GormUser
-			if err := db.Find(&users).Error; err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			if err := orm.Find(&users).Error; err != nil {
+				abortWithError(c, err, 500)
 				return
 			}
 			c.JSON(200, users)
@@ -618,10 +1011,14 @@ func main() {
 		// 查询单个用户
 		// curl http://localhost:8080/gorm/users/1
 		gormApi.GET("/users/:id", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var user GormUser
-			if err := db.First(&user, c.Param("id")).Error; err != nil {
+			if err := orm.First(&user, c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) {
 				c.JSON(404, gin.H{"error": "not found"})
 				return
+			} else if err != nil {
+				abortWithError(c, err, 500)
+				return
 			}
 			c.JSON(200, user)
 		})
@@ -629,26 +1026,40 @@ func main() {
 		// 更新用户
 		// curl -X PUT -H "Content-Type: application/json" -d '{"name":"Jerry"}' http://localhost:8080/gorm/users/1
 		gormApi.PUT("/users/:id", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var user GormUser
-			if err := db.First(&user, c.Param("id")).Error; err != nil {
+			if err := orm.First(&user, c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) {
 				c.JSON(404, gin.H{"error": "not found"})
 				return
+			} else if err != nil {
+				abortWithError(c, err, 500)
+				return
 			}
 			var update struct{ Name string }
 			if err := c.ShouldBindJSON(&update); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
+				abortWithError(c, err, 400)
+				return
+			}
+			// 只更新 name 列；Save 在未命中行时会退化为 upsert，可能覆盖其他租户的同主键记录
+			if err := orm.Model(&user).Update("name", update.Name).Error; err != nil {
+				abortWithError(c, err, 500)
 				return
 			}
-			user.Name = update.Name
-			db.Save(&user)
 			c.JSON(200, user)
 		})
 
 		// 删除用户
 		// curl -X DELETE http://localhost:8080/gorm/users/1
 		gormApi.DELETE("/users/:id", func(c *gin.Context) {
-			if err := db.Delete(&GormUser{}, c.Param("id")).Error; err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			id, err := strconv.Atoi(c.Param("id"))
+			if err != nil {
+				c.JSON(400, gin.H{"error": "invalid user id"})
+				return
+			}
+			orm := db.WithContext(c.Request.Context())
+			// 主键放在模型上，检索索引可以按 ID 增量删除
+			if err := orm.Delete(&GormUser{ID: uint(id)}).Error; err != nil {
+				abortWithError(c, err, 500)
 				return
 			}
 			c.JSON(200, gin.H{"message": "deleted"})
@@ -657,6 +1068,7 @@ func main() {
 		// 条件查询与分页
 		// curl "http://localhost:8080/gorm/query?name=Tom&page=1&page_size=2"
 		gormApi.GET("/query", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var users []GormUser
 			name := c.Query("name")
 			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
@@ -667,7 +1079,7 @@ func main() {
 			if pageSize < 1 {
 				pageSize = 10
 			}
-			query := db.Model(&GormUser{})
+			query := orm.Model(&GormUser{})
 			if name != "" {
 				query = query.Where("name LIKE ?", "%"+name+"%")
 			}
@@ -675,7 +1087,7 @@ func main() {
 			query.Count(&total)
 			query = query.Offset((page - 1) * pageSize).Limit(pageSize)
 			if err := query.Find(&users).Error; err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+				abortWithError(c, err, 500)
 				return
 			}
 			c.JSON(200, gin.H{
@@ -686,16 +1098,36 @@ func main() {
 			})
 		})
 
+		// 全文检索（相关度排序 + 前缀/容错匹配 + 高亮片段）
+		// curl "http://localhost:8080/gorm/search?q=tom&limit=10&offset=0"
+		gormApi.GET("/search", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
+			q := ParseSearchQuery(c)
+			hits, total, err := searcher.Search(orm, q)
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, gin.H{
+				"engine": searcher.Engine(),
+				"total":  total,
+				"limit":  q.Limit,
+				"offset": q.Offset,
+				"data":   hits,
+			})
+		})
+
 		// 排序
 		// curl "http://localhost:8080/gorm/sorted?order=desc"
 		gormApi.GET("/sorted", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var users []GormUser
 			order := c.DefaultQuery("order", "asc")
 			if order != "asc" && order != "desc" {
 				order = "asc"
 			}
-			if err := db.Order("id " + order).Find(&users).Error; err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			if err := orm.Order("id " + order).Find(&users).Error; err != nil {
+				abortWithError(c, err, 500)
 				return
 			}
 			c.JSON(200, users)
@@ -704,12 +1136,13 @@ func main() {
 		// 事务示例
 		// curl -X POST -H "Content-Type: application/json" -d '{"name":"TxUser"}' http://localhost:8080/gorm/tx
 		gormApi.POST("/tx", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var user GormUser
 			if err := c.ShouldBindJSON(&user); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
+				abortWithError(c, err, 400)
 				return
 			}
-			err := db.Transaction(func(tx *gorm.DB) error {
+			err := orm.Transaction(func(tx *gorm.DB) error {
 				if err := tx.Create(&user).Error; err != nil {
 					return err
 				}
@@ -717,7 +1150,7 @@ func main() {
 				return nil
 			})
 			if err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+				abortWithError(c, err, 500)
 				return
 			}
 			c.JSON(200, user)
@@ -726,39 +1159,239 @@ func main() {
 		// 批量插入
 		// curl -X POST -H "Content-Type: application/json" -d '[{"name":"A"},{"name":"B"}]' http://localhost:8080/gorm/batch
 		gormApi.POST("/batch", func(c *gin.Context) {
+			orm := db.WithContext(c.Request.Context())
 			var users []GormUser
 			if err := c.ShouldBindJSON(&users); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
+				abortWithError(c, err, 400)
 				return
 			}
-			if err := db.Create(&users).Error; err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
+			if err := orm.Create(&users).Error; err != nil {
+				abortWithError(c, err, 500)
 				return
 			}
 			c.JSON(200, users)
 		})
 	}
 
-	// 启动 HTTP 服务（非阻塞）
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
-	fmt.Println("服务已启动，监听端口:", port)
+	// 管理接口，需要 admin scope：角色为 admin 的用户、带 admin scope 的服务账号 token 或 API Key
+	// 获取 token: curl -X POST -d "username=admin&password=123456" http://localhost:8080/login-jwt
+	admin := r.Group("/admin", RequireIdentity(authMiddleware), RequireScope(ScopeAdmin), BodyLimit(limits.Body), Timeout(limits.AdminTimeout))
+	{
+		// 任务列表，可按状态和类型过滤，只包含当前租户的任务
+		// curl -H "Authorization: Bearer <token>" "http://localhost:8080/admin/jobs?status=dead&type=welcome_notification&page=1&page_size=20"
+		admin.GET("/jobs", func(c *gin.Context) {
+			var jobs []Job
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			if page < 1 {
+				page = 1
+			}
+			if pageSize < 1 {
+				pageSize = 20
+			}
+			query := queue.ForTenant(c.Request.Context())
+			if status := c.Query("status"); status != "" {
+				query = query.Where("status = ?", status)
+			}
+			if jobType := c.Query("type"); jobType != "" {
+				query = query.Where("type = ?", jobType)
+			}
+			var total int64
+			query.Count(&total)
+			if err := query.Order("id desc").Offset((page - 1) * pageSize).Limit(pageSize).Find(&jobs).Error; err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, gin.H{
+				"total":     total,
+				"page":      page,
+				"page_size": pageSize,
+				"data":      jobs,
+			})
+		})
 
-	// 等待中断信号以优雅关停
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	fmt.Println("收到退出信号，正在优雅关停...")
+		// 任务详情
+		// curl -H "Authorization: Bearer <token>" http://localhost:8080/admin/jobs/1
+		admin.GET("/jobs/:id", func(c *gin.Context) {
+			var job Job
+			if err := queue.ForTenant(c.Request.Context()).First(&job, c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "not found"})
+				return
+			} else if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, job)
+		})
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server Shutdown:", err)
+		// 手动重试任务（常用于死信任务）
+		// curl -X POST -H "Authorization: Bearer <token>" http://localhost:8080/admin/jobs/1/retry
+		admin.POST("/jobs/:id/retry", func(c *gin.Context) {
+			id, err := strconv.Atoi(c.Param("id"))
+			if err != nil {
+				c.JSON(400, gin.H{"error": "invalid job id"})
+				return
+			}
+			job, err := queue.Retry(c.Request.Context(), uint(id))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "not found"})
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, 409)
+				return
+			}
+			c.JSON(200, job)
+		})
+
+		// 异步重建全文检索索引
+		// curl -X POST -H "Authorization: Bearer <token>" http://localhost:8080/admin/search/reindex
+		admin.POST("/search/reindex", func(c *gin.Context) {
+			job, err := queue.Enqueue(c.Request.Context(), "search_reindex", nil)
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(202, job)
+		})
+
+		// 创建 API Key（当前租户），明文只在此次响应中返回
+		// expires_in 为空表示不过期
+		// curl -X POST -H "Authorization: Bearer <token>" -H "Content-Type: application/json" -d '{"name":"billing","scopes":["users:read"],"expires_in":"720h"}' http://localhost:8080/admin/api-keys
+		admin.POST("/api-keys", func(c *gin.Context) {
+			var req struct {
+				Name      string   `json:"name" binding:"required"`
+				Scopes    []string `json:"scopes"`
+				ExpiresIn string   `json:"expires_in"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				abortWithError(c, err, 400)
+				return
+			}
+			var ttl time.Duration
+			if req.ExpiresIn != "" {
+				var err error
+				if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+					c.JSON(400, gin.H{"error": "invalid expires_in"})
+					return
+				}
+			}
+			key, plaintext, err := app.APIKeys.Create(c.Request.Context(), req.Name, req.Scopes, ttl)
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(201, gin.H{"key": plaintext, "api_key": key})
+		})
+
+		// API Key 列表（不含明文和哈希）
+		// curl -H "Authorization: Bearer <token>" http://localhost:8080/admin/api-keys
+		admin.GET("/api-keys", func(c *gin.Context) {
+			keys, err := app.APIKeys.List(c.Request.Context())
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, keys)
+		})
+
+		// 吊销 API Key，立即生效
+		// curl -X DELETE -H "Authorization: Bearer <token>" http://localhost:8080/admin/api-keys/1
+		admin.DELETE("/api-keys/:id", func(c *gin.Context) {
+			id, err := strconv.Atoi(c.Param("id"))
+			if err != nil {
+				c.JSON(400, gin.H{"error": "invalid api key id"})
+				return
+			}
+			key, err := app.APIKeys.Revoke(c.Request.Context(), uint(id))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "not found"})
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, key)
+		})
+
+		// 签发重定向 token，可跳转到白名单之外的地址，默认 10 分钟有效
+		// curl -X POST -H "Authorization: Bearer <token>" -H "Content-Type: application/json" -d '{"url":"https://example.com/welcome","expires_in":"1h"}' http://localhost:8080/admin/redirect-tokens
+		admin.POST("/redirect-tokens", func(c *gin.Context) {
+			var req struct {
+				URL       string `json:"url" binding:"required"`
+				ExpiresIn string `json:"expires_in"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				abortWithError(c, err, 400)
+				return
+			}
+			ttl := 10 * time.Minute
+			if req.ExpiresIn != "" {
+				var err error
+				if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+					c.JSON(400, gin.H{"error": "invalid expires_in"})
+					return
+				}
+			}
+			token, err := app.Redirects.Sign(req.URL, ttl)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(201, gin.H{"token": token, "redirect_url": "/redirect?token=" + url.QueryEscape(token)})
+		})
+
+		// 策略规则管理，见 policy.go；只能查看全局规则和本租户的规则，只能修改本租户的规则
+		// curl -H "Authorization: Bearer <token>" http://localhost:8080/admin/policies
+		admin.GET("/policies", func(c *gin.Context) {
+			c.JSON(200, gin.H{"mode": app.Policies.Mode(), "rules": app.Policies.RulesFor(c.GetString(tenantKey))})
+		})
+		// 新增或覆盖数据库中的规则，表达式无法编译时返回 400，保存后立即生效
+		// curl -X PUT -H "Authorization: Bearer <token>" -H "Content-Type: application/json" -d '{"expression":"user.role == \"admin\" || request.method == \"GET\"","routes":["/gorm/*"],"audit":true}' http://localhost:8080/admin/policies/gorm-write
+		admin.PUT("/policies/:name", func(c *gin.Context) {
+			var rule PolicyRule
+			if err := c.ShouldBindJSON(&rule); err != nil {
+				abortWithError(c, err, 400)
+				return
+			}
+			rule.Name = c.Param("name")
+			err := app.Policies.Save(c.Request.Context(), &rule)
+			if errors.Is(err, ErrInvalidPolicy) {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, rule)
+		})
+		// curl -X DELETE -H "Authorization: Bearer <token>" http://localhost:8080/admin/policies/gorm-write
+		admin.DELETE("/policies/:name", func(c *gin.Context) {
+			err := app.Policies.Delete(c.Request.Context(), c.Param("name"))
+			if errors.Is(err, ErrPolicyNotFound) {
+				c.JSON(404, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, 500)
+				return
+			}
+			c.JSON(200, gin.H{"deleted": c.Param("name")})
+		})
+		// 重新读取规则文件和数据库（也可以向进程发送 SIGHUP）
+		// curl -X POST -H "Authorization: Bearer <token>" http://localhost:8080/admin/policies/reload
+		admin.POST("/policies/reload", func(c *gin.Context) {
+			if err := app.Policies.Reload(c.Request.Context()); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"mode": app.Policies.Mode(), "rules": app.Policies.RulesFor(c.GetString(tenantKey))})
+		})
 	}
-	fmt.Println("服务已安全关闭")
+
+	return r
 }
 
 // TimingMiddleware 统计请求耗时的中间件
@@ -767,7 +1400,7 @@ func TimingMiddleware() gin.HandlerFunc {
 		start := time.Now()
 		c.Next()
 		cost := time.Since(start)
-		fmt.Printf("请求 %s 耗时: %v\n", c.Request.URL.Path, cost)
+		fmt.Printf("请求 %s 耗时: %v 状态: %d trace_id: %s\n", c.Request.URL.Path, cost, c.Writer.Status(), TraceID(c.Request.Context()))
 	}
 }
 
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+/*
+OIDC 登录（授权码模式 + PKCE）
+
+1. GET /login/oidc           生成 state / nonce / PKCE verifier，302 跳转到 OIDC 提供方的授权页
+2. GET /login/oidc/callback  校验 state，用授权码和 verifier 换取 token，按提供方 JWKS 校验 ID Token 和 nonce，
+                             关联或创建本地 GormUser，最后签发与 /login-jwt 相同的 gin-jwt token
+
+配置（设置 OIDC_ISSUER 后启用）：
+- OIDC_ISSUER         提供方地址，通过 {issuer}/.well-known/openid-configuration 自动发现端点
+- OIDC_CLIENT_ID / OIDC_CLIENT_SECRET
+- OIDC_REDIRECT_URL   回调地址，如 http://localhost:8080/login/oidc/callback
+- OIDC_SCOPES         默认 "openid profile email"
+- OIDC_MAX_PENDING    同时进行中的登录数上限，默认 10000，超过时 /login/oidc 返回 503
+
+关联规则（均在登录租户内）：
+- 已经关联过 (issuer, subject) 的用户直接登录
+- 否则创建新用户；不按邮箱自动关联已有的本地用户，提供方声明的邮箱不能证明对本地账号的所有权
+- 新用户的名称为 oidc:<issuer 主机>:<subject>，不使用提供方可控的 name/preferred_username，
+  不会与本地用户或演示账号（admin/alice）重名
+- 新用户的邮箱（email_verified 为 true 时）加密保存，未配置字段加密（KMS_KEY_ID）时不保存
+*/
+
+const (
+	// oidcStateCookie 保存 state，回调时比对，防止登录 CSRF
+	oidcStateCookie = "oidc_state"
+	// oidcLoginTTL 从跳转到回调的最长时间
+	oidcLoginTTL = 10 * time.Minute
+	// oidcSweepInterval 清理过期登录的最小间隔
+	oidcSweepInterval = time.Minute
+	// defaultOIDCMaxPending 默认的进行中登录数上限
+	defaultOIDCMaxPending = 10000
+)
+
+// OIDCConfig OIDC 客户端配置
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	MaxPending   int
+}
+
+// LoadOIDCConfig 从环境变量读取配置，未设置 OIDC_ISSUER 时返回 nil
+func LoadOIDCConfig() *OIDCConfig {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	return &OIDCConfig{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(getenv("OIDC_SCOPES", "openid profile email")),
+		MaxPending:   getenvInt("OIDC_MAX_PENDING", defaultOIDCMaxPending),
+	}
+}
+
+// oidcPending 一次进行中的登录
+type oidcPending struct {
+	verifier string
+	nonce    string
+	tenant   string
+	expires  time.Time
+}
+
+// OIDCLogin OIDC 登录流程
+type OIDCLogin struct {
+	cfg  OIDCConfig
+	db   *gorm.DB
+	auth *jwt.GinJWTMiddleware
+	// storeEmail 保存提供方验证过的邮箱，邮箱加密保存，未启用字段加密时不保存
+	storeEmail bool
+
+	// 提供方在第一次登录时才发现，启动时提供方不可用不影响服务启动
+	initMu   sync.Mutex
+	provider *oidc.Provider
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	mu        sync.Mutex
+	pending   map[string]oidcPending
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewOIDCLogin 创建登录流程，auth 用于签发本地 token
+func NewOIDCLogin(cfg OIDCConfig, db *gorm.DB, auth *jwt.GinJWTMiddleware) *OIDCLogin {
+	return &OIDCLogin{
+		cfg:     cfg,
+		db:      db,
+		auth:    auth,
+		pending: map[string]oidcPending{},
+		now:     time.Now,
+	}
+}
+
+// discover 发现提供方端点，失败时下次请求重试
+func (l *OIDCLogin) discover(ctx context.Context) error {
+	l.initMu.Lock()
+	defer l.initMu.Unlock()
+	if l.provider != nil {
+		return nil
+	}
+	provider, err := oidc.NewProvider(ctx, l.cfg.Issuer)
+	if err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+	l.provider = provider
+	l.oauth = &oauth2.Config{
+		ClientID:     l.cfg.ClientID,
+		ClientSecret: l.cfg.ClientSecret,
+		RedirectURL:  l.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       l.cfg.Scopes,
+	}
+	l.verifier = provider.Verifier(&oidc.Config{ClientID: l.cfg.ClientID})
+	return nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Start 跳转到提供方授权页，登录租户取自当前请求（TenantMiddleware）
+func (l *OIDCLogin) Start(c *gin.Context) {
+	if err := l.discover(c.Request.Context()); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	state, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	if !l.remember(state, oidcPending{verifier: verifier, nonce: nonce, tenant: c.GetString(tenantKey)}) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many pending oidc logins"})
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcLoginTTL.Seconds()), "/login/oidc", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, l.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)))
+}
+
+// remember 保存进行中的登录，达到上限时返回 false。
+// 过期的登录按 oidcSweepInterval 定期清理，达到上限时立即清理一次
+func (l *OIDCLogin) remember(state string, p oidcPending) bool {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= oidcSweepInterval || len(l.pending) >= l.maxPending() {
+		for k, old := range l.pending {
+			if now.After(old.expires) {
+				delete(l.pending, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	if len(l.pending) >= l.maxPending() {
+		return false
+	}
+	p.expires = now.Add(oidcLoginTTL)
+	l.pending[state] = p
+	return true
+}
+
+func (l *OIDCLogin) maxPending() int {
+	if l.cfg.MaxPending > 0 {
+		return l.cfg.MaxPending
+	}
+	return defaultOIDCMaxPending
+}
+
+// take 取出并删除 state 对应的登录
+func (l *OIDCLogin) take(state string) (oidcPending, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.pending[state]
+	delete(l.pending, state)
+	if !ok || l.now().After(p.expires) {
+		return oidcPending{}, false
+	}
+	return p, true
+}
+
+// oidcClaims ID Token 中用到的字段
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// Callback 处理提供方回调并签发本地 token
+func (l *OIDCLogin) Callback(c *gin.Context) {
+	if e := c.Query("error"); e != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc: " + e, "description": c.Query("error_description")})
+		return
+	}
+	state := c.Query("state")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	if state == "" || cookie != state {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid oidc state"})
+		return
+	}
+	c.SetCookie(oidcStateCookie, "", -1, "/login/oidc", "", c.Request.TLS != nil, true)
+	pending, ok := l.take(state)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "oidc login expired"})
+		return
+	}
+	if err := l.discover(c.Request.Context()); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	token, err := l.oauth.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc code exchange failed: " + err.Error()})
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc: missing id_token"})
+		return
+	}
+	idToken, err := l.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc: " + err.Error()})
+		return
+	}
+	if idToken.Nonce != pending.nonce {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc: nonce mismatch"})
+		return
+	}
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc: " + err.Error()})
+		return
+	}
+
+	// 回调请求来自浏览器跳转，不带 X-Tenant，使用发起登录时的租户
+	user, err := l.linkUser(WithTenant(ctx, pending.tenant), idToken.Issuer, idToken.Subject, claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	jwtToken, expire, err := l.auth.TokenGenerator(&Principal{
+		ID:     int(user.ID),
+		Name:   user.Name,
+		Tenant: pending.tenant,
+		Kind:   PrincipalUser,
+		Role:   "user",
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	l.auth.LoginResponse(c, http.StatusOK, jwtToken, expire)
+}
+
+// linkUser 按关联规则找到或创建本地用户，ctx 需携带租户
+func (l *OIDCLogin) linkUser(ctx context.Context, issuer, subject string, claims oidcClaims) (*GormUser, error) {
+	var user GormUser
+	err := l.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("oidc_issuer = ? AND oidc_subject = ?", issuer, subject).Limit(1).Find(&user)
+		if res.Error != nil || res.RowsAffected == 1 {
+			return res.Error
+		}
+		user = GormUser{Name: oidcUserName(issuer, subject), OIDCIssuer: issuer, OIDCSubject: subject}
+		if claims.EmailVerified && l.storeEmail {
+			user.Email = NewEncryptedString(claims.Email)
+		}
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("oidc: link user: %w", err)
+	}
+	return &user, nil
+}
+
+// oidcUserName 新用户的本地名称，按提供方和 subject 命名空间化
+func oidcUserName(issuer, subject string) string {
+	host := issuer
+	if u, err := url.Parse(issuer); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return "oidc:" + host + ":" + subject
+}
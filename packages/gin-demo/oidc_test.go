@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// mockOIDCProvider 进程内的 OIDC 提供方：发现、授权、token（校验 PKCE）和 JWKS 端点
+type mockOIDCProvider struct {
+	*httptest.Server
+	t         *testing.T
+	key       *rsa.PrivateKey
+	signKey   *rsa.PrivateKey // 签名 ID Token 用的私钥，替换为其他私钥可模拟伪造的 token
+	subject   string
+	email     string
+	mu        sync.Mutex
+	authorize map[string]url.Values // code -> 授权请求参数
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{t: t, key: key, signKey: key, subject: "alice-sub", email: "alice@example.com", authorize: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &p.key.PublicKey, KeyID: "k1", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	// 授权端点直接“同意”，带 code 跳回客户端
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "pkce required", http.StatusBadRequest)
+			return
+		}
+		code := "code-" + q.Get("state")
+		p.mu.Lock()
+		p.authorize[code] = q
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		auth, ok := p.authorize[r.Form.Get("code")]
+		delete(p.authorize, r.Form.Get("code"))
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		clientID, secret, _ := r.BasicAuth()
+		if !ok || clientID != "gin-demo" || secret != "s3cret" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != auth.Get("code_challenge") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(auth.Get("nonce")),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) idToken(nonce string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.signKey},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "k1"))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            p.URL,
+		"sub":            p.subject,
+		"aud":            "gin-demo",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          p.email,
+		"email_verified": true,
+		"name":           "Alice OIDC",
+		// 提供方可控的用户名不会用作本地名称，不能冒充演示账号
+		"preferred_username": "admin",
+	})
+	sig, err := signer.Sign(claims)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	token, _ := sig.CompactSerialize()
+	return token
+}
+
+// oidcLogin 走完整的浏览器跳转流程，返回回调的状态码和响应
+func oidcLogin(t *testing.T, h http.Handler, tenant string, tamper func(callback *url.URL, cookie *http.Cookie)) (int, map[string]interface{}) {
+	req := httptest.NewRequest("GET", "/login/oidc", nil)
+	req.Header.Set("X-Tenant", tenant)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("发起登录期望 302，得到 %d %s", w.Code, w.Body.String())
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// 浏览器跟随跳转到提供方，提供方再跳回回调地址
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("提供方期望 302 到回调地址，得到 %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if tamper != nil {
+		tamper(callback, cookie)
+	}
+
+	req = httptest.NewRequest("GET", callback.RequestURI(), nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+// TestOIDCLogin 授权码 + PKCE 登录、ID Token 校验以及本地用户的关联和创建
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	t.Setenv("OIDC_ISSUER", provider.URL)
+	t.Setenv("OIDC_CLIENT_ID", "gin-demo")
+	t.Setenv("OIDC_CLIENT_SECRET", "s3cret")
+	t.Setenv("OIDC_REDIRECT_URL", "http://gin-demo.test/login/oidc/callback")
+	t.Setenv("KMS_KEY_ID", "test-key")
+	t.Setenv("KMS_DEV_CMK", "0123456789abcdef0123456789abcdef")
+	app, h := newTestApp(t)
+
+	// 已有同邮箱的本地用户，首次 OIDC 登录不会按邮箱关联到该用户，而是新建用户
+	acme, _ := tenantDB(app.DB, "acme")
+	existing := GormUser{Name: "alice", Email: NewEncryptedString("alice@example.com")}
+	if err := acme.Create(&existing).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := oidcLogin(t, h, "acme", nil)
+	if code != 200 || body["token"] == nil {
+		t.Fatalf("OIDC 登录期望 200 并返回 token，得到 %d %+v", code, body)
+	}
+	var profile struct {
+		User Principal `json:"user"`
+	}
+	doJSON(t, h, "GET", "/auth/profile", "", &profile, "Authorization", "Bearer "+body["token"].(string))
+	if profile.User.ID == 0 || profile.User.ID == int(existing.ID) || profile.User.Tenant != "acme" || profile.User.Kind != PrincipalUser || !strings.HasPrefix(profile.User.Name, "oidc:") {
+		t.Errorf("不应按邮箱关联到已有用户 %d@acme，得到 %+v", existing.ID, profile.User)
+	}
+	var unchanged GormUser
+	acme.First(&unchanged, existing.ID)
+	if unchanged.OIDCSubject != "" {
+		t.Errorf("已有用户不应被关联，得到 %+v", unchanged)
+	}
+
+	// 再次登录按 (issuer, subject) 找到同一用户；其他租户创建新用户
+	oidcLogin(t, h, "acme", nil)
+	var count int64
+	acme.Model(&GormUser{}).Count(&count)
+	if count != 2 {
+		t.Errorf("重复登录不应创建新用户，acme 下有 %d 个用户", count)
+	}
+	if code, _ := oidcLogin(t, h, "globex", nil); code != 200 {
+		t.Fatalf("globex 登录期望 200，得到 %d", code)
+	}
+	globex, _ := tenantDB(app.DB, "globex")
+	var created GormUser
+	globex.Where("oidc_subject = ?", "alice-sub").First(&created)
+	if created.ID == 0 || created.ID == existing.ID || !strings.HasPrefix(created.Name, "oidc:") || !strings.HasSuffix(created.Name, ":alice-sub") {
+		t.Errorf("globex 下期望新建用户，得到 %+v", created)
+	}
+	// 邮箱加密保存
+	var stored string
+	app.DB.Table("gorm_users").Select("email").Where("id = ?", created.ID).Row().Scan(&stored)
+	if created.Email.String != "alice@example.com" || !strings.HasPrefix(stored, "ake:") {
+		t.Errorf("期望邮箱加密保存，得到 %q，数据库中为 %q", created.Email.String, stored)
+	}
+
+	cases := []struct {
+		name       string
+		setup      func()
+		tamper     func(callback *url.URL, cookie *http.Cookie)
+		expectCode int
+	}{
+		{"state 与 cookie 不一致", nil, func(_ *url.URL, cookie *http.Cookie) { cookie.Value = "other" }, 400},
+		{"授权码被篡改", nil, func(cb *url.URL, _ *http.Cookie) {
+			q := cb.Query()
+			q.Set("code", "forged")
+			cb.RawQuery = q.Encode()
+		}, 401},
+		{"提供方返回错误", nil, func(cb *url.URL, _ *http.Cookie) {
+			cb.RawQuery = "error=access_denied&state=" + cb.Query().Get("state")
+		}, 401},
+		{"ID Token 签名不在 JWKS 中", func() {
+			provider.signKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+		}, nil, 401},
+	}
+	for _, c := range cases {
+		if c.setup != nil {
+			c.setup()
+		}
+		if code, body := oidcLogin(t, h, "acme", c.tamper); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d %+v", c.name, c.expectCode, code, body)
+		} else if code == 401 && !strings.Contains(body["error"].(string), "oidc") {
+			t.Errorf("%s: 错误信息不符合预期 %+v", c.name, body)
+		}
+	}
+}
+
+// TestOIDCPendingBounded 进行中的登录有上限，过期的登录会被清理
+func TestOIDCPendingBounded(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	t.Setenv("OIDC_ISSUER", provider.URL)
+	t.Setenv("OIDC_CLIENT_ID", "gin-demo")
+	t.Setenv("OIDC_REDIRECT_URL", "http://gin-demo.test/login/oidc/callback")
+	t.Setenv("OIDC_MAX_PENDING", "3")
+	app, h := newTestApp(t)
+	now := time.Now()
+	app.OIDC.now = func() time.Time { return now }
+
+	start := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/login/oidc", nil))
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := start(); code != http.StatusFound {
+			t.Fatalf("第 %d 次发起登录期望 302，得到 %d", i+1, code)
+		}
+	}
+	if code := start(); code != http.StatusServiceUnavailable {
+		t.Errorf("达到上限后期望 503，得到 %d", code)
+	}
+
+	now = now.Add(oidcLoginTTL + time.Second)
+	if code := start(); code != http.StatusFound {
+		t.Errorf("过期登录清理后期望 302，得到 %d", code)
+	}
+	if n := len(app.OIDC.pending); n != 1 {
+		t.Errorf("过期登录应被清理，剩余 %d 个", n)
+	}
+}
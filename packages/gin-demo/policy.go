@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+/*
+基于 expr 表达式的请求策略
+
+规则来自 POLICY_FILE（JSON 数组）和 policy_rules 表。每条规则：
+- name        规则名，用于管理接口和审计日志
+- expression  expr 表达式，结果必须是 bool，例如 user.role == "admin" || request.method == "GET"
+- routes      生效的路由，形如 "/gorm/*"、"DELETE /auth/*"，匹配 gin 的路由模板（/user/:name）；为空时对所有请求生效
+- audit       为 true 时只记录结果不拦截，用于上线前试运行
+
+规则文件中的规则是全局规则，对所有租户生效；管理接口保存的规则属于当前租户（tenant 字段），只对该租户的请求生效，
+一个租户的管理员只能查看和修改本租户的规则，不能覆盖全局规则，也不能影响其他租户。
+数据库中 tenant 为空的规则（升级前保存的规则）同样作为全局规则，只能直接修改数据库。
+
+请求命中的所有规则都返回 true 才放行；表达式执行出错或结果不是 bool 时按拒绝处理。
+规则在加载时编译一次，之后每个请求只执行编译好的程序。
+/admin/policies 下的管理接口不执行规则（仍需要 admin scope），避免错误的规则把管理员也拦在外面。
+
+表达式可用的变量：
+- user      当前身份 {id, name, tenant, kind, role, scopes}，未登录时 kind 为 "anonymous"
+- claims    JWT 原始 claims，未携带 JWT 时为空
+- request   {method, path, route, ip, query}，route 为路由模板
+- params    路径参数，例如 params.name
+- headers   请求头，key 为小写，例如 headers["x-tenant"]
+- tenant    当前租户
+- authenticated  是否已登录
+
+配置：
+- POLICY_MODE             enforce（默认）拦截，audit 全部规则只记录不拦截，off 关闭
+- POLICY_FILE             规则文件
+- POLICY_RELOAD_INTERVAL  定期重新加载的间隔，默认 30s，0 表示只在 SIGHUP 或管理接口调用时重新加载
+*/
+
+// 策略模式
+const (
+	PolicyEnforce = "enforce"
+	PolicyAudit   = "audit"
+	PolicyOff     = "off"
+)
+
+var (
+	// ErrPolicyNotFound 规则不存在
+	ErrPolicyNotFound = errors.New("policy rule not found")
+	// ErrInvalidPolicy 规则无法编译
+	ErrInvalidPolicy = errors.New("invalid policy rule")
+)
+
+// policyAdminRoutes 策略管理接口的路由前缀，不受规则约束
+const policyAdminRoutes = "/admin/policies"
+
+// PolicyRule 一条命名的策略规则，持久化在 policy_rules 表，名称在租户内唯一
+// Tenant 为空表示全局规则；规则在启动时跨租户加载，所以字段不叫 TenantID、不走租户回调
+type PolicyRule struct {
+	ID          uint      `gorm:"primaryKey" json:"-"`
+	Tenant      string    `gorm:"uniqueIndex:idx_policy_rules_tenant_name;not null;default:''" json:"tenant,omitempty"`
+	Name        string    `gorm:"uniqueIndex:idx_policy_rules_tenant_name;not null" json:"name"`
+	Expression  string    `gorm:"not null" json:"expression"`
+	Routes      []string  `gorm:"serializer:json" json:"routes,omitempty"`
+	Audit       bool      `json:"audit"`
+	Description string    `json:"description,omitempty"`
+	Source      string    `gorm:"-" json:"source"` // file 或 db
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// visibleTo 判断规则是否对 tenant 生效：全局规则和该租户自己的规则
+func (r *PolicyRule) visibleTo(tenant string) bool {
+	return r.Tenant == "" || r.Tenant == tenant
+}
+
+// appliesTo 判断规则是否对当前路由生效
+func (r *PolicyRule) appliesTo(method, route string) bool {
+	if len(r.Routes) == 0 {
+		return true
+	}
+	for _, pattern := range r.Routes {
+		if m, p, ok := strings.Cut(pattern, " "); ok {
+			if !strings.EqualFold(m, method) {
+				continue
+			}
+			pattern = strings.TrimSpace(p)
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(route, prefix) {
+				return true
+			}
+		} else if route == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyDecision 一次规则判定的结果，用于审计日志
+type PolicyDecision struct {
+	Rule     string
+	Allowed  bool
+	Enforced bool // false 表示审计模式，结果不影响请求
+	Err      error
+	Method   string
+	Route    string
+	User     string
+}
+
+type compiledRule struct {
+	PolicyRule
+	program *vm.Program
+}
+
+// policySet 一次加载的全部规则，加载后只读，通过原子指针整体替换
+type policySet struct {
+	rules       []*compiledRule
+	fingerprint string
+	loadedAt    time.Time
+}
+
+// PolicyEngine 加载、编译并执行策略规则
+type PolicyEngine struct {
+	db       *gorm.DB
+	file     string
+	mode     string
+	interval time.Duration
+	mu       sync.Mutex // 串行化加载和修改，保证数据库中的规则与生效的规则一致
+	current  atomic.Pointer[policySet]
+	logf     func(PolicyDecision)
+}
+
+// LoadPolicyEngine 从环境变量读取配置并加载规则，规则编译失败时返回错误
+func LoadPolicyEngine(db *gorm.DB) (*PolicyEngine, error) {
+	mode := getenv("POLICY_MODE", PolicyEnforce)
+	if mode != PolicyEnforce && mode != PolicyAudit && mode != PolicyOff {
+		return nil, fmt.Errorf("invalid POLICY_MODE %q", mode)
+	}
+	e, err := NewPolicyEngine(db, os.Getenv("POLICY_FILE"), mode)
+	if err != nil {
+		return nil, err
+	}
+	e.interval = getenvDuration("POLICY_RELOAD_INTERVAL", 30*time.Second)
+	return e, nil
+}
+
+// NewPolicyEngine 创建引擎、迁移 policy_rules 表并加载规则，file 为空时只使用数据库中的规则
+func NewPolicyEngine(db *gorm.DB, file, mode string) (*PolicyEngine, error) {
+	if err := db.AutoMigrate(&PolicyRule{}); err != nil {
+		return nil, err
+	}
+	// 名称曾经全局唯一，改为在租户内唯一
+	if m := db.Migrator(); m.HasIndex(&PolicyRule{}, "idx_policy_rules_name") {
+		if err := m.DropIndex(&PolicyRule{}, "idx_policy_rules_name"); err != nil {
+			return nil, err
+		}
+	}
+	e := &PolicyEngine{db: db, file: file, mode: mode, logf: logPolicyDecision}
+	e.current.Store(&policySet{})
+	if err := e.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Mode 当前模式
+func (e *PolicyEngine) Mode() string {
+	return e.mode
+}
+
+// Rules 当前生效的全部规则（所有租户）
+func (e *PolicyEngine) Rules() []PolicyRule {
+	set := e.current.Load()
+	rules := make([]PolicyRule, len(set.rules))
+	for i, r := range set.rules {
+		rules[i] = r.PolicyRule
+	}
+	return rules
+}
+
+// RulesFor 对 tenant 生效的规则：全局规则和该租户的规则
+func (e *PolicyEngine) RulesFor(tenant string) []PolicyRule {
+	rules := []PolicyRule{}
+	for _, r := range e.current.Load().rules {
+		if r.visibleTo(tenant) {
+			rules = append(rules, r.PolicyRule)
+		}
+	}
+	return rules
+}
+
+// loadRules 读取规则文件和数据库（db 可以是事务），按租户和名称排序；
+// 全局的同名规则以数据库为准，租户规则与全局规则互不覆盖
+func (e *PolicyEngine) loadRules(db *gorm.DB) ([]PolicyRule, error) {
+	type ruleKey struct{ tenant, name string }
+	byName := map[ruleKey]PolicyRule{}
+	if e.file != "" {
+		data, err := os.ReadFile(e.file)
+		if err != nil {
+			return nil, err
+		}
+		var fileRules []PolicyRule
+		if err := json.Unmarshal(data, &fileRules); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.file, err)
+		}
+		for _, r := range fileRules {
+			r.Source, r.Tenant = "file", ""
+			byName[ruleKey{"", r.Name}] = r
+		}
+	}
+	var dbRules []PolicyRule
+	if err := db.Find(&dbRules).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range dbRules {
+		r.Source = "db"
+		byName[ruleKey{r.Tenant, r.Name}] = r
+	}
+	rules := make([]PolicyRule, 0, len(byName))
+	for _, r := range byName {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Tenant != rules[j].Tenant {
+			return rules[i].Tenant < rules[j].Tenant
+		}
+		return rules[i].Name < rules[j].Name
+	})
+	return rules, nil
+}
+
+// policyEnvSample 编译时用于检查变量名的环境，与 policyEnv 的结构一致
+var policyEnvSample = map[string]interface{}{
+	"user":          map[string]interface{}{},
+	"claims":        map[string]interface{}{},
+	"request":       map[string]interface{}{},
+	"params":        map[string]string{},
+	"headers":       map[string]string{},
+	"tenant":        "",
+	"authenticated": false,
+}
+
+// CompilePolicy 编译表达式，未知变量或结果不是 bool 时返回 ErrInvalidPolicy
+func CompilePolicy(expression string) (*vm.Program, error) {
+	program, err := expr.Compile(expression, expr.Env(policyEnvSample), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+	return program, nil
+}
+
+// Reload 重新读取并编译全部规则；任意规则无效时返回错误并保留原有规则
+// 规则内容没有变化时不会重新编译
+func (e *PolicyEngine) Reload(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	set, err := e.build(e.db.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	e.swap(set)
+	return nil
+}
+
+// build 读取并编译全部规则，内容与当前规则相同时返回 nil
+func (e *PolicyEngine) build(db *gorm.DB) (*policySet, error) {
+	rules, err := e.loadRules(db)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	fingerprint := hex.EncodeToString(sum[:])
+	if fingerprint == e.current.Load().fingerprint {
+		return nil, nil
+	}
+
+	set := &policySet{fingerprint: fingerprint, loadedAt: time.Now()}
+	var errs []error
+	for _, r := range rules {
+		if r.Name == "" {
+			errs = append(errs, fmt.Errorf("%w: rule without name", ErrInvalidPolicy))
+			continue
+		}
+		program, err := CompilePolicy(r.Expression)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy %s: %w", r.Name, err))
+			continue
+		}
+		set.rules = append(set.rules, &compiledRule{PolicyRule: r, program: program})
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return set, nil
+}
+
+// swap 替换生效的规则，set 为 nil 表示没有变化
+func (e *PolicyEngine) swap(set *policySet) {
+	if set == nil {
+		return
+	}
+	e.current.Store(set)
+	log.Printf("policy: loaded %d rules", len(set.rules))
+}
+
+// modify 在事务中修改数据库中的规则并重新编译全部规则，编译失败时回滚，成功提交后才替换生效的规则
+func (e *PolicyEngine) modify(ctx context.Context, change func(tx *gorm.DB) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var set *policySet
+	err := e.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+		var err error
+		set, err = e.build(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	e.swap(set)
+	return nil
+}
+
+// Watch 按 POLICY_RELOAD_INTERVAL 定期重新加载，直到 ctx 结束
+func (e *PolicyEngine) Watch(ctx context.Context) {
+	if e.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := e.Reload(ctx); err != nil {
+			log.Println("reload policies:", err)
+		}
+	}
+}
+
+// Save 保存 ctx 中租户的规则（按名称新增或覆盖）并立即生效；
+// 先编译，表达式无效时返回 ErrInvalidPolicy，任何一步失败都不会保存
+func (e *PolicyEngine) Save(ctx context.Context, rule *PolicyRule) error {
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		return ErrMissingTenant
+	}
+	if rule.Name == "" {
+		return fmt.Errorf("%w: rule without name", ErrInvalidPolicy)
+	}
+	if _, err := CompilePolicy(rule.Expression); err != nil {
+		return err
+	}
+	rule.Tenant = tenant
+	err := e.modify(ctx, func(tx *gorm.DB) error {
+		var existing PolicyRule
+		res := tx.Where("tenant = ? AND name = ?", tenant, rule.Name).Limit(1).Find(&existing)
+		if res.Error != nil {
+			return res.Error
+		}
+		rule.ID = existing.ID
+		return tx.Save(rule).Error
+	})
+	if err != nil {
+		return err
+	}
+	rule.Source = "db"
+	return nil
+}
+
+// Delete 删除 ctx 中租户的规则并立即生效，不能删除全局规则和其他租户的规则
+func (e *PolicyEngine) Delete(ctx context.Context, name string) error {
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		return ErrMissingTenant
+	}
+	return e.modify(ctx, func(tx *gorm.DB) error {
+		res := tx.Where("tenant = ? AND name = ?", tenant, name).Delete(&PolicyRule{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrPolicyNotFound
+		}
+		return nil
+	})
+}
+
+// policyEnv 构造表达式的执行环境：身份和 JWT claims 来自 TenantMiddleware 已经校验过的结果，不再重复解析 token
+func policyEnv(c *gin.Context) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if v, exists := c.Get(jwtClaimsKey); exists {
+		if parsed, ok := v.(jwt.MapClaims); ok {
+			claims = parsed
+		}
+	}
+	p, ok := principalFrom(c)
+	user := map[string]interface{}{"kind": "anonymous", "name": "", "role": "", "tenant": "", "id": 0, "scopes": []string{}}
+	if ok {
+		scopes := p.Scopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+		user = map[string]interface{}{"id": p.ID, "name": p.Name, "tenant": p.Tenant, "kind": p.Kind, "role": p.Role, "scopes": scopes}
+	}
+
+	params := map[string]string{}
+	for _, param := range c.Params {
+		params[param.Key] = param.Value
+	}
+	headers := map[string]string{}
+	for k := range c.Request.Header {
+		headers[strings.ToLower(k)] = c.Request.Header.Get(k)
+	}
+	query := map[string]string{}
+	for k := range c.Request.URL.Query() {
+		query[k] = c.Query(k)
+	}
+	return map[string]interface{}{
+		"user":   user,
+		"claims": claims,
+		"request": map[string]interface{}{
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+			"route":  c.FullPath(),
+			"ip":     c.ClientIP(),
+			"query":  query,
+		},
+		"params":        params,
+		"headers":       headers,
+		"tenant":        c.GetString(tenantKey),
+		"authenticated": ok,
+	}
+}
+
+// Middleware 对每个请求执行命中的规则，需在 TenantMiddleware 之后使用
+func (e *PolicyEngine) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		set := e.current.Load()
+		method, route := c.Request.Method, c.FullPath()
+		if e.mode == PolicyOff || len(set.rules) == 0 || strings.HasPrefix(route, policyAdminRoutes) {
+			c.Next()
+			return
+		}
+		var env map[string]interface{}
+		tenant := c.GetString(tenantKey)
+		for _, r := range set.rules {
+			if !r.visibleTo(tenant) || !r.appliesTo(method, route) {
+				continue
+			}
+			if env == nil {
+				env = policyEnv(c)
+			}
+			out, err := expr.Run(r.program, env)
+			allowed, _ := out.(bool)
+			d := PolicyDecision{
+				Rule:     r.Name,
+				Allowed:  err == nil && allowed,
+				Enforced: e.mode == PolicyEnforce && !r.Audit,
+				Err:      err,
+				Method:   method,
+				Route:    route,
+			}
+			if user, ok := env["user"].(map[string]interface{}); ok {
+				d.User = fmt.Sprintf("%v:%v@%v", user["kind"], user["name"], user["tenant"])
+			}
+			e.logf(d)
+			if !d.Allowed && d.Enforced {
+				trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("policy.denied", r.Name))
+				c.AbortWithStatusJSON(403, gin.H{"error": "forbidden by policy", "policy": r.Name})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// logPolicyDecision 默认的审计日志：记录全部拒绝结果，以及审计模式下的全部结果
+func logPolicyDecision(d PolicyDecision) {
+	if d.Allowed && d.Enforced {
+		return
+	}
+	mode := PolicyEnforce
+	if !d.Enforced {
+		mode = PolicyAudit
+	}
+	if d.Err != nil {
+		log.Printf("policy: rule=%s mode=%s allowed=false %s %s user=%s error=%v", d.Rule, mode, d.Method, d.Route, d.User, d.Err)
+		return
+	}
+	log.Printf("policy: rule=%s mode=%s allowed=%v %s %s user=%s", d.Rule, mode, d.Allowed, d.Method, d.Route, d.User)
+}
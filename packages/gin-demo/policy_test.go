@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPolicyRules 规则按路由生效，基于角色、路径参数和请求头判断，执行出错按拒绝处理，审计规则只记录不拦截
+func TestPolicyRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policies.json")
+	rules := `[
+		{"name": "gorm-write", "expression": "user.role == \"admin\" || request.method == \"GET\"", "routes": ["/gorm/*"]},
+		{"name": "no-root", "expression": "params.name != \"root\"", "routes": ["GET /user/:name"]},
+		{"name": "canary", "expression": "headers[\"x-canary\"] != \"block\"", "routes": ["/ping"]},
+		{"name": "audit-only", "expression": "authenticated", "routes": ["/hello"], "audit": true},
+		{"name": "broken-at-runtime", "expression": "claims.exp > 0", "routes": ["/text"]}
+	]`
+	if err := os.WriteFile(file, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("POLICY_FILE", file)
+	app, h := newTestApp(t)
+	var decisions []PolicyDecision
+	app.Policies.logf = func(d PolicyDecision) { decisions = append(decisions, d) }
+
+	token := func(name, role string) []string {
+		tok, _, err := app.Auth.TokenGenerator(&Principal{ID: 1, Name: name, Tenant: "acme", Kind: PrincipalUser, Role: role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{"Authorization", "Bearer " + tok}
+	}
+	admin, alice := token("admin", "admin"), token("alice", "user")
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		expectCode int
+	}{
+		{"普通用户读", "GET", "/gorm/users", "", alice, 200},
+		{"普通用户写", "POST", "/gorm/users", `{"name":"bob"}`, alice, 403},
+		{"管理员写", "POST", "/gorm/users", `{"name":"bob"}`, admin, 200},
+		{"未登录写", "DELETE", "/gorm/users/1", "", nil, 403},
+		{"路径参数命中", "GET", "/user/root", "", nil, 403},
+		{"路径参数未命中", "GET", "/user/bob", "", nil, 200},
+		{"请求头命中", "GET", "/ping", "", []string{"X-Canary", "block"}, 403},
+		{"请求头未命中", "GET", "/ping", "", nil, 200},
+		{"审计规则不拦截", "GET", "/hello", "", nil, 200},
+		{"执行出错按拒绝处理", "GET", "/text", "", nil, 403},
+		{"未配置规则的路由", "GET", "/xml", "", nil, 200},
+	}
+	for _, c := range cases {
+		if code := doJSON(t, h, c.method, c.path, c.body, nil, c.headers...); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d", c.name, c.expectCode, code)
+		}
+	}
+
+	var audited *PolicyDecision
+	for i := range decisions {
+		if decisions[i].Rule == "audit-only" {
+			audited = &decisions[i]
+		}
+	}
+	if audited == nil || audited.Allowed || audited.Enforced || audited.Route != "/hello" {
+		t.Errorf("审计规则应记录未通过的结果，得到 %+v", audited)
+	}
+}
+
+// TestPolicyReload 管理接口修改规则立即生效，规则文件变化后重新加载，无效规则不会替换现有规则
+func TestPolicyReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policies.json")
+	write := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[]`)
+	t.Setenv("POLICY_FILE", file)
+	app, h := newTestApp(t)
+	app.Policies.logf = func(PolicyDecision) {}
+	adminAuth := []string{"Authorization", "Bearer " + loginToken(t, h, "default")}
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		expectCode int
+	}{
+		{"初始放行", "GET", "/ping", "", nil, 200},
+		{"无法编译的表达式", "PUT", "/admin/policies/ping", `{"expression":"unknown_var == 1"}`, adminAuth, 400},
+		{"结果不是 bool", "PUT", "/admin/policies/ping", `{"expression":"\"GET\""}`, adminAuth, 400},
+		{"新增规则", "PUT", "/admin/policies/ping", `{"expression":"request.method != \"GET\"","routes":["/ping"]}`, adminAuth, 200},
+		{"规则立即生效", "GET", "/ping", "", nil, 403},
+		{"改为审计", "PUT", "/admin/policies/ping", `{"expression":"request.method != \"GET\"","routes":["/ping"],"audit":true}`, adminAuth, 200},
+		{"审计不拦截", "GET", "/ping", "", nil, 200},
+		{"拦截全部管理接口的规则", "PUT", "/admin/policies/lockout", `{"expression":"false","routes":["/admin/*"]}`, adminAuth, 200},
+		{"其他管理接口被拦截", "GET", "/admin/api-keys", "", adminAuth, 403},
+		{"策略管理接口不受规则约束", "GET", "/admin/policies", "", adminAuth, 200},
+		{"删除拦截规则", "DELETE", "/admin/policies/lockout", "", adminAuth, 200},
+		{"策略管理接口仍需 admin", "DELETE", "/admin/policies/ping", "", nil, 401},
+		{"删除规则", "DELETE", "/admin/policies/ping", "", adminAuth, 200},
+		{"删除不存在的规则", "DELETE", "/admin/policies/ping", "", adminAuth, 404},
+	}
+	for _, s := range steps {
+		if code := doJSON(t, h, s.method, s.path, s.body, nil, s.headers...); code != s.expectCode {
+			t.Fatalf("%s: 期望 %d，得到 %d", s.name, s.expectCode, code)
+		}
+	}
+
+	write(`[{"name": "ping-file", "expression": "false", "routes": ["/ping"]}]`)
+	if err := app.Policies.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := doJSON(t, h, "GET", "/ping", "", nil); code != 403 {
+		t.Errorf("规则文件修改后期望 403，得到 %d", code)
+	}
+
+	write(`[{"name": "ping-file", "expression": "true +", "routes": ["/ping"]}]`)
+	if code := doJSON(t, h, "POST", "/admin/policies/reload", "", nil, adminAuth...); code != 400 {
+		t.Errorf("无效规则文件期望 400，得到 %d", code)
+	}
+	if rules := app.Policies.Rules(); len(rules) != 1 || rules[0].Expression != "false" {
+		t.Errorf("加载失败时应保留原有规则，得到 %+v", rules)
+	}
+
+	// 其他规则无法编译时新规则不会保存
+	if code := doJSON(t, h, "PUT", "/admin/policies/other", `{"expression":"true"}`, nil, adminAuth...); code != 400 {
+		t.Errorf("重新编译失败时期望 400，得到 %d", code)
+	}
+	var count int64
+	app.DB.Model(&PolicyRule{}).Where("name = ?", "other").Count(&count)
+	if count != 0 {
+		t.Errorf("重新编译失败时规则不应保存")
+	}
+
+	// 全局审计模式下任何规则都不拦截
+	app.Policies.mode = PolicyAudit
+	if code := doJSON(t, h, "GET", "/ping", "", nil); code != 200 {
+		t.Errorf("审计模式期望 200，得到 %d", code)
+	}
+}
+
+// TestPolicyTenantIsolation 管理接口保存的规则只对本租户生效，其他租户看不到也删不掉；规则文件中的全局规则对所有租户生效
+func TestPolicyTenantIsolation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(file, []byte(`[{"name": "global", "expression": "headers[\"x-block\"] != \"1\"", "routes": ["/ping"]}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("POLICY_FILE", file)
+	app, h := newTestApp(t)
+	app.Policies.logf = func(PolicyDecision) {}
+	acme := []string{"Authorization", "Bearer " + loginToken(t, h, "acme")}
+	globex := []string{"Authorization", "Bearer " + loginToken(t, h, "globex")}
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		expectCode int
+	}{
+		{"acme 新增规则", "PUT", "/admin/policies/block-ping", `{"expression":"false","routes":["/ping"]}`, acme, 200},
+		{"acme 被拦截", "GET", "/ping", "", acme, 403},
+		{"globex 不受影响", "GET", "/ping", "", globex, 200},
+		{"未登录（default 租户）不受影响", "GET", "/ping", "", nil, 200},
+		{"globex 不能删除 acme 的规则", "DELETE", "/admin/policies/block-ping", "", globex, 404},
+		{"全局规则不能被删除", "DELETE", "/admin/policies/global", "", acme, 404},
+		{"acme 仍被拦截", "GET", "/ping", "", acme, 403},
+		{"acme 删除自己的规则", "DELETE", "/admin/policies/block-ping", "", acme, 200},
+		{"acme 恢复", "GET", "/ping", "", acme, 200},
+	}
+	for _, s := range steps {
+		if code := doJSON(t, h, s.method, s.path, s.body, nil, s.headers...); code != s.expectCode {
+			t.Fatalf("%s: 期望 %d，得到 %d", s.name, s.expectCode, code)
+		}
+	}
+
+	// 同名的租户规则不会覆盖全局规则
+	doJSON(t, h, "PUT", "/admin/policies/global", `{"expression":"true","routes":["/ping"]}`, nil, globex...)
+	if code := doJSON(t, h, "GET", "/ping", "", nil, append(globex, "X-Block", "1")...); code != 403 {
+		t.Errorf("全局规则期望仍然生效，得到 %d", code)
+	}
+	var list struct {
+		Rules []PolicyRule `json:"rules"`
+	}
+	doJSON(t, h, "GET", "/admin/policies", "", &list, acme...)
+	if len(list.Rules) != 1 || list.Rules[0].Name != "global" || list.Rules[0].Tenant != "" {
+		t.Errorf("acme 只应看到全局规则，得到 %+v", list.Rules)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// 身份类型
+const (
+	PrincipalUser       = "user"        // 用户名密码登录的 JWT
+	PrincipalService    = "service"     // admin token 签发的服务账号 JWT
+	PrincipalAPIKey     = "api_key"     // API Key
+	PrincipalClientCert = "client_cert" // 双向 TLS 客户端证书
+)
+
+// 权限范围（scope），API Key 和服务账号 token 需要显式授予，用户登录身份按角色授予（见 roleScopes）
+const (
+	ScopeUsersRead  = "users:read"  // 读取用户（/api/*/users、/gorm、/search）
+	ScopeUsersWrite = "users:write" // 创建、修改、删除用户
+	ScopeLinksRead  = "links:read"  // 查看短链接
+	ScopeLinksWrite = "links:write" // 创建短链接
+	ScopeAdmin      = "admin"       // /admin 下的管理接口
+)
+
+// roleScopes 用户登录身份（PrincipalUser）按角色拥有的 scope，没有角色时按 user 处理
+var roleScopes = map[string][]string{
+	"admin": {"*"},
+	"user":  {ScopeUsersRead, ScopeUsersWrite, ScopeLinksRead, ScopeLinksWrite},
+}
+
+// Principal 统一的调用方身份，handler 通过 c.Get(identityKey) 读取
+// JWT、API Key、客户端证书最终都解析为 *Principal
+type Principal struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Tenant string   `json:"tenant"`
+	Kind   string   `json:"kind"`
+	Role   string   `json:"role,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// HasScope 判断是否拥有某个权限范围（"*" 表示全部）
+// 用户登录身份按角色授权，其他身份只有显式授予的 scope
+func (p *Principal) HasScope(scope string) bool {
+	scopes := p.Scopes
+	if p.Kind == PrincipalUser {
+		role := p.Role
+		if role == "" {
+			role = "user"
+		}
+		scopes = append(append([]string{}, roleScopes[role]...), p.Scopes...)
+	}
+	for _, s := range scopes {
+		if s == scope || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// principalFromClaims 从 JWT claims 还原身份（与 PayloadFunc 写入的字段对应），缺少 id 或 name 时返回 false
+func principalFromClaims(claims map[string]interface{}) (*Principal, bool) {
+	id, ok := claims[identityKey].(float64)
+	if !ok {
+		return nil, false
+	}
+	name, ok := claims["name"].(string)
+	if !ok {
+		return nil, false
+	}
+	tenant, _ := claims[tenantClaim].(string)
+	kind, _ := claims["kind"].(string)
+	if kind == "" {
+		kind = PrincipalUser
+	}
+	role, _ := claims["role"].(string)
+	var scopes []string
+	if list, ok := claims["scopes"].([]interface{}); ok {
+		for _, scope := range list {
+			if s, ok := scope.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return &Principal{ID: int(id), Name: name, Tenant: tenant, Kind: kind, Role: role, Scopes: scopes}, true
+}
+
+// principalKey gin.Context 中保存预先解析出的身份（API Key、客户端证书、会话，以及 TenantMiddleware 校验过的 JWT）
+const principalKey = "principal"
+
+// jwtClaimsKey gin-jwt 保存已校验 claims 的 key，jwt.ExtractClaims 从这里读取
+const jwtClaimsKey = "JWT_PAYLOAD"
+
+// verifiedClaims 解析并校验请求中的 JWT（签名和过期时间），规则与 gin-jwt 的 MiddlewareFunc 相同
+func verifiedClaims(auth *jwt.GinJWTMiddleware, c *gin.Context) (jwt.MapClaims, bool) {
+	claims, err := auth.GetClaimsFromJWT(c)
+	if err != nil {
+		return nil, false
+	}
+	var exp int64
+	switch v := claims[auth.ExpField].(type) {
+	case float64:
+		exp = int64(v)
+	case json.Number:
+		if exp, err = v.Int64(); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	return claims, exp >= auth.TimeFunc().Unix()
+}
+
+// setPrincipal 记录预先解析出的身份，TenantMiddleware 据此确定租户
+func setPrincipal(c *gin.Context, p *Principal) {
+	c.Set(principalKey, p)
+}
+
+// principalFrom 返回预先解析出的身份
+func principalFrom(c *gin.Context) (*Principal, bool) {
+	v, ok := c.Get(principalKey)
+	if !ok {
+		return nil, false
+	}
+	p, ok := v.(*Principal)
+	return p, ok
+}
+
+// RequireIdentity 需要登录的路由：接受 API Key、客户端证书或 JWT，统一写入 identityKey
+func RequireIdentity(auth *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	jwtHandler := auth.MiddlewareFunc()
+	return func(c *gin.Context) {
+		if p, ok := principalFrom(c); ok {
+			c.Set(identityKey, p)
+			c.Next()
+			return
+		}
+		jwtHandler(c)
+	}
+}
+
+// RequireScopes 按请求方法检查当前身份的 scope：只读请求（GET/HEAD/OPTIONS）需要 read，其他需要 write
+// 匿名请求不在这里拦截（只能访问默认租户，见 tenant.go），需要登录的路由另加 RequireIdentity
+func RequireScopes(read, write string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := principalFrom(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		scope := write
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			scope = read
+		}
+		if !p.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireScope 要求当前身份拥有指定 scope，需在 RequireIdentity 之后使用
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, _ := c.Get(identityKey)
+		if p, ok := v.(*Principal); ok && p.HasScope(scope) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing scope " + scope})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+安全重定向与短链接
+
+- /redirect?url=... 只允许跳转到站内相对路径或 REDIRECT_ALLOWED_HOSTS 中的域名，防止开放重定向
+- /redirect?token=... 跳转到服务端签名过的地址（HMAC-SHA256，带过期时间），用于白名单之外的一次性链接，
+  签名由管理接口 POST /admin/redirect-tokens 生成
+- 短链接持久化在 short_links 表，/r/:code 每次访问点击数加一，过期后返回 410
+- GET /links/:code 只返回创建者自己的短链接，同租户的管理员（admin scope）可以查看租户内全部短链接
+
+配置：
+- REDIRECT_ALLOWED_HOSTS  逗号分隔，支持 *.example.com 匹配子域名，默认 "www.baidu.com"
+- REDIRECT_DEFAULT_URL    /redirect 不带参数时的目标，默认 "https://www.baidu.com"
+- REDIRECT_SECRET         签名密钥，默认与 JWT_SECRET 相同；都未设置时使用进程内随机密钥，重启后已签发的 token 失效
+*/
+
+var (
+	// ErrRedirectNotAllowed 目标地址不在白名单中或格式不安全
+	ErrRedirectNotAllowed = errors.New("redirect target not allowed")
+	// ErrInvalidRedirectToken 签名错误或已过期
+	ErrInvalidRedirectToken = errors.New("invalid or expired redirect token")
+	// ErrShortLinkNotFound 短链接不存在
+	ErrShortLinkNotFound = errors.New("short link not found")
+	// ErrShortLinkExpired 短链接已过期
+	ErrShortLinkExpired = errors.New("short link expired")
+	// ErrShortLinkExists 自定义短码已被占用
+	ErrShortLinkExists = errors.New("short link code already exists")
+)
+
+// Redirector 校验重定向目标并签发/校验重定向 token
+type Redirector struct {
+	allowedHosts []string
+	defaultURL   string
+	secret       []byte
+	now          func() time.Time
+}
+
+// LoadRedirector 从环境变量读取白名单和签名密钥
+func LoadRedirector() *Redirector {
+	var hosts []string
+	for _, h := range strings.Split(getenv("REDIRECT_ALLOWED_HOSTS", "www.baidu.com"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return &Redirector{
+		allowedHosts: hosts,
+		defaultURL:   getenv("REDIRECT_DEFAULT_URL", "https://www.baidu.com"),
+		secret:       getenvSecret("REDIRECT_SECRET", "JWT_SECRET"),
+		now:          time.Now,
+	}
+}
+
+// hostAllowed 精确匹配，或 *.example.com 匹配任意子域名
+func (r *Redirector) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range r.allowedHosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTarget 只接受 http(s) 绝对地址或以 / 开头的站内路径
+// 拒绝 //evil.com、/\evil.com 这类会被浏览器当成其他站点的写法，以及带用户信息的地址
+func parseTarget(raw string) (*url.URL, error) {
+	if raw == "" || strings.ContainsAny(raw, "\\\r\n\t") {
+		return nil, ErrRedirectNotAllowed
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, ErrRedirectNotAllowed
+	}
+	if u.Scheme == "" && u.Host == "" {
+		if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") {
+			return nil, ErrRedirectNotAllowed
+		}
+		return u, nil
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, ErrRedirectNotAllowed
+	}
+	return u, nil
+}
+
+// Check 校验目标地址，站内路径总是允许，外部地址需要在白名单中
+func (r *Redirector) Check(raw string) (string, error) {
+	u, err := parseTarget(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && !r.hostAllowed(u.Hostname()) {
+		return "", fmt.Errorf("%w: %s", ErrRedirectNotAllowed, u.Hostname())
+	}
+	return u.String(), nil
+}
+
+// redirectClaims 重定向 token 的内容
+type redirectClaims struct {
+	URL     string `json:"u"`
+	Expires int64  `json:"e"`
+}
+
+func (r *Redirector) sign(payload string) string {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign 为任意 http(s) 地址签发有效期为 ttl 的 token，不要求目标在白名单中
+func (r *Redirector) Sign(raw string, ttl time.Duration) (string, error) {
+	u, err := parseTarget(raw)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(redirectClaims{URL: u.String(), Expires: r.now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + r.sign(payload), nil
+}
+
+// Verify 校验 token 并返回目标地址
+func (r *Redirector) Verify(token string) (string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(r.sign(payload))) {
+		return "", ErrInvalidRedirectToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidRedirectToken
+	}
+	var claims redirectClaims
+	if err := json.Unmarshal(data, &claims); err != nil || r.now().Unix() > claims.Expires {
+		return "", ErrInvalidRedirectToken
+	}
+	return claims.URL, nil
+}
+
+// ShortLink 短链接，短码全局唯一：/r/:code 由浏览器直接访问，不带租户信息
+// Tenant 只用于管理接口的权限判断，不使用 TenantID，避免租户插件给 /r/:code 的查询附加租户条件
+type ShortLink struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Code          string     `gorm:"uniqueIndex;not null" json:"code"`
+	TargetURL     string     `gorm:"not null" json:"target_url"`
+	Tenant        string     `gorm:"index" json:"tenant"`
+	CreatedBy     string     `json:"created_by"`
+	Clicks        int64      `gorm:"not null;default:0" json:"clicks"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	LastClickedAt *time.Time `json:"last_clicked_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// shortCodePattern 自定义短码的格式
+var shortCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+const shortCodeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func randomShortCode(n int) (string, error) {
+	buf := make([]byte, n)
+	max := big.NewInt(int64(len(shortCodeAlphabet)))
+	for i := range buf {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		buf[i] = shortCodeAlphabet[idx.Int64()]
+	}
+	return string(buf), nil
+}
+
+// ShortLinkStore 短链接的创建、查询与点击统计
+type ShortLinkStore struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+// NewShortLinkStore 创建存储并迁移 short_links 表
+func NewShortLinkStore(db *gorm.DB) (*ShortLinkStore, error) {
+	if err := db.AutoMigrate(&ShortLink{}); err != nil {
+		return nil, err
+	}
+	return &ShortLinkStore{db: db, now: time.Now}, nil
+}
+
+// Create 创建短链接，code 为空时随机生成；target 需已通过 Redirector.Check，ttl 为 0 表示不过期
+// 租户取自 ctx，短码是否已占用以数据库唯一索引为准，并发创建同一短码时只有一个成功
+func (s *ShortLinkStore) Create(ctx context.Context, target, code, createdBy string, ttl time.Duration) (*ShortLink, error) {
+	if code != "" && !shortCodePattern.MatchString(code) {
+		return nil, fmt.Errorf("invalid short link code %q", code)
+	}
+	tenant, _ := TenantFrom(ctx)
+	link := &ShortLink{TargetURL: target, Tenant: tenant, CreatedBy: createdBy}
+	if ttl > 0 {
+		expires := s.now().Add(ttl)
+		link.ExpiresAt = &expires
+	}
+	orm := s.db.WithContext(ctx)
+	// 随机短码冲突时重新生成
+	for attempt := 0; attempt < 5; attempt++ {
+		link.Code = code
+		if code == "" {
+			var err error
+			if link.Code, err = randomShortCode(7); err != nil {
+				return nil, err
+			}
+		}
+		err := orm.Create(link).Error
+		if err == nil {
+			return link, nil
+		}
+		if !s.duplicated(err) {
+			return nil, err
+		}
+		if code != "" {
+			return nil, ErrShortLinkExists
+		}
+	}
+	return nil, ErrShortLinkExists
+}
+
+// duplicated 判断是否违反唯一索引，由数据库驱动翻译为 gorm.ErrDuplicatedKey
+func (s *ShortLinkStore) duplicated(err error) bool {
+	if t, ok := s.db.Dialector.(gorm.ErrorTranslator); ok {
+		err = t.Translate(err)
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
+
+// Visible 判断短链接对调用方是否可见：同租户的创建者或租户管理员
+func (l *ShortLink) Visible(p *Principal) bool {
+	if p == nil || l.Tenant != p.Tenant {
+		return false
+	}
+	return l.CreatedBy == p.Name+"@"+p.Tenant || p.HasScope(ScopeAdmin)
+}
+
+// Get 按短码查询，不计点击
+func (s *ShortLinkStore) Get(ctx context.Context, code string) (*ShortLink, error) {
+	var link ShortLink
+	res := s.db.WithContext(ctx).Where("code = ?", code).Limit(1).Find(&link)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrShortLinkNotFound
+	}
+	return &link, nil
+}
+
+// Resolve 查询短链接并记录一次点击
+func (s *ShortLinkStore) Resolve(ctx context.Context, code string) (*ShortLink, error) {
+	link, err := s.Get(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	if link.ExpiresAt != nil && !now.Before(*link.ExpiresAt) {
+		return nil, ErrShortLinkExpired
+	}
+	// 在数据库中自增，并发访问不会丢失计数
+	err = s.db.WithContext(ctx).Model(&ShortLink{}).Where("id = ?", link.ID).Updates(map[string]interface{}{
+		"clicks":          gorm.Expr("clicks + 1"),
+		"last_clicked_at": now,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	link.Clicks++
+	link.LastClickedAt = &now
+	return link, nil
+}
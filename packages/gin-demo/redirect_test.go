@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRedirectorCheck 白名单与常见的开放重定向绕过写法
+func TestRedirectorCheck(t *testing.T) {
+	r := &Redirector{allowedHosts: []string{"www.baidu.com", "*.example.com"}, now: time.Now}
+	cases := []struct {
+		target string
+		allow  bool
+	}{
+		{"https://www.baidu.com/s?wd=gin", true},
+		{"http://WWW.BAIDU.COM", true},
+		{"https://api.example.com/x", true},
+		{"https://a.b.example.com", true},
+		{"/auth/profile?x=1", true},
+		{"https://example.com", false}, // 通配符只匹配子域名
+		{"https://evil.com", false},
+		{"https://www.baidu.com.evil.com", false},
+		{"https://evilexample.com", false},
+		{"https://www.baidu.com@evil.com", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+		{"javascript:alert(1)", false},
+		{"ftp://www.baidu.com", false},
+		{"auth/profile", false},
+		{"https://www.baidu.com\r\nSet-Cookie: a=b", false},
+	}
+	for _, c := range cases {
+		if _, err := r.Check(c.target); (err == nil) != c.allow {
+			t.Errorf("%q: 期望允许=%v，得到 %v", c.target, c.allow, err)
+		}
+	}
+}
+
+// TestRedirectToken 签名 token 可以跳转白名单之外的地址，篡改或过期后失效
+func TestRedirectToken(t *testing.T) {
+	now := time.Now()
+	r := &Redirector{secret: []byte("k"), now: func() time.Time { return now }}
+	token, err := r.Sign("https://evil.com/welcome", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := r.Verify(token); err != nil || target != "https://evil.com/welcome" {
+		t.Errorf("期望校验通过，得到 %q %v", target, err)
+	}
+	other := &Redirector{secret: []byte("other"), now: r.now}
+	if _, err := other.Verify(token); err == nil {
+		t.Error("不同密钥签发的 token 应校验失败")
+	}
+	if _, err := r.Verify(token[1:]); err == nil {
+		t.Error("篡改后的 token 应校验失败")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := r.Verify(token); err == nil {
+		t.Error("过期的 token 应校验失败")
+	}
+	if _, err := r.Sign("//evil.com", time.Minute); err == nil {
+		t.Error("协议相对地址不应签发")
+	}
+}
+
+// TestShortLinks 创建短链接、跳转计数、过期和重定向接口
+func TestShortLinks(t *testing.T) {
+	app, h := newTestApp(t)
+	token, _, err := app.Auth.TokenGenerator(&Principal{ID: 1, Name: "alice", Tenant: "acme", Kind: PrincipalUser})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := []string{"Authorization", "Bearer " + token}
+
+	var created struct {
+		ShortURL string    `json:"short_url"`
+		Link     ShortLink `json:"link"`
+	}
+	if code := doJSON(t, h, "POST", "/links", `{"url":"https://www.baidu.com/s?wd=gin","code":"gin"}`, &created, auth...); code != 201 {
+		t.Fatalf("创建短链接期望 201，得到 %d", code)
+	}
+	if created.ShortURL != "/r/gin" || created.Link.CreatedBy != "alice@acme" {
+		t.Errorf("短链接不符合预期: %+v", created)
+	}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/r/gin", nil))
+		if w.Code != 302 || w.Header().Get("Location") != "https://www.baidu.com/s?wd=gin" {
+			t.Fatalf("跳转期望 302 到目标地址，得到 %d %q", w.Code, w.Header().Get("Location"))
+		}
+	}
+	var link ShortLink
+	doJSON(t, h, "GET", "/links/gin", "", &link, auth...)
+	if link.Clicks != 2 || link.LastClickedAt == nil {
+		t.Errorf("期望点击数 2，得到 %+v", link)
+	}
+
+	// 只有创建者和租户管理员能查看短链接
+	other := func(p *Principal) []string {
+		token, _, err := app.Auth.TokenGenerator(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{"Authorization", "Bearer " + token}
+	}
+	owners := []struct {
+		name       string
+		headers    []string
+		expectCode int
+	}{
+		{"同租户的其他用户", other(&Principal{ID: 2, Name: "bob", Tenant: "acme", Kind: PrincipalUser}), 404},
+		{"其他租户的同名用户", other(&Principal{ID: 1, Name: "alice", Tenant: "globex", Kind: PrincipalUser}), 404},
+		{"同租户的管理员", []string{"Authorization", "Bearer " + loginToken(t, h, "acme")}, 200},
+	}
+	for _, c := range owners {
+		if code := doJSON(t, h, "GET", "/links/gin", "", nil, c.headers...); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d", c.name, c.expectCode, code)
+		}
+	}
+
+	// 过期的短链接返回 410
+	app.Links.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	doJSON(t, h, "POST", "/links", `{"url":"/ping","code":"old","expires_in":"1h"}`, nil, auth...)
+	app.Links.now = time.Now
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		expectCode int
+	}{
+		{"未登录", "POST", "/links", `{"url":"https://www.baidu.com"}`, nil, 401},
+		{"目标不在白名单", "POST", "/links", `{"url":"https://evil.com"}`, auth, 400},
+		{"短码已存在", "POST", "/links", `{"url":"/ping","code":"gin"}`, auth, 409},
+		{"短码格式错误", "POST", "/links", `{"url":"/ping","code":"a/b"}`, auth, 400},
+		{"不存在的短链接", "GET", "/r/missing", "", nil, 404},
+		{"已过期", "GET", "/r/old", "", nil, 410},
+		{"默认跳转", "GET", "/redirect", "", nil, 302},
+		{"白名单内", "GET", "/redirect?url=" + url.QueryEscape("https://www.baidu.com/x"), "", nil, 302},
+		{"开放重定向", "GET", "/redirect?url=" + url.QueryEscape("https://evil.com"), "", nil, 400},
+		{"无效 token", "GET", "/redirect?token=abc.def", "", nil, 400},
+	}
+	for _, c := range cases {
+		if code := doJSON(t, h, c.method, c.path, c.body, nil, c.headers...); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d", c.name, c.expectCode, code)
+		}
+	}
+
+	// 管理接口签发的 token 可以跳转到白名单之外
+	var signed struct {
+		RedirectURL string `json:"redirect_url"`
+	}
+	doJSON(t, h, "POST", "/admin/redirect-tokens", `{"url":"https://partner.test/welcome"}`, &signed, "Authorization", "Bearer "+loginToken(t, h, "default"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", signed.RedirectURL, nil))
+	if w.Code != 302 || !strings.HasPrefix(w.Header().Get("Location"), "https://partner.test/") {
+		t.Errorf("签名跳转期望 302 到 partner.test，得到 %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// TestRedirectSecret 未配置密钥时不使用固定的默认值，其他进程签发的 token 无法通过校验
+func TestRedirectSecret(t *testing.T) {
+	t.Setenv("REDIRECT_SECRET", "")
+	t.Setenv("JWT_SECRET", "")
+	a, b := LoadRedirector(), LoadRedirector()
+	if string(a.secret) == "secret key" || bytes.Equal(a.secret, b.secret) {
+		t.Fatalf("未配置密钥时期望随机密钥，得到 %q", a.secret)
+	}
+	token, err := a.Sign("https://partner.test/", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Verify(token); err == nil {
+		t.Error("不同密钥签发的 token 不应通过校验")
+	}
+
+	t.Setenv("JWT_SECRET", "jwt-secret")
+	if got := LoadRedirector().secret; string(got) != "jwt-secret" {
+		t.Errorf("期望回退到 JWT_SECRET，得到 %q", got)
+	}
+}
+
+// TestShortLinkDuplicate 短码以唯一索引判断是否已占用，并发创建同一短码时返回 ErrShortLinkExists 而不是数据库错误
+func TestShortLinkDuplicate(t *testing.T) {
+	app, _ := newTestApp(t)
+	ctx := WithTenant(context.Background(), "acme")
+	if _, err := app.Links.Create(ctx, "/ping", "dup", "alice@acme", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Links.Create(ctx, "/ping", "dup", "bob@acme", 0); !errors.Is(err, ErrShortLinkExists) {
+		t.Errorf("期望 ErrShortLinkExists，得到 %v", err)
+	}
+	if _, err := app.Links.Create(ctx, "/ping", "", "bob@acme", 0); err != nil {
+		t.Errorf("随机短码期望创建成功，得到 %v", err)
+	}
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+用户全文检索
+
+两套实现共用同一套查询语义：
+1. ftsSearcher：基于 SQLite FTS5 的外部内容表（external content table），由触发器在每次写入时同步索引，
+   使用 bm25() 排序、highlight()/snippet() 生成高亮片段
+2. InvertedIndex：进程内倒排索引，用于内存存储 UserStore；当 SQLite 未编译 FTS5 时也作为 GORM 数据的兜底
+
+查询语义：
+- 查询文本按 Unicode 字母/数字切词并转小写，多个词之间为 AND 关系
+- prefix=true 时每个词同时做前缀匹配（"al" 命中 "alice"）
+- fuzzy=true 时允许拼写错误：长度 3~5 的词允许 1 次编辑，更长的词允许 2 次编辑（含相邻字符交换）
+- 结果按相关度降序排列，完全匹配 > 前缀匹配 > 容错匹配
+
+注意：mattn/go-sqlite3 默认不包含 FTS5，需要使用构建标签开启：
+  go run -tags sqlite_fts5 .
+*/
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	// 高亮标记，先用不可见字符占位，HTML 转义后再替换成 <mark>，避免用户数据中的标签被当作 HTML 渲染
+	markOpen  = "\x02"
+	markClose = "\x03"
+
+	// 片段最多保留的词数
+	snippetTokens = 16
+
+	// 各类匹配的权重
+	weightExact  = 1.0
+	weightPrefix = 0.8
+	weightFuzzy  = 0.5
+
+	// BM25 参数
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// SearchQuery 检索参数
+type SearchQuery struct {
+	Text   string // 原始查询文本
+	Prefix bool   // 是否启用前缀匹配
+	Fuzzy  bool   // 是否启用拼写容错
+	Limit  int
+	Offset int
+}
+
+// SearchHit 内存存储的检索结果
+type SearchHit struct {
+	User
+	Score     float64 `json:"score"`
+	Highlight string  `json:"highlight"`
+}
+
+// GormSearchHit 数据库检索结果
+type GormSearchHit struct {
+	GormUser
+	Score     float64 `json:"score"`
+	Highlight string  `json:"highlight"`
+}
+
+// ParseSearchQuery 从请求参数解析检索条件
+// 兼容旧接口的 name 参数；prefix、fuzzy 默认开启
+func ParseSearchQuery(c *gin.Context) SearchQuery {
+	text := c.Query("q")
+	if text == "" {
+		text = c.Query("name")
+	}
+	q := SearchQuery{
+		Text:   text,
+		Prefix: c.DefaultQuery("prefix", "true") != "false",
+		Fuzzy:  c.DefaultQuery("fuzzy", "true") != "false",
+	}
+	q.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	q.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	return q.normalize()
+}
+
+func (q SearchQuery) normalize() SearchQuery {
+	if q.Limit < 1 {
+		q.Limit = defaultSearchLimit
+	}
+	if q.Limit > maxSearchLimit {
+		q.Limit = maxSearchLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	return q
+}
+
+// token 是切词结果，start/end 为原文中的字节偏移
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize 按 Unicode 字母/数字切词并转小写，与 FTS5 unicode61 分词器保持一致
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{term: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// queryTerms 返回去重后的查询词
+func queryTerms(text string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, t := range tokenize(text) {
+		if !seen[t.term] {
+			seen[t.term] = true
+			terms = append(terms, t.term)
+		}
+	}
+	return terms
+}
+
+// maxEdits 根据词长决定允许的编辑距离
+func maxEdits(term string) int {
+	n := utf8.RuneCountInString(term)
+	switch {
+	case n < 3:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance 计算 Damerau-Levenshtein（OSA）距离，超过 limit 时提前返回 limit+1
+func editDistance(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return limit + 1
+	}
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// renderHighlight 将带占位标记的文本做 HTML 转义并替换为 <mark> 标签
+func renderHighlight(marked string) string {
+	escaped := html.EscapeString(marked)
+	escaped = strings.ReplaceAll(escaped, markOpen, "<mark>")
+	return strings.ReplaceAll(escaped, markClose, "</mark>")
+}
+
+// InvertedIndex 进程内倒排索引，并发安全
+type InvertedIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[int]int // term -> docID -> 词频
+	docs     map[int]indexedDoc
+	terms    []string // 有序词表，用于前缀查找
+	totalLen int
+}
+
+type indexedDoc struct {
+	text   string
+	tokens []token
+}
+
+type indexMatch struct {
+	ID        int
+	Score     float64
+	Highlight string // 带占位标记，输出前需经 renderHighlight 处理
+}
+
+// NewInvertedIndex 创建空索引
+func NewInvertedIndex() *InvertedIndex {
+	idx := &InvertedIndex{}
+	idx.Clear()
+	return idx
+}
+
+// Clear 清空索引
+func (idx *InvertedIndex) Clear() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.postings = map[string]map[int]int{}
+	idx.docs = map[int]indexedDoc{}
+	idx.terms = nil
+	idx.totalLen = 0
+}
+
+// Put 新增或替换文档
+func (idx *InvertedIndex) Put(id int, text string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+	doc := indexedDoc{text: text, tokens: tokenize(text)}
+	for _, t := range doc.tokens {
+		docs, ok := idx.postings[t.term]
+		if !ok {
+			docs = map[int]int{}
+			idx.postings[t.term] = docs
+			idx.insertTerm(t.term)
+		}
+		docs[id]++
+	}
+	idx.docs[id] = doc
+	idx.totalLen += len(doc.tokens)
+}
+
+// Remove 删除文档
+func (idx *InvertedIndex) Remove(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+func (idx *InvertedIndex) remove(id int) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for _, t := range doc.tokens {
+		docs := idx.postings[t.term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, t.term)
+			idx.deleteTerm(t.term)
+		}
+	}
+	idx.totalLen -= len(doc.tokens)
+	delete(idx.docs, id)
+}
+
+func (idx *InvertedIndex) insertTerm(term string) {
+	i := sort.SearchStrings(idx.terms, term)
+	idx.terms = append(idx.terms, "")
+	copy(idx.terms[i+1:], idx.terms[i:])
+	idx.terms[i] = term
+}
+
+func (idx *InvertedIndex) deleteTerm(term string) {
+	i := sort.SearchStrings(idx.terms, term)
+	if i < len(idx.terms) && idx.terms[i] == term {
+		idx.terms = append(idx.terms[:i], idx.terms[i+1:]...)
+	}
+}
+
+// expand 把一个查询词扩展为索引中的候选词及其权重
+func (idx *InvertedIndex) expand(term string, q SearchQuery) map[string]float64 {
+	candidates := map[string]float64{}
+	if _, ok := idx.postings[term]; ok {
+		candidates[term] = weightExact
+	}
+	if q.Prefix {
+		for i := sort.SearchStrings(idx.terms, term); i < len(idx.terms) && strings.HasPrefix(idx.terms[i], term); i++ {
+			if _, ok := candidates[idx.terms[i]]; !ok {
+				candidates[idx.terms[i]] = weightPrefix
+			}
+		}
+	}
+	if limit := maxEdits(term); q.Fuzzy && limit > 0 {
+		for _, candidate := range idx.terms {
+			if _, ok := candidates[candidate]; ok {
+				continue
+			}
+			if d := editDistance(term, candidate, limit); d <= limit {
+				candidates[candidate] = weightFuzzy / float64(d)
+			}
+		}
+	}
+	return candidates
+}
+
+// Search 执行检索，返回当前页结果与命中总数
+func (idx *InvertedIndex) Search(q SearchQuery) ([]indexMatch, int) {
+	q = q.normalize()
+	terms := queryTerms(q.Text)
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if len(terms) == 0 || len(idx.docs) == 0 {
+		return nil, 0
+	}
+
+	n := float64(len(idx.docs))
+	avgLen := float64(idx.totalLen) / n
+	scores := map[int]float64{}
+	hits := map[int]int{}
+	matched := map[int]map[string]bool{}
+	for _, term := range terms {
+		best := map[int]float64{}
+		for candidate, weight := range idx.expand(term, q) {
+			docs := idx.postings[candidate]
+			df := float64(len(docs))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			for id, tf := range docs {
+				docLen := float64(len(idx.docs[id].tokens))
+				f := float64(tf)
+				s := weight * idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*docLen/avgLen))
+				if s > best[id] {
+					best[id] = s
+				}
+				if matched[id] == nil {
+					matched[id] = map[string]bool{}
+				}
+				matched[id][candidate] = true
+			}
+		}
+		for id, s := range best {
+			scores[id] += s
+			hits[id]++
+		}
+	}
+
+	var ids []int
+	for id, count := range hits {
+		if count == len(terms) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	total := len(ids)
+	if q.Offset >= total {
+		return nil, total
+	}
+	ids = ids[q.Offset:min(q.Offset+q.Limit, total)]
+	result := make([]indexMatch, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, indexMatch{
+			ID:        id,
+			Score:     scores[id],
+			Highlight: idx.docs[id].snippet(matched[id]),
+		})
+	}
+	return result, total
+}
+
+// snippet 生成高亮片段，文本过长时只保留首个命中词附近的内容
+func (d indexedDoc) snippet(matched map[string]bool) string {
+	first := -1
+	for i, t := range d.tokens {
+		if matched[t.term] {
+			first = i
+			break
+		}
+	}
+	from, to := 0, len(d.text)
+	prefix, suffix := "", ""
+	if len(d.tokens) > snippetTokens && first >= 0 {
+		lo := max(0, first-snippetTokens/4)
+		hi := min(len(d.tokens), lo+snippetTokens)
+		from, to = d.tokens[lo].start, d.tokens[hi-1].end
+		if lo > 0 {
+			prefix = "…"
+		}
+		if hi < len(d.tokens) {
+			suffix = "…"
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	pos := from
+	for _, t := range d.tokens {
+		if t.start < from || t.end > to || !matched[t.term] {
+			continue
+		}
+		b.WriteString(d.text[pos:t.start])
+		b.WriteString(markOpen + d.text[t.start:t.end] + markClose)
+		pos = t.end
+	}
+	b.WriteString(d.text[pos:to])
+	b.WriteString(suffix)
+	return b.String()
+}
+
+// UserSearcher GORM 用户检索接口，db 由调用方传入，便于附加作用域
+type UserSearcher interface {
+	// Engine 返回检索引擎名称
+	Engine() string
+	Search(db *gorm.DB, q SearchQuery) ([]GormSearchHit, int64, error)
+	// Reindex 从 gorm_users 全量重建索引
+	Reindex(db *gorm.DB) error
+}
+
+// NewUserSearcher 优先使用 FTS5，不可用时退化为进程内倒排索引
+func NewUserSearcher(db *gorm.DB) (UserSearcher, error) {
+	var fts5 bool
+	if err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5).Error; err != nil {
+		return nil, err
+	}
+	if fts5 {
+		fts := &ftsSearcher{}
+		if err := fts.migrate(db); err != nil {
+			return nil, err
+		}
+		return fts, nil
+	}
+	s := &indexSearcher{indexes: map[string]*InvertedIndex{}, gen: map[string]uint64{}}
+	if err := s.registerCallbacks(db); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ftsSearcher 基于 SQLite FTS5 的检索
+type ftsSearcher struct{}
+
+const (
+	ftsTable      = "gorm_users_fts"
+	ftsVocabTable = "gorm_users_fts_vocab"
+)
+
+// migrate 创建 FTS5 外部内容表、词表视图和同步触发器，并重建一次索引
+func (s *ftsSearcher) migrate(db *gorm.DB) error {
+	stmts := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS ` + ftsTable + ` USING fts5(name, content='gorm_users', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS ` + ftsVocabTable + ` USING fts5vocab(` + ftsTable + `, 'row')`,
+		`CREATE TRIGGER IF NOT EXISTS gorm_users_fts_ai AFTER INSERT ON gorm_users BEGIN
+			INSERT INTO ` + ftsTable + `(rowid, name) VALUES (new.id, new.name);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS gorm_users_fts_ad AFTER DELETE ON gorm_users BEGIN
+			INSERT INTO ` + ftsTable + `(` + ftsTable + `, rowid, name) VALUES ('delete', old.id, old.name);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS gorm_users_fts_au AFTER UPDATE ON gorm_users BEGIN
+			INSERT INTO ` + ftsTable + `(` + ftsTable + `, rowid, name) VALUES ('delete', old.id, old.name);
+			INSERT INTO ` + ftsTable + `(rowid, name) VALUES (new.id, new.name);
+		END`,
+		`INSERT INTO ` + ftsTable + `(` + ftsTable + `) VALUES ('rebuild')`,
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range stmts {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *ftsSearcher) Engine() string { return "fts5" }
+
+func (s *ftsSearcher) Reindex(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO ` + ftsTable + `(` + ftsTable + `) VALUES ('rebuild')`).Error
+}
+
+// matchExpr 把查询词转换为 FTS5 MATCH 表达式，例如 ("alice" OR "alice"* OR "alicr") AND ("bob")
+func (s *ftsSearcher) matchExpr(db *gorm.DB, q SearchQuery) (string, error) {
+	var groups []string
+	for _, term := range queryTerms(q.Text) {
+		quoted := `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		alts := []string{quoted}
+		if q.Prefix {
+			alts = append(alts, quoted+"*")
+		}
+		if limit := maxEdits(term); q.Fuzzy && limit > 0 {
+			n := utf8.RuneCountInString(term)
+			var vocab []string
+			err := db.Raw(`SELECT term FROM `+ftsVocabTable+` WHERE length(term) BETWEEN ? AND ?`, n-limit, n+limit).
+				Scan(&vocab).Error
+			if err != nil {
+				return "", err
+			}
+			for _, candidate := range vocab {
+				if candidate != term && editDistance(term, candidate, limit) <= limit {
+					alts = append(alts, `"`+strings.ReplaceAll(candidate, `"`, `""`)+`"`)
+				}
+			}
+		}
+		groups = append(groups, "("+strings.Join(alts, " OR ")+")")
+	}
+	return strings.Join(groups, " AND "), nil
+}
+
+func (s *ftsSearcher) Search(db *gorm.DB, q SearchQuery) ([]GormSearchHit, int64, error) {
+	// FTS 虚拟表不在租户回调的覆盖范围内，这里显式按 gorm_users.tenant_id 过滤
+	tenant, ok := TenantFrom(db.Statement.Context)
+	if !ok {
+		return nil, 0, ErrMissingTenant
+	}
+	q = q.normalize()
+	expr, err := s.matchExpr(db, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	if expr == "" {
+		// 空查询返回空列表（JSON 为 []），与倒排索引实现一致
+		return []GormSearchHit{}, 0, nil
+	}
+
+	var total int64
+	err = db.Table(ftsTable).
+		Joins("JOIN gorm_users ON gorm_users.id = "+ftsTable+".rowid").
+		Where(ftsTable+" MATCH ? AND gorm_users.tenant_id = ?", expr, tenant).
+		Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rows []scoredRow
+	err = db.Table(ftsTable).
+		Select("gorm_users.id AS id, -bm25("+ftsTable+") AS score, snippet("+ftsTable+", 0, ?, ?, '…', ?) AS highlight", markOpen, markClose, snippetTokens).
+		Joins("JOIN gorm_users ON gorm_users.id = "+ftsTable+".rowid").
+		Where(ftsTable+" MATCH ? AND gorm_users.tenant_id = ?", expr, tenant).
+		Order("score DESC, gorm_users.id").
+		Limit(q.Limit).Offset(q.Offset).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return loadSearchHits(db, rows, total)
+}
+
+// scoredRow 检索引擎返回的一行结果，Highlight 仍带占位标记
+type scoredRow struct {
+	ID        uint
+	Score     float64
+	Highlight string
+}
+
+// loadSearchHits 按检索结果的顺序加载完整的用户记录
+func loadSearchHits(db *gorm.DB, rows []scoredRow, total int64) ([]GormSearchHit, int64, error) {
+	if len(rows) == 0 {
+		return []GormSearchHit{}, total, nil
+	}
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	var users []GormUser
+	if err := db.Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+	byID := make(map[uint]GormUser, len(users))
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+	hits := make([]GormSearchHit, 0, len(rows))
+	for _, row := range rows {
+		if u, ok := byID[row.ID]; ok {
+			hits = append(hits, GormSearchHit{GormUser: u, Score: row.Score, Highlight: renderHighlight(row.Highlight)})
+		}
+	}
+	return hits, total, nil
+}
+
+// indexSearcher 在 FTS5 不可用时，用倒排索引检索 GORM 数据
+// 每个租户一份索引，第一次检索时从数据库加载；之后写回调按主键增量更新（Put/Remove），
+// 无法从语句中确定行（例如按条件批量更新或删除）时丢弃该租户的索引，下一次检索时重新加载。
+// 重新加载总是构建新的索引再整体替换，正在检索的请求继续使用旧索引，不会看到清空或只加载了一部分的索引。
+// 通过 db.Exec 执行的原生 SQL 不会触发回调
+type indexSearcher struct {
+	mu      sync.Mutex
+	indexes map[string]*InvertedIndex // 租户 -> 索引
+	gen     map[string]uint64         // 租户 -> 写入次数，加载期间有写入时不保存加载结果
+	epoch   uint64                    // 丢弃全部索引的次数
+}
+
+func (s *indexSearcher) Engine() string { return "memory" }
+
+func (s *indexSearcher) Reindex(db *gorm.DB) error {
+	s.invalidate("")
+	return nil
+}
+
+// invalidate 丢弃 tenant 的索引，tenant 为空时丢弃全部索引
+func (s *indexSearcher) invalidate(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tenant == "" {
+		s.indexes = map[string]*InvertedIndex{}
+		s.epoch++
+		return
+	}
+	delete(s.indexes, tenant)
+	s.gen[tenant]++
+}
+
+// apply 在 tenant 已加载的索引上执行增量更新，未加载时只记录写入
+func (s *indexSearcher) apply(tenant string, fn func(index *InvertedIndex)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen[tenant]++
+	if index := s.indexes[tenant]; index != nil {
+		fn(index)
+	}
+}
+
+// writtenUsers 写语句涉及的用户（tx.Statement.ReflectValue 中的记录），主键未知时返回 false
+func writtenUsers(tx *gorm.DB) ([]GormUser, bool) {
+	var users []GormUser
+	collect := func(v reflect.Value) bool {
+		u, ok := reflect.Indirect(v).Interface().(GormUser)
+		if !ok || u.ID == 0 {
+			return false
+		}
+		users = append(users, u)
+		return true
+	}
+	switch rv := reflect.Indirect(tx.Statement.ReflectValue); rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if !collect(rv.Index(i)) {
+				return nil, false
+			}
+		}
+	case reflect.Struct:
+		if !collect(rv) {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	return users, len(users) > 0
+}
+
+// writeTenant 写语句所在的租户，优先使用 context，其次使用记录上的 tenant_id
+func writeTenant(tx *gorm.DB, u GormUser) string {
+	if tenant, ok := TenantFrom(tx.Statement.Context); ok {
+		return tenant
+	}
+	return u.TenantID
+}
+
+func (s *indexSearcher) registerCallbacks(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().After("gorm:create").Register("search:index_create", s.afterCreate),
+		cb.Update().After("gorm:update").Register("search:index_update", s.afterUpdate),
+		cb.Delete().After("gorm:delete").Register("search:index_delete", s.afterDelete),
+	)
+}
+
+// skipIndexing 只处理成功的 gorm_users 写入
+func skipIndexing(tx *gorm.DB) bool {
+	return tx.Error != nil || tx.Statement.Table != "gorm_users"
+}
+
+func (s *indexSearcher) afterCreate(tx *gorm.DB) {
+	if skipIndexing(tx) {
+		return
+	}
+	users, ok := writtenUsers(tx)
+	if !ok {
+		tenant, _ := TenantFrom(tx.Statement.Context)
+		s.invalidate(tenant)
+		return
+	}
+	for _, u := range users {
+		s.apply(writeTenant(tx, u), func(index *InvertedIndex) { index.Put(int(u.ID), u.Name) })
+	}
+}
+
+// afterUpdate 按主键重新读取更新后的名称；Update/Updates 写入的列不一定反映在模型上
+func (s *indexSearcher) afterUpdate(tx *gorm.DB) {
+	if skipIndexing(tx) {
+		return
+	}
+	tenant, _ := TenantFrom(tx.Statement.Context)
+	users, ok := writtenUsers(tx)
+	if !ok {
+		s.invalidate(tenant)
+		return
+	}
+	ids := make([]uint, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	var fresh []GormUser
+	if err := tx.Session(&gorm.Session{NewDB: true}).Select("id", "name", "tenant_id").Where("id IN ?", ids).Find(&fresh).Error; err != nil {
+		s.invalidate(tenant)
+		return
+	}
+	found := make(map[uint]bool, len(fresh))
+	for _, u := range fresh {
+		found[u.ID] = true
+		s.apply(writeTenant(tx, u), func(index *InvertedIndex) { index.Put(int(u.ID), u.Name) })
+	}
+	for _, u := range users {
+		if !found[u.ID] {
+			s.apply(writeTenant(tx, u), func(index *InvertedIndex) { index.Remove(int(u.ID)) })
+		}
+	}
+}
+
+func (s *indexSearcher) afterDelete(tx *gorm.DB) {
+	if skipIndexing(tx) {
+		return
+	}
+	users, ok := writtenUsers(tx)
+	if !ok {
+		tenant, _ := TenantFrom(tx.Statement.Context)
+		s.invalidate(tenant)
+		return
+	}
+	for _, u := range users {
+		s.apply(writeTenant(tx, u), func(index *InvertedIndex) { index.Remove(int(u.ID)) })
+	}
+}
+
+// indexFor 返回当前租户的索引，尚未加载或已被丢弃时从数据库加载新的索引
+// 查询经过租户回调，只会加载当前租户的数据；加载期间有写入时本次检索使用加载结果，但不保存，下一次重新加载
+func (s *indexSearcher) indexFor(db *gorm.DB) (*InvertedIndex, error) {
+	tenant, ok := TenantFrom(db.Statement.Context)
+	if !ok {
+		return nil, ErrMissingTenant
+	}
+	s.mu.Lock()
+	index, gen, epoch := s.indexes[tenant], s.gen[tenant], s.epoch
+	s.mu.Unlock()
+	if index != nil {
+		return index, nil
+	}
+
+	var users []GormUser
+	if err := db.Session(&gorm.Session{NewDB: true}).Select("id", "name").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	index = NewInvertedIndex()
+	for _, u := range users {
+		index.Put(int(u.ID), u.Name)
+	}
+	s.mu.Lock()
+	if s.gen[tenant] == gen && s.epoch == epoch && s.indexes[tenant] == nil {
+		s.indexes[tenant] = index
+	}
+	s.mu.Unlock()
+	return index, nil
+}
+
+func (s *indexSearcher) Search(db *gorm.DB, q SearchQuery) ([]GormSearchHit, int64, error) {
+	index, err := s.indexFor(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	matches, total := index.Search(q)
+	rows := make([]scoredRow, 0, len(matches))
+	for _, m := range matches {
+		rows = append(rows, scoredRow{ID: uint(m.ID), Score: m.Score, Highlight: m.Highlight})
+	}
+	return loadSearchHits(db, rows, int64(total))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// TestInvertedIndexSearch 表驱动测试：完全匹配、前缀、拼写容错与高亮
+func TestInvertedIndexSearch(t *testing.T) {
+	store := NewUserStore([]User{
+		{ID: 1, Name: "Alice Smith"},
+		{ID: 2, Name: "Bob"},
+		{ID: 3, Name: "Alicia Keys"},
+		{ID: 4, Name: "<b>Mallory</b>"},
+	})
+
+	cases := []struct {
+		name      string
+		query     SearchQuery
+		expectIDs []int
+		highlight string // 第一个结果的高亮，空表示不检查
+	}{
+		{"完全匹配", SearchQuery{Text: "alice"}, []int{1}, "<mark>Alice</mark> Smith"},
+		{"关闭前缀时不做前缀匹配", SearchQuery{Text: "ali"}, nil, ""},
+		{"前缀匹配", SearchQuery{Text: "ali", Prefix: true}, []int{1, 3}, ""},
+		{"拼写容错", SearchQuery{Text: "alcie", Fuzzy: true}, []int{1}, ""},
+		{"完全匹配排在容错匹配之前", SearchQuery{Text: "alicia", Fuzzy: true}, []int{3, 1}, ""},
+		{"多个词为 AND 关系", SearchQuery{Text: "ali keys", Prefix: true, Fuzzy: true}, []int{3}, ""},
+		{"高亮会转义 HTML", SearchQuery{Text: "mallory"}, []int{4}, "&lt;b&gt;<mark>Mallory</mark>&lt;/b&gt;"},
+	}
+	for _, c := range cases {
+		hits, total := store.Search(c.query)
+		if total != len(c.expectIDs) || len(hits) != len(c.expectIDs) {
+			t.Errorf("%s: 期望 %d 条结果，得到 %d 条 %+v", c.name, len(c.expectIDs), total, hits)
+			continue
+		}
+		for i, id := range c.expectIDs {
+			if hits[i].ID != id {
+				t.Errorf("%s: 第 %d 条期望 ID %d，得到 %d", c.name, i, id, hits[i].ID)
+			}
+		}
+		if c.highlight != "" && hits[0].Highlight != c.highlight {
+			t.Errorf("%s: 期望高亮 %q，得到 %q", c.name, c.highlight, hits[0].Highlight)
+		}
+	}
+
+	// 写操作后索引立即更新
+	store.Update(2, "Bobby Tables")
+	if hits, _ := store.Search(SearchQuery{Text: "tables"}); len(hits) != 1 || hits[0].ID != 2 {
+		t.Errorf("更新后期望检索到 ID 2，得到 %+v", hits)
+	}
+	store.Delete(2)
+	if hits, _ := store.Search(SearchQuery{Text: "tables"}); len(hits) != 0 {
+		t.Errorf("删除后期望无结果，得到 %+v", hits)
+	}
+}
+
+// TestUserSearcher 验证 GORM 检索在每次写入后都能查到最新数据
+// 默认构建下使用倒排索引兜底，使用 -tags sqlite_fts5 运行时覆盖 FTS5 实现
+func TestUserSearcher(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&GormUser{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTenantScope(db); err != nil {
+		t.Fatal(err)
+	}
+	db = db.WithContext(WithTenant(context.Background(), defaultTenant))
+	db.Create(&[]GormUser{{Name: "Tom Hanks"}, {Name: "Tommy Lee"}, {Name: "Jerry"}})
+
+	searcher, err := NewUserSearcher(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("检索引擎: %s", searcher.Engine())
+
+	hits, total, err := searcher.Search(db, SearchQuery{Text: "tom", Prefix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || hits[0].Name != "Tom Hanks" {
+		t.Errorf("期望 2 条结果且 Tom Hanks 排第一，得到 %d 条 %+v", total, hits)
+	}
+	if hits[0].Highlight != "<mark>Tom</mark> Hanks" {
+		t.Errorf("高亮不符合预期: %q", hits[0].Highlight)
+	}
+
+	db.Model(&GormUser{}).Where("name = ?", "Jerry").Update("name", "Jerome")
+	hits, _, err = searcher.Search(db, SearchQuery{Text: "jerom", Fuzzy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Name != "Jerome" {
+		t.Errorf("更新后期望检索到 Jerome，得到 %+v", hits)
+	}
+
+	db.Where("name = ?", "Jerome").Delete(&GormUser{})
+	if _, total, _ := searcher.Search(db, SearchQuery{Text: "jerome"}); total != 0 {
+		t.Errorf("删除后期望无结果，得到 %d 条", total)
+	}
+}
+
+// TestSearchEmptyQuery 空查询返回空数组而不是 null，客户端可以直接遍历
+func TestSearchEmptyQuery(t *testing.T) {
+	_, h := newTestApp(t)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/search", `[]`},
+		{"/search?q=", `[]`},
+		{"/search?name=%20", `[]`},
+		{"/gorm/search?q=", `"data":[]`},
+		{"/gorm/search?q=%20", `"data":[]`},
+	}
+	for _, tt := range tests {
+		var raw json.RawMessage
+		if code := doJSON(t, h, "GET", tt.path, "", &raw); code != 200 {
+			t.Fatalf("%s 期望 200，得到 %d", tt.path, code)
+		}
+		if !strings.Contains(string(raw), tt.want) {
+			t.Errorf("%s 期望包含 %s，得到 %s", tt.path, tt.want, raw)
+		}
+	}
+}
+
+// TestIndexSearcherIncremental 倒排索引兜底按租户增量更新：按主键的写入不重建索引，其他租户的写入不影响当前租户
+func TestIndexSearcherIncremental(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&GormUser{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTenantScope(db); err != nil {
+		t.Fatal(err)
+	}
+	searcher := &indexSearcher{indexes: map[string]*InvertedIndex{}, gen: map[string]uint64{}}
+	if err := searcher.registerCallbacks(db); err != nil {
+		t.Fatal(err)
+	}
+	acme := db.WithContext(WithTenant(context.Background(), "acme"))
+	globex := db.WithContext(WithTenant(context.Background(), "globex"))
+	acme.Create(&GormUser{Name: "Tom Hanks"})
+	globex.Create(&GormUser{Name: "Tom Cruise"})
+
+	names := func(q string) []string {
+		t.Helper()
+		hits, _, err := searcher.Search(acme, SearchQuery{Text: q, Prefix: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]string, len(hits))
+		for i, h := range hits {
+			out[i] = h.Name
+		}
+		return out
+	}
+	if got := names("tom"); len(got) != 1 || got[0] != "Tom Hanks" {
+		t.Fatalf("期望只检索到本租户的 Tom Hanks，得到 %v", got)
+	}
+	index := searcher.indexes["acme"]
+
+	jerry := GormUser{Name: "Jerry"}
+	acme.Create(&jerry)
+	globex.Where("name = ?", "Tom Cruise").Delete(&GormUser{})
+	acme.Model(&jerry).Update("name", "Jerome")
+	if got := names("jerome"); len(got) != 1 {
+		t.Errorf("更新后期望检索到 Jerome，得到 %v", got)
+	}
+	if got := names("jerry"); len(got) != 0 {
+		t.Errorf("更新后旧名称不应再命中，得到 %v", got)
+	}
+	acme.Delete(&GormUser{ID: jerry.ID})
+	if got := names("jerome"); len(got) != 0 {
+		t.Errorf("删除后期望无结果，得到 %v", got)
+	}
+	if searcher.indexes["acme"] != index {
+		t.Error("按主键写入和其他租户的写入不应重建当前租户的索引")
+	}
+
+	// 无法确定行的批量写入丢弃索引，下一次检索加载新的索引
+	acme.Model(&GormUser{}).Where("name = ?", "Tom Hanks").Update("name", "Tommy Lee")
+	if got := names("tommy"); len(got) != 1 {
+		t.Errorf("批量更新后期望检索到 Tommy Lee，得到 %v", got)
+	}
+	if searcher.indexes["acme"] == index {
+		t.Error("批量写入后期望替换为新的索引")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+HTTP 服务配置
+
+超时（避免慢连接长期占用资源）：
+- HTTP_READ_HEADER_TIMEOUT 默认 5s
+- HTTP_READ_TIMEOUT        默认 15s
+- HTTP_WRITE_TIMEOUT       默认 30s
+- HTTP_IDLE_TIMEOUT        默认 120s
+
+TLS（设置 TLS_CERT_FILE 和 TLS_KEY_FILE 后启用，自动支持 HTTP/2）：
+- 证书在收到 SIGHUP 或文件修改后自动重新加载（每 TLS_RELOAD_INTERVAL 检查一次，默认 10s），加载失败时继续使用旧证书
+- TLS_CLIENT_CA_FILE 开启双向 TLS，TLS_CLIENT_AUTH 可选 request（可不带证书）/ require（默认，必须带证书）
+- MTLS_IDENTITIES_FILE 把客户端证书 subject 映射为身份，格式：
+  {"CN=billing,O=Acme": {"id": 100, "name": "svc-billing", "tenant": "acme", "scopes": ["users:read"]}}
+  key 可以是完整 subject 或只写 "CN=xxx"；没有映射的证书只完成 TLS 校验，不会获得身份
+
+未启用 TLS 时默认开启 h2c（明文 HTTP/2），可通过 HTTP2_H2C=false 关闭。
+*/
+
+// ServerConfig HTTP 服务配置
+type ServerConfig struct {
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	H2C               bool
+
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	ClientAuth     tls.ClientAuthType
+	ReloadInterval time.Duration // 证书文件的轮询间隔，<= 0 时只通过 SIGHUP 重新加载
+}
+
+// TLSEnabled 是否配置了证书
+func (cfg ServerConfig) TLSEnabled() bool {
+	return cfg.CertFile != "" && cfg.KeyFile != ""
+}
+
+// LoadServerConfig 从环境变量读取服务配置，端口沿用 PORT
+func LoadServerConfig() (ServerConfig, error) {
+	cfg := ServerConfig{
+		Addr:              ":" + getenv("PORT", "8080"),
+		ReadHeaderTimeout: getenvDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       getenvDuration("HTTP_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      getenvDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       getenvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		H2C:               getenv("HTTP2_H2C", "true") == "true",
+		CertFile:          os.Getenv("TLS_CERT_FILE"),
+		KeyFile:           os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile:      os.Getenv("TLS_CLIENT_CA_FILE"),
+		ReloadInterval:    getenvDuration("TLS_RELOAD_INTERVAL", 10*time.Second),
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return cfg, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.ClientCAFile != "" {
+		if !cfg.TLSEnabled() {
+			return cfg, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		switch mode := getenv("TLS_CLIENT_AUTH", "require"); mode {
+		case "request":
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return cfg, fmt.Errorf("invalid TLS_CLIENT_AUTH %q, want request or require", mode)
+		}
+	}
+	return cfg, nil
+}
+
+// NewServer 按配置创建 http.Server，启用 TLS 时同时返回证书加载器（用于 SIGHUP 重新加载），否则为 nil
+func NewServer(cfg ServerConfig, handler http.Handler) (*http.Server, *CertReloader, error) {
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		Protocols:         new(http.Protocols),
+	}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	if !cfg.TLSEnabled() {
+		srv.Protocols.SetUnencryptedHTTP2(cfg.H2C)
+		return srv, nil, nil
+	}
+
+	reloader, err := NewCertReloader(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv.TLSConfig = reloader.TLSConfig(cfg.ClientAuth)
+	return srv, reloader, nil
+}
+
+// CertReloader 持有当前使用的证书和客户端 CA，支持在不重启服务的情况下替换
+type CertReloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time // 三个文件中最新的修改时间
+}
+
+// NewCertReloader 加载证书，caFile 为空时不校验客户端证书
+func NewCertReloader(certFile, keyFile, caFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新读取证书文件，失败时保留原证书
+func (r *CertReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", r.caFile)
+		}
+	}
+	r.mu.Lock()
+	r.cert, r.pool, r.modTime = &cert, pool, modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Watch 定期检查证书文件的修改时间，有变化时重新加载，直到 ctx 结束
+// interval <= 0 时不轮询，只能通过 SIGHUP 或 Reload 重新加载（与 PolicyEngine.Watch 一致）
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		modTime, err := r.latestModTime()
+		r.mu.RLock()
+		changed := err == nil && !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			log.Println("reload tls certificate:", err)
+			continue
+		}
+		log.Println("tls certificate reloaded")
+	}
+}
+
+// TLSConfig 返回每次握手都读取当前证书的 tls.Config
+func (r *CertReloader) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.Certificates = []tls.Certificate{*r.cert}
+		if r.pool != nil {
+			cfg.ClientCAs = r.pool
+			cfg.ClientAuth = clientAuth
+		}
+		return cfg, nil
+	}
+	return base
+}
+
+// ClientCertIdentities 客户端证书 subject 到身份的映射
+type ClientCertIdentities map[string]Principal
+
+// LoadClientCertIdentities 读取 MTLS_IDENTITIES_FILE，未配置时返回空映射
+func LoadClientCertIdentities() (ClientCertIdentities, error) {
+	ids := ClientCertIdentities{}
+	file := os.Getenv("MTLS_IDENTITIES_FILE")
+	if file == "" {
+		return ids, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for subject, p := range ids {
+		if p.Tenant == "" {
+			p.Tenant = defaultTenant
+		}
+		if !tenantPattern.MatchString(p.Tenant) {
+			return nil, fmt.Errorf("%s: invalid tenant %q for %s", file, p.Tenant, subject)
+		}
+		p.Kind = PrincipalClientCert
+		ids[subject] = p
+	}
+	return ids, nil
+}
+
+// Lookup 按完整 subject 或 "CN=xxx" 查找身份
+func (ids ClientCertIdentities) Lookup(cert *x509.Certificate) (Principal, bool) {
+	if p, ok := ids[cert.Subject.String()]; ok {
+		return p, true
+	}
+	p, ok := ids["CN="+cert.Subject.CommonName]
+	return p, ok
+}
+
+// ClientCertMiddleware 把已通过校验的客户端证书映射为身份，需放在 TenantMiddleware 之前
+func ClientCertMiddleware(ids ClientCertIdentities) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// VerifiedChains 非空说明证书已由 TLS 层按 TLS_CLIENT_CA_FILE 校验
+		if tlsState := c.Request.TLS; tlsState != nil && len(tlsState.VerifiedChains) > 0 {
+			if p, ok := ids.Lookup(tlsState.VerifiedChains[0][0]); ok {
+				setPrincipal(c, &p)
+			}
+		}
+		c.Next()
+	}
+}
+
+// describeTLS 启动日志中的 TLS 说明
+func describeTLS(cfg ServerConfig) string {
+	if !cfg.TLSEnabled() {
+		if cfg.H2C {
+			return "http (h2c)"
+		}
+		return "http"
+	}
+	parts := []string{"https (h2)"}
+	if cfg.ClientCAFile != "" {
+		parts = append(parts, "mTLS")
+	}
+	return strings.Join(parts, " + ")
+}
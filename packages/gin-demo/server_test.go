@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA 测试用的自签名 CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue 签发证书，返回 PEM 编码的证书和私钥
+func (ca *testCA) issue(t *testing.T, serial int64, subject pkix.Name, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// TestServerMutualTLS HTTP/2 over TLS、客户端证书身份映射以及证书热加载
+func TestServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	certPEM, keyPEM := ca.issue(t, 100, pkix.Name{CommonName: "127.0.0.1"}, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := write("server.crt", certPEM), write("server.key", keyPEM)
+	caFile := write("ca.crt", ca.pem)
+	ids, _ := json.Marshal(map[string]Principal{"CN=billing": {ID: 100, Name: "svc-billing", Tenant: "acme"}})
+	t.Setenv("MTLS_IDENTITIES_FILE", write("identities.json", ids))
+
+	_, h := newTestApp(t)
+	cfg := ServerConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv, certs, err := NewServer(cfg, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientCertPEM, clientKeyPEM := ca.issue(t, 200, pkix.Name{CommonName: "billing"}, x509.ExtKeyUsageClientAuth)
+	clientCert, _ := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	get := func(path string, withCert bool, headers ...string) *http.Response {
+		tlsCfg := &tls.Config{RootCAs: roots}
+		if withCert {
+			tlsCfg.Certificates = []tls.Certificate{clientCert}
+		}
+		// 每次新建 Transport，保证重新握手
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg, ForceAttemptHTTP2: true}}
+		req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+path, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/auth/profile", true)
+	if resp.ProtoMajor != 2 {
+		t.Errorf("期望 HTTP/2，得到 %s", resp.Proto)
+	}
+	var profile struct {
+		User Principal `json:"user"`
+	}
+	json.NewDecoder(resp.Body).Decode(&profile)
+	if resp.StatusCode != 200 || profile.User.Name != "svc-billing" || profile.User.Tenant != "acme" {
+		t.Errorf("客户端证书期望映射为 svc-billing@acme，得到 %d %+v", resp.StatusCode, profile.User)
+	}
+	if resp := get("/auth/profile", false); resp.StatusCode != 401 {
+		t.Errorf("没有证书也没有 token 期望 401，得到 %d", resp.StatusCode)
+	}
+	if resp := get("/ping", true, "X-Tenant", "globex"); resp.StatusCode != 403 {
+		t.Errorf("请求头与证书租户不一致期望 403，得到 %d", resp.StatusCode)
+	}
+
+	// 替换证书文件后重新加载，新连接使用新证书
+	certPEM, keyPEM = ca.issue(t, 101, pkix.Name{CommonName: "127.0.0.1"}, x509.ExtKeyUsageServerAuth)
+	write("server.crt", certPEM)
+	write("server.key", keyPEM)
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serial := get("/ping", false).TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 101 {
+		t.Errorf("重新加载后期望证书序列号 101，得到 %d", serial)
+	}
+
+	// 加载失败时保留旧证书
+	write("server.key", []byte("broken"))
+	if err := certs.Reload(); err == nil {
+		t.Error("私钥损坏时期望 Reload 返回错误")
+	}
+	if resp := get("/ping", false); resp.StatusCode != 200 {
+		t.Errorf("加载失败后应继续使用旧证书，得到 %d", resp.StatusCode)
+	}
+}
+
+// TestServerH2C 未启用 TLS 时支持明文 HTTP/2
+func TestServerH2C(t *testing.T) {
+	_, h := newTestApp(t)
+	srv, certs, err := NewServer(ServerConfig{H2C: true}, h)
+	if err != nil || certs != nil {
+		t.Fatalf("NewServer: %v %v", certs, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("期望 h2c，得到 %s", resp.Proto)
+	}
+}
+
+// TestCertReloaderWatchDisabled TLS_RELOAD_INTERVAL <= 0 时不轮询，也不会 panic
+func TestCertReloaderWatchDisabled(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		done := make(chan struct{})
+		go func() {
+			(&CertReloader{}).Watch(context.Background(), interval)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("interval=%s 期望立即返回", interval)
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Cookie 会话
+
+存储方式（SESSION_STORE）：
+- cookie-signed     会话内容放在 cookie 中，HMAC-SHA256 签名防篡改，内容对客户端可见
+- cookie-encrypted  会话内容放在 cookie 中，AES-GCM 加密
+- memory            服务端内存（默认），cookie 中只有 <tenant>.<token>；会话数有上限，过期会话由 Watch 定期清理
+- db                服务端 sessions 表，只保存 token 的 SHA-256，多实例共享
+
+- 滚动过期：每次访问把过期时间推后 SESSION_IDLE_TIMEOUT，但不超过创建后 SESSION_MAX_AGE；
+  距上次续期不足 1 分钟时不写存储
+- 防会话固定：登录成功后作废旧会话并签发新的会话 ID，登录前写入的数据会被带到新会话
+- 已登录的会话与 API Key / 客户端证书一样通过 setPrincipal 记录身份，RequireIdentity 直接接受；
+  请求带 Authorization 或 X-API-Key 时以请求头为准，gin-jwt 的 cookie: jwt 查找方式不受影响
+- 只有服务端存储（memory / db）支持 GET /sessions 列出和吊销会话；cookie 会话无法在服务端吊销，只能等待过期
+
+- 吊销接口只接受完整的 PublicID（16 位十六进制），不做前缀匹配
+
+配置：SESSION_STORE、SESSION_SECRET（默认与 JWT_SECRET 相同，都未设置时使用进程内随机密钥）、SESSION_COOKIE（默认 gd_session）、
+SESSION_IDLE_TIMEOUT（默认 30m）、SESSION_MAX_AGE（默认 24h）、SESSION_MEMORY_MAX（内存存储的会话数上限，默认 100000）
+*/
+
+var (
+	// ErrSessionNotFound 会话不存在、已过期或 cookie 无效
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionListUnsupported 存储不支持列出和吊销会话
+	ErrSessionListUnsupported = errors.New("session store does not support listing sessions")
+	// ErrTooManySessions 内存存储的会话数已达上限
+	ErrTooManySessions = errors.New("too many sessions")
+	// ErrTooManySessionValues 单个会话的数据项已达上限
+	ErrTooManySessionValues = errors.New("too many session values")
+)
+
+const (
+	// sessionKey gin.Context 中保存当前会话
+	sessionKey = "session"
+	// defaultMaxMemorySessions 内存存储默认的会话数上限
+	defaultMaxMemorySessions = 100000
+	// maxSessionValues 单个会话最多保存的数据项
+	maxSessionValues = 32
+	// sessionSweepInterval 清理过期会话的间隔
+	sessionSweepInterval = time.Minute
+)
+
+// Session 一次会话，服务端存储时持久化在 sessions 表
+type Session struct {
+	ID         string            `gorm:"primaryKey;size:64" json:"-"` // 服务端存储：token 的 SHA-256；cookie 存储为空
+	TenantID   string            `gorm:"index;not null" json:"tenant_id"`
+	UserKey    string            `gorm:"index" json:"-"` // 登录用户的标识，未登录为空
+	Principal  *Principal        `gorm:"serializer:json" json:"principal,omitempty"`
+	Data       map[string]string `gorm:"serializer:json" json:"data,omitempty"`
+	UserAgent  string            `json:"user_agent,omitempty"`
+	IP         string            `json:"ip,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	LastSeenAt time.Time         `json:"last_seen_at"`
+	ExpiresAt  time.Time         `gorm:"index" json:"expires_at"`
+
+	value string // 当前 cookie 值，服务端存储时为 <tenant>.<token>
+}
+
+// PublicID 列表和吊销接口使用的会话标识（ID 前 16 位），cookie 会话为空
+func (s *Session) PublicID() string {
+	if len(s.ID) < 16 {
+		return ""
+	}
+	return s.ID[:16]
+}
+
+// validPublicID 判断是否为完整的 PublicID，避免把用户输入当作匹配模式
+func validPublicID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
+
+// principalUserKey 同一用户的会话共用的标识，演示账号 ID 相同，需带上名称
+func principalUserKey(p *Principal) string {
+	return fmt.Sprintf("%s:%d:%s", p.Kind, p.ID, p.Name)
+}
+
+// SessionStore 会话存储
+type SessionStore interface {
+	// Get 按 cookie 值读取会话，无效时返回 ErrSessionNotFound
+	Get(ctx context.Context, value string) (*Session, error)
+	// Save 保存会话并更新 s.value；s.ID 为空的服务端会话会生成新 token
+	Save(ctx context.Context, s *Session) error
+	// Delete 删除会话，cookie 存储无法删除
+	Delete(ctx context.Context, s *Session) error
+}
+
+// SessionLister 支持按用户列出和吊销会话的存储
+type SessionLister interface {
+	List(ctx context.Context, tenant, userKey string) ([]Session, error)
+	// Revoke 吊销该用户 PublicID 为 id 的会话，不存在时返回 ErrSessionNotFound
+	Revoke(ctx context.Context, tenant, userKey, id string) error
+}
+
+// newSessionToken 生成服务端会话的 token 和对应的 ID
+func newSessionToken(tenant string) (value, id string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return tenant + "." + token, hashSessionToken(token), nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseSessionValue 拆出租户和会话 ID
+func parseSessionValue(value string) (tenant, id string, ok bool) {
+	tenant, token, ok := strings.Cut(value, ".")
+	if !ok || token == "" || !tenantPattern.MatchString(tenant) {
+		return "", "", false
+	}
+	return tenant, hashSessionToken(token), true
+}
+
+// MemorySessionStore 服务端内存存储，重启后会话失效
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+	max      int
+	now      func() time.Time
+}
+
+// NewMemorySessionStore 创建内存存储，最多保存 max 个会话（<= 0 时使用默认上限）
+func NewMemorySessionStore(max int) *MemorySessionStore {
+	if max <= 0 {
+		max = defaultMaxMemorySessions
+	}
+	return &MemorySessionStore{sessions: map[string]Session{}, max: max, now: time.Now}
+}
+
+func (m *MemorySessionStore) Get(ctx context.Context, value string) (*Session, error) {
+	tenant, id, ok := parseSessionValue(value)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.TenantID != tenant || !m.now().Before(s.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	s.Data = cloneData(s.Data)
+	s.value = value
+	return &s, nil
+}
+
+func (m *MemorySessionStore) Save(ctx context.Context, s *Session) error {
+	if s.ID == "" {
+		value, id, err := newSessionToken(s.TenantID)
+		if err != nil {
+			return err
+		}
+		s.ID, s.value = id, value
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.sessions[s.ID]; !exists && len(m.sessions) >= m.max {
+		return ErrTooManySessions
+	}
+	stored := *s
+	stored.Data = cloneData(s.Data)
+	m.sessions[s.ID] = stored
+	return nil
+}
+
+// cloneData 内存中保存的会话与请求中使用的会话不能共享 map
+func cloneData(data map[string]string) map[string]string {
+	out := make(map[string]string, len(data))
+	for k, v := range data {
+		out[k] = v
+	}
+	return out
+}
+
+// Sweep 删除过期会话，由 SessionManager.Watch 定期调用
+func (m *MemorySessionStore) Sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for id, s := range m.sessions {
+		if !now.Before(s.ExpiresAt) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, s.ID)
+	return nil
+}
+
+func (m *MemorySessionStore) List(ctx context.Context, tenant, userKey string) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Session
+	now := m.now()
+	for _, s := range m.sessions {
+		if s.TenantID == tenant && s.UserKey == userKey && now.Before(s.ExpiresAt) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemorySessionStore) Revoke(ctx context.Context, tenant, userKey, id string) error {
+	if !validPublicID(id) {
+		return ErrSessionNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.sessions {
+		if s.TenantID == tenant && s.UserKey == userKey && s.PublicID() == id {
+			delete(m.sessions, key)
+			return nil
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// DBSessionStore 服务端数据库存储，按租户隔离
+type DBSessionStore struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+// NewDBSessionStore 创建存储并迁移 sessions 表
+func NewDBSessionStore(db *gorm.DB) (*DBSessionStore, error) {
+	if err := db.AutoMigrate(&Session{}); err != nil {
+		return nil, err
+	}
+	return &DBSessionStore{db: db, now: time.Now}, nil
+}
+
+func (d *DBSessionStore) Get(ctx context.Context, value string) (*Session, error) {
+	tenant, id, ok := parseSessionValue(value)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	var s Session
+	res := d.db.WithContext(WithTenant(ctx, tenant)).Where("id = ? AND expires_at > ?", id, d.now()).Limit(1).Find(&s)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrSessionNotFound
+	}
+	s.value = value
+	return &s, nil
+}
+
+func (d *DBSessionStore) Save(ctx context.Context, s *Session) error {
+	orm := d.db.WithContext(WithTenant(ctx, s.TenantID))
+	if s.ID == "" {
+		value, id, err := newSessionToken(s.TenantID)
+		if err != nil {
+			return err
+		}
+		s.ID, s.value = id, value
+		// 新会话时顺便清理本租户的过期会话
+		orm.Where("expires_at <= ?", d.now()).Delete(&Session{})
+		return orm.Create(s).Error
+	}
+	return orm.Model(s).Select("user_key", "principal", "data", "last_seen_at", "expires_at").Updates(s).Error
+}
+
+func (d *DBSessionStore) Delete(ctx context.Context, s *Session) error {
+	return d.db.WithContext(WithTenant(ctx, s.TenantID)).Delete(&Session{}, "id = ?", s.ID).Error
+}
+
+func (d *DBSessionStore) List(ctx context.Context, tenant, userKey string) ([]Session, error) {
+	var sessions []Session
+	err := d.db.WithContext(WithTenant(ctx, tenant)).
+		Where("user_key = ? AND expires_at > ?", userKey, d.now()).Order("created_at").Find(&sessions).Error
+	return sessions, err
+}
+
+func (d *DBSessionStore) Revoke(ctx context.Context, tenant, userKey, id string) error {
+	if !validPublicID(id) {
+		return ErrSessionNotFound
+	}
+	// 按 PublicID 精确匹配，不使用 LIKE
+	res := d.db.WithContext(WithTenant(ctx, tenant)).Where("user_key = ? AND substr(id, 1, 16) = ?", userKey, id).Delete(&Session{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// maxCookieSize 浏览器单个 cookie 的上限约 4KB
+const maxCookieSize = 4000
+
+// CookieSessionStore 会话内容放在 cookie 中，服务端不保存
+type CookieSessionStore struct {
+	signKey []byte
+	aead    cipher.AEAD // 为 nil 时只签名不加密
+	now     func() time.Time
+}
+
+// NewCookieSessionStore 由 secret 派生签名和加密密钥
+func NewCookieSessionStore(secret []byte, encrypt bool) (*CookieSessionStore, error) {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+	s := &CookieSessionStore{signKey: derive("session-sign"), now: time.Now}
+	if encrypt {
+		block, err := aes.NewCipher(derive("session-encrypt"))
+		if err != nil {
+			return nil, err
+		}
+		if s.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (cs *CookieSessionStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, cs.signKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (cs *CookieSessionStore) Get(ctx context.Context, value string) (*Session, error) {
+	var data []byte
+	if cs.aead != nil {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		n := cs.aead.NonceSize()
+		if err != nil || len(raw) < n {
+			return nil, ErrSessionNotFound
+		}
+		if data, err = cs.aead.Open(nil, raw[:n], raw[n:], nil); err != nil {
+			return nil, ErrSessionNotFound
+		}
+	} else {
+		payload, sig, ok := strings.Cut(value, ".")
+		if !ok || !hmac.Equal([]byte(sig), []byte(cs.sign(payload))) {
+			return nil, ErrSessionNotFound
+		}
+		var err error
+		if data, err = base64.RawURLEncoding.DecodeString(payload); err != nil {
+			return nil, ErrSessionNotFound
+		}
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil || !cs.now().Before(s.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	s.value = value
+	return &s, nil
+}
+
+func (cs *CookieSessionStore) Save(ctx context.Context, s *Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	var value string
+	if cs.aead != nil {
+		nonce := make([]byte, cs.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		value = base64.RawURLEncoding.EncodeToString(cs.aead.Seal(nonce, nonce, data, nil))
+	} else {
+		payload := base64.RawURLEncoding.EncodeToString(data)
+		value = payload + "." + cs.sign(payload)
+	}
+	if len(value) > maxCookieSize {
+		return fmt.Errorf("session cookie too large: %d bytes", len(value))
+	}
+	s.value = value
+	return nil
+}
+
+func (cs *CookieSessionStore) Delete(ctx context.Context, s *Session) error {
+	return nil
+}
+
+// SessionManager 会话的读取、续期、登录与注销
+type SessionManager struct {
+	store      SessionStore
+	cookieName string
+	idle       time.Duration
+	maxAge     time.Duration
+	// touchInterval 距上次续期超过该时长才写存储，避免每个请求都写
+	touchInterval time.Duration
+	now           func() time.Time
+}
+
+// LoadSessionManager 根据 SESSION_STORE 创建会话管理
+func LoadSessionManager(db *gorm.DB) (*SessionManager, error) {
+	var store SessionStore
+	var err error
+	switch kind := getenv("SESSION_STORE", "memory"); kind {
+	case "memory":
+		store = NewMemorySessionStore(getenvInt("SESSION_MEMORY_MAX", defaultMaxMemorySessions))
+	case "db":
+		store, err = NewDBSessionStore(db)
+	case "cookie-signed":
+		store, err = NewCookieSessionStore(getenvSecret("SESSION_SECRET", "JWT_SECRET"), false)
+	case "cookie-encrypted":
+		store, err = NewCookieSessionStore(getenvSecret("SESSION_SECRET", "JWT_SECRET"), true)
+	default:
+		err = fmt.Errorf("unknown SESSION_STORE %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionManager(store), nil
+}
+
+// NewSessionManager 使用默认 cookie 名称和有效期创建会话管理
+func NewSessionManager(store SessionStore) *SessionManager {
+	return &SessionManager{
+		store:         store,
+		cookieName:    getenv("SESSION_COOKIE", "gd_session"),
+		idle:          getenvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		maxAge:        getenvDuration("SESSION_MAX_AGE", 24*time.Hour),
+		touchInterval: time.Minute,
+		now:           time.Now,
+	}
+}
+
+// Watch 定期清理内存存储中的过期会话，直到 ctx 结束；其他存储直接返回
+func (m *SessionManager) Watch(ctx context.Context) {
+	sweeper, ok := m.store.(interface{ Sweep() })
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweeper.Sweep()
+		}
+	}
+}
+
+// expiry 滚动过期时间，不超过绝对有效期
+func (m *SessionManager) expiry(s *Session, now time.Time) time.Time {
+	exp := now.Add(m.idle)
+	if limit := s.CreatedAt.Add(m.maxAge); exp.After(limit) {
+		exp = limit
+	}
+	return exp
+}
+
+func (m *SessionManager) setCookie(c *gin.Context, s *Session) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	maxAge := int(s.ExpiresAt.Sub(m.now()).Seconds())
+	c.SetCookie(m.cookieName, s.value, maxAge, "/", "", c.Request.TLS != nil, true)
+}
+
+func (m *SessionManager) clearCookie(c *gin.Context) {
+	c.SetCookie(m.cookieName, "", -1, "/", "", c.Request.TLS != nil, true)
+}
+
+// save 保存会话并写 cookie
+func (m *SessionManager) save(c *gin.Context, s *Session) error {
+	if err := m.store.Save(c.Request.Context(), s); err != nil {
+		return err
+	}
+	m.setCookie(c, s)
+	return nil
+}
+
+// Middleware 读取会话并滚动续期；已登录的会话记录为当前身份，需放在 TenantMiddleware 之前
+func (m *SessionManager) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, err := c.Cookie(m.cookieName)
+		if err != nil || value == "" {
+			c.Next()
+			return
+		}
+		s, err := m.store.Get(c.Request.Context(), value)
+		if errors.Is(err, ErrSessionNotFound) {
+			m.clearCookie(c)
+			c.Next()
+			return
+		}
+		if err != nil {
+			abortWithError(c, err, http.StatusInternalServerError)
+			return
+		}
+		now := m.now()
+		if now.Sub(s.LastSeenAt) >= m.touchInterval {
+			s.LastSeenAt = now
+			s.ExpiresAt = m.expiry(s, now)
+			if err := m.save(c, s); err != nil {
+				abortWithError(c, err, http.StatusInternalServerError)
+				return
+			}
+		}
+		c.Set(sessionKey, s)
+		// 请求头中的 JWT / API Key 优先
+		if _, ok := principalFrom(c); !ok && s.Principal != nil &&
+			c.GetHeader("Authorization") == "" && c.GetHeader("X-API-Key") == "" {
+			setPrincipal(c, s.Principal)
+		}
+		c.Next()
+	}
+}
+
+// SessionFrom 返回当前请求的会话
+func SessionFrom(c *gin.Context) (*Session, bool) {
+	v, ok := c.Get(sessionKey)
+	if !ok {
+		return nil, false
+	}
+	s, ok := v.(*Session)
+	return s, ok
+}
+
+// newSession 在当前租户下创建未保存的会话
+func (m *SessionManager) newSession(c *gin.Context) *Session {
+	now := m.now()
+	s := &Session{
+		TenantID:   c.GetString(tenantKey),
+		Data:       map[string]string{},
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	s.ExpiresAt = m.expiry(s, now)
+	return s
+}
+
+// Set 写入会话数据，没有会话时创建匿名会话
+func (m *SessionManager) Set(c *gin.Context, key, value string) (*Session, error) {
+	s, ok := SessionFrom(c)
+	if !ok {
+		s = m.newSession(c)
+		c.Set(sessionKey, s)
+	}
+	if s.Data == nil {
+		s.Data = map[string]string{}
+	}
+	if _, exists := s.Data[key]; !exists && len(s.Data) >= maxSessionValues {
+		return nil, ErrTooManySessionValues
+	}
+	s.Data[key] = value
+	return s, m.save(c, s)
+}
+
+// Login 登录成功后签发新会话：旧会话作废，登录前的数据带到新会话，防止会话固定攻击
+func (m *SessionManager) Login(c *gin.Context, p *Principal) (*Session, error) {
+	s := m.newSession(c)
+	s.TenantID = p.Tenant
+	s.Principal = p
+	s.UserKey = principalUserKey(p)
+	if old, ok := SessionFrom(c); ok {
+		for k, v := range old.Data {
+			s.Data[k] = v
+		}
+		if err := m.store.Delete(c.Request.Context(), old); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.save(c, s); err != nil {
+		return nil, err
+	}
+	c.Set(sessionKey, s)
+	return s, nil
+}
+
+// Logout 删除当前会话并清除 cookie
+func (m *SessionManager) Logout(c *gin.Context) error {
+	m.clearCookie(c)
+	if s, ok := SessionFrom(c); ok {
+		c.Set(sessionKey, nil)
+		return m.store.Delete(c.Request.Context(), s)
+	}
+	return nil
+}
+
+// List 列出 p 的全部会话
+func (m *SessionManager) List(ctx context.Context, p *Principal) ([]Session, error) {
+	lister, ok := m.store.(SessionLister)
+	if !ok {
+		return nil, ErrSessionListUnsupported
+	}
+	return lister.List(ctx, p.Tenant, principalUserKey(p))
+}
+
+// Revoke 吊销 p 名下 PublicID 为 id 的会话
+func (m *SessionManager) Revoke(ctx context.Context, p *Principal, id string) error {
+	lister, ok := m.store.(SessionLister)
+	if !ok {
+		return ErrSessionListUnsupported
+	}
+	return lister.Revoke(ctx, p.Tenant, principalUserKey(p), id)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionRequest 携带会话 cookie 发起请求，返回响应和新的 cookie（未下发时沿用原值，清除时为空）
+func sessionRequest(t *testing.T, h http.Handler, method, path, body, cookie string, headers ...string) (*httptest.ResponseRecorder, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if path == "/login-session" {
+		// 匿名请求只能在登录入口选择租户，登录后会话身份带有租户
+		req.Header.Set("X-Tenant", "acme")
+	}
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: "gd_session", Value: cookie})
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "gd_session" {
+			cookie = c.Value
+			if c.MaxAge < 0 {
+				cookie = ""
+			}
+		}
+	}
+	return w, cookie
+}
+
+// TestSessionStores 各存储方式的匿名会话、登录换 ID、会话身份、列出吊销和注销
+func TestSessionStores(t *testing.T) {
+	for _, store := range []string{"memory", "db", "cookie-signed", "cookie-encrypted"} {
+		t.Run(store, func(t *testing.T) {
+			t.Setenv("SESSION_STORE", store)
+			_, h := newTestApp(t)
+			serverSide := store == "memory" || store == "db"
+
+			w, anon := sessionRequest(t, h, "PUT", "/session/values/theme", "blue", "")
+			if w.Code != 200 || anon == "" {
+				t.Fatalf("写入会话数据期望 200 并下发 cookie，得到 %d %s", w.Code, w.Body.String())
+			}
+			w, device1 := sessionRequest(t, h, "POST", "/login-session", "username=admin&password=123456", anon)
+			if w.Code != 200 || device1 == "" || device1 == anon {
+				t.Fatalf("登录后期望更换会话 cookie，得到 %d %q", w.Code, device1)
+			}
+
+			var current Session
+			w, _ = sessionRequest(t, h, "GET", "/session", "", device1)
+			json.Unmarshal(w.Body.Bytes(), &current)
+			if current.Data["theme"] != "blue" || current.Principal == nil || current.Principal.Name != "admin" {
+				t.Errorf("登录后会话应保留登录前的数据并带上身份，得到 %s", w.Body.String())
+			}
+			if w, _ := sessionRequest(t, h, "GET", "/auth/profile", "", device1); w.Code != 200 {
+				t.Errorf("会话身份访问受保护接口期望 200，得到 %d", w.Code)
+			}
+			if w, _ := sessionRequest(t, h, "GET", "/auth/profile", "", anon); w.Code != 401 {
+				t.Errorf("登录前的会话不应获得身份，得到 %d", w.Code)
+			}
+			if w, _ := sessionRequest(t, h, "GET", "/auth/profile", "", device1, "X-Tenant", "globex"); w.Code != 403 {
+				t.Errorf("会话租户与请求头不一致期望 403，得到 %d", w.Code)
+			}
+			if serverSide {
+				if w, _ := sessionRequest(t, h, "GET", "/session", "", anon); w.Code != 404 {
+					t.Errorf("登录后旧会话 ID 应失效，得到 %d", w.Code)
+				}
+			}
+
+			// 第二个设备登录，在第一个设备上列出并吊销
+			_, device2 := sessionRequest(t, h, "POST", "/login-session", "username=admin&password=123456", "")
+			w, _ = sessionRequest(t, h, "GET", "/sessions", "", device1)
+			if !serverSide {
+				if w.Code != 501 {
+					t.Errorf("cookie 会话列出期望 501，得到 %d", w.Code)
+				}
+				return
+			}
+			var list []struct {
+				ID      string `json:"id"`
+				Current bool   `json:"current"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &list)
+			if w.Code != 200 || len(list) != 2 {
+				t.Fatalf("期望 2 个会话，得到 %d %s", w.Code, w.Body.String())
+			}
+			var other string
+			for _, s := range list {
+				if !s.Current {
+					other = s.ID
+				}
+			}
+			// 通配符和前缀不能匹配会话
+			for _, id := range []string{strings.Repeat("%25", 16), strings.Repeat("_", 16), other[:8], strings.ToUpper(other)} {
+				if w, _ := sessionRequest(t, h, "DELETE", "/sessions/"+id, "", device1); w.Code != 404 {
+					t.Errorf("吊销 %q 期望 404，得到 %d", id, w.Code)
+				}
+			}
+			if w, _ := sessionRequest(t, h, "GET", "/auth/profile", "", device2); w.Code != 200 {
+				t.Fatalf("通配符不应吊销会话，得到 %d", w.Code)
+			}
+			if w, _ := sessionRequest(t, h, "DELETE", "/sessions/"+other, "", device1); w.Code != 200 {
+				t.Fatalf("吊销会话期望 200，得到 %d", w.Code)
+			}
+			if w, _ := sessionRequest(t, h, "GET", "/auth/profile", "", device2); w.Code != 401 {
+				t.Errorf("被吊销的会话期望 401，得到 %d", w.Code)
+			}
+			_, alice := sessionRequest(t, h, "POST", "/login-session", "username=alice&password=123456", "")
+			if w, _ := sessionRequest(t, h, "DELETE", "/sessions/"+list[0].ID, "", alice); w.Code != 404 {
+				t.Errorf("不能吊销其他用户的会话，得到 %d", w.Code)
+			}
+
+			w, cleared := sessionRequest(t, h, "POST", "/logout-session", "", device1)
+			if w.Code != 200 || cleared != "" {
+				t.Errorf("注销期望清除 cookie，得到 %d %q", w.Code, cleared)
+			}
+			if w, _ := sessionRequest(t, h, "GET", "/auth/profile", "", device1); w.Code != 401 {
+				t.Errorf("注销后的会话期望 401，得到 %d", w.Code)
+			}
+		})
+	}
+}
+
+// TestSessionRollingExpiry 访问时滚动续期，但不超过绝对有效期；篡改的 cookie 无效
+func TestSessionRollingExpiry(t *testing.T) {
+	start := time.Now()
+	now := start
+	clock := func() time.Time { return now }
+	store, _ := NewCookieSessionStore([]byte("k"), false)
+	store.now = clock
+	m := &SessionManager{store: store, cookieName: "gd_session", idle: 30 * time.Minute, maxAge: time.Hour, touchInterval: time.Minute, now: clock}
+	s := &Session{TenantID: "acme", CreatedAt: now, LastSeenAt: now}
+	s.ExpiresAt = m.expiry(s, now)
+	if err := store.Save(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(m.Middleware())
+	r.GET("/", func(c *gin.Context) {
+		if s, ok := SessionFrom(c); ok {
+			c.JSON(200, s)
+			return
+		}
+		c.Status(404)
+	})
+
+	cases := []struct {
+		advance     time.Duration
+		expectCode  int
+		expectUntil time.Duration // 相对创建时间
+	}{
+		{20 * time.Minute, 200, 50 * time.Minute},
+		{25 * time.Minute, 200, time.Hour}, // 45m 时续期到 75m，被绝对有效期截断
+		{20 * time.Minute, 404, 0},         // 65m 已超过绝对有效期
+	}
+	value := s.value
+	for i, c := range cases {
+		now = now.Add(c.advance)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "gd_session", Value: value})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != c.expectCode {
+			t.Fatalf("第 %d 次访问期望 %d，得到 %d", i, c.expectCode, w.Code)
+		}
+		if w.Code != 200 {
+			continue
+		}
+		var got Session
+		json.Unmarshal(w.Body.Bytes(), &got)
+		if want := start.Add(c.expectUntil); !got.ExpiresAt.Equal(want) {
+			t.Errorf("第 %d 次访问期望过期时间 %v，得到 %v", i, want, got.ExpiresAt)
+		}
+		for _, ck := range w.Result().Cookies() {
+			value = ck.Value
+		}
+	}
+
+	payload, sig, _ := strings.Cut(value, ".")
+	if _, err := store.Get(context.Background(), payload+"x."+sig); err == nil {
+		t.Error("篡改的 cookie 应无效")
+	}
+}
+
+// TestMemorySessionStoreBounded 内存存储的会话数有上限，过期会话清理后可以继续创建；单个会话的数据项有上限
+func TestMemorySessionStoreBounded(t *testing.T) {
+	now := time.Now()
+	store := NewMemorySessionStore(2)
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+	save := func() (*Session, error) {
+		s := &Session{TenantID: "default", CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+		return s, store.Save(ctx, s)
+	}
+	first, _ := save()
+	save()
+	if _, err := save(); err != ErrTooManySessions {
+		t.Fatalf("达到上限后期望 ErrTooManySessions，得到 %v", err)
+	}
+	if err := store.Save(ctx, first); err != nil {
+		t.Errorf("更新已有会话不受上限影响，得到 %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	store.Sweep()
+	if _, err := save(); err != nil || len(store.sessions) != 1 {
+		t.Errorf("清理过期会话后期望可以创建，得到 %v，剩余 %d 个", err, len(store.sessions))
+	}
+
+	_, h := newTestApp(t)
+	var cookie string
+	for i := 0; i < maxSessionValues; i++ {
+		var w *httptest.ResponseRecorder
+		if w, cookie = sessionRequest(t, h, "PUT", fmt.Sprintf("/session/values/k%d", i), "v", cookie); w.Code != 200 {
+			t.Fatalf("第 %d 个数据项期望 200，得到 %d", i, w.Code)
+		}
+	}
+	if w, _ := sessionRequest(t, h, "PUT", "/session/values/overflow", "v", cookie); w.Code != 400 {
+		t.Errorf("数据项超过上限期望 400，得到 %d", w.Code)
+	}
+}
@@ -0,0 +1,12 @@
+// 极简前端路由：页面由服务端的 SPA 回退返回 index.html，路径由这里解析
+(function () {
+  var app = document.getElementById("app");
+  function render() {
+    app.textContent = "当前路由: " + location.pathname;
+  }
+  fetch("/ping")
+    .then(function (resp) { return resp.json(); })
+    .then(function (data) { app.dataset.ping = data.message; })
+    .finally(render);
+  window.addEventListener("popstate", render);
+})();
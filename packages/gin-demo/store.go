@@ -0,0 +1,115 @@
+package main
+
+import "sync"
+
+// UserStore 内存用户存储
+// 所有写操作都在锁内完成，并同步更新倒排索引，保证 /search 的结果与列表一致
+type UserStore struct {
+	mu    sync.RWMutex
+	users []User
+	index *InvertedIndex
+}
+
+// NewUserStore 使用初始数据创建内存存储
+func NewUserStore(initial []User) *UserStore {
+	s := &UserStore{index: NewInvertedIndex()}
+	s.Reset(initial)
+	return s
+}
+
+// List 返回全部用户的副本
+func (s *UserStore) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]User{}, s.users...)
+}
+
+// Count 返回用户数量
+func (s *UserStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// Get 按 ID 查找用户
+func (s *UserStore) Get(id int) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.ID == id {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Add 追加用户
+func (s *UserStore) Add(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, user)
+	s.index.Put(user.ID, user.Name)
+}
+
+// Update 修改用户名称，用户不存在时返回 false
+func (s *UserStore) Update(id int, name string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, user := range s.users {
+		if user.ID == id {
+			s.users[i].Name = name
+			s.index.Put(id, name)
+			return s.users[i], true
+		}
+	}
+	return User{}, false
+}
+
+// Delete 删除用户，用户不存在时返回 false
+func (s *UserStore) Delete(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, user := range s.users {
+		if user.ID == id {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			s.index.Remove(id)
+			// 允许重复 ID 的历史行为：若还有同 ID 的用户，重新建立其索引
+			for _, rest := range s.users {
+				if rest.ID == id {
+					s.index.Put(rest.ID, rest.Name)
+					break
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Reset 用给定数据替换全部用户并重建索引
+func (s *UserStore) Reset(users []User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append([]User{}, users...)
+	s.index.Clear()
+	for _, user := range s.users {
+		s.index.Put(user.ID, user.Name)
+	}
+}
+
+// Search 在内存索引上执行全文检索，返回当前页结果与命中总数
+func (s *UserStore) Search(q SearchQuery) ([]SearchHit, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches, total := s.index.Search(q)
+	hits := make([]SearchHit, 0, len(matches))
+	for _, m := range matches {
+		for _, user := range s.users {
+			if user.ID == m.ID {
+				hits = append(hits, SearchHit{User: user, Score: m.Score, Highlight: renderHighlight(m.Highlight)})
+				break
+			}
+		}
+	}
+	return hits, total
+}
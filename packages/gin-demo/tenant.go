@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+多租户隔离
+
+租户的确定顺序：
+1. 请求携带有效 JWT 时使用 claims 中的 tenant（由 PayloadFunc 写入），此时 X-Tenant 请求头必须为空或与之一致
+   API Key、双向 TLS 客户端证书解析出的身份（见 principal.go）同样带租户，规则与 JWT 相同
+2. 匿名请求只能在登录入口（/login-jwt 等）通过 X-Tenant 请求头选择租户，登录成功后租户写入 token；
+   其他路由上匿名请求携带 X-Tenant 时返回 401，否则任何人都能通过请求头读写其他租户的数据
+3. 都没有时使用 defaultTenant
+无论来源如何，租户都必须在 TENANTS 配置的已知租户中（defaultTenant 始终可用），
+按租户分区的内存存储和令牌桶不会因为任意的租户名无限增长
+
+隔离手段（“默认隔离”，而不是依赖每个 handler 自觉加条件）：
+- 内存存储按租户分区：handler 只能通过 TenantStores.Of(c) 拿到当前租户的 UserStore
+- GORM：带 TenantID 字段的模型在查询/更新/删除时由回调自动追加 tenant_id 条件，创建时自动写入 tenant_id；
+  context 中没有租户时直接报错 ErrMissingTenant，不会退化为全表查询
+- 限流：已认证的请求按租户限流，匿名请求按客户端 IP 限流
+*/
+
+const (
+	// tenantKey gin.Context 中保存租户 ID 的 key
+	tenantKey = "tenant"
+	// tenantClaim JWT claims 中的租户字段
+	tenantClaim = "tenant"
+	// defaultTenant 未指定租户时使用的租户，兼容原有的单租户数据
+	defaultTenant = "default"
+	// tenantAuthenticatedKey gin.Context 中标记租户来自已认证的身份（JWT / API Key / 客户端证书 / 会话）
+	tenantAuthenticatedKey = "tenant_authenticated"
+)
+
+var (
+	// ErrMissingTenant 访问租户隔离的表时 context 中没有租户
+	ErrMissingTenant = errors.New("tenant: missing tenant in context")
+	// ErrTenantImmutable 试图修改记录的 tenant_id
+	ErrTenantImmutable = errors.New("tenant: tenant_id is immutable")
+
+	tenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+)
+
+type tenantCtxKey struct{}
+
+// WithTenant 返回携带租户 ID 的 context
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenant)
+}
+
+// TenantFrom 从 context 中读取租户 ID
+func TenantFrom(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantCtxKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// TenantSet 已知租户，defaultTenant 始终包含在内
+type TenantSet map[string]bool
+
+// LoadTenantSet 从环境变量 TENANTS 读取已知租户，格式 "acme,globex"
+func LoadTenantSet() (TenantSet, error) {
+	set := TenantSet{}
+	for _, tenant := range strings.Split(getenv("TENANTS", ""), ",") {
+		tenant = strings.TrimSpace(tenant)
+		if tenant == "" {
+			continue
+		}
+		if !tenantPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("invalid tenant %q in TENANTS", tenant)
+		}
+		set[tenant] = true
+	}
+	return set, nil
+}
+
+// Has 判断租户是否已知
+func (s TenantSet) Has(tenant string) bool {
+	return tenant == defaultTenant || s[tenant]
+}
+
+// TenantMiddleware 解析当前请求的租户，写入 gin.Context 和 c.Request.Context()
+// auth 用于校验 JWT 并读取 tenant claim，token 无效或过期时视为未登录；
+// loginRoutes 为匿名请求可以通过 X-Tenant 请求头选择租户的路由
+func TenantMiddleware(auth *jwt.GinJWTMiddleware, tenants TenantSet, loginRoutes ...string) gin.HandlerFunc {
+	login := map[string]bool{}
+	for _, route := range loginRoutes {
+		login[route] = true
+	}
+	return func(c *gin.Context) {
+		header := c.GetHeader("X-Tenant")
+		tenant, authenticated := header, false
+		if claims, ok := verifiedClaims(auth, c); ok {
+			claimed, _ := claims[tenantClaim].(string)
+			if claimed == "" {
+				claimed = defaultTenant
+			}
+			if tenant != "" && tenant != claimed {
+				c.AbortWithStatusJSON(403, gin.H{"error": "tenant mismatch"})
+				return
+			}
+			tenant, authenticated = claimed, true
+			// 记录校验过的 claims 和身份，后续中间件（scope、策略）和 RequireIdentity 不必再解析 token
+			c.Set(jwtClaimsKey, claims)
+			if p, ok := principalFromClaims(claims); ok {
+				if _, exists := principalFrom(c); !exists {
+					p.Tenant = claimed
+					setPrincipal(c, p)
+				}
+			}
+		}
+		if p, ok := principalFrom(c); ok {
+			if tenant != "" && tenant != p.Tenant {
+				c.AbortWithStatusJSON(403, gin.H{"error": "tenant mismatch"})
+				return
+			}
+			tenant, authenticated = p.Tenant, true
+		}
+		switch {
+		case authenticated:
+		case header == "" || header == defaultTenant:
+			tenant = defaultTenant
+		case !login[c.FullPath()]:
+			c.AbortWithStatusJSON(401, gin.H{"error": "tenant requires authentication"})
+			return
+		}
+		if !tenantPattern.MatchString(tenant) {
+			c.AbortWithStatusJSON(400, gin.H{"error": "invalid tenant"})
+			return
+		}
+		if !tenants.Has(tenant) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "unknown tenant"})
+			return
+		}
+		c.Set(tenantKey, tenant)
+		c.Set(tenantAuthenticatedKey, authenticated)
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("tenant.id", tenant))
+		c.Request = c.Request.WithContext(WithTenant(c.Request.Context(), tenant))
+		c.Next()
+	}
+}
+
+// TenantStores 按租户分区的内存用户存储
+type TenantStores struct {
+	mu      sync.Mutex
+	initial []User
+	stores  map[string]*UserStore
+}
+
+// NewTenantStores 创建分区存储，每个租户首次访问时以 initial 初始化
+func NewTenantStores(initial []User) *TenantStores {
+	return &TenantStores{initial: initial, stores: map[string]*UserStore{}}
+}
+
+// For 返回指定租户的存储
+func (ts *TenantStores) For(tenant string) *UserStore {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	store, ok := ts.stores[tenant]
+	if !ok {
+		store = NewUserStore(ts.initial)
+		ts.stores[tenant] = store
+	}
+	return store
+}
+
+// Of 返回当前请求所属租户的存储，需在 TenantMiddleware 之后使用
+func (ts *TenantStores) Of(c *gin.Context) *UserStore {
+	tenant := c.GetString(tenantKey)
+	if tenant == "" {
+		// 没有经过 TenantMiddleware 属于路由配置错误，宁可失败也不能落到共享分区
+		panic(ErrMissingTenant)
+	}
+	return ts.For(tenant)
+}
+
+// RegisterTenantScope 注册 GORM 回调，为带 TenantID 字段的模型自动附加租户条件，重复调用时不会重复注册
+func RegisterTenantScope(db *gorm.DB) error {
+	cb := db.Callback()
+	if cb.Query().Get("tenant:query") != nil {
+		return nil
+	}
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("tenant:create", tenantCreate),
+		cb.Query().Before("gorm:query").Register("tenant:query", tenantQuery),
+		cb.Row().Before("gorm:row").Register("tenant:row", tenantQuery),
+		cb.Update().Before("gorm:update").Register("tenant:update", tenantUpdate),
+		cb.Delete().Before("gorm:delete").Register("tenant:delete", tenantDelete),
+	)
+}
+
+// tenantScope 判断语句是否需要租户隔离，需要时返回当前租户
+// 原生 SQL（Raw/Exec）无法自动改写，由调用方自行处理
+func tenantScope(tx *gorm.DB) (string, bool) {
+	stmt := tx.Statement
+	if tx.Error != nil || stmt.Schema == nil || stmt.SQL.Len() > 0 || stmt.Schema.LookUpField("TenantID") == nil {
+		return "", false
+	}
+	tenant, ok := TenantFrom(stmt.Context)
+	if !ok {
+		tx.AddError(fmt.Errorf("%w: %s", ErrMissingTenant, stmt.Schema.Table))
+		return "", false
+	}
+	return tenant, true
+}
+
+func addTenantWhere(tx *gorm.DB, tenant string) {
+	tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "tenant_id"}, Value: tenant},
+	}})
+}
+
+// wouldBeGlobal 判断更新/删除是否既没有条件也没有主键
+// 这种情况下不追加租户条件，交给 GORM 返回 ErrMissingWhereClause，避免误删整个租户的数据
+func wouldBeGlobal(tx *gorm.DB) bool {
+	stmt := tx.Statement
+	if stmt.AllowGlobalUpdate {
+		return false
+	}
+	if _, ok := stmt.Clauses["WHERE"]; ok {
+		return false
+	}
+	// gorm:update / gorm:delete 会根据模型上的主键值追加条件
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Slice, reflect.Array:
+		return stmt.ReflectValue.Len() == 0
+	case reflect.Struct:
+		for _, f := range stmt.Schema.PrimaryFields {
+			if _, zero := f.ValueOf(stmt.Context, stmt.ReflectValue); !zero {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func tenantCreate(tx *gorm.DB) {
+	if tenant, ok := tenantScope(tx); ok {
+		// 无论客户端传入什么 tenant_id，都以当前租户为准
+		tx.Statement.SetColumn("TenantID", tenant, true)
+	}
+}
+
+func tenantQuery(tx *gorm.DB) {
+	if tenant, ok := tenantScope(tx); ok {
+		addTenantWhere(tx, tenant)
+	}
+}
+
+func tenantUpdate(tx *gorm.DB) {
+	tenant, ok := tenantScope(tx)
+	if !ok || wouldBeGlobal(tx) {
+		return
+	}
+	switch dest := tx.Statement.Dest.(type) {
+	case map[string]interface{}:
+		for _, key := range []string{"TenantID", "tenant_id"} {
+			if v, exists := dest[key]; exists && v != tenant {
+				tx.AddError(ErrTenantImmutable)
+				return
+			}
+		}
+	default:
+		tx.Statement.SetColumn("TenantID", tenant, true)
+	}
+	addTenantWhere(tx, tenant)
+}
+
+func tenantDelete(tx *gorm.DB) {
+	if tenant, ok := tenantScope(tx); ok && !wouldBeGlobal(tx) {
+		addTenantWhere(tx, tenant)
+	}
+}
+
+// RateLimit 令牌桶参数
+type RateLimit struct {
+	RPS   float64 // 每秒补充的令牌数
+	Burst int     // 桶容量
+}
+
+// TenantRateLimiter 令牌桶限流器，已认证的请求按租户分桶，匿名请求按客户端 IP 分桶
+type TenantRateLimiter struct {
+	mu         sync.Mutex
+	def        RateLimit
+	overrides  map[string]RateLimit
+	buckets    map[string]*tokenBucket
+	maxBuckets int // 令牌桶数量上限，超出时淘汰已经补满（等同于新建）的桶
+	now        func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTenantRateLimiter 创建限流器，overrides 为按租户覆盖的限额
+func NewTenantRateLimiter(def RateLimit, overrides map[string]RateLimit) *TenantRateLimiter {
+	if overrides == nil {
+		overrides = map[string]RateLimit{}
+	}
+	return &TenantRateLimiter{
+		def:        def,
+		overrides:  overrides,
+		buckets:    map[string]*tokenBucket{},
+		maxBuckets: defaultMaxRateLimitBuckets,
+		now:        time.Now,
+	}
+}
+
+// defaultMaxRateLimitBuckets 默认最多保留的令牌桶数量
+const defaultMaxRateLimitBuckets = 10000
+
+// LoadTenantRateLimiter 从环境变量读取限流配置
+// RATE_LIMIT_RPS / RATE_LIMIT_BURST 为默认限额，TENANT_RATE_LIMITS 按租户覆盖，格式 "acme=50:100,beta=5:10"
+// RATE_LIMIT_MAX_BUCKETS 为令牌桶数量上限（默认 10000）
+func LoadTenantRateLimiter() (*TenantRateLimiter, error) {
+	def := RateLimit{
+		RPS:   float64(getenvInt("RATE_LIMIT_RPS", 20)),
+		Burst: getenvInt("RATE_LIMIT_BURST", 40),
+	}
+	overrides, err := parseRateLimits(getenv("TENANT_RATE_LIMITS", ""))
+	if err != nil {
+		return nil, err
+	}
+	l := NewTenantRateLimiter(def, overrides)
+	if n := getenvInt("RATE_LIMIT_MAX_BUCKETS", defaultMaxRateLimitBuckets); n > 0 {
+		l.maxBuckets = n
+	}
+	return l, nil
+}
+
+func parseRateLimits(spec string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		tenant, limit, ok := strings.Cut(item, "=")
+		rps, burst, ok2 := strings.Cut(limit, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid rate limit %q, want tenant=rps:burst", item)
+		}
+		r, err := strconv.ParseFloat(rps, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q: %w", item, err)
+		}
+		b, err := strconv.Atoi(burst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q: %w", item, err)
+		}
+		limits[tenant] = RateLimit{RPS: r, Burst: b}
+	}
+	return limits, nil
+}
+
+// Allow 消耗 key 对应令牌桶中的一个令牌，返回是否放行、剩余令牌数和需要等待的时间
+// tenant 用于查找按租户覆盖的限额，为空时使用默认限额
+func (l *TenantRateLimiter) Allow(key, tenant string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, ok := l.overrides[tenant]
+	if !ok || tenant == "" {
+		limit = l.def
+	}
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.maxBuckets {
+			l.evict(now)
+		}
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.RPS)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, int(b.tokens), 0
+	}
+	if limit.RPS <= 0 {
+		return false, 0, time.Minute
+	}
+	return false, 0, time.Duration((1 - b.tokens) / limit.RPS * float64(time.Second))
+}
+
+// evict 淘汰按默认限额已经补满的令牌桶，删除它们与新建等价；都没有补满时淘汰任意一个
+func (l *TenantRateLimiter) evict(now time.Time) {
+	full := time.Duration(math.MaxInt64)
+	if l.def.RPS > 0 {
+		full = time.Duration(float64(l.def.Burst) / l.def.RPS * float64(time.Second))
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	for key := range l.buckets {
+		if len(l.buckets) < l.maxBuckets {
+			return
+		}
+		delete(l.buckets, key)
+	}
+}
+
+// RateLimitMiddleware 限流，需在 TenantMiddleware 之后使用
+// 已认证的请求按租户计数；匿名请求的租户不可信，按客户端 IP 计数，避免轮换 X-Tenant 绕过限流
+func RateLimitMiddleware(l *TenantRateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, tenant := "ip:"+c.ClientIP(), ""
+		if c.GetBool(tenantAuthenticatedKey) {
+			tenant = c.GetString(tenantKey)
+			key = "tenant:" + tenant
+		}
+		ok, remaining, wait := l.Allow(key, tenant)
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(429, gin.H{"error": "too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestApp 使用独立的内存数据库构造完整服务，已知租户为 acme、globex 和 tiny
+func newTestApp(t *testing.T) (*App, http.Handler) {
+	t.Setenv("TENANTS", "acme,globex,tiny")
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&GormUser{}); err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, setupRouter(app)
+}
+
+// loginToken 以演示账号 admin 登录指定租户，返回 JWT
+func loginToken(t *testing.T, h http.Handler, tenant string) string {
+	var login struct {
+		Token string `json:"token"`
+	}
+	req := httptest.NewRequest("POST", "/login-jwt", strings.NewReader("username=admin&password=123456"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Tenant", tenant)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.Token == "" {
+		t.Fatalf("登录租户 %s 失败: %d %s", tenant, w.Code, w.Body.String())
+	}
+	return login.Token
+}
+
+// doJSON 发送请求并解析 JSON 响应，headers 为成对的请求头名和值
+func doJSON(t *testing.T, h http.Handler, method, path, body string, out interface{}, headers ...string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: 响应不是 JSON: %s", method, path, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+// TestTenantIsolationMemoryStore 内存存储按租户分区，其他租户看不到也改不了
+func TestTenantIsolationMemoryStore(t *testing.T) {
+	_, h := newTestApp(t)
+	acme, globex := loginToken(t, h, "acme"), loginToken(t, h, "globex")
+
+	if code := doJSON(t, h, "POST", "/api/v1/users", `{"id":3,"name":"Charlie"}`, nil, "Authorization", "Bearer "+acme); code != 200 {
+		t.Fatalf("创建用户期望 200，得到 %d", code)
+	}
+
+	var list []User
+	doJSON(t, h, "GET", "/api/v1/users", "", &list, "Authorization", "Bearer "+globex)
+	for _, u := range list {
+		if u.ID == 3 {
+			t.Errorf("租户 globex 不应看到 acme 的用户: %+v", list)
+		}
+	}
+	if code := doJSON(t, h, "GET", "/api/v1/users/3", "", nil, "Authorization", "Bearer "+globex); code != 404 {
+		t.Errorf("跨租户读取期望 404，得到 %d", code)
+	}
+	if code := doJSON(t, h, "DELETE", "/api/v1/users/3", "", nil, "Authorization", "Bearer "+globex); code != 404 {
+		t.Errorf("跨租户删除期望 404，得到 %d", code)
+	}
+	var hits []SearchHit
+	doJSON(t, h, "GET", "/search?q=charlie", "", &hits, "Authorization", "Bearer "+globex)
+	if len(hits) != 0 {
+		t.Errorf("跨租户检索期望无结果，得到 %+v", hits)
+	}
+	if code := doJSON(t, h, "GET", "/api/v1/users/3", "", nil, "Authorization", "Bearer "+acme); code != 200 {
+		t.Errorf("本租户读取期望 200，得到 %d", code)
+	}
+}
+
+// TestTenantIsolationGorm GORM 查询自动附加租户条件
+func TestTenantIsolationGorm(t *testing.T) {
+	_, h := newTestApp(t)
+	acme, globex := loginToken(t, h, "acme"), loginToken(t, h, "globex")
+
+	var created GormUser
+	// 请求体中伪造的 tenant_id 会被忽略
+	doJSON(t, h, "POST", "/gorm/users", `{"name":"Tom","tenant_id":"globex"}`, &created, "Authorization", "Bearer "+acme)
+	if created.TenantID != "acme" {
+		t.Fatalf("期望 tenant_id 为 acme，得到 %q", created.TenantID)
+	}
+	path := "/gorm/users/" + jsonNumber(created.ID)
+
+	var list []GormUser
+	doJSON(t, h, "GET", "/gorm/users", "", &list, "Authorization", "Bearer "+globex)
+	if len(list) != 0 {
+		t.Errorf("租户 globex 不应看到任何用户，得到 %+v", list)
+	}
+	cases := []struct {
+		method, body string
+	}{
+		{"GET", ""},
+		{"PUT", `{"name":"Hacked"}`},
+	}
+	for _, c := range cases {
+		if code := doJSON(t, h, c.method, path, c.body, nil, "Authorization", "Bearer "+globex); code != 404 {
+			t.Errorf("跨租户 %s 期望 404，得到 %d", c.method, code)
+		}
+	}
+	doJSON(t, h, "DELETE", path, "", nil, "Authorization", "Bearer "+globex)
+
+	var page struct {
+		Total int64 `json:"total"`
+	}
+	doJSON(t, h, "GET", "/gorm/query?name=Tom", "", &page, "Authorization", "Bearer "+globex)
+	if page.Total != 0 {
+		t.Errorf("跨租户条件查询期望 0 条，得到 %d", page.Total)
+	}
+	doJSON(t, h, "GET", "/gorm/search?q=tom", "", &page, "Authorization", "Bearer "+globex)
+	if page.Total != 0 {
+		t.Errorf("跨租户全文检索期望 0 条，得到 %d", page.Total)
+	}
+
+	var got GormUser
+	if code := doJSON(t, h, "GET", path, "", &got, "Authorization", "Bearer "+acme); code != 200 || got.Name != "Tom" {
+		t.Errorf("跨租户修改/删除不应生效，得到 %d %+v", code, got)
+	}
+}
+
+func jsonNumber(id uint) string {
+	b, _ := json.Marshal(id)
+	return string(b)
+}
+
+// TestTenantScopeFailsClosed 没有租户的查询直接报错，而不是返回全表数据
+func TestTenantScopeFailsClosed(t *testing.T) {
+	app, _ := newTestApp(t)
+	acme := app.DB.WithContext(WithTenant(context.Background(), "acme"))
+	acme.Create(&GormUser{Name: "Tom"})
+
+	var users []GormUser
+	if err := app.DB.Find(&users).Error; !errors.Is(err, ErrMissingTenant) {
+		t.Errorf("缺少租户时期望 ErrMissingTenant，得到 %v", err)
+	}
+	if err := acme.Model(&GormUser{}).Where("name = ?", "Tom").Update("tenant_id", "globex").Error; !errors.Is(err, ErrTenantImmutable) {
+		t.Errorf("修改 tenant_id 期望 ErrTenantImmutable，得到 %v", err)
+	}
+	if err := acme.Delete(&GormUser{}).Error; !errors.Is(err, gorm.ErrMissingWhereClause) {
+		t.Errorf("无条件删除期望 ErrMissingWhereClause，得到 %v", err)
+	}
+}
+
+// TestTenantFromJWT token 中的租户不能被 X-Tenant 请求头覆盖
+func TestTenantFromJWT(t *testing.T) {
+	_, h := newTestApp(t)
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	req := httptest.NewRequest("POST", "/login-jwt", strings.NewReader("username=alice&password=123456"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Tenant", "acme")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.Token == "" {
+		t.Fatalf("登录失败: %s", w.Body.String())
+	}
+
+	var profile struct {
+		User Principal `json:"user"`
+	}
+	doJSON(t, h, "GET", "/auth/profile", "", &profile, "Authorization", "Bearer "+login.Token)
+	if profile.User.Tenant != "acme" {
+		t.Errorf("期望 token 租户为 acme，得到 %q", profile.User.Tenant)
+	}
+	if code := doJSON(t, h, "GET", "/users", "", nil, "Authorization", "Bearer "+login.Token, "X-Tenant", "globex"); code != 403 {
+		t.Errorf("请求头与 token 租户不一致期望 403，得到 %d", code)
+	}
+}
+
+// TestTenantRateLimit 已认证的请求按租户限流，匿名请求按客户端 IP 限流
+func TestTenantRateLimit(t *testing.T) {
+	app, h := newTestApp(t)
+	tiny, acme := loginToken(t, h, "tiny"), loginToken(t, h, "acme")
+	app.Limiter = NewTenantRateLimiter(RateLimit{RPS: 0.01, Burst: 1}, map[string]RateLimit{"acme": {RPS: 100, Burst: 100}})
+	h = setupRouter(app)
+
+	get := func(remoteAddr string, headers ...string) int {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.RemoteAddr = remoteAddr
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	cases := []struct {
+		name       string
+		remoteAddr string
+		headers    []string
+		expectCode int
+	}{
+		{"租户 tiny 第一次请求", "10.0.0.1:1", []string{"Authorization", "Bearer " + tiny}, 200},
+		{"同一租户换 IP 仍然超限", "10.0.0.2:1", []string{"Authorization", "Bearer " + tiny}, 429},
+		{"其他租户不受影响", "10.0.0.1:1", []string{"Authorization", "Bearer " + acme}, 200},
+		{"匿名请求按 IP 计数", "10.0.0.3:1", nil, 200},
+		{"同一 IP 再次请求", "10.0.0.3:1", nil, 429},
+		{"伪造 X-Forwarded-For 无效", "10.0.0.3:1", []string{"X-Forwarded-For", "1.2.3.4"}, 429},
+		{"另一个 IP", "10.0.0.4:1", nil, 200},
+	}
+	for _, c := range cases {
+		if code := get(c.remoteAddr, c.headers...); code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d", c.name, c.expectCode, code)
+		}
+	}
+}
+
+// TestTenantHeaderRequiresAuth 匿名请求只能在登录入口选择已知租户
+func TestTenantHeaderRequiresAuth(t *testing.T) {
+	_, h := newTestApp(t)
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		expectCode int
+	}{
+		{"匿名读取其他租户", "GET", "/gorm/users", "", []string{"X-Tenant", "acme"}, 401},
+		{"匿名写入其他租户", "POST", "/api/v1/users", `{"id":9,"name":"Eve"}`, []string{"X-Tenant", "acme"}, 401},
+		{"匿名使用默认租户", "GET", "/gorm/users", "", []string{"X-Tenant", "default"}, 200},
+		{"没有请求头时使用默认租户", "GET", "/gorm/users", "", nil, 200},
+		{"登录未知租户", "POST", "/login-jwt", "username=admin&password=123456", []string{"X-Tenant", "victim", "Content-Type", "application/x-www-form-urlencoded"}, 403},
+		{"登录已知租户", "POST", "/login-jwt", "username=admin&password=123456", []string{"X-Tenant", "acme", "Content-Type", "application/x-www-form-urlencoded"}, 200},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		if c.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for i := 0; i+1 < len(c.headers); i += 2 {
+			req.Header.Set(c.headers[i], c.headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.expectCode {
+			t.Errorf("%s: 期望 %d，得到 %d %s", c.name, c.expectCode, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestRateLimiterBounded 令牌桶数量有上限，轮换客户端不会让内存无限增长
+func TestRateLimiterBounded(t *testing.T) {
+	l := NewTenantRateLimiter(RateLimit{RPS: 1, Burst: 1}, nil)
+	l.maxBuckets = 10
+	for i := 0; i < 1000; i++ {
+		l.Allow("ip:"+strconv.Itoa(i), "")
+	}
+	if len(l.buckets) > l.maxBuckets {
+		t.Errorf("令牌桶数量期望不超过 %d，得到 %d", l.maxBuckets, len(l.buckets))
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+/*
+分布式追踪（OpenTelemetry）
+
+- TracingMiddleware 从请求头 traceparent（W3C Trace Context）中提取上游链路，为每个请求创建一个 server span，
+  span 名称使用路由模板（如 "GET /api/v2/users/:id"），并把 traceparent 写回响应头
+- GormTracing 插件为每次 GORM 调用创建子 span，只要 handler 使用 db.WithContext(c.Request.Context())
+- 错误响应（状态码 >= 400 的 JSON 对象）自动带上 trace_id，访问日志同样输出 trace_id
+
+导出方式由环境变量决定：
+- OTEL_TRACES_EXPORTER=otlp    通过 OTLP/HTTP 导出，地址使用 OTEL_EXPORTER_OTLP_ENDPOINT（如 http://localhost:4318）
+- OTEL_TRACES_EXPORTER=stdout  输出到标准输出，便于本地调试
+- OTEL_TRACES_EXPORTER=none    不导出（未设置 OTLP 地址时的默认值）
+服务名使用 OTEL_SERVICE_NAME，默认 gin-demo。
+*/
+
+const tracerName = "gin-demo"
+
+// InitTracing 按环境变量初始化全局 TracerProvider 和 traceparent 传播器，返回的函数用于关停时刷新未导出的 span
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporterName := os.Getenv("OTEL_TRACES_EXPORTER")
+	if exporterName == "" {
+		exporterName = "none"
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			exporterName = "otlp"
+		}
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", exporterName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(getenv("OTEL_SERVICE_NAME", "gin-demo")),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// TraceID 返回 context 中当前 span 的 trace ID，没有有效 span 时返回空字符串
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// TracingMiddleware 提取 traceparent 并为请求创建 server span，应放在除 Compress 以外的所有中间件之前
+func TracingMiddleware(tp trace.TracerProvider) gin.HandlerFunc {
+	tracer := tp.Tracer(tracerName)
+	return func(c *gin.Context) {
+		propagator := otel.GetTextMapPropagator()
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		// 路由匹配在中间件之前完成，这里已经能拿到路由模板；未匹配的路由不带模板，避免 span 名称基数过高
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+		if route != "" {
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+
+		c.Request = c.Request.WithContext(ctx)
+		propagator.Inject(ctx, propagation.HeaderCarrier(c.Writer.Header()))
+		if traceID := TraceID(ctx); traceID != "" {
+			c.Writer = &traceErrorWriter{ResponseWriter: c.Writer, traceID: traceID}
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		for _, err := range c.Errors {
+			span.RecordError(err)
+		}
+	}
+}
+
+// traceErrorWriter 在错误响应的 JSON 对象中追加 trace_id，handler 不需要逐个修改
+type traceErrorWriter struct {
+	gin.ResponseWriter
+	traceID string
+}
+
+func (w *traceErrorWriter) Write(data []byte) (int, error) {
+	if w.Status() < 400 || !strings.Contains(w.Header().Get("Content-Type"), "json") {
+		return w.ResponseWriter.Write(data)
+	}
+	var body map[string]interface{}
+	if json.Unmarshal(data, &body) != nil {
+		return w.ResponseWriter.Write(data)
+	}
+	if _, ok := body["trace_id"]; !ok {
+		body["trace_id"] = w.traceID
+	}
+	out, err := json.Marshal(body)
+	if err != nil {
+		return w.ResponseWriter.Write(data)
+	}
+	if _, err := w.ResponseWriter.Write(out); err != nil {
+		return 0, err
+	}
+	// 返回原始长度，调用方据此判断是否写完
+	return len(data), nil
+}
+
+func (w *traceErrorWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// GormTracing GORM 插件，为每次数据库调用创建子 span
+type GormTracing struct {
+	tracer trace.Tracer
+}
+
+// NewGormTracing 使用 tp 创建 GORM 追踪插件
+func NewGormTracing(tp trace.TracerProvider) *GormTracing {
+	return &GormTracing{tracer: tp.Tracer(tracerName)}
+}
+
+// Name 实现 gorm.Plugin
+func (p *GormTracing) Name() string {
+	return "otel:tracing"
+}
+
+// Initialize 实现 gorm.Plugin，在每类操作前后注册回调
+func (p *GormTracing) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	var errs []error
+	register := func(op string, before, after func(string, func(*gorm.DB)) error) {
+		errs = append(errs,
+			before("otel:before_"+op, p.before(op)),
+			after("otel:after_"+op, p.after),
+		)
+	}
+	register("create", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register)
+	register("query", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register)
+	register("update", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register)
+	register("delete", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register)
+	register("row", cb.Row().Before("gorm:row").Register, cb.Row().After("gorm:row").Register)
+	register("raw", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register)
+	return errors.Join(errs...)
+}
+
+type gormSpanKey struct{}
+
+// gormSpan 保存 span 以及创建前的 context，结束后恢复，避免复用同一个查询对象时 span 互相嵌套
+type gormSpan struct {
+	span   trace.Span
+	parent context.Context
+}
+
+func (p *GormTracing) before(op string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		parent := tx.Statement.Context
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, span := p.tracer.Start(parent, "gorm."+op,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemNameSQLite, semconv.DBOperationName(op)),
+		)
+		tx.Statement.Context = context.WithValue(ctx, gormSpanKey{}, gormSpan{span: span, parent: parent})
+	}
+}
+
+func (p *GormTracing) after(tx *gorm.DB) {
+	s, ok := tx.Statement.Context.Value(gormSpanKey{}).(gormSpan)
+	if !ok {
+		return
+	}
+	tx.Statement.Context = s.parent
+	defer s.span.End()
+	if table := tx.Statement.Table; table != "" {
+		s.span.SetAttributes(semconv.DBCollectionName(table))
+	}
+	s.span.SetAttributes(
+		semconv.DBQueryText(tx.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+	)
+	if err := tx.Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// TestTracing 继承上游 traceparent，请求 span 使用路由模板命名，GORM 调用为其子 span，错误响应带 trace_id
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	t.Setenv("COMPRESS_MIN_SIZE", "1")
+	_, h := newTestApp(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var body struct {
+		Error   string `json:"error"`
+		TraceID string `json:"trace_id"`
+	}
+	code := doJSON(t, h, "GET", "/gorm/users/999", "", &body, "traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	if code != 404 {
+		t.Fatalf("期望 404，得到 %d", code)
+	}
+	if body.Error == "" || body.TraceID != traceID {
+		t.Errorf("错误响应期望带上游 trace_id，得到 %+v", body)
+	}
+
+	// 压缩后的错误响应同样带 trace_id
+	req := httptest.NewRequest("GET", "/gorm/users/999", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("期望错误响应被压缩，得到 %q", w.Header().Get("Content-Encoding"))
+	}
+	if err := json.Unmarshal(decodeBody(t, "gzip", w.Body), &body); err != nil || body.TraceID != traceID {
+		t.Errorf("压缩的错误响应期望带 trace_id，得到 %+v %v", body, err)
+	}
+
+	var server, query *tracetest.SpanStub
+	spans := exporter.GetSpans()
+	for i := range spans {
+		switch spans[i].Name {
+		case "GET /gorm/users/:id":
+			server = &spans[i]
+		case "gorm.query":
+			query = &spans[i]
+		}
+	}
+	if server == nil || query == nil {
+		t.Fatalf("期望请求 span 和 gorm.query span，得到 %+v", spans)
+	}
+	if server.SpanContext.TraceID().String() != traceID || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("请求 span 应继承上游链路，得到 trace %s parent %s", server.SpanContext.TraceID(), server.Parent.SpanID())
+	}
+	if query.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("gorm.query 应为请求 span 的子 span")
+	}
+	var route string
+	for _, kv := range server.Attributes {
+		if kv.Key == semconv.HTTPRouteKey {
+			route = kv.Value.AsString()
+		}
+	}
+	if route != "/gorm/users/:id" {
+		t.Errorf("期望 http.route 为 /gorm/users/:id，得到 %q", route)
+	}
+
+	// 成功响应不改写响应体，traceparent 写回响应头
+	req = httptest.NewRequest("GET", "/ping", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "trace_id") {
+		t.Errorf("成功响应不应带 trace_id: %s", w.Body.String())
+	}
+	if w.Header().Get("traceparent") == "" {
+		t.Errorf("期望响应头带 traceparent")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userResourceRoutes 内存用户资源的共享 handler，由 APIVersions 挂载到各个版本以及旧的 /users 路径下
+// 版本差异（字段改名、响应信封等）由 APIVersion 的转换函数处理，这里只写一份业务逻辑
+func userResourceRoutes(users *TenantStores) []VersionedRoute {
+	return []VersionedRoute{
+		// 获取用户列表
+		// 调用方式: curl http://localhost:8080/api/v2/users
+		{http.MethodGet, "/users", func(c *gin.Context) (int, interface{}) {
+			return http.StatusOK, users.Of(c).List()
+		}},
+
+		// 添加用户
+		// 调用方式: curl -X POST -H "Content-Type: application/json" -d '{"id":3,"name":"Charlie"}' http://localhost:8080/api/v2/users
+		{http.MethodPost, "/users", func(c *gin.Context) (int, interface{}) {
+			var newUser User
+			if err := c.ShouldBindJSON(&newUser); err != nil {
+				return http.StatusBadRequest, gin.H{"error": err.Error()}
+			}
+			users.Of(c).Add(newUser)
+			return http.StatusOK, newUser
+		}},
+
+		// 统计用户数量
+		// 调用方式: curl http://localhost:8080/api/v2/users/count
+		{http.MethodGet, "/users/count", func(c *gin.Context) (int, interface{}) {
+			return http.StatusOK, gin.H{"count": users.Of(c).Count()}
+		}},
+
+		// 重置用户列表为初始状态
+		// 调用方式: curl -X POST http://localhost:8080/api/v2/users/reset
+		{http.MethodPost, "/users/reset", func(c *gin.Context) (int, interface{}) {
+			users.Of(c).Reset(initialUsers)
+			return http.StatusOK, gin.H{
+				"message": "User list reset",
+				"users":   users.Of(c).List(),
+			}
+		}},
+
+		// 根据用户ID获取用户详情
+		// 调用方式: curl http://localhost:8080/api/v2/users/1
+		{http.MethodGet, "/users/:id", func(c *gin.Context) (int, interface{}) {
+			id, err := strconv.Atoi(c.Param("id"))
+			if err != nil {
+				return http.StatusBadRequest, gin.H{"error": "Invalid user id"}
+			}
+			if user, ok := users.Of(c).Get(id); ok {
+				return http.StatusOK, user
+			}
+			return http.StatusNotFound, gin.H{"error": "User not found"}
+		}},
+
+		// 更新用户信息（v2 也接受 display_name 字段）
+		// 调用方式: curl -X PUT -H "Content-Type: application/json" -d '{"name":"NewName"}' http://localhost:8080/api/v2/users/1
+		{http.MethodPut, "/users/:id", func(c *gin.Context) (int, interface{}) {
+			id, err := strconv.Atoi(c.Param("id"))
+			if err != nil {
+				return http.StatusBadRequest, gin.H{"error": "Invalid user id"}
+			}
+			var updateData struct {
+				Name string `json:"name"`
+			}
+			if err := c.ShouldBindJSON(&updateData); err != nil {
+				return http.StatusBadRequest, gin.H{"error": err.Error()}
+			}
+			if user, ok := users.Of(c).Update(id, updateData.Name); ok {
+				return http.StatusOK, user
+			}
+			return http.StatusNotFound, gin.H{"error": "User not found"}
+		}},
+
+		// 删除用户
+		// 调用方式: curl -X DELETE http://localhost:8080/api/v2/users/1
+		{http.MethodDelete, "/users/:id", func(c *gin.Context) (int, interface{}) {
+			id, err := strconv.Atoi(c.Param("id"))
+			if err != nil {
+				return http.StatusBadRequest, gin.H{"error": "Invalid user id"}
+			}
+			if users.Of(c).Delete(id) {
+				return http.StatusOK, gin.H{"message": "User deleted"}
+			}
+			return http.StatusNotFound, gin.H{"error": "User not found"}
+		}},
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+API 版本管理
+
+同一套 VersionedHandler 挂载到多个版本下，版本之间的差异只体现在 APIVersion 的请求/响应转换上：
+- /api/v1/...、/api/v2/...   路径指定版本
+- /api/...                   按 Accept: application/vnd.gin-demo.v2+json 协商版本，未指定时使用当前版本
+- 旧的无版本路径（如 /users）   保持原有（v1）的响应格式，只通过废弃响应头提醒迁移；
+                              也可按配置 308 重定向到 /api/v1/...，响应格式同样不变
+
+已废弃的版本在响应中带上 Deprecation / Sunset（RFC 8594）/ Link 头，提醒客户端迁移。
+*/
+
+const (
+	// apiVersionKey gin.Context 中保存当前请求版本的 key
+	apiVersionKey = "api_version"
+	// apiLegacyKey gin.Context 中保存旧路径对应的版本化前缀（如 "/api"），用于给出 successor-version
+	apiLegacyKey = "api_legacy_prefix"
+	// vendorMediaPrefix 版本协商使用的媒体类型前缀
+	vendorMediaPrefix = "application/vnd.gin-demo."
+)
+
+var vendorMediaPattern = regexp.MustCompile(`^application/vnd\.gin-demo\.(v\d+)\+json$`)
+
+// VersionedHandler 与版本无关的 handler，返回状态码和响应体，由版本负责转换和输出
+type VersionedHandler func(c *gin.Context) (int, interface{})
+
+// VersionedRoute 挂载到每个版本下的路由
+type VersionedRoute struct {
+	Method  string
+	Path    string
+	Handler VersionedHandler
+}
+
+// APIVersion 单个版本的定义
+type APIVersion struct {
+	Name         string
+	DeprecatedAt time.Time // 非零表示已废弃
+	Sunset       time.Time // 计划下线时间，非零时输出 Sunset 头
+	DocURL       string    // 迁移说明，输出为 Link rel="deprecation"
+
+	// RequestTransform 在 handler 之前改写请求，返回错误时以 400 结束请求
+	RequestTransform func(c *gin.Context) error
+	// ResponseTransform 改写 handler 返回的响应体
+	ResponseTransform func(c *gin.Context, status int, body interface{}) interface{}
+}
+
+// Deprecated 是否已废弃
+func (v *APIVersion) Deprecated() bool {
+	return !v.DeprecatedAt.IsZero()
+}
+
+// APIVersions 版本注册表
+type APIVersions struct {
+	versions map[string]*APIVersion
+	current  string
+	// Legacy 旧路径使用的版本，为空时使用当前版本；旧客户端依赖原有的响应格式，不能随当前版本变化
+	Legacy string
+	// LegacyRedirect 为 true 时旧路径 308 重定向到 Legacy 版本的路径，否则作为别名直接处理
+	LegacyRedirect bool
+}
+
+// NewAPIVersions 创建版本注册表，current 为未指定版本时使用的版本
+func NewAPIVersions(current string, versions ...*APIVersion) *APIVersions {
+	vs := &APIVersions{versions: map[string]*APIVersion{}, current: current}
+	for _, v := range versions {
+		vs.versions[v.Name] = v
+	}
+	if _, ok := vs.versions[current]; !ok {
+		panic(fmt.Sprintf("api version %q is not registered", current))
+	}
+	return vs
+}
+
+// Names 返回已注册的版本名，按字典序
+func (vs *APIVersions) Names() []string {
+	names := make([]string, 0, len(vs.versions))
+	for name := range vs.versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe 返回版本列表及废弃信息，供 /api/versions 展示
+func (vs *APIVersions) Describe() gin.H {
+	list := make([]gin.H, 0, len(vs.versions))
+	for _, name := range vs.Names() {
+		v := vs.versions[name]
+		item := gin.H{"name": v.Name, "deprecated": v.Deprecated()}
+		if v.Deprecated() {
+			item["deprecated_at"] = v.DeprecatedAt.UTC()
+		}
+		if !v.Sunset.IsZero() {
+			item["sunset"] = v.Sunset.UTC()
+		}
+		list = append(list, item)
+	}
+	return gin.H{"current": vs.current, "versions": list, "media_type": vendorMediaPrefix + "{version}+json"}
+}
+
+// Mount 在 api 分组下挂载每个版本（/v1/...）以及按 Accept 协商版本的无版本路由
+func (vs *APIVersions) Mount(api gin.IRouter, routes []VersionedRoute) {
+	for _, name := range vs.Names() {
+		v := vs.versions[name]
+		group := api.Group("/" + name)
+		for _, route := range routes {
+			group.Handle(route.Method, route.Path, vs.serve(func(*gin.Context) (*APIVersion, bool) { return v, true }, route.Handler))
+		}
+	}
+	for _, route := range routes {
+		api.Handle(route.Method, route.Path, vs.serve(vs.negotiate, route.Handler))
+	}
+}
+
+// MountLegacy 把旧的无版本路径挂到 r 下，apiPrefix 为 Mount 使用的前缀（如 "/api"）
+// 旧路径默认使用 Legacy 版本，客户端仍可通过 Accept 媒体类型指定其他版本
+func (vs *APIVersions) MountLegacy(r gin.IRouter, apiPrefix string, routes []VersionedRoute) {
+	legacy := vs.Legacy
+	if legacy == "" {
+		legacy = vs.current
+	}
+	pick := func(c *gin.Context) (*APIVersion, bool) {
+		c.Set(apiLegacyKey, apiPrefix)
+		return vs.negotiateDefault(c, legacy)
+	}
+	for _, route := range routes {
+		if vs.LegacyRedirect {
+			r.Handle(route.Method, route.Path, func(c *gin.Context) {
+				target := apiPrefix + "/" + legacy + c.Request.URL.Path
+				if c.Request.URL.RawQuery != "" {
+					target += "?" + c.Request.URL.RawQuery
+				}
+				// 308 保留请求方法和请求体
+				c.Redirect(http.StatusPermanentRedirect, target)
+			})
+			continue
+		}
+		r.Handle(route.Method, route.Path, vs.serve(pick, route.Handler))
+	}
+}
+
+// negotiate 根据 Accept 头选择版本，未指定厂商媒体类型时使用当前版本
+func (vs *APIVersions) negotiate(c *gin.Context) (*APIVersion, bool) {
+	return vs.negotiateDefault(c, vs.current)
+}
+
+// negotiateDefault 根据 Accept 头选择版本，未指定厂商媒体类型时使用 def
+func (vs *APIVersions) negotiateDefault(c *gin.Context, def string) (*APIVersion, bool) {
+	for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if !strings.HasPrefix(mediaType, vendorMediaPrefix) {
+			continue
+		}
+		m := vendorMediaPattern.FindStringSubmatch(mediaType)
+		if m == nil {
+			continue
+		}
+		if v, ok := vs.versions[m[1]]; ok {
+			c.Header("Content-Type", mediaType+"; charset=utf-8")
+			return v, true
+		}
+		return nil, false
+	}
+	return vs.versions[def], true
+}
+
+// serve 把共享 handler 包装成某个版本的 gin handler
+func (vs *APIVersions) serve(pick func(*gin.Context) (*APIVersion, bool), h VersionedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, ok := pick(c)
+		if !ok {
+			c.JSON(http.StatusNotAcceptable, gin.H{"error": "unsupported api version", "supported": vs.Names()})
+			return
+		}
+		c.Set(apiVersionKey, v.Name)
+		c.Header("API-Version", v.Name)
+		if v.Deprecated() {
+			vs.writeDeprecation(c, v)
+		}
+		if v.RequestTransform != nil {
+			if err := v.RequestTransform(c); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		status, body := h(c)
+		if v.ResponseTransform != nil {
+			body = v.ResponseTransform(c, status, body)
+		}
+		c.JSON(status, body)
+	}
+}
+
+// writeDeprecation 输出废弃相关的响应头
+func (vs *APIVersions) writeDeprecation(c *gin.Context, v *APIVersion) {
+	c.Header("Deprecation", fmt.Sprintf("@%d", v.DeprecatedAt.Unix()))
+	if !v.Sunset.IsZero() {
+		c.Header("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+	}
+	var links []string
+	if v.DocURL != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="deprecation"`, v.DocURL))
+	}
+	// 路径中带版本号时给出当前版本的对应地址，旧路径给出带当前版本的新地址
+	if prefix := c.GetString(apiLegacyKey); prefix != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="successor-version"`, prefix+"/"+vs.current+c.Request.URL.Path))
+	} else if marker := "/" + v.Name + "/"; strings.Contains(c.Request.URL.Path, marker) {
+		successor := strings.Replace(c.Request.URL.Path, marker, "/"+vs.current+"/", 1)
+		links = append(links, fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+	}
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+}
+
+// renameJSONFields 请求转换工具：把 JSON 请求体中的旧字段名改为新字段名（新字段已存在时不覆盖）
+func renameJSONFields(c *gin.Context, renames map[string]string) error {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return nil
+	}
+	raw, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if len(bytes.TrimSpace(raw)) == 0 || json.Unmarshal(raw, &fields) != nil {
+		// 不是 JSON 对象时原样交给 handler 处理
+		c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+		return nil
+	}
+	for from, to := range renames {
+		if v, ok := fields[from]; ok {
+			if _, exists := fields[to]; !exists {
+				fields[to] = v
+			}
+			delete(fields, from)
+		}
+	}
+	raw, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+	c.Request.ContentLength = int64(len(raw))
+	return nil
+}
+
+// envelopeResponse 响应转换工具：成功响应包装为 {"data": ...}，错误响应保持原样
+func envelopeResponse(c *gin.Context, status int, body interface{}) interface{} {
+	if status >= 400 {
+		return body
+	}
+	return gin.H{"data": body, "api_version": c.GetString(apiVersionKey)}
+}
+
+// newAPIVersions 本项目的版本定义
+// v1 已废弃，下线时间可通过 API_V1_SUNSET（RFC3339）调整；v2 使用 {"data": ...} 信封并支持 display_name 字段
+// 旧路径（/users 等）与 v1 的响应格式相同
+func newAPIVersions() *APIVersions {
+	sunset, err := time.Parse(time.RFC3339, getenv("API_V1_SUNSET", "2027-06-30T00:00:00Z"))
+	if err != nil {
+		panic("invalid API_V1_SUNSET: " + err.Error())
+	}
+	vs := NewAPIVersions("v2",
+		&APIVersion{
+			Name:         "v1",
+			DeprecatedAt: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			Sunset:       sunset,
+			DocURL:       "/api/versions",
+		},
+		&APIVersion{
+			Name: "v2",
+			RequestTransform: func(c *gin.Context) error {
+				return renameJSONFields(c, map[string]string{"display_name": "name"})
+			},
+			ResponseTransform: envelopeResponse,
+		},
+	)
+	vs.Legacy = "v1"
+	vs.LegacyRedirect = getenv("API_LEGACY_MODE", "alias") == "redirect"
+	return vs
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAPIVersioning 表驱动测试：路径版本、媒体类型协商、旧路径别名与废弃响应头
+func TestAPIVersioning(t *testing.T) {
+	_, h := newTestApp(t)
+
+	cases := []struct {
+		name       string
+		path       string
+		accept     string
+		expectCode int
+		version    string // 期望的 API-Version 响应头
+		deprecated bool   // 是否期望 Deprecation/Sunset 头
+		envelope   bool   // 是否期望 {"data": ...} 信封
+	}{
+		{"v1 路径", "/api/v1/users", "", 200, "v1", true, false},
+		{"v2 路径", "/api/v2/users", "", 200, "v2", false, true},
+		{"未指定版本使用当前版本", "/api/users", "", 200, "v2", false, true},
+		{"按媒体类型协商 v1", "/api/users", "application/vnd.gin-demo.v1+json", 200, "v1", true, false},
+		{"旧路径保持 v1 的响应格式", "/users", "", 200, "v1", true, false},
+		{"旧路径按媒体类型协商 v2", "/users", "application/vnd.gin-demo.v2+json", 200, "v2", false, true},
+		{"未知版本返回 406", "/api/users", "application/vnd.gin-demo.v9+json", 406, "", false, false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.expectCode {
+			t.Errorf("%s: 期望状态码 %d，得到 %d", c.name, c.expectCode, w.Code)
+			continue
+		}
+		if got := w.Header().Get("API-Version"); got != c.version {
+			t.Errorf("%s: 期望 API-Version %q，得到 %q", c.name, c.version, got)
+		}
+		if got := w.Header().Get("Deprecation") != "" && w.Header().Get("Sunset") != ""; got != c.deprecated {
+			t.Errorf("%s: 期望废弃头 %v，得到 %v", c.name, c.deprecated, w.Header())
+		}
+		if c.expectCode != 200 {
+			continue
+		}
+		var body interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		_, wrapped := body.(map[string]interface{})
+		if wrapped != c.envelope {
+			t.Errorf("%s: 期望信封 %v，得到 %s", c.name, c.envelope, w.Body.String())
+		}
+	}
+
+	// v1 的 Link 头指向 v2 的对应地址
+	req := httptest.NewRequest("GET", "/api/v1/users/1", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if link := w.Header().Get("Link"); !strings.Contains(link, `</api/v2/users/1>; rel="successor-version"`) {
+		t.Errorf("期望 Link 头包含 successor-version，得到 %q", link)
+	}
+
+	// 旧路径的 Link 头指向当前版本的新地址
+	req = httptest.NewRequest("GET", "/users/1", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if link := w.Header().Get("Link"); !strings.Contains(link, `</api/v2/users/1>; rel="successor-version"`) {
+		t.Errorf("旧路径期望 Link 头包含 successor-version，得到 %q", link)
+	}
+
+	// v2 接受 display_name 作为 name 的别名
+	var updated struct {
+		Data User `json:"data"`
+	}
+	if code := doJSON(t, h, "PUT", "/api/v2/users/1", `{"display_name":"Alicia"}`, &updated); code != 200 || updated.Data.Name != "Alicia" {
+		t.Errorf("v2 更新期望 name 为 Alicia，得到 %d %+v", code, updated)
+	}
+}
+
+// TestAPIVersionLegacyRedirect API_LEGACY_MODE=redirect 时旧路径 308 重定向到 v1，响应格式不变
+func TestAPIVersionLegacyRedirect(t *testing.T) {
+	t.Setenv("API_LEGACY_MODE", "redirect")
+	_, h := newTestApp(t)
+
+	req := httptest.NewRequest("GET", "/users/1?x=1", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "/api/v1/users/1?x=1" {
+		t.Errorf("期望 308 到 /api/v1/users/1?x=1，得到 %d %q", w.Code, w.Header().Get("Location"))
+	}
+}